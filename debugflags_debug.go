@@ -0,0 +1,39 @@
+//go:build debug
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
+)
+
+// debugUsage lists the flags that only debug builds have
+const debugUsage = "\033[33mDEBUG OPTIONS (debug builds only, for testing):\033[0m\n" +
+	"    --inject-latency=<dur> Delay each packet injected into the tunnel (e.g., 50ms)\n" +
+	"    --inject-jitter=<dur> Vary the injected delay by up to this much either way\n" +
+	"    --inject-packet-loss=<p> Drop injected packets with probability p (e.g., 0.01)\n\n"
+
+// registerDebugFlags defines the debug-only flags. The returned function
+// checks them and applies them to impairment once the flags are parsed.
+func registerDebugFlags() func(logger *wrapguard.Logger, impairment *wrapguard.Impairment) error {
+	latency := flag.Duration("inject-latency", 0, "DEBUG BUILD ONLY: delay each packet injected into the tunnel")
+	jitter := flag.Duration("inject-jitter", 0, "DEBUG BUILD ONLY: vary the injected delay by up to this much either way")
+	loss := flag.Float64("inject-packet-loss", 0, "DEBUG BUILD ONLY: drop injected packets with this probability")
+
+	return func(logger *wrapguard.Logger, impairment *wrapguard.Impairment) error {
+		if *latency < 0 || *jitter < 0 {
+			return fmt.Errorf("--inject-latency and --inject-jitter cannot be negative")
+		}
+		if *loss < 0 || *loss > 1 {
+			return fmt.Errorf("--inject-packet-loss must be between 0 and 1, got %v", *loss)
+		}
+
+		*impairment = wrapguard.Impairment{Latency: *latency, Jitter: *jitter, PacketLoss: *loss}
+		if *latency > 0 || *jitter > 0 || *loss > 0 {
+			logger.Warnf("Debug build: degrading tunnel traffic with %v latency, %v jitter and %v packet loss", *latency, *jitter, *loss)
+		}
+		return nil
+	}
+}
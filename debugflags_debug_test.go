@@ -0,0 +1,67 @@
+//go:build debug
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestMainWithInvalidDebugFlags(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_DEBUG_FLAG") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, os.Getenv("TEST_DEBUG_FLAG"), "--", "true"}
+		main()
+		return
+	}
+
+	tests := []struct {
+		flag     string
+		expected string
+	}{
+		{"--inject-packet-loss=1.5", "--inject-packet-loss must be between 0 and 1"},
+		{"--inject-latency=-5ms", "cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidDebugFlags")
+			cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_DEBUG_FLAG=1", "TEST_DEBUG_FLAG="+tt.flag)
+
+			output, err := cmd.CombinedOutput()
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+				t.Fatalf("expected exit code 1, got %v", err)
+			}
+			if !strings.Contains(string(output), tt.expected) {
+				t.Errorf("expected %q in output, got %s", tt.expected, output)
+			}
+		})
+	}
+}
+
+func TestMainWithDebugImpairment(t *testing.T) {
+	if os.Getenv("TEST_MAIN_DEBUG_IMPAIRMENT") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--inject-latency=50ms", "--inject-jitter=10ms", "--inject-packet-loss=0.01", "--", "true"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithDebugImpairment")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_DEBUG_IMPAIRMENT=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("wrapguard failed: %v\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "Debug build: degrading tunnel traffic with 50ms latency, 10ms jitter and 0.01 packet loss") {
+		t.Errorf("expected a warning about the impairment, got %s", output)
+	}
+}
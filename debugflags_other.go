@@ -0,0 +1,13 @@
+//go:build !debug
+
+package main
+
+import "github.com/puzed/wrapguard/pkg/wrapguard"
+
+// debugUsage is empty, as release builds have no debug-only flags
+const debugUsage = ""
+
+// registerDebugFlags defines no flags outside debug builds
+func registerDebugFlags() func(logger *wrapguard.Logger, impairment *wrapguard.Impairment) error {
+	return func(logger *wrapguard.Logger, impairment *wrapguard.Impairment) error { return nil }
+}
@@ -19,9 +19,117 @@ static int (*real_bind)(int sockfd, const struct sockaddr *addr, socklen_t addrl
 
 // Global variables for configuration
 static char *ipc_path = NULL;
+static char *ipc_token = NULL;
 static int socks_port = 0;
 static int initialized = 0;
 
+// Process name reported with CONNECT messages for routing by application
+static char exe_name[64] = "";
+
+// One SOCKS5 port per tunnel, and the IPv4 routes that select between them
+#define MAX_SOCKS_PORTS 8
+#define MAX_SOCKS_ROUTES 256
+
+struct socks_route {
+    uint32_t network;
+    uint32_t mask;
+    int bits;
+    int index;
+};
+
+static int socks_ports[MAX_SOCKS_PORTS];
+static int socks_port_count = 0;
+static struct socks_route socks_routes[MAX_SOCKS_ROUTES];
+static int socks_route_count = 0;
+
+// Parse WRAPGUARD_SOCKS_PORT, a comma-separated list of ports
+static void parse_socks_ports(const char *value) {
+    char *copy = strdup(value);
+    if (!copy) return;
+
+    char *saveptr = NULL;
+    for (char *tok = strtok_r(copy, ",", &saveptr); tok && socks_port_count < MAX_SOCKS_PORTS; tok = strtok_r(NULL, ",", &saveptr)) {
+        int port = atoi(tok);
+        if (port > 0 && port <= 65535) {
+            socks_ports[socks_port_count++] = port;
+        }
+    }
+    free(copy);
+
+    if (socks_port_count > 0) {
+        socks_port = socks_ports[0];
+    }
+}
+
+// Parse WRAPGUARD_SOCKS_ROUTES, comma-separated CIDR=index pairs
+static void parse_socks_routes(const char *value) {
+    char *copy = strdup(value);
+    if (!copy) return;
+
+    char *saveptr = NULL;
+    for (char *tok = strtok_r(copy, ",", &saveptr); tok && socks_route_count < MAX_SOCKS_ROUTES; tok = strtok_r(NULL, ",", &saveptr)) {
+        char *eq = strchr(tok, '=');
+        char *slash = strchr(tok, '/');
+        if (!eq || !slash || slash > eq) continue;
+        *eq = '\0';
+        *slash = '\0';
+
+        struct in_addr network;
+        int bits = atoi(slash + 1);
+        int index = atoi(eq + 1);
+        if (inet_pton(AF_INET, tok, &network) != 1 || bits < 0 || bits > 32 || index < 0 || index >= socks_port_count) {
+            continue;
+        }
+
+        struct socks_route *route = &socks_routes[socks_route_count++];
+        route->mask = bits == 0 ? 0 : htonl(0xFFFFFFFFu << (32 - bits));
+        route->network = network.s_addr & route->mask;
+        route->bits = bits;
+        route->index = index;
+    }
+    free(copy);
+}
+
+// Pick the SOCKS5 port of the tunnel with the most specific route to the
+// destination, defaulting to the first tunnel
+static int select_socks_port(const struct sockaddr_in *target) {
+    int best_bits = -1;
+    int best_index = 0;
+    for (int i = 0; i < socks_route_count; i++) {
+        struct socks_route *route = &socks_routes[i];
+        if ((target->sin_addr.s_addr & route->mask) == route->network && route->bits > best_bits) {
+            best_bits = route->bits;
+            best_index = route->index;
+        }
+    }
+    return socks_port_count > 0 ? socks_ports[best_index] : socks_port;
+}
+
+// Check whether a port is one of our SOCKS5 proxies
+static int is_socks_port(int port) {
+    for (int i = 0; i < socks_port_count; i++) {
+        if (socks_ports[i] == port) return 1;
+    }
+    return 0;
+}
+
+// Read the process name from /proc/self/comm, replacing characters that
+// would need escaping in JSON
+static void load_exe_name() {
+    FILE *comm = fopen("/proc/self/comm", "r");
+    if (!comm) return;
+    
+    if (fgets(exe_name, sizeof(exe_name), comm)) {
+        exe_name[strcspn(exe_name, "\n")] = '\0';
+        for (char *c = exe_name; *c; c++) {
+            if (*c == '"' || *c == '\\' || (unsigned char)*c < 0x20) {
+                *c = '_';
+            }
+        }
+    }
+    fclose(comm);
+}
+
 // Initialize the library
 static void init_library() {
     if (initialized) return;
@@ -33,20 +141,27 @@ static void init_library() {
     
     // Get configuration from environment
     ipc_path = getenv("WRAPGUARD_IPC_PATH");
+    ipc_token = getenv("WRAPGUARD_IPC_TOKEN");
     char *socks_port_str = getenv("WRAPGUARD_SOCKS_PORT");
     if (socks_port_str) {
-        socks_port = atoi(socks_port_str);
+        parse_socks_ports(socks_port_str);
+    }
+    char *socks_routes_str = getenv("WRAPGUARD_SOCKS_ROUTES");
+    if (socks_routes_str) {
+        parse_socks_routes(socks_routes_str);
     }
+    load_exe_name();
     
     // Debug output (only in debug mode)
     char *debug_mode = getenv("WRAPGUARD_DEBUG");
     if (debug_mode && strcmp(debug_mode, "1") == 0) {
         fprintf(stderr, "WrapGuard LD_PRELOAD: Initialized\n");
         fprintf(stderr, "WrapGuard LD_PRELOAD: IPC path: %s\n", ipc_path ? ipc_path : "NULL");
-        fprintf(stderr, "WrapGuard LD_PRELOAD: SOCKS port: %d\n", socks_port);
+        fprintf(stderr, "WrapGuard LD_PRELOAD: SOCKS port: %d (%d tunnels, %d routes)\n", socks_port, socks_port_count, socks_route_count);
     }
     
-    if (!ipc_path || socks_port == 0) {
+    // Without a SOCKS port (--proxy-mode=http) connect() is passed through
+    if (!ipc_path) {
         fprintf(stderr, "WrapGuard: Missing environment variables\n");
     }
 }
@@ -56,6 +171,10 @@ static int should_intercept_connect(const struct sockaddr *addr) {
     if (addr->sa_family != AF_INET && addr->sa_family != AF_INET6) {
         return 0; // Only intercept IP connections
     }
+
+    if (socks_port == 0) {
+        return 0; // No SOCKS5 proxy to route through
+    }
     
     if (addr->sa_family == AF_INET) {
         struct sockaddr_in *in_addr = (struct sockaddr_in *)addr;
@@ -64,7 +183,7 @@ static int should_intercept_connect(const struct sockaddr *addr) {
         uint32_t ip = ntohl(in_addr->sin_addr.s_addr);
         if ((ip & 0xFF000000) == 0x7F000000) { // 127.x.x.x
             int port = ntohs(in_addr->sin_port);
-            if (port == socks_port) {
+            if (is_socks_port(port)) {
                 return 0; // Don't intercept connections to our own SOCKS proxy
             }
         }
@@ -76,32 +195,89 @@ static int should_intercept_connect(const struct sockaddr *addr) {
     return 0;
 }
 
-// Send IPC message
-static void send_ipc_message(const char *type, int fd, int port, const char *addr) {
-    if (!ipc_path) return;
+// Correlates IPC messages with their responses
+static int64_t ipc_next_id = 0;
+
+// Wait up to 5 seconds for the response to message id on sock. Returns 0 if
+// wrapguard handled the message, -1 otherwise, with its error in error_buf.
+static int read_ipc_response(int sock, int64_t id, char *error_buf, size_t error_len) {
+    struct timeval timeout = {5, 0};
+    setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, &timeout, sizeof(timeout));
+
+    char response[512];
+    size_t used = 0;
+    while (used < sizeof(response) - 1 && !memchr(response, '\n', used)) {
+        ssize_t n = read(sock, response + used, sizeof(response) - 1 - used);
+        if (n <= 0) {
+            snprintf(error_buf, error_len, "no response from wrapguard");
+            return -1;
+        }
+        used += n;
+    }
+    response[used] = '\0';
+
+    char expected_id[32];
+    snprintf(expected_id, sizeof(expected_id), "{\"id\":%lld,", (long long)id);
+    if (strncmp(response, expected_id, strlen(expected_id)) == 0 && strstr(response, "\"ok\":true")) {
+        return 0;
+    }
+
+    // Copy the error message out of {"id":N,"ok":false,"error":"..."}
+    char *error = strstr(response, "\"error\":\"");
+    if (error) {
+        error += strlen("\"error\":\"");
+        size_t len = strcspn(error, "\"");
+        if (len >= error_len) len = error_len - 1;
+        memcpy(error_buf, error, len);
+        error_buf[len] = '\0';
+    } else {
+        snprintf(error_buf, error_len, "unexpected response from wrapguard");
+    }
+    return -1;
+}
+
+// Send IPC message and wait for wrapguard to handle it. src_port is the
+// local port of a CONNECT's connection to the SOCKS5 proxy, or 0. Returns 0
+// on success and -1 on failure, with the reason in error_buf.
+static int send_ipc_message(const char *type, int fd, int port, const char *addr, int src_port, char *error_buf, size_t error_len) {
+    snprintf(error_buf, error_len, "IPC unavailable");
+    if (!ipc_path) return -1;
     
     int sock = socket(AF_UNIX, SOCK_STREAM, 0);
-    if (sock < 0) return;
+    if (sock < 0) return -1;
     
+    int result = -1;
     struct sockaddr_un sun;
     memset(&sun, 0, sizeof(sun));
     sun.sun_family = AF_UNIX;
     strncpy(sun.sun_path, ipc_path, sizeof(sun.sun_path) - 1);
     
     if (connect(sock, (struct sockaddr *)&sun, sizeof(sun)) == 0) {
-        char message[512];
-        snprintf(message, sizeof(message),
-                "{\"type\":\"%s\",\"fd\":%d,\"port\":%d,\"addr\":\"%s\"}\n",
-                type, fd, port, addr ? addr : "");
+        // Authenticate before sending the message itself
+        char message[768];
+        int len = snprintf(message, sizeof(message),
+                "{\"type\":\"AUTH\",\"token\":\"%s\"}\n",
+                ipc_token ? ipc_token : "");
+        if (len < 0 || len >= (int)sizeof(message)) {
+            close(sock);
+            return -1;
+        }
+        int64_t id = __sync_add_and_fetch(&ipc_next_id, 1);
+        snprintf(message + len, sizeof(message) - len,
+                "{\"version\":2,\"type\":\"%s\",\"fd\":%d,\"port\":%d,\"addr\":\"%s\",\"src_port\":%d,\"exe_name\":\"%s\",\"id\":%lld}\n",
+                type, fd, port, addr ? addr : "", src_port, exe_name, (long long)id);
         
-        write(sock, message, strlen(message));
+        if (write(sock, message, strlen(message)) == (ssize_t)strlen(message)) {
+            result = read_ipc_response(sock, id, error_buf, error_len);
+        }
     }
     
     close(sock);
+    return result;
 }
 
 // SOCKS5 connection helper
-static int socks5_connect(int sockfd, const struct sockaddr *addr, socklen_t addrlen) {
+static int socks5_connect(int sockfd, const struct sockaddr *addr, socklen_t addrlen, const char *addr_str) {
     char *debug_mode = getenv("WRAPGUARD_DEBUG");
     
     if (addr->sa_family != AF_INET) {
@@ -110,15 +286,16 @@ static int socks5_connect(int sockfd, const struct sockaddr *addr, socklen_t add
     }
     
     struct sockaddr_in *target = (struct sockaddr_in *)addr;
+    int proxy_port = select_socks_port(target);
     struct sockaddr_in socks_addr;
     memset(&socks_addr, 0, sizeof(socks_addr));
     socks_addr.sin_family = AF_INET;
     socks_addr.sin_addr.s_addr = htonl(INADDR_LOOPBACK);
-    socks_addr.sin_port = htons(socks_port);
+    socks_addr.sin_port = htons(proxy_port);
     
     // Connect to SOCKS5 proxy
     if (debug_mode && strcmp(debug_mode, "1") == 0) {
-        fprintf(stderr, "WrapGuard LD_PRELOAD: Connecting to SOCKS5 proxy at 127.0.0.1:%d\n", socks_port);
+        fprintf(stderr, "WrapGuard LD_PRELOAD: Connecting to SOCKS5 proxy at 127.0.0.1:%d\n", proxy_port);
     }
     int connect_result = real_connect(sockfd, (struct sockaddr *)&socks_addr, sizeof(socks_addr));
     if (connect_result != 0 && errno != EINPROGRESS) {
@@ -155,6 +332,20 @@ static int socks5_connect(int sockfd, const struct sockaddr *addr, socklen_t add
         fprintf(stderr, "WrapGuard LD_PRELOAD: Connected to SOCKS5 proxy, starting handshake\n");
     }
     
+    // Report the connection with our source port, so the proxy can tell
+    // which process it belongs to
+    struct sockaddr_in local_addr;
+    socklen_t local_len = sizeof(local_addr);
+    int src_port = 0;
+    if (getsockname(sockfd, (struct sockaddr *)&local_addr, &local_len) == 0) {
+        src_port = ntohs(local_addr.sin_port);
+    }
+    char ipc_error[256];
+    if (send_ipc_message("CONNECT", sockfd, 0, addr_str, src_port, ipc_error, sizeof(ipc_error)) != 0 &&
+        debug_mode && strcmp(debug_mode, "1") == 0) {
+        fprintf(stderr, "WrapGuard LD_PRELOAD: CONNECT for %s not acknowledged: %s\n", addr_str, ipc_error);
+    }
+    
     // SOCKS5 handshake
     unsigned char handshake[] = {0x05, 0x01, 0x00}; // Version 5, 1 method, no auth
     if (debug_mode && strcmp(debug_mode, "1") == 0) {
@@ -262,11 +453,8 @@ int connect(int sockfd, const struct sockaddr *addr, socklen_t addrlen) {
         fprintf(stderr, "WrapGuard LD_PRELOAD: INTERCEPTING %s, routing through SOCKS5\n", addr_str);
     }
     
-    // Send IPC message
-    send_ipc_message("CONNECT", sockfd, 0, addr_str);
-    
-    // Route through SOCKS5
-    return socks5_connect(sockfd, addr, addrlen);
+    // Route through SOCKS5, reporting the connection over IPC
+    return socks5_connect(sockfd, addr, addrlen, addr_str);
 }
 
 // Intercepted bind function
@@ -294,8 +482,17 @@ int bind(int sockfd, const struct sockaddr *addr, socklen_t addrlen) {
         int sock_type;
         socklen_t opt_len = sizeof(sock_type);
         if (getsockopt(sockfd, SOL_SOCKET, SO_TYPE, &sock_type, &opt_len) == 0 && sock_type == SOCK_STREAM) {
-            // Send IPC message to set up port forwarding
-            send_ipc_message("BIND", sockfd, port, NULL);
+            // Send IPC message to set up port forwarding, and wait for the
+            // listener so that the port is reachable once bind returns. The
+            // socket itself is bound either way, so bind still succeeds, and
+            // wrapguard logs the failure itself.
+            char ipc_error[256];
+            if (send_ipc_message("BIND", sockfd, port, NULL, 0, ipc_error, sizeof(ipc_error)) != 0) {
+                char *debug_mode = getenv("WRAPGUARD_DEBUG");
+                if (debug_mode && strcmp(debug_mode, "1") == 0) {
+                    fprintf(stderr, "WrapGuard LD_PRELOAD: Failed to forward port %d: %s\n", port, ipc_error);
+                }
+            }
         }
     }
     
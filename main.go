@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/netip"
 	"os"
 	"os/exec"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
 )
 
 var version = "1.0.0-dev"
 
+// maxRestartDelay caps the exponential backoff between child restarts
+const maxRestartDelay = 60 * time.Second
+
 func printUsage() {
 	help := fmt.Sprintf(`
 ╦ ╦┬─┐┌─┐┌─┐╔═╗┬ ┬┌─┐┬─┐┌┬┐
@@ -27,7 +37,8 @@ func printUsage() {
 `, version)
 
 	help += "\033[33mUSAGE:\033[0m\n"
-	help += "    wrapguard --config=<path> -- <command> [args...]\n\n"
+	help += "    wrapguard --config=<path> -- <command> [args...]\n"
+	help += "    wrapguard diagnose --config=<path> [--routes]\n\n"
 
 	help += "\033[33mEXAMPLES:\033[0m\n"
 	help += "    \033[36m# Check your tunneled IP address\033[0m\n"
@@ -42,14 +53,75 @@ func printUsage() {
 	help += "    \033[36m# Interactive shell with tunneled network\033[0m\n"
 	help += "    wrapguard --config=wg0.conf -- bash\n\n"
 
+	help += "    \033[36m# Check the config and peers before filing a bug\033[0m\n"
+	help += "    wrapguard diagnose --config=wg0.conf\n\n"
+
 	help += "\033[33mOPTIONS:\033[0m\n"
-	help += "    --config=<path>    Path to WireGuard configuration file\n"
+	help += "    --config=<path>    Path to WireGuard configuration file (repeatable)\n"
+	help += "    --wrapguard-config=<path> TOML file with wrapguard settings\n"
+	help += "    --config-watch     Apply changes to the --config files while running\n"
+	help += "    --no-env-expand    Do not expand ${VAR} in .tmpl config files\n"
 	help += "    --exit-node=<ip>   Route all traffic through specified peer IP\n"
 	help += "    --route=<policy>   Add routing policy (CIDR:peerIP)\n"
 	help += "    --log-level=<level> Set log level (error, warn, info, debug)\n"
 	help += "    --log-file=<path>  Set file to write logs to (default: terminal)\n"
+	help += "    --audit-log=<path> Append a record of every config load and reload to this file\n"
+	help += "    --log-format=<fmt> Log output (json, syslog; default: json)\n"
+	help += "    --log-deduplicate-window=<dur> Collapse identical log entries within this window into a summary\n"
+	help += "    --wg-verbose       Log wireguard-go's handshake messages at debug level\n"
+	help += "    --log-handshakes   Log a structured audit entry with the peer key for every handshake\n"
+	help += "    --syslog-facility=<name> Syslog facility (default: daemon)\n"
+	help += "    --log-rotate-count=<n> Rotated log files to keep (default: 5)\n"
+	help += "    --log-max-size-mb=<n> Rotate the log file at this size (SIGUSR2 rotates too)\n"
+	help += "    --proxy-mode=<mode> Proxy servers to start (socks5, http, both)\n"
+	help += "    --restart-on-fail  Restart the child when it exits with a non-zero code\n"
+	help += "    --restart-max-attempts=<n> Maximum restarts (default: 5)\n"
+	help += "    --restart-delay=<dur> Initial restart delay, doubling up to 60s (default: 1s)\n"
+	help += "    --env-passthrough=<vars> Only pass these environment variables to the child\n"
+	help += "    --clear-env        Pass no environment variables except wrapguard's own\n"
+	help += "    --ipc-max-connections=<n> Simultaneous IPC connections (default: 256)\n"
+	help += "    --ipc-token=<token> IPC secret passed to the child (default: random per run)\n"
+	help += "    --allow-network=<cidr> Only let the child reach these networks (repeatable)\n"
+	help += "    --socks-deny-network=<cidr> Block SOCKS5 connections to a network (repeatable)\n"
+	help += "    --socks-deny-host=<pattern> Block SOCKS5 connections to hosts, e.g. *.internal.corp (repeatable)\n"
+	help += "    --socks-upstream=<url> Chain non-WireGuard traffic through an upstream proxy, or another wrapguard for a second hop\n"
+	help += "    --hop-count=<n>    Most chained wrapguard hops a connection may take (1-4, default: 4)\n"
+	help += "    --socks-max-conn-rate=<n> SOCKS5 connections per second (default: 100)\n"
+	help += "    --allow-overlapping-routes Warn instead of failing on overlapping AllowedIPs\n"
+	help += "    --split-tunnel     Only tunnel Route and narrower AllowedIPs destinations, ignoring 0.0.0.0/0\n"
+	help += "    --ecmp=<mode>      Spread connections over peers with equal routes (hash, round-robin, random)\n"
+	help += "    --timeout=<dur>    Kill the child process after a maximum duration\n"
+	help += "    --child-user=<user> Run the child as another user, e.g. nobody when wrapguard runs as root\n"
+	help += "    --child-group=<group> Run the child with another group (default: the --child-user's primary group)\n"
+	help += "    --child-netns      Run the child in a network namespace it can only leave through the proxies (Linux, root)\n"
+	help += "    --max-child-fds=<n> Limit the child to n open file descriptors (RLIMIT_NOFILE)\n"
+	help += "    --forward-port=<port>/tcp Forward a port to the child without LD_PRELOAD, e.g. 8080-8090/tcp (repeatable)\n"
+	help += "    --forward-http=<spec> Expose a tunnel service locally, localPort:targetHost:targetPort[:rewriteHost] (repeatable)\n"
+	help += "    --forward-port-dir=<dir> Forward the ports described by *.port files in a directory, rescanned on SIGHUP\n"
+	help += "    --connect-timeout=<dur> Queue forwarded connections until the port is ready (default: 10s)\n"
+	help += "    --forward-idle-timeout=<dur> Close forwarded connections idle this long, 0 disables (default: 300s)\n"
+	help += "    --graceful-shutdown-timeout=<dur> Wait for the child to exit after a signal before killing it (default: 5s)\n"
+	help += "    --proxy-protocol=v2 Send a PROXY protocol header with the peer address to forwarded ports\n"
+	help += "    --no-proxy-protocol-ports=<ports> Forwarded ports that get no PROXY header (e.g., 22,25)\n"
+	help += "    --pid-file=<path>  Write the wrapguard PID to a file for process supervisors\n"
+	help += "    --pid-file-overwrite Replace an existing PID file instead of failing\n"
+	help += "    --readiness-file=<path> Create a file once the handshake completes\n"
+	help += "    --readiness-timeout=<dur> Exit if the handshake takes longer (default: 30s)\n"
+	help += "    --readiness-http-addr=<addr> Serve a readiness probe (e.g., :8080/ready)\n"
+	help += "    --pac-addr=<addr>  Serve a proxy auto-config file for browsers (e.g., :8080/proxy.pac)\n"
+	help += "    --on-connected=<cmd> Run a command after the first WireGuard handshake\n"
+	help += "    --on-disconnected=<cmd> Run a command when the tunnel goes down\n"
+	help += "    --endpoint-dns-ttl=<dur> Re-resolve peer endpoint hostnames (default: 300s)\n"
+	help += "    --generate-keypair Print a new WireGuard key pair and exit\n"
+	help += "    --generate-config  Print a config built from the flags below, without starting a tunnel\n"
+	help += "    --private-key=<file> Private key file for --generate-config (default: generate one)\n"
+	help += "    --address=<cidr>   Interface address for --generate-config (e.g., 10.0.0.2/24)\n"
+	help += "    --peer-pubkey=<key> Peer public key for --generate-config\n"
+	help += "    --peer-endpoint=<host:port> Peer endpoint for --generate-config\n"
+	help += "    --peer-allowedips=<cidrs> Comma-separated peer AllowedIPs for --generate-config\n"
 	help += "    --help             Show this help message\n"
 	help += "    --version          Show version information\n\n"
+	help += debugUsage
 
 	help += "\033[33mFEATURES:\033[0m\n"
 	help += "    ✓ No root/sudo required\n"
@@ -73,24 +145,553 @@ func printUsage() {
 	os.Stderr.WriteString(help)
 }
 
+// buildChildEnv assembles the child's environment. By default the whole parent
+// environment is passed through. With clearEnv or a passthrough allowlist, only
+// the allowlisted variables are kept. wrapguardEnv is always appended.
+func buildChildEnv(environ []string, clearEnv bool, passthrough []string, wrapguardEnv []string) []string {
+	if !clearEnv && len(passthrough) == 0 {
+		return append(append([]string{}, environ...), wrapguardEnv...)
+	}
+
+	allowed := make(map[string]bool, len(passthrough))
+	for _, name := range passthrough {
+		allowed[name] = true
+	}
+
+	var env []string
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		if allowed[name] {
+			env = append(env, entry)
+		}
+	}
+	return append(env, wrapguardEnv...)
+}
+
+// watchSuspend suspends the agent's tunnels on one signal and resumes them
+// on the next, so that the handshake is renewed after the machine wakes up.
+// The child process keeps running throughout.
+func watchSuspend(ctx context.Context, agent *wrapguard.Agent, signals <-chan os.Signal, logger *wrapguard.Logger) {
+	suspended := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		if !suspended {
+			if err := agent.Suspend(); err != nil {
+				logger.Errorf("Failed to suspend: %v", err)
+				continue
+			}
+			suspended = true
+			continue
+		}
+
+		if err := agent.Resume(ctx); err != nil {
+			logger.Warnf("Resume incomplete: %v", err)
+		}
+		suspended = false
+	}
+}
+
+// configErrorHint suggests a fix for a config error, as a sentence to append
+// to the message, or returns "" when there is nothing more useful to say
+func configErrorHint(err error) string {
+	var (
+		notFound wrapguard.ErrConfigNotFound
+		key      wrapguard.ErrInvalidKey
+		address  wrapguard.ErrInvalidAddress
+		noPeers  wrapguard.ErrNoPeers
+	)
+	switch {
+	case errors.As(err, &notFound):
+		return ". Check the --config path."
+	case errors.As(err, &key) && key.Err == nil:
+		return fmt.Sprintf(". Did you forget to set %s?", key.Key)
+	case errors.As(err, &key):
+		return fmt.Sprintf(". %s must be a base64 key as printed by wg genkey or wg pubkey.", key.Key)
+	case errors.As(err, &address):
+		return ". Set Address in [Interface] to a CIDR such as 10.0.0.2/24."
+	case errors.As(err, &noPeers):
+		return ". Add a [Peer] section with PublicKey and AllowedIPs."
+	}
+	return ""
+}
+
+// writeKeyPair prints a new key pair in config file syntax
+func writeKeyPair(w io.Writer) error {
+	private, public, err := wrapguard.GenerateKeyPair()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "PrivateKey = %s\nPublicKey = %s\n", private, public)
+	return err
+}
+
+// runGenerateConfig writes the config for opts to stdout. The private key is
+// read from privateKeyFile, or generated with its public key printed to
+// stderr so it can be given to the peer.
+func runGenerateConfig(opts wrapguard.GenerateConfigOptions, privateKeyFile string, stdout, stderr io.Writer) error {
+	if privateKeyFile != "" {
+		key, err := os.ReadFile(privateKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read private key: %w", err)
+		}
+		opts.PrivateKey = strings.TrimSpace(string(key))
+	} else {
+		private, public, err := wrapguard.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		opts.PrivateKey = private
+		fmt.Fprintf(stderr, "Generated a new private key; public key: %s\n", public)
+	}
+
+	config, err := wrapguard.GenerateConfig(opts)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(config)
+	return err
+}
+
+// runDiagnose runs the diagnose subcommand with the arguments after
+// "diagnose", writing the JSON report to stdout. It returns the exit code: 0
+// when every check passed and 1 otherwise. With --routes it writes the
+// config's routing table instead.
+func runDiagnose(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "Path to the WireGuard configuration file to check")
+	timeout := fs.Duration("timeout", wrapguard.DefaultDiagnoseTimeout, "Wait this long for each peer's handshake response")
+	routes := fs.Bool("routes", false, "Print the routing table built from the config as JSON instead of running the checks")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *configPath == "" {
+		fmt.Fprintf(stderr, "\n\033[31m✗ Error:\033[0m diagnose requires --config\n")
+		return 1
+	}
+
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+
+	if *routes {
+		config, err := wrapguard.ParseConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(stderr, "\n\033[31m✗ Error:\033[0m %v\n", err)
+			return 1
+		}
+		if err := encoder.Encode(wrapguard.NewRoutingEngine(config, wrapguard.RoutingOptions{})); err != nil {
+			fmt.Fprintf(stderr, "\n\033[31m✗ Error:\033[0m Failed to write routing table: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	// The library is expected next to the binary, as when running a command
+	opts := wrapguard.DiagnoseOptions{Timeout: *timeout}
+	if execPath, err := os.Executable(); err == nil {
+		opts.LibraryPath = filepath.Join(filepath.Dir(execPath), "libwrapguard.so")
+	}
+	results := wrapguard.Diagnose(context.Background(), *configPath, opts)
+
+	if err := encoder.Encode(results); err != nil {
+		fmt.Fprintf(stderr, "\n\033[31m✗ Error:\033[0m Failed to write report: %v\n", err)
+		return 1
+	}
+
+	for _, result := range results {
+		if !result.OK {
+			return 1
+		}
+	}
+	return 0
+}
+
+// childCredential looks up the user and group the child should run as. When
+// only childUser is given the child gets that user's primary group, and when
+// only childGroup is given it keeps wrapguard's user. It returns nil when
+// neither is set.
+func childCredential(childUser, childGroup string) (*syscall.Credential, error) {
+	if childUser == "" && childGroup == "" {
+		return nil, nil
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if childUser != "" {
+		u, err := user.Lookup(childUser)
+		if err != nil {
+			return nil, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, fmt.Errorf("invalid uid %q for user %s", u.Uid, childUser)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, fmt.Errorf("invalid gid %q for user %s", u.Gid, childUser)
+		}
+	}
+	if childGroup != "" {
+		g, err := user.LookupGroup(childGroup)
+		if err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return nil, fmt.Errorf("invalid gid %q for group %s", g.Gid, childGroup)
+		}
+	}
+
+	// Only root can drop the supplementary groups
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), NoSetGroups: os.Geteuid() != 0}, nil
+}
+
+// writePIDFile records the current process ID in path for process
+// supervisors. An existing file is only replaced when overwrite is set, so a
+// second wrapguard using the same path fails instead of taking it over.
+func writePIDFile(path string, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%d\n", os.Getpid()); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+// applySettings sets the flags in fs from a --wrapguard-config file, except
+// those already given on the command line. The file's routes are used only
+// when no --route flag was given.
+func applySettings(fs *flag.FlagSet, settings *wrapguard.Settings) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	values := []struct {
+		flag  string
+		value string
+	}{
+		{"log-level", settings.LogLevel},
+		{"log-file", settings.LogFile},
+		{"exit-node", settings.ExitNode},
+		{"on-connected", settings.OnConnected},
+		{"on-disconnected", settings.OnDisconnected},
+	}
+	for _, v := range values {
+		if v.value == "" || explicit[v.flag] {
+			continue
+		}
+		if err := fs.Set(v.flag, v.value); err != nil {
+			return fmt.Errorf("invalid %s: %w", v.flag, err)
+		}
+	}
+
+	if !explicit["route"] {
+		for _, route := range settings.Routes {
+			if err := fs.Set("route", route); err != nil {
+				return fmt.Errorf("invalid route %q: %w", route, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configAudit records config reloads in the --audit-log, keeping the hash
+// and tunnel configs in use to compare the next reload with
+type configAudit struct {
+	log     *wrapguard.AuditLogger
+	hash    string
+	configs []*wrapguard.WireGuardConfig
+}
+
+// reloadConfigs parses the config files again, with the CLI routing
+// options, and applies them to the running tunnels. audit is nil without
+// --audit-log.
+func reloadConfigs(agent *wrapguard.Agent, configOpts wrapguard.ConfigOptions, configPaths []string, exitNode string, routes []string, audit *configAudit, logger *wrapguard.Logger) {
+	// Hash the files before parsing them, so the hash matches what was read
+	// unless they change again in between, which triggers another reload
+	var hash string
+	var err error
+	if audit != nil {
+		hash, err = wrapguard.HashConfigFiles(configPaths)
+	}
+	var configs []*wrapguard.WireGuardConfig
+	if err == nil {
+		configs, err = configOpts.ParseTunnelConfigs(configPaths)
+	}
+	if err == nil && (exitNode != "" || len(routes) > 0) {
+		err = wrapguard.ApplyCLIRoutesToTunnels(configs, exitNode, routes)
+	}
+	if err == nil {
+		err = agent.Reload(configs)
+	}
+	if err != nil {
+		logger.Errorf("Failed to reload WireGuard config, keeping the previous one: %v", err)
+		return
+	}
+	logger.Infof("Reloaded WireGuard config from %s", strings.Join(configPaths, ", "))
+
+	if audit != nil {
+		if err := audit.log.ConfigReloaded("config_watch", audit.hash, hash, wrapguard.SummarizeConfigDiffs(audit.configs, configs)); err != nil {
+			logger.Errorf("%v", err)
+		}
+		audit.hash = hash
+		audit.configs = configs
+	}
+}
+
+// waitUntilReady waits up to timeout for every tunnel to complete a
+// handshake, then creates readinessFile, marks the probe server ready and
+// logs the ready event with the time since started
+func waitUntilReady(ctx context.Context, agent *wrapguard.Agent, timeout time.Duration, readinessFile string, probe *wrapguard.ReadinessServer, started time.Time, logger *wrapguard.Logger) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := agent.WaitForHandshake(ctx); err != nil {
+		return fmt.Errorf("no WireGuard handshake within %v", timeout)
+	}
+
+	if readinessFile != "" {
+		if err := os.WriteFile(readinessFile, nil, 0644); err != nil {
+			return fmt.Errorf("failed to create readiness file: %w", err)
+		}
+	}
+	if probe != nil {
+		probe.SetReady()
+	}
+
+	logger.WithFields(map[string]interface{}{
+		"event":      "ready",
+		"elapsed_ms": time.Since(started).Milliseconds(),
+	}).Infof("WrapGuard ready")
+	return nil
+}
+
 func main() {
-	var configPath string
+	started := time.Now()
+
+	// Subcommands come before the flags, which belong to the tunnel itself
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		os.Exit(runDiagnose(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
+	var configPaths []string
+	var configWatch bool
 	var showHelp bool
 	var showVersion bool
 	var logLevelStr string
 	var logFile string
+	var auditLogPath string
+	var logFormat string
+	var logDedupeWindow time.Duration
+	var wgVerbose bool
+	var logHandshakes bool
+	var syslogFacility string
 	var exitNode string
 	var routes []string
-	flag.StringVar(&configPath, "config", "", "Path to WireGuard configuration file")
+	var proxyMode string
+	var allowOverlapping bool
+	var splitTunnel bool
+	var ecmpMode string
+	var childTimeout time.Duration
+	var endpointDNSTTL time.Duration
+	var socksMaxRate float64
+	var socksUpstream string
+	hopCount := wrapguard.MaxHopCount
+	var allowNetworks []netip.Prefix
+	var socksDenyNetworks []netip.Prefix
+	var socksDenyHosts []string
+	var ipcMaxConns int
+	var ipcToken string
+	var onConnected string
+	var onDisconnected string
+	var connectTimeout time.Duration
+	var forwardIdleTimeout time.Duration
+	var shutdownTimeout time.Duration
+	var proxyProtocol string
+	var noProxyProtocolPorts []int
+	var forwardPorts []wrapguard.ForwardedPort
+	var forwardPortDir string
+	var forwardHTTP []wrapguard.HTTPForwardConfig
+	var clearEnv bool
+	var childUser string
+	var childGroup string
+	var childNetnsEnabled bool
+	var maxChildFDs int
+	var envPassthrough []string
+	var noEnvExpand bool
+	var restartOnFail bool
+	var restartMaxAttempts int
+	var restartDelay time.Duration
+	var logRotateCount int
+	var logMaxSizeMB int
+	var pidFile string
+	var pidFileOverwrite bool
+	var readinessFile string
+	var readinessTimeout time.Duration
+	var readinessAddr string
+	var pacAddr string
+	var settingsPath string
+	var generateKeypair bool
+	var generateConfig bool
+	var generateOpts wrapguard.GenerateConfigOptions
+	var privateKeyFile string
+	var peerAllowedIPs string
+	flag.Func("config", "Path to WireGuard configuration file (repeat to merge peers, or to add a tunnel when the file has an [Interface] section)", func(value string) error {
+		configPaths = append(configPaths, value)
+		return nil
+	})
+	flag.BoolVar(&configWatch, "config-watch", false, "Reload the --config files when they change, adding, removing and updating peers without a restart")
+	flag.StringVar(&settingsPath, "wrapguard-config", "", "TOML file with wrapguard settings in a [wrapguard] table; flags take precedence")
 	flag.BoolVar(&showHelp, "help", false, "Show help message")
 	flag.BoolVar(&showVersion, "version", false, "Show version information")
 	flag.StringVar(&logLevelStr, "log-level", "info", "Set log level (error, warn, info, debug)")
 	flag.StringVar(&logFile, "log-file", "", "Set file to write logs to (default: terminal)")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Append a JSON line to this file for every config load and reload, whatever the log level")
+	flag.StringVar(&logFormat, "log-format", "json", "Log output (json, syslog)")
+	flag.DurationVar(&logDedupeWindow, "log-deduplicate-window", 0, "Write a repeated log entry once per window, followed by a count of the repeats (e.g., 5s)")
+	flag.BoolVar(&wgVerbose, "wg-verbose", false, "Log wireguard-go's verbose messages at debug level")
+	flag.BoolVar(&logHandshakes, "log-handshakes", false, "Log every WireGuard handshake message sent or received, with the peer's public key, at info level")
+	flag.StringVar(&syslogFacility, "syslog-facility", "daemon", "Syslog facility with --log-format=syslog")
+	flag.IntVar(&logRotateCount, "log-rotate-count", 5, "Number of rotated log files to keep")
+	flag.IntVar(&logMaxSizeMB, "log-max-size-mb", 0, "Rotate the log file when it exceeds this size in MB (0 disables)")
 	flag.StringVar(&exitNode, "exit-node", "", "Route all traffic through specified peer IP (e.g., 10.0.0.3)")
+	flag.BoolVar(&allowOverlapping, "allow-overlapping-routes", false, "Warn instead of failing when peers have overlapping AllowedIPs")
+	flag.BoolVar(&splitTunnel, "split-tunnel", false, "Ignore AllowedIPs of 0.0.0.0/0 and ::/0, dialing destinations without a narrower route directly")
+	flag.Func("ecmp", "Spread connections over peers whose routes to a destination tie on prefix length and priority (hash, round-robin, random)", func(value string) error {
+		if err := wrapguard.ValidateECMPMode(value); err != nil {
+			return err
+		}
+		ecmpMode = value
+		return nil
+	})
+	flag.DurationVar(&childTimeout, "timeout", 0, "Kill the child process after this duration (e.g., 30s)")
+	flag.DurationVar(&shutdownTimeout, "graceful-shutdown-timeout", 5*time.Second, "Wait this long for the child to exit after SIGINT, SIGTERM or --timeout before killing it")
+	flag.StringVar(&childUser, "child-user", "", "Run the child process as this user, with its primary group unless --child-group is set")
+	flag.StringVar(&childGroup, "child-group", "", "Run the child process with this group")
+	flag.BoolVar(&childNetnsEnabled, "child-netns", false, "Run the child process in its own network namespace, connected to wrapguard only through the proxy ports (Linux only, needs root)")
+	flag.IntVar(&maxChildFDs, "max-child-fds", 0, "Set the child's soft and hard open file limit (RLIMIT_NOFILE) to this, and warn about IPC floods over 10 messages a second per allowed descriptor (0 disables)")
+	flag.StringVar(&forwardPortDir, "forward-port-dir", "", "Forward a port for each *.port file in this directory, following changes (rescanned every 2s and on SIGHUP)")
+	flag.Func("forward-port", "Forward this port from the tunnel to the child without LD_PRELOAD (repeatable, e.g., 8080/tcp or 8080-8090/tcp)", func(value string) error {
+		ports, err := wrapguard.ParseForwardedPorts(value)
+		if err != nil {
+			return err
+		}
+		forwardPorts = append(forwardPorts, ports...)
+		return nil
+	})
+	flag.Func("forward-http", "Listen on a local port and forward to a host through the tunnel, optionally rewriting the HTTP Host header (repeatable, e.g., 8080:internal.corp:80:true)", func(value string) error {
+		forward, err := wrapguard.ParseHTTPForward(value)
+		if err != nil {
+			return err
+		}
+		forwardHTTP = append(forwardHTTP, forward)
+		return nil
+	})
+	flag.DurationVar(&connectTimeout, "connect-timeout", 10*time.Second, "Wait this long for a forwarded port to accept connections before resetting")
+	flag.DurationVar(&forwardIdleTimeout, "forward-idle-timeout", 300*time.Second, "Close forwarded connections that carry no data for this long (0 disables)")
+	flag.Func("proxy-protocol", "Send a PROXY protocol header to forwarded ports so services see the peer address (v2)", func(value string) error {
+		if value != "v2" {
+			return fmt.Errorf("unsupported PROXY protocol version %q (expected v2)", value)
+		}
+		proxyProtocol = value
+		return nil
+	})
+	flag.Func("no-proxy-protocol-ports", "Comma-separated forwarded ports that never get a PROXY protocol header (e.g., 22,25)", func(value string) error {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			port, err := strconv.Atoi(field)
+			if err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("invalid port %q", field)
+			}
+			noProxyProtocolPorts = append(noProxyProtocolPorts, port)
+		}
+		return nil
+	})
+	flag.StringVar(&onConnected, "on-connected", "", "Shell command to run in the background after the first WireGuard handshake")
+	flag.StringVar(&onDisconnected, "on-disconnected", "", "Shell command to run in the background when a connected tunnel is closed")
+	flag.StringVar(&pidFile, "pid-file", "", "Write the wrapguard process ID to this file once the tunnels are up")
+	flag.BoolVar(&pidFileOverwrite, "pid-file-overwrite", false, "Replace an existing --pid-file instead of failing")
+	flag.StringVar(&readinessFile, "readiness-file", "", "Create this file once the WireGuard handshake completes, before starting the child")
+	flag.DurationVar(&readinessTimeout, "readiness-timeout", 30*time.Second, "Exit if the readiness handshake takes longer than this")
+	flag.StringVar(&readinessAddr, "readiness-http-addr", "", "Serve a readiness probe at this address and path (e.g., :8080/ready)")
+	flag.StringVar(&pacAddr, "pac-addr", "", "Serve a PAC file sending WireGuard destinations through the SOCKS5 proxy (e.g., :8080/proxy.pac)")
+	flag.DurationVar(&endpointDNSTTL, "endpoint-dns-ttl", 300*time.Second, "Re-resolve peer endpoint hostnames at this interval (0 disables)")
+	flag.StringVar(&proxyMode, "proxy-mode", "both", "Proxy servers to start (socks5, http, both)")
+	flag.BoolVar(&noEnvExpand, "no-env-expand", false, "Do not expand environment variables in .tmpl config files")
+	flag.BoolVar(&restartOnFail, "restart-on-fail", false, "Restart the child process when it exits with a non-zero code")
+	flag.IntVar(&restartMaxAttempts, "restart-max-attempts", 5, "Maximum number of restarts with --restart-on-fail")
+	flag.DurationVar(&restartDelay, "restart-delay", time.Second, "Delay before the first restart, doubling each time up to 60s")
+	flag.BoolVar(&clearEnv, "clear-env", false, "Start the child with an empty environment apart from wrapguard's own variables")
+	flag.Func("env-passthrough", "Comma-separated environment variables to pass to the child (e.g., HOME,PATH,LANG)", func(value string) error {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				envPassthrough = append(envPassthrough, name)
+			}
+		}
+		return nil
+	})
+	flag.IntVar(&ipcMaxConns, "ipc-max-connections", 256, "Maximum simultaneous IPC connections from the child (0 disables)")
+	flag.StringVar(&ipcToken, "ipc-token", "", "Secret the child must send on IPC connections (default: random per run)")
+	flag.Func("allow-network", "Only allow connections from the child to this network (repeatable, e.g., 10.0.0.0/8)", func(value string) error {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		allowNetworks = append(allowNetworks, prefix.Masked())
+		return nil
+	})
+	flag.Func("socks-deny-network", "Block SOCKS5 connections to this network (repeatable, e.g., 169.254.0.0/16)", func(value string) error {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		socksDenyNetworks = append(socksDenyNetworks, prefix.Masked())
+		return nil
+	})
+	flag.Func("socks-deny-host", "Block SOCKS5 connections to this hostname; *.example.com covers subdomains (repeatable)", func(value string) error {
+		if value = strings.TrimSpace(value); value == "" {
+			return fmt.Errorf("empty host pattern")
+		}
+		socksDenyHosts = append(socksDenyHosts, value)
+		return nil
+	})
+	flag.StringVar(&socksUpstream, "socks-upstream", "", "Chain non-WireGuard traffic through an upstream proxy (socks5://, socks4:// or http://), such as another wrapguard's HTTP CONNECT proxy")
+	flag.Func("hop-count", "Reject HTTP CONNECT requests that have already passed through this many chained wrapguard instances, or through this one (1-4, default 4)", func(value string) error {
+		hops, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid hop count: %s", value)
+		}
+		if err := wrapguard.ValidateHopCount(hops); err != nil {
+			return err
+		}
+		hopCount = hops
+		return nil
+	})
+	flag.Float64Var(&socksMaxRate, "socks-max-conn-rate", 100, "Maximum SOCKS5 connections per second from the child (0 disables)")
 	flag.Func("route", "Add routing policy (format: CIDR:peerIP, e.g., 192.168.1.0/24:10.0.0.3)", func(value string) error {
 		routes = append(routes, value)
 		return nil
 	})
+	flag.BoolVar(&generateKeypair, "generate-keypair", false, "Print a new WireGuard private and public key and exit")
+	flag.BoolVar(&generateConfig, "generate-config", false, "Write a WireGuard config built from --private-key, --address and the --peer-* flags to stdout and exit")
+	flag.StringVar(&privateKeyFile, "private-key", "", "File with the base64 private key for --generate-config (default: generate a new key)")
+	flag.StringVar(&generateOpts.Address, "address", "", "Interface address for --generate-config (e.g., 10.0.0.2/24)")
+	flag.StringVar(&generateOpts.PeerPublicKey, "peer-pubkey", "", "Peer public key for --generate-config")
+	flag.StringVar(&generateOpts.PeerEndpoint, "peer-endpoint", "", "Peer endpoint host:port for --generate-config")
+	flag.StringVar(&peerAllowedIPs, "peer-allowedips", "", "Comma-separated peer AllowedIPs for --generate-config (e.g., 0.0.0.0/0)")
+	applyDebugFlags := registerDebugFlags()
 	flag.Usage = printUsage
 	flag.Parse()
 
@@ -104,22 +705,80 @@ func main() {
 		os.Exit(0)
 	}
 
-	if configPath == "" {
+	if generateKeypair {
+		if len(configPaths) > 0 {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m --generate-keypair cannot be used with --config\n")
+			os.Exit(1)
+		}
+		if err := writeKeyPair(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Failed to generate key pair: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Write a config for new users instead of starting a tunnel
+	if generateConfig {
+		generateOpts.PeerAllowedIPs = strings.Split(peerAllowedIPs, ",")
+		if err := runGenerateConfig(generateOpts, privateKeyFile, os.Stdout, os.Stderr); err != nil {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Failed to generate config: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if len(configPaths) == 0 {
 		printUsage()
 		os.Exit(1)
 	}
 
+	// The WireGuard config holds the keys and peers; wrapguard's own
+	// behaviour can come from a separate TOML file
+	if settingsPath != "" {
+		settings, err := wrapguard.ParseSettingsFile(settingsPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Invalid wrapguard config: %v\n", err)
+			os.Exit(1)
+		}
+		if err := applySettings(flag.CommandLine, settings); err != nil {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Invalid wrapguard config: %v\n", err)
+			os.Exit(1)
+		}
+		if settings.MetricsAddr != "" {
+			fmt.Fprintf(os.Stderr, "wrapguard: ignoring metrics_addr, this build has no metrics endpoint\n")
+		}
+	}
+
+	// A [WrapGuard] section in the first config fills in what the flags and
+	// --wrapguard-config left unset. Reading it expands a template unless
+	// --no-env-expand was given, so set that first.
+	configOpts := wrapguard.ConfigOptions{NoEnvExpand: noEnvExpand}
+	if section := configOpts.ReadWrapGuardConfig(configPaths[0]); section != (wrapguard.WrapGuardConfig{}) {
+		if err := applySettings(flag.CommandLine, section.Settings()); err != nil {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Invalid [WrapGuard] section: %v\n", err)
+			os.Exit(1)
+		}
+		if section.MetricsAddr != "" {
+			fmt.Fprintf(os.Stderr, "wrapguard: ignoring MetricsAddr, this build has no metrics endpoint\n")
+		}
+	}
+
 	// Parse log level
-	logLevel, err := ParseLogLevel(logLevelStr)
+	logLevel, err := wrapguard.ParseLogLevel(logLevelStr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Invalid log level: %v\n", err)
 		os.Exit(1)
 	}
 
+	if logFormat == "syslog" && logFile != "" {
+		fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m --log-file cannot be combined with --log-format=syslog\n")
+		os.Exit(1)
+	}
+
 	// Setup logger output
 	var logOutput io.Writer = os.Stderr
 	if logFile != "" {
-		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		file, err := wrapguard.OpenRotatingFile(logFile, logRotateCount, int64(logMaxSizeMB)*1024*1024)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Failed to open log file: %v\n", err)
 			os.Exit(1)
@@ -128,9 +787,67 @@ func main() {
 		logOutput = file
 	}
 
+	// Open the audit log before anything is loaded, so it records everything
+	var auditLog *wrapguard.AuditLogger
+	if auditLogPath != "" {
+		var err error
+		auditLog, err = wrapguard.OpenAuditLog(auditLogPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m %v\n", err)
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+	}
+
+	// Validate proxy mode
+	switch proxyMode {
+	case "socks5", "http", "both":
+	default:
+		fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Invalid proxy mode: %s (expected socks5, http or both)\n", proxyMode)
+		os.Exit(1)
+	}
+	if pacAddr != "" && proxyMode == "http" {
+		fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m --pac-addr needs the SOCKS5 proxy, which --proxy-mode=http disables\n")
+		os.Exit(1)
+	}
+
 	// Create logger
-	logger := NewLogger(logLevel, logOutput)
-	SetGlobalLogger(logger)
+	var logger *wrapguard.Logger
+	switch logFormat {
+	case "json":
+		logger = wrapguard.NewLogger(logLevel, logOutput)
+	case "syslog":
+		facility, err := wrapguard.ParseSyslogFacility(syslogFacility)
+		if err == nil {
+			logger, err = wrapguard.NewSyslogLogger(logLevel, facility, "wrapguard")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Failed to set up syslog: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "\n\033[31m✗ Error:\033[0m Invalid log format: %s (expected json or syslog)\n", logFormat)
+		os.Exit(1)
+	}
+	if logDedupeWindow > 0 {
+		logger = logger.Deduplicate(logDedupeWindow)
+	}
+	wrapguard.SetGlobalLogger(logger)
+
+	// Rotate the log file on SIGUSR2
+	if logFile != "" {
+		rotateChan := make(chan os.Signal, 1)
+		signal.Notify(rotateChan, syscall.SIGUSR2)
+		go func() {
+			for range rotateChan {
+				if err := logger.Rotate(); err != nil {
+					fmt.Fprintf(os.Stderr, "wrapguard: failed to rotate log file: %v\n", err)
+					continue
+				}
+				logger.Infof("Log file rotated")
+			}
+		}()
+	}
 
 	args := flag.Args()
 	if len(args) == 0 {
@@ -139,63 +856,250 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Chain non-WireGuard destinations through the upstream proxy, if configured
+	var upstreamDial wrapguard.DialFunc
+	if socksUpstream != "" {
+		dial, err := wrapguard.NewUpstreamDialer(socksUpstream)
+		if err != nil {
+			logger.Errorf("Invalid upstream proxy: %v", err)
+			os.Exit(1)
+		}
+		upstreamDial = dial
+	}
+
+	// Drop privileges for the child, if configured
+	credential, err := childCredential(childUser, childGroup)
+	if err != nil {
+		logger.Errorf("Failed to look up child user: %v", err)
+		os.Exit(1)
+	}
+
+	// Limit the child's open files, if configured
+	var childFDs syscall.Rlimit
+	if maxChildFDs < 0 {
+		logger.Errorf("Invalid --max-child-fds: %d (expected 0 or more)", maxChildFDs)
+		os.Exit(1)
+	}
+	if maxChildFDs > 0 {
+		if childFDs, err = childFDLimit(maxChildFDs); err != nil {
+			logger.Errorf("Failed to limit the child's open files: %v", err)
+			os.Exit(1)
+		}
+		if childFDs.Max < uint64(maxChildFDs) {
+			logger.Warnf("--max-child-fds=%d is over wrapguard's own hard limit, using %d", maxChildFDs, childFDs.Max)
+		}
+		logger.Infof("Child open file limit: rlimit soft %d, hard %d", childFDs.Cur, childFDs.Max)
+	}
+
+	// The option structs take zero to mean the default, where these flags
+	// take it to mean no limit, no wait or no timeout
+	if ipcMaxConns == 0 {
+		ipcMaxConns = -1
+	}
+	if connectTimeout == 0 {
+		connectTimeout = -1
+	}
+	if forwardIdleTimeout == 0 {
+		forwardIdleTimeout = -1
+	}
+	agent := &wrapguard.Agent{
+		ProxyMode:      proxyMode,
+		EndpointDNSTTL: endpointDNSTTL,
+		ForwardPorts:   forwardPorts,
+		ForwardPortDir: forwardPortDir,
+		ForwardHTTP:    forwardHTTP,
+		Tunnel: wrapguard.TunnelOptions{
+			Routing:        wrapguard.RoutingOptions{SplitTunnel: splitTunnel, ECMPMode: ecmpMode},
+			Verbose:        wgVerbose,
+			LogHandshakes:  logHandshakes,
+			OnConnected:    onConnected,
+			OnDisconnected: onDisconnected,
+		},
+		Proxy: wrapguard.ProxyOptions{
+			AllowedNetworks: allowNetworks,
+			UpstreamDial:    upstreamDial,
+			MaxConnRate:     socksMaxRate,
+			DenyNetworks:    socksDenyNetworks,
+			DenyHosts:       socksDenyHosts,
+			HopCount:        hopCount,
+		},
+		IPC: wrapguard.IPCOptions{
+			Token:              ipcToken,
+			MaxConnections:     ipcMaxConns,
+			MessageRateWarning: maxChildFDs * 10,
+		},
+		Forwarder: wrapguard.ForwarderOptions{
+			ConnectTimeout:       connectTimeout,
+			IdleTimeout:          forwardIdleTimeout,
+			ProxyProtocol:        proxyProtocol,
+			NoProxyProtocolPorts: noProxyProtocolPorts,
+		},
+	}
+	if err := applyDebugFlags(logger, &agent.Tunnel.Impairment); err != nil {
+		logger.Errorf("Invalid debug option: %v", err)
+		os.Exit(1)
+	}
+
 	// Parse WireGuard configuration
-	config, err := ParseConfig(configPath)
+	configOpts.AllowOverlappingRoutes = allowOverlapping
+	var configHash string
+	if auditLog != nil {
+		var err error
+		if configHash, err = wrapguard.HashConfigFiles(configPaths); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+	configs, err := configOpts.ParseTunnelConfigs(configPaths)
 	if err != nil {
-		logger.Errorf("Failed to parse WireGuard config: %v", err)
+		var configErrs wrapguard.ConfigErrors
+		if errors.As(err, &configErrs) {
+			for _, configErr := range configErrs {
+				logger.Errorf("Invalid WireGuard config: %v%s", configErr, configErrorHint(configErr))
+			}
+			logger.Errorf("Failed to parse WireGuard config: %d errors found", len(configErrs))
+		} else {
+			logger.Errorf("Failed to parse WireGuard config: %v%s", err, configErrorHint(err))
+		}
 		os.Exit(1)
 	}
 
 	// Apply CLI routing options
 	if exitNode != "" || len(routes) > 0 {
-		if err := ApplyCLIRoutes(config, exitNode, routes); err != nil {
+		if err := wrapguard.ApplyCLIRoutesToTunnels(configs, exitNode, routes); err != nil {
 			logger.Errorf("Failed to apply routing options: %v", err)
 			os.Exit(1)
 		}
 	}
 
-	// Create IPC server for communication with LD_PRELOAD library
-	ipcServer, err := NewIPCServer()
-	if err != nil {
-		logger.Errorf("Failed to start IPC server: %v", err)
-		os.Exit(1)
+	if auditLog != nil {
+		if err := auditLog.ConfigLoaded("startup", configHash); err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
 	}
-	defer ipcServer.Close()
 
 	// Create context for cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start WireGuard tunnel
-	logger.Infof("Creating WireGuard tunnel...")
-	tunnel, err := NewTunnel(ctx, config)
-	if err != nil {
-		logger.Errorf("Failed to create tunnel: %v", err)
+	// Start the tunnels, proxy servers, IPC server and port forwarder
+	if err := agent.StartTunnels(ctx, configs); err != nil {
+		logger.Errorf("Failed to start WrapGuard: %v", err)
 		os.Exit(1)
 	}
-	defer tunnel.Close()
-	logger.Infof("WireGuard tunnel created successfully")
+	defer agent.Stop()
 
-	// Start SOCKS5 server that routes through WireGuard tunnel
-	logger.Infof("Starting SOCKS5 server...")
-	socksServer, err := NewSOCKS5Server(tunnel)
-	if err != nil {
-		logger.Errorf("Failed to start SOCKS5 server: %v", err)
+	// Record our PID for process supervisors now that the tunnels are up
+	if pidFile != "" {
+		if err := writePIDFile(pidFile, pidFileOverwrite); err != nil {
+			logger.Errorf("Failed to write PID file: %v", err)
+			agent.Stop()
+			os.Exit(1)
+		}
+		defer os.Remove(pidFile)
+	}
+
+	// exitStarted undoes the startup so far and exits, as os.Exit skips deferred calls
+	exitStarted := func() {
+		agent.Stop()
+		if pidFile != "" {
+			os.Remove(pidFile)
+		}
 		os.Exit(1)
 	}
-	defer socksServer.Close()
-	logger.Infof("SOCKS5 server started on port %d", socksServer.Port())
 
-	// Start port forwarder for incoming connections
-	forwarder := NewPortForwarder(tunnel, ipcServer.MessageChan())
-	go forwarder.Run(ctx)
+	// A child running as another user needs to reach the IPC socket
+	if credential != nil {
+		if err := agent.ChownIPCSocket(int(credential.Uid), int(credential.Gid)); err != nil {
+			logger.Errorf("Failed to hand the IPC socket to the child user: %v", err)
+			exitStarted()
+		}
+		logger.Infof("Child process will run as uid %d gid %d", credential.Uid, credential.Gid)
+	}
+
+	// Isolate the child in a network namespace whose only way out is the
+	// proxies, bridged onto its loopback
+	var netns *childNetns
+	if childNetnsEnabled {
+		netns, err = newChildNetns(agent.ProxyPorts(), logger)
+		if err != nil {
+			logger.Errorf("Failed to isolate the child network: %v", err)
+			exitStarted()
+		}
+		defer netns.Close()
+		logger.Infof("Child process will run in its own network namespace")
+	}
+
+	// Let browsers find the SOCKS5 proxies through a PAC file
+	var pacServer *wrapguard.PACServer
+	if pacAddr != "" {
+		pacServer, err = wrapguard.NewPACServer(pacAddr, agent.ServePAC)
+		if err != nil {
+			logger.Errorf("Failed to start PAC server: %v", err)
+			exitStarted()
+		}
+		defer pacServer.Close()
+	}
+
+	// Hold the child back until the tunnels are up, for container readiness probes
+	var readinessServer *wrapguard.ReadinessServer
+	if readinessAddr != "" {
+		readinessServer, err = wrapguard.NewReadinessServer(readinessAddr)
+		if err != nil {
+			logger.Errorf("Failed to start readiness probe: %v", err)
+			exitStarted()
+		}
+		defer readinessServer.Close()
+	}
+	if readinessFile != "" || readinessServer != nil {
+		if err := waitUntilReady(ctx, agent, readinessTimeout, readinessFile, readinessServer, started, logger); err != nil {
+			logger.Errorf("WrapGuard not ready: %v", err)
+			exitStarted()
+		}
+	}
+	if readinessFile != "" {
+		defer os.Remove(readinessFile)
+	}
+
+	// Rescan the forwarded port directory on SIGHUP
+	if forwardPortDir != "" {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				logger.Infof("Received SIGHUP, rescanning %s", forwardPortDir)
+				agent.ScanForwardPortDir()
+			}
+		}()
+	}
+
+	// Apply config changes as the files are saved
+	if configWatch {
+		var audit *configAudit
+		if auditLog != nil {
+			audit = &configAudit{log: auditLog, hash: configHash, configs: configs}
+		}
+		wrapguard.WatchConfigFiles(ctx, configPaths, func() {
+			reloadConfigs(agent, configOpts, configPaths, exitNode, routes, audit, logger)
+		})
+	}
+
+	// Suspend and resume the tunnels around hibernation
+	if len(suspendSignals) > 0 {
+		suspendChan := make(chan os.Signal, 1)
+		signal.Notify(suspendChan, suspendSignals...)
+		go watchSuspend(ctx, agent, suspendChan, logger)
+	}
 
 	// Show startup messages using structured logging
 	logger.Infof("WrapGuard v%s initialized", version)
-	logger.Infof("Config: %s", configPath)
-	logger.Infof("Interface: %s", config.Interface.Address)
-	if len(config.Peers) > 0 {
-		logger.Infof("Peer endpoint: %s", config.Peers[0].Endpoint)
+	logger.Infof("Config: %s", strings.Join(configPaths, ", "))
+	for _, config := range configs {
+		logger.Infof("Interface: %s", strings.Join(config.Interface.Address, ", "))
+		if len(config.Peers) > 0 {
+			logger.Infof("Peer endpoint: %s", config.Peers[0].Endpoint)
+		}
 	}
 	logger.Infof("Launching: [%s]", strings.Join(args, " "))
 
@@ -207,59 +1111,136 @@ func main() {
 	}
 	libPath := filepath.Join(filepath.Dir(execPath), "libwrapguard.so")
 
-	// Prepare child process
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	// Set LD_PRELOAD and IPC socket path
-	cmd.Env = append(os.Environ(),
-		fmt.Sprintf("LD_PRELOAD=%s", libPath),
-		fmt.Sprintf("WRAPGUARD_IPC_PATH=%s", ipcServer.SocketPath()),
-		fmt.Sprintf("WRAPGUARD_SOCKS_PORT=%d", socksServer.Port()),
-	)
-
-	// Start the child process
-	if err := cmd.Start(); err != nil {
-		logger.Errorf("Failed to start child process: %v", err)
-		os.Exit(1)
-	}
+	// Set LD_PRELOAD, IPC socket path and token, and proxy ports
+	wrapguardEnv := append([]string{fmt.Sprintf("LD_PRELOAD=%s", libPath)}, agent.Env()...)
+	childEnv := buildChildEnv(os.Environ(), clearEnv, envPassthrough, wrapguardEnv)
 
 	// Handle signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Wait for child process or signal
-	done := make(chan error, 1)
-	go func() {
-		done <- cmd.Wait()
-	}()
+	// Enforce the maximum wall-clock duration of the child, if configured.
+	// The limit covers all restarts together.
+	var timeoutChan <-chan time.Time
+	if childTimeout > 0 {
+		timer := time.NewTimer(childTimeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
 
-	select {
-	case err := <-done:
-		if err != nil {
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				os.Exit(exitErr.ExitCode())
+	exitCode := 0
+	nextDelay := restartDelay
+childLoop:
+	for attempt := 0; ; attempt++ {
+		// Prepare child process
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = childEnv
+		if credential != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+		}
+		if maxChildFDs > 0 {
+			limitChildFDs(cmd, childFDs)
+		}
+
+		// Start the child process
+		start := cmd.Start
+		if netns != nil {
+			start = func() error { return netns.start(cmd) }
+		}
+		if err := start(); err != nil {
+			logger.Errorf("Failed to start child process: %v", err)
+			exitCode = 1
+			break
+		}
+
+		// Wait for child process or signal
+		done := make(chan error, 1)
+		go func() {
+			done <- cmd.Wait()
+		}()
+
+		select {
+		case err := <-done:
+			exitCode = 0
+			if err != nil {
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					exitCode = exitErr.ExitCode()
+				} else {
+					logger.Errorf("Child process error: %v", err)
+					exitCode = 1
+				}
 			}
-			logger.Errorf("Child process error: %v", err)
-			os.Exit(1)
+		case sig := <-sigChan:
+			logger.Infof("Received signal %v, shutting down...", sig)
+			// Take the tunnels down first, so connections the child opens
+			// while it exits fail now rather than being cut off by Stop
+			if err := agent.Down(); err != nil {
+				logger.Warnf("Failed to take tunnels down: %v", err)
+			}
+			// Forward signal to child process
+			if cmd.Process != nil {
+				cmd.Process.Signal(sig)
+			}
+			// Wait for child to exit
+			select {
+			case <-done:
+			case <-time.After(shutdownTimeout):
+				logger.Warnf("Child process did not exit gracefully, killing...")
+				cmd.Process.Kill()
+			}
+			exitCode = 1
+			break childLoop
+		case <-timeoutChan:
+			logger.Warnf("Child process exceeded timeout of %v, terminating...", childTimeout)
+			cmd.Process.Signal(syscall.SIGTERM)
+			select {
+			case <-done:
+			case <-time.After(shutdownTimeout):
+				logger.Warnf("Child process did not exit after SIGTERM, killing...")
+				cmd.Process.Kill()
+			}
+			// Match the exit code used by timeout(1)
+			exitCode = 124
+			break childLoop
 		}
-		// Exit cleanly when child process completes successfully
-		os.Exit(0)
-	case sig := <-sigChan:
-		logger.Infof("Received signal %v, shutting down...", sig)
-		// Forward signal to child process
-		if cmd.Process != nil {
-			cmd.Process.Signal(sig)
+
+		if exitCode == 0 || !restartOnFail || attempt >= restartMaxAttempts {
+			break
 		}
-		// Wait for child to exit
+
+		// Restart the failed child after a delay that doubles each time
+		logger.Warnf("Child process exited with code %d, restarting in %v (attempt %d of %d)", exitCode, nextDelay, attempt+1, restartMaxAttempts)
 		select {
-		case <-done:
-		case <-time.After(5 * time.Second):
-			logger.Warnf("Child process did not exit gracefully, killing...")
-			cmd.Process.Kill()
+		case <-time.After(nextDelay):
+		case sig := <-sigChan:
+			logger.Infof("Received signal %v, shutting down...", sig)
+			break childLoop
+		case <-timeoutChan:
+			logger.Warnf("Child process exceeded timeout of %v, not restarting", childTimeout)
+			exitCode = 124
+			break childLoop
 		}
-		os.Exit(1)
+		nextDelay = min(nextDelay*2, maxRestartDelay)
+	}
+
+	// os.Exit skips deferred calls, so stop the agent explicitly to run PostDown
+	// hooks and remove the PID and readiness files
+	agent.Stop()
+	if pidFile != "" {
+		os.Remove(pidFile)
+	}
+	if pacServer != nil {
+		pacServer.Close()
+	}
+	if readinessServer != nil {
+		readinessServer.Close()
+	}
+	if readinessFile != "" {
+		os.Remove(readinessFile)
 	}
+	logger.Flush()
+	os.Exit(exitCode)
 }
@@ -2,13 +2,33 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
 )
 
 func TestPrintUsage(t *testing.T) {
@@ -23,13 +43,12 @@ func TestPrintUsage(t *testing.T) {
 	os.Stderr = oldStderr
 
 	// Read captured output
-	buf := make([]byte, 4096)
-	n, err := r.Read(buf)
-	if err != nil && n == 0 {
+	buf, err := io.ReadAll(r)
+	if err != nil || len(buf) == 0 {
 		t.Fatal("failed to read usage output")
 	}
 
-	output := string(buf[:n])
+	output := string(buf)
 
 	// Check that usage contains expected elements
 	expectedParts := []string{
@@ -166,6 +185,322 @@ func TestMainWithInvalidLogLevel(t *testing.T) {
 	}
 }
 
+func TestMainWithInvalidProxyMode(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_PROXY_MODE") == "1" {
+		// We're in the subprocess
+		tempConfig := createTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--proxy-mode=invalid", "echo", "hello"}
+		main()
+		return
+	}
+
+	// Run subprocess
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidProxyMode")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_PROXY_MODE=1")
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if exitErr.ExitCode() != 1 {
+				t.Errorf("expected exit code 1 for invalid proxy mode, got %d", exitErr.ExitCode())
+			}
+		}
+	}
+
+	if !strings.Contains(string(output), "Invalid proxy mode") {
+		t.Error("should show invalid proxy mode error")
+	}
+}
+
+// buildPreloadLibrary compiles the LD_PRELOAD library next to the test
+// binary, where main looks for it, skipping the test without gcc
+func buildPreloadLibrary(t *testing.T) {
+	t.Helper()
+
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not available")
+	}
+	lib := filepath.Join(filepath.Dir(os.Args[0]), "libwrapguard.so")
+	if output, err := exec.Command("gcc", "-shared", "-fPIC", "-o", lib, "lib/intercept.c", "-ldl").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the LD_PRELOAD library: %v\n%s", err, output)
+	}
+	t.Cleanup(func() { os.Remove(lib) })
+}
+
+func TestMainWithHTTPProxyModeChild(t *testing.T) {
+	if os.Getenv("TEST_MAIN_HTTP_PROXY_MODE") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		script := fmt.Sprintf("exec 3<>/dev/tcp/127.0.0.1/%s && echo connected", os.Getenv("TEST_TARGET_PORT"))
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=error", "--proxy-mode=http", "--", "bash", "-c", script}
+		main()
+		return
+	}
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	buildPreloadLibrary(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Without a SOCKS5 proxy the library leaves the child's connections alone
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithHTTPProxyModeChild")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_HTTP_PROXY_MODE=1", fmt.Sprintf("TEST_TARGET_PORT=%d", listener.Addr().(*net.TCPAddr).Port))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("expected the child to connect, got %v\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "connected") || strings.Contains(string(output), "Missing environment variables") {
+		t.Errorf("unexpected output:\n%s", output)
+	}
+}
+
+func TestMainWithInvalidLogFormat(t *testing.T) {
+	if args := os.Getenv("TEST_MAIN_LOG_FORMAT_ARGS"); args != "" {
+		// We're in the subprocess
+		tempConfig := createTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = append([]string{"wrapguard", "--config=" + tempConfig}, strings.Fields(args)...)
+		os.Args = append(os.Args, "echo", "hello")
+		main()
+		return
+	}
+
+	logFile := filepath.Join(t.TempDir(), "wrapguard.log")
+	tests := []struct {
+		name     string
+		args     string
+		expected string
+	}{
+		{"unknown format", "--log-format=xml", "Invalid log format: xml"},
+		{"unknown facility", "--log-format=syslog --syslog-facility=bogus", "invalid syslog facility: bogus"},
+		{"syslog with log file", "--log-format=syslog --log-file=" + logFile, "--log-file cannot be combined with --log-format=syslog"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidLogFormat")
+			cmd.Env = append(os.Environ(), "TEST_MAIN_LOG_FORMAT_ARGS="+tt.args)
+
+			output, err := cmd.CombinedOutput()
+			if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+				t.Errorf("expected exit code 1, got %v", err)
+			}
+			if !strings.Contains(string(output), tt.expected) {
+				t.Errorf("expected %q in output:\n%s", tt.expected, output)
+			}
+		})
+	}
+
+	if _, err := os.Stat(logFile); !os.IsNotExist(err) {
+		t.Error("log file should not be created when syslog is requested")
+	}
+}
+
+func TestMainWithInvalidAllowNetwork(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_ALLOW_NETWORK") == "1" {
+		// We're in the subprocess
+		tempConfig := createTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--allow-network=10.0.0.0/33", "echo", "hello"}
+		main()
+		return
+	}
+
+	// Run subprocess
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidAllowNetwork")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_ALLOW_NETWORK=1")
+
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Error("expected failure for invalid --allow-network")
+	}
+
+	if !strings.Contains(string(output), "invalid network") {
+		t.Errorf("should show invalid network error, got %q", output)
+	}
+}
+
+func TestMainWithInvalidECMP(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_ECMP") == "1" {
+		// We're in the subprocess
+		tempConfig := createTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--ecmp=weighted", "echo", "hello"}
+		main()
+		return
+	}
+
+	// Run subprocess
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidECMP")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_ECMP=1")
+
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Error("expected failure for invalid --ecmp")
+	}
+
+	if !strings.Contains(string(output), "invalid ECMP mode: weighted") {
+		t.Errorf("should show invalid ECMP mode error, got %q", output)
+	}
+}
+
+func TestMainWithInvalidHopCount(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_HOP_COUNT") == "1" {
+		// We're in the subprocess
+		tempConfig := createTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--hop-count=5", "echo", "hello"}
+		main()
+		return
+	}
+
+	// Run subprocess
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidHopCount")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_HOP_COUNT=1")
+
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Error("expected failure for invalid --hop-count")
+	}
+
+	if !strings.Contains(string(output), "invalid hop count: 5 (expected 1 to 4)") {
+		t.Errorf("should show invalid hop count error, got %q", output)
+	}
+}
+
+func TestMainWithInvalidSOCKSDenyRule(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_SOCKS_DENY") == "1" {
+		// We're in the subprocess
+		tempConfig := createTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, os.Getenv("TEST_SOCKS_DENY_FLAG"), "echo", "hello"}
+		main()
+		return
+	}
+
+	tests := []struct {
+		flag     string
+		expected string
+	}{
+		{"--socks-deny-network=169.254.0.0/33", "invalid network"},
+		{"--socks-deny-host=", "empty host pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidSOCKSDenyRule")
+			cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_SOCKS_DENY=1", "TEST_SOCKS_DENY_FLAG="+tt.flag)
+
+			output, err := cmd.CombinedOutput()
+			if err == nil {
+				t.Errorf("expected failure for %s", tt.flag)
+			}
+			if !strings.Contains(string(output), tt.expected) {
+				t.Errorf("expected %q in output, got %q", tt.expected, output)
+			}
+		})
+	}
+}
+
+func TestMainWithInvalidProxyProtocol(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_PROXY_PROTOCOL") == "1" {
+		// We're in the subprocess
+		tempConfig := createTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, os.Getenv("TEST_PROXY_PROTOCOL_FLAG"), "echo", "hello"}
+		main()
+		return
+	}
+
+	tests := []struct {
+		flag     string
+		expected string
+	}{
+		{"--proxy-protocol=v1", "unsupported PROXY protocol version"},
+		{"--no-proxy-protocol-ports=22,ssh", `invalid port "ssh"`},
+		{"--no-proxy-protocol-ports=70000", `invalid port "70000"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidProxyProtocol")
+			cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_PROXY_PROTOCOL=1", "TEST_PROXY_PROTOCOL_FLAG="+tt.flag)
+
+			output, err := cmd.CombinedOutput()
+			if err == nil {
+				t.Errorf("expected failure for %s", tt.flag)
+			}
+			if !strings.Contains(string(output), tt.expected) {
+				t.Errorf("expected %q in output, got %q", tt.expected, output)
+			}
+		})
+	}
+}
+
+func TestMainWithInvalidForwardPort(t *testing.T) {
+	if os.Getenv("TEST_MAIN_INVALID_FORWARD_PORT") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, os.Getenv("TEST_FORWARD_PORT_FLAG"), "echo", "hello"}
+		main()
+		return
+	}
+
+	tests := []struct {
+		flag     string
+		expected string
+	}{
+		{"--forward-port=8080/sctp", `invalid protocol "sctp"`},
+		{"--forward-port=/tcp", "missing port"},
+		{"--forward-port=9000-8000/tcp", "invalid port range"},
+		{"--forward-port=53/udp", "UDP port forwarding is not supported"},
+		{"--forward-http=8080:internal.corp", `invalid target "internal.corp"`},
+		{"--forward-http=8080:internal.corp:80:maybe", `invalid rewriteHost "maybe"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=TestMainWithInvalidForwardPort")
+			cmd.Env = append(os.Environ(), "TEST_MAIN_INVALID_FORWARD_PORT=1", "TEST_FORWARD_PORT_FLAG="+tt.flag)
+
+			output, err := cmd.CombinedOutput()
+			if err == nil {
+				t.Errorf("expected failure for %s", tt.flag)
+			}
+			if !strings.Contains(string(output), tt.expected) {
+				t.Errorf("expected %q in output, got %q", tt.expected, output)
+			}
+		})
+	}
+}
+
 func TestMainWithInvalidConfig(t *testing.T) {
 	if os.Getenv("TEST_MAIN_INVALID_CONFIG") == "1" {
 		// We're in the subprocess
@@ -188,6 +523,40 @@ func TestMainWithInvalidConfig(t *testing.T) {
 	}
 }
 
+func TestConfigErrorHint(t *testing.T) {
+	peer := "\n[Peer]\nPublicKey = " + testKey(2) + "\nAllowedIPs = 10.150.0.0/24\n"
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{"missing private key", "[Interface]\nAddress = 10.150.0.2/24\n" + peer, ". Did you forget to set PrivateKey?"},
+		{"invalid private key", "[Interface]\nPrivateKey = nope\nAddress = 10.150.0.2/24\n" + peer, ". PrivateKey must be a base64 key as printed by wg genkey or wg pubkey."},
+		{"invalid address", "[Interface]\nPrivateKey = " + testKey(1) + "\nAddress = 10.150.0.2\n" + peer, ". Set Address in [Interface] to a CIDR such as 10.0.0.2/24."},
+		{"no peers", "[Interface]\nPrivateKey = " + testKey(1) + "\nAddress = 10.150.0.2/24\n", ". Add a [Peer] section with PublicKey and AllowedIPs."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := wrapguard.ParseConfigReader(strings.NewReader(tt.config))
+			if err == nil {
+				t.Fatal("expected a config error")
+			}
+			if hint := configErrorHint(err); hint != tt.expected {
+				t.Errorf("expected hint %q, got %q", tt.expected, hint)
+			}
+		})
+	}
+
+	_, err := wrapguard.ParseConfig(filepath.Join(t.TempDir(), "missing.conf"))
+	if hint := configErrorHint(err); hint != ". Check the --config path." {
+		t.Errorf("unexpected hint for a missing file %q", hint)
+	}
+	if hint := configErrorHint(errors.New("something else")); hint != "" {
+		t.Errorf("expected no hint for other errors, got %q", hint)
+	}
+}
+
 func TestMainWithNoCommand(t *testing.T) {
 	if os.Getenv("TEST_MAIN_NO_COMMAND") == "1" {
 		// We're in the subprocess
@@ -243,6 +612,57 @@ func TestMainWithLogFile(t *testing.T) {
 	// The test mainly ensures no panic occurs with log file option
 }
 
+func TestMainWithLogDeduplicate(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "wrapguard.log")
+	if os.Getenv("TEST_MAIN_LOG_DEDUPLICATE") == "1" {
+		// We're in the subprocess
+		logFile = os.Getenv("TEST_LOG_FILE")
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		// Each repeat of the peers file logs the same duplicate peer warning
+		peers := filepath.Join(t.TempDir(), "peers.conf")
+		os.WriteFile(peers, []byte("[Peer]\nPublicKey = "+testKey(2)+"\nAllowedIPs = 10.150.0.0/24\n"), 0600)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--config=" + peers, "--config=" + peers, "--config=" + peers, "--config=" + peers,
+			"--allow-overlapping-routes", "--log-file=" + logFile, "--log-deduplicate-window=1m", "--", "true"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithLogDeduplicate")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_LOG_DEDUPLICATE=1", "TEST_LOG_FILE="+logFile)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("wrapguard failed: %v\n%s", err, output)
+	}
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+
+	// The first of the four identical warnings is written, and the summary
+	// for the other three is flushed at exit
+	var written, suppressed int
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if !strings.Contains(line, "Duplicate peer public key") {
+			continue
+		}
+		var entry struct {
+			Suppressed int `json:"suppressed"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		written++
+		suppressed += entry.Suppressed
+	}
+	if written != 2 || suppressed != 3 {
+		t.Errorf("expected one warning and a summary of 3 repeats, got %d lines and %d suppressed:\n%s", written, suppressed, data)
+	}
+}
+
 func TestFlagParsing(t *testing.T) {
 	// Test flag parsing logic separately
 	tests := []struct {
@@ -436,55 +856,1317 @@ AllowedIPs = 0.0.0.0/0`
 	return tempFile.Name()
 }
 
-// Test global logger setup in main
-func TestMainLoggerSetup(t *testing.T) {
-	// Test that the logger is set up correctly in main
-	// We can't easily test this without running main, but we can test
-	// the logger creation logic
-
-	tests := []struct {
-		name     string
-		logLevel string
-		logFile  string
-		wantErr  bool
-	}{
-		{"valid info level", "info", "", false},
-		{"valid debug level", "debug", "", false},
-		{"valid error level", "error", "", false},
-		{"valid warn level", "warn", "", false},
-		{"invalid level", "invalid", "", true},
-		{"valid with file", "info", "/tmp/test.log", false},
+// testKey returns a deterministic base64 WireGuard key for the given seed
+func testKey(seed byte) string {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i) + seed
 	}
+	return base64.StdEncoding.EncodeToString(key)
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			logLevel, err := ParseLogLevel(tt.logLevel)
+// Helper function to create a temporary config file that passes validation
+func createValidTempConfig(t *testing.T) string {
+	tempFile, err := os.CreateTemp("", "wrapguard-valid-*.conf")
+	if err != nil {
+		t.Fatalf("failed to create temp config: %v", err)
+	}
 
-			if tt.wantErr {
-				if err == nil {
-					t.Error("expected error for invalid log level")
-				}
-				return
-			}
+	config := `[Interface]
+PrivateKey = ` + testKey(1) + `
+Address = 10.150.0.2/24
 
-			if err != nil {
-				t.Errorf("unexpected error: %v", err)
-				return
-			}
+[Peer]
+PublicKey = ` + testKey(2) + `
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 10.150.0.0/24`
+
+	if _, err := tempFile.WriteString(config); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+
+	tempFile.Close()
+	return tempFile.Name()
+}
+
+func TestMainWithTimeout(t *testing.T) {
+	if os.Getenv("TEST_MAIN_TIMEOUT") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=error", "--timeout=500ms", "--", "sleep", "60"}
+		main()
+		return
+	}
+
+	// Run subprocess
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithTimeout")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_TIMEOUT=1")
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Run()
+	}()
+
+	select {
+	case err := <-done:
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			t.Fatalf("expected exit error, got %v", err)
+		}
+		if exitErr.ExitCode() != 124 {
+			t.Errorf("expected exit code 124 after timeout, got %d", exitErr.ExitCode())
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("child was not terminated promptly, took %v", elapsed)
+		}
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("wrapguard did not enforce --timeout")
+	}
+}
+
+func TestChildCredential(t *testing.T) {
+	if credential, err := childCredential("", ""); credential != nil || err != nil {
+		t.Errorf("expected no credential without flags, got %+v, %v", credential, err)
+	}
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no nobody user: %v", err)
+	}
+	uid, _ := strconv.Atoi(nobody.Uid)
+	gid, _ := strconv.Atoi(nobody.Gid)
+
+	// The user's primary group is used without --child-group
+	credential, err := childCredential("nobody", "")
+	if err != nil {
+		t.Fatalf("childCredential failed: %v", err)
+	}
+	if credential.Uid != uint32(uid) || credential.Gid != uint32(gid) {
+		t.Errorf("expected %d:%d, got %d:%d", uid, gid, credential.Uid, credential.Gid)
+	}
+	if credential.NoSetGroups != (os.Geteuid() != 0) {
+		t.Errorf("expected supplementary groups to be dropped only as root, got NoSetGroups %v", credential.NoSetGroups)
+	}
+
+	// --child-group alone keeps wrapguard's user
+	group, err := user.LookupGroupId(nobody.Gid)
+	if err != nil {
+		t.Skipf("no group for gid %s: %v", nobody.Gid, err)
+	}
+	credential, err = childCredential("", group.Name)
+	if err != nil {
+		t.Fatalf("childCredential failed: %v", err)
+	}
+	if credential.Uid != uint32(os.Getuid()) || credential.Gid != uint32(gid) {
+		t.Errorf("expected %d:%d, got %d:%d", os.Getuid(), gid, credential.Uid, credential.Gid)
+	}
+
+	if _, err := childCredential("wrapguard-no-such-user", ""); err == nil {
+		t.Error("expected an error for an unknown user")
+	}
+	if _, err := childCredential("nobody", "wrapguard-no-such-group"); err == nil {
+		t.Error("expected an error for an unknown group")
+	}
+}
+
+func TestMainWithChildUser(t *testing.T) {
+	if os.Getenv("TEST_MAIN_CHILD_USER") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--child-user=nobody", "--", "id", "-u"}
+		main()
+		return
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("running the child as another user needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no nobody user: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithChildUser")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_CHILD_USER=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("wrapguard --child-user failed: %v\n%s", err, stderr.String())
+	}
+
+	if !strings.Contains(string(output), nobody.Uid+"\n") {
+		t.Errorf("expected the child to run as uid %s, got %q", nobody.Uid, output)
+	}
+	if !strings.Contains(stderr.String(), "Child process will run as uid "+nobody.Uid) {
+		t.Errorf("expected the child's uid to be logged:\n%s", stderr.String())
+	}
+}
+
+func TestMainWithMaxChildFDs(t *testing.T) {
+	if os.Getenv("TEST_MAIN_MAX_CHILD_FDS") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--max-child-fds=" + os.Getenv("TEST_MAX_CHILD_FDS"), "--", "sh", "-c", "ulimit -S -n; ulimit -H -n"}
+		main()
+		return
+	}
+
+	run := func(maxFDs string) (string, string, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMainWithMaxChildFDs")
+		cmd.Env = append(os.Environ(), "TEST_MAIN_MAX_CHILD_FDS=1", "TEST_MAX_CHILD_FDS="+maxFDs)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		output, err := cmd.Output()
+		return string(output), stderr.String(), err
+	}
+
+	output, stderr, err := run("100")
+	if err != nil {
+		t.Fatalf("wrapguard --max-child-fds failed: %v\n%s", err, stderr)
+	}
+	if !strings.HasPrefix(output, "100\n100\n") {
+		t.Errorf("expected the child's soft and hard limits to be 100, got %q", output)
+	}
+	if !strings.Contains(stderr, "Child open file limit: rlimit soft 100, hard 100") {
+		t.Errorf("expected the limits to be logged:\n%s", stderr)
+	}
+
+	if _, stderr, err := run("-1"); err == nil || !strings.Contains(stderr, "Invalid --max-child-fds") {
+		t.Errorf("expected a negative limit to be rejected, got %v:\n%s", err, stderr)
+	}
+}
+
+func TestMainWithChildNetns(t *testing.T) {
+	if os.Getenv("TEST_MAIN_CHILD_NETNS") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--child-netns", "--", "readlink", "/proc/self/ns/net"}
+		main()
+		return
+	}
+
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("network namespaces need Linux and root")
+	}
+	ours, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Skipf("no network namespace to compare with: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithChildNetns")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_CHILD_NETNS=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("wrapguard --child-netns failed: %v\n%s", err, stderr.String())
+	}
+
+	if !strings.HasPrefix(string(output), "net:[") || strings.Contains(string(output), ours) {
+		t.Errorf("expected the child in a namespace other than %s, got %q", ours, output)
+	}
+	if !strings.Contains(stderr.String(), "Child process will run in its own network namespace") {
+		t.Errorf("expected the namespace to be logged:\n%s", stderr.String())
+	}
+}
+
+func TestMainWithWireGuardVerbose(t *testing.T) {
+	if os.Getenv("TEST_MAIN_WG_VERBOSE") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=debug", os.Getenv("TEST_WG_VERBOSE_FLAG"), "--", "true"}
+		main()
+		return
+	}
+
+	for _, flag := range []string{"--wg-verbose", "--log-format=json"} {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMainWithWireGuardVerbose")
+		cmd.Env = append(os.Environ(), "TEST_MAIN_WG_VERBOSE=1", "TEST_WG_VERBOSE_FLAG="+flag)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("wrapguard %s failed: %v\n%s", flag, err, output)
+		}
+
+		verbose := strings.Contains(string(output), `"level":"debug","message":"WireGuard: UAPI: Updating private key"`)
+		if verbose != (flag == "--wg-verbose") {
+			t.Errorf("with %s, expected wireguard-go debug messages %v, got:\n%s", flag, flag == "--wg-verbose", output)
+		}
+	}
+}
+
+func TestMainWithGracefulShutdown(t *testing.T) {
+	if os.Getenv("TEST_MAIN_GRACEFUL_SHUTDOWN") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		// The child ignores SIGTERM, so only the kill after the timeout ends it
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=debug", "--graceful-shutdown-timeout=200ms", "--", "sh", "-c", `trap "" TERM; echo ready; exec sleep 60`}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithGracefulShutdown")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_GRACEFUL_SHUTDOWN=1")
+	var stderr syncBuffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("failed to capture stdout: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start wrapguard: %v", err)
+	}
+
+	// Wait for the child to set up its trap before signalling wrapguard
+	ready := make([]byte, len("ready\n"))
+	if _, err := io.ReadFull(stdout, ready); err != nil {
+		cmd.Process.Kill()
+		t.Fatalf("child did not start: %v\n%s", err, stderr.String())
+	}
+	go io.Copy(io.Discard, stdout)
+
+	start := time.Now()
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Errorf("expected exit code 1 after a signal, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("--graceful-shutdown-timeout was not honoured, took %v", elapsed)
+		}
+	case <-time.After(20 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("wrapguard did not kill the child after --graceful-shutdown-timeout")
+	}
+
+	// The tunnel goes down before the child is signalled and killed
+	output := stderr.String()
+	downAt := strings.Index(output, "Taking WireGuard tunnel down before shutdown")
+	killAt := strings.Index(output, "Child process did not exit gracefully")
+	if downAt < 0 || killAt < downAt {
+		t.Errorf("unexpected shutdown sequence:\n%s", output)
+	}
+}
+
+func TestBuildChildEnv(t *testing.T) {
+	environ := []string{"HOME=/home/test", "PATH=/usr/bin", "AWS_SECRET_ACCESS_KEY=secret", "LANG=C.UTF-8"}
+	wrapguardEnv := []string{"LD_PRELOAD=/opt/libwrapguard.so", "WRAPGUARD_IPC_PATH=/tmp/wg.sock"}
+
+	tests := []struct {
+		name        string
+		clearEnv    bool
+		passthrough []string
+		expected    []string
+	}{
+		{
+			name:     "default passes everything",
+			expected: append(append([]string{}, environ...), wrapguardEnv...),
+		},
+		{
+			name:     "clear env",
+			clearEnv: true,
+			expected: wrapguardEnv,
+		},
+		{
+			name:        "clear env with passthrough",
+			clearEnv:    true,
+			passthrough: []string{"HOME", "LANG"},
+			expected:    append([]string{"HOME=/home/test", "LANG=C.UTF-8"}, wrapguardEnv...),
+		},
+		{
+			name:        "passthrough alone filters",
+			passthrough: []string{"PATH", "MISSING"},
+			expected:    append([]string{"PATH=/usr/bin"}, wrapguardEnv...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := buildChildEnv(environ, tt.clearEnv, tt.passthrough, wrapguardEnv)
+			if !reflect.DeepEqual(env, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, env)
+			}
+		})
+	}
+}
+
+func TestMainWithClearEnv(t *testing.T) {
+	if os.Getenv("TEST_MAIN_CLEAR_ENV") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=error", "--clear-env", "--env-passthrough=HOME,WRAPGUARD_TEST_KEEP", "--", "env"}
+		main()
+		return
+	}
+
+	// Run subprocess
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithClearEnv")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_CLEAR_ENV=1", "WRAPGUARD_TEST_KEEP=kept", "WRAPGUARD_TEST_SECRET=hidden")
+
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("wrapguard failed: %v", err)
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if name, _, found := strings.Cut(line, "="); found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	expected := []string{"HOME", "LD_PRELOAD", "WRAPGUARD_HTTP_PROXY_PORT", "WRAPGUARD_IPC_PATH", "WRAPGUARD_IPC_TOKEN", "WRAPGUARD_SOCKS_PORT", "WRAPGUARD_TEST_KEEP"}
+	if os.Getenv("HOME") == "" {
+		expected = expected[1:]
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected child environment %v, got %v\n%s", expected, names, output)
+	}
+}
+
+func TestMainWithIPCToken(t *testing.T) {
+	if os.Getenv("TEST_MAIN_IPC_TOKEN") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=debug", "--ipc-token=s3cret-token", "--", "env"}
+		main()
+		return
+	}
+
+	// Run subprocess
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithIPCToken")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_IPC_TOKEN=1")
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("wrapguard failed: %v\n%s", err, stderr.String())
+	}
+
+	if !strings.Contains(string(output), "WRAPGUARD_IPC_TOKEN=s3cret-token\n") {
+		t.Errorf("expected the token in the child environment, got:\n%s", output)
+	}
+
+	// Only the child's env output may contain the token, never the log
+	if strings.Contains(stderr.String(), "s3cret-token") {
+		t.Errorf("token leaked into the log:\n%s", stderr.String())
+	}
+}
+
+func TestWritePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapguard.pid")
+	expected := strconv.Itoa(os.Getpid()) + "\n"
+
+	if err := writePIDFile(path, false); err != nil {
+		t.Fatalf("writePIDFile failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read PID file: %v", err)
+	}
+	if string(data) != expected {
+		t.Errorf("expected PID file %q, got %q", expected, data)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm() != 0644 {
+		t.Errorf("expected mode 0644, got %v", info.Mode().Perm())
+	}
+
+	// A second start with the same PID file fails unless overwriting
+	if err := writePIDFile(path, false); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected os.ErrExist for an existing PID file, got %v", err)
+	}
+
+	os.WriteFile(path, []byte("99999999\n"), 0644)
+	if err := writePIDFile(path, true); err != nil {
+		t.Fatalf("writePIDFile with overwrite failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != expected {
+		t.Errorf("expected overwritten PID file %q, got %q", expected, data)
+	}
+}
+
+func TestMainWithPIDFile(t *testing.T) {
+	if os.Getenv("TEST_MAIN_PID_FILE") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		pidFile := os.Getenv("TEST_PID_FILE")
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=error", "--pid-file=" + pidFile}
+		if os.Getenv("TEST_PID_FILE_OVERWRITE") == "1" {
+			os.Args = append(os.Args, "--pid-file-overwrite")
+		}
+		os.Args = append(os.Args, "--", "cat", pidFile)
+		main()
+		return
+	}
+
+	run := func(pidFile string, overwrite bool) (*exec.Cmd, string, error) {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMainWithPIDFile")
+		cmd.Env = append(os.Environ(), "TEST_MAIN_PID_FILE=1", "TEST_PID_FILE="+pidFile)
+		if overwrite {
+			cmd.Env = append(cmd.Env, "TEST_PID_FILE_OVERWRITE=1")
+		}
+		output, err := cmd.Output()
+		return cmd, string(output), err
+	}
+
+	t.Run("written and removed", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "wrapguard.pid")
+
+		cmd, output, err := run(pidFile, false)
+		if err != nil {
+			t.Fatalf("wrapguard failed: %v", err)
+		}
+
+		// The child printed the PID file while wrapguard was running
+		if expected := strconv.Itoa(cmd.Process.Pid) + "\n"; !strings.HasPrefix(output, expected) {
+			t.Errorf("expected PID file contents %q, got %q", expected, output)
+		}
+		if _, err := os.Stat(pidFile); !os.IsNotExist(err) {
+			t.Errorf("expected PID file to be removed after exit, got %v", err)
+		}
+	})
+
+	t.Run("existing file", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "wrapguard.pid")
+		os.WriteFile(pidFile, []byte("1\n"), 0644)
+
+		if _, _, err := run(pidFile, false); err == nil {
+			t.Error("expected wrapguard to refuse an existing PID file")
+		}
+		if data, _ := os.ReadFile(pidFile); string(data) != "1\n" {
+			t.Errorf("expected the existing PID file to be left alone, got %q", data)
+		}
+
+		cmd, output, err := run(pidFile, true)
+		if err != nil {
+			t.Fatalf("wrapguard with --pid-file-overwrite failed: %v", err)
+		}
+		if expected := strconv.Itoa(cmd.Process.Pid) + "\n"; !strings.HasPrefix(output, expected) {
+			t.Errorf("expected PID file contents %q, got %q", expected, output)
+		}
+	})
+}
+
+func TestMainWithAuditLog(t *testing.T) {
+	if os.Getenv("TEST_MAIN_AUDIT_LOG") == "1" {
+		// We're in the subprocess
+		os.Args = []string{"wrapguard", "--config=" + os.Getenv("TEST_AUDIT_CONFIG"), "--log-level=error", "--audit-log=" + os.Getenv("TEST_AUDIT_LOG"), "--", "true"}
+		main()
+		return
+	}
+
+	tempConfig := createValidTempConfig(t)
+	defer os.Remove(tempConfig)
+	auditLog := filepath.Join(t.TempDir(), "audit.log")
+
+	// Each run appends to the log instead of replacing it
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMainWithAuditLog")
+		cmd.Env = append(os.Environ(), "TEST_MAIN_AUDIT_LOG=1", "TEST_AUDIT_CONFIG="+tempConfig, "TEST_AUDIT_LOG="+auditLog)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("wrapguard with --audit-log failed: %v\n%s", err, output)
+		}
+	}
+
+	hash, err := wrapguard.HashConfigFiles([]string{tempConfig})
+	if err != nil {
+		t.Fatalf("HashConfigFiles failed: %v", err)
+	}
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected an entry per run, got %q", data)
+	}
+	for _, line := range lines {
+		var entry wrapguard.AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid audit entry %q: %v", line, err)
+		}
+		if entry.Event != "config_loaded" || entry.By != "startup" || entry.Hash != hash {
+			t.Errorf("unexpected audit entry %+v", entry)
+		}
+	}
+
+	if info, err := os.Stat(auditLog); err == nil && info.Mode().Perm() != 0600 {
+		t.Errorf("expected the audit log to be private, got mode %v", info.Mode().Perm())
+	}
+}
+
+func TestMainWithPACAddr(t *testing.T) {
+	if os.Getenv("TEST_MAIN_PAC") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=error", "--pac-addr=" + os.Getenv("TEST_PAC_ADDR"), "--proxy-mode=" + os.Getenv("TEST_PAC_PROXY_MODE"), "--", "sleep", "10"}
+		main()
+		return
+	}
+
+	run := func(addr, proxyMode string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMainWithPACAddr")
+		cmd.Env = append(os.Environ(), "TEST_MAIN_PAC=1", "TEST_PAC_ADDR="+addr, "TEST_PAC_PROXY_MODE="+proxyMode)
+		return cmd
+	}
+
+	t.Run("serves the PAC file", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to find a free port: %v", err)
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		cmd := run(fmt.Sprintf("127.0.0.1:%d/proxy.pac", port), "both")
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("failed to start wrapguard: %v", err)
+		}
+		defer func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}()
+
+		var body []byte
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/proxy.pac", port)); err == nil {
+				body, _ = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		// createValidTempConfig routes 10.150.0.0/24 through the tunnel
+		if !strings.Contains(string(body), `isInNet(ip, "10.150.0.0", "255.255.255.0")`) || !strings.Contains(string(body), "SOCKS5 127.0.0.1:") {
+			t.Errorf("unexpected PAC file:\n%s", body)
+		}
+	})
+
+	t.Run("needs the SOCKS5 proxy", func(t *testing.T) {
+		output, err := run("127.0.0.1:0/proxy.pac", "http").CombinedOutput()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Fatalf("expected exit code 1, got %v", err)
+		}
+		if !strings.Contains(string(output), "--pac-addr needs the SOCKS5 proxy") {
+			t.Errorf("expected a proxy mode error, got:\n%s", output)
+		}
+	})
+}
+
+func TestWriteKeyPair(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeKeyPair(&buf); err != nil {
+		t.Fatalf("writeKeyPair failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "PrivateKey = ") || !strings.HasPrefix(lines[1], "PublicKey = ") {
+		t.Fatalf("unexpected key pair output %q", buf.String())
+	}
+
+	private := strings.TrimPrefix(lines[0], "PrivateKey = ")
+	public := strings.TrimPrefix(lines[1], "PublicKey = ")
+	if derived, err := wrapguard.PublicKey(private); err != nil || derived != public {
+		t.Errorf("public key %s does not belong to the private key (%s, %v)", public, derived, err)
+	}
+}
+
+func TestMainWithGenerateKeypair(t *testing.T) {
+	if os.Getenv("TEST_MAIN_GENERATE_KEYPAIR") == "1" {
+		// We're in the subprocess
+		os.Args = append([]string{"wrapguard", "--generate-keypair"}, strings.Fields(os.Getenv("TEST_GENERATE_KEYPAIR_ARGS"))...)
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithGenerateKeypair")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_GENERATE_KEYPAIR=1")
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("wrapguard --generate-keypair failed: %v", err)
+	}
+	if !regexp.MustCompile(`^PrivateKey = \S{44}\nPublicKey = \S{44}\n$`).Match(output) {
+		t.Errorf("unexpected key pair output %q", output)
+	}
+
+	// --generate-keypair does not mix with starting a tunnel
+	cmd = exec.Command(os.Args[0], "-test.run=TestMainWithGenerateKeypair")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_GENERATE_KEYPAIR=1", "TEST_GENERATE_KEYPAIR_ARGS=--config=wg0.conf")
+	output, err = cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1 with --config, got %v", err)
+	}
+	if !strings.Contains(string(output), "--generate-keypair cannot be used with --config") {
+		t.Errorf("expected a conflict error, got %s", output)
+	}
+}
+
+func TestRunGenerateConfig(t *testing.T) {
+	opts := wrapguard.GenerateConfigOptions{
+		Address:        "10.0.0.2/24",
+		PeerPublicKey:  testKey(2),
+		PeerEndpoint:   "127.0.0.1:51820",
+		PeerAllowedIPs: []string{"0.0.0.0/0"},
+	}
+
+	parse := func(t *testing.T, data []byte) *wrapguard.WireGuardConfig {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "wg0.conf")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+		config, err := wrapguard.ParseConfig(path)
+		if err != nil {
+			t.Fatalf("generated config does not parse: %v\n%s", err, data)
+		}
+		return config
+	}
+
+	t.Run("private key file", func(t *testing.T) {
+		keyFile := filepath.Join(t.TempDir(), "private.key")
+		os.WriteFile(keyFile, []byte(testKey(1)+"\n"), 0600)
+
+		var stdout, stderr bytes.Buffer
+		if err := runGenerateConfig(opts, keyFile, &stdout, &stderr); err != nil {
+			t.Fatalf("runGenerateConfig failed: %v", err)
+		}
+		if stderr.Len() != 0 {
+			t.Errorf("expected nothing on stderr with a key file, got %q", stderr.String())
+		}
+
+		config := parse(t, stdout.Bytes())
+		want, _ := wrapguard.ParseConfigReader(strings.NewReader("[Interface]\nPrivateKey = " + testKey(1) + "\nAddress = 10.0.0.2/24\n\n[Peer]\nPublicKey = " + testKey(2) + "\nEndpoint = 127.0.0.1:51820\nAllowedIPs = 0.0.0.0/0\n"))
+		if !reflect.DeepEqual(config, want) {
+			t.Errorf("expected %+v, got %+v", want, config)
+		}
+	})
+
+	t.Run("generated key", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		if err := runGenerateConfig(opts, "", &stdout, &stderr); err != nil {
+			t.Fatalf("runGenerateConfig failed: %v", err)
+		}
+		config := parse(t, stdout.Bytes())
+
+		// The public key printed to stderr belongs to the generated private key
+		_, public, ok := strings.Cut(strings.TrimSpace(stderr.String()), "public key: ")
+		if !ok {
+			t.Fatalf("expected the public key on stderr, got %q", stderr.String())
+		}
+		private := strings.TrimPrefix(strings.SplitN(stdout.String(), "\n", 3)[1], "PrivateKey = ")
+		if derived, err := wrapguard.PublicKey(private); err != nil || derived != public {
+			t.Errorf("public key %s does not match the private key (%s, %v)", public, derived, err)
+		}
+		if !slices.Equal(config.Interface.Address, []string{"10.0.0.2/24"}) || len(config.Peers) != 1 {
+			t.Errorf("unexpected config %+v", config)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		if err := runGenerateConfig(opts, filepath.Join(t.TempDir(), "missing.key"), io.Discard, io.Discard); err == nil || !strings.Contains(err.Error(), "failed to read private key") {
+			t.Errorf("expected a read error, got %v", err)
+		}
+		bad := opts
+		bad.Address = ""
+		if err := runGenerateConfig(bad, "", io.Discard, io.Discard); err == nil || !strings.Contains(err.Error(), "interface address is required") {
+			t.Errorf("expected a validation error, got %v", err)
+		}
+	})
+}
+
+func TestMainWithGenerateConfig(t *testing.T) {
+	if os.Getenv("TEST_MAIN_GENERATE_CONFIG") == "1" {
+		// We're in the subprocess
+		os.Args = []string{"wrapguard", "--generate-config", "--address=10.0.0.2/24", "--peer-pubkey=" + testKey(2), "--peer-endpoint=127.0.0.1:51820", "--peer-allowedips=10.0.0.0/24,10.1.0.0/16"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithGenerateConfig")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_GENERATE_CONFIG=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("wrapguard --generate-config failed: %v\n%s", err, stderr.String())
+	}
+
+	config, err := wrapguard.ParseConfigReader(bytes.NewReader(output))
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v\n%s", err, output)
+	}
+	if !reflect.DeepEqual(config.Peers[0].AllowedIPs, []string{"10.0.0.0/24", "10.1.0.0/16"}) {
+		t.Errorf("unexpected AllowedIPs %v", config.Peers[0].AllowedIPs)
+	}
+	if !strings.Contains(stderr.String(), "public key: ") {
+		t.Errorf("expected the generated public key on stderr, got %q", stderr.String())
+	}
+}
+
+func TestRunDiagnose(t *testing.T) {
+	tempConfig := createValidTempConfig(t)
+	defer os.Remove(tempConfig)
+
+	// Nothing answers on the peer's endpoint, so that check fails
+	var stdout, stderr bytes.Buffer
+	if code := runDiagnose([]string{"--config=" + tempConfig, "--timeout=200ms"}, &stdout, &stderr); code != 1 {
+		t.Errorf("expected exit code 1, got %d", code)
+	}
+
+	var results []wrapguard.DiagnosticResult
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, stdout.String())
+	}
+	checks := make(map[string]wrapguard.DiagnosticResult)
+	for _, result := range results {
+		checks[result.Check] = result
+	}
+	if !checks["config_valid"].OK || !checks["os_supported"].OK {
+		t.Errorf("expected the config and OS checks to pass: %+v", results)
+	}
+	if _, ok := checks["preload_library"]; !ok {
+		t.Error("expected the library next to the binary to be checked")
+	}
+	if reachable := checks["peer_reachable"]; reachable.OK || reachable.Peer != testKey(2) || reachable.Error == "" {
+		t.Errorf("unexpected peer_reachable result %+v", reachable)
+	}
+
+	// --routes prints the routing table instead of the checks
+	stdout.Reset()
+	if code := runDiagnose([]string{"--config=" + tempConfig, "--routes"}, &stdout, &stderr); code != 0 {
+		t.Errorf("expected exit code 0 with --routes, got %d: %s", code, stderr.String())
+	}
+	var table struct {
+		Routes []json.RawMessage `json:"routes"`
+		Peers  []struct {
+			Idx        int      `json:"idx"`
+			PublicKey  string   `json:"public_key"`
+			AllowedIPs []string `json:"allowed_ips"`
+		} `json:"peers"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &table); err != nil {
+		t.Fatalf("routing table is not JSON: %v\n%s", err, stdout.String())
+	}
+	if len(table.Peers) != 1 || table.Peers[0].PublicKey != testKey(2) || len(table.Peers[0].AllowedIPs) == 0 {
+		t.Errorf("unexpected routing table %s", stdout.String())
+	}
+
+	stdout.Reset()
+	if code := runDiagnose([]string{"--config=" + filepath.Join(t.TempDir(), "missing.conf"), "--routes"}, &stdout, &stderr); code != 1 || stdout.Len() != 0 {
+		t.Errorf("expected --routes to fail without output for a missing config, got %d: %s", code, stdout.String())
+	}
+
+	stdout.Reset()
+	if code := runDiagnose(nil, &stdout, &stderr); code != 1 || stdout.Len() != 0 {
+		t.Errorf("expected diagnose without --config to fail without a report, got %d: %s", code, stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "diagnose requires --config") {
+		t.Errorf("unexpected stderr %q", stderr.String())
+	}
+}
+
+func TestMainWithDiagnose(t *testing.T) {
+	if os.Getenv("TEST_MAIN_DIAGNOSE") == "1" {
+		// We're in the subprocess
+		os.Args = []string{"wrapguard", "diagnose", "--config=" + os.Getenv("TEST_DIAGNOSE_CONFIG")}
+		main()
+		return
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.conf")
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithDiagnose")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_DIAGNOSE=1", "TEST_DIAGNOSE_CONFIG="+missing)
+	output, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1 for a missing config, got %v", err)
+	}
+
+	// The report replaces the usual startup, which would fail on a missing config
+	var results []wrapguard.DiagnosticResult
+	if err := json.Unmarshal(output, &results); err != nil {
+		t.Fatalf("report is not JSON: %v\n%s", err, output)
+	}
+	for _, result := range results {
+		if result.Check == "config_valid" && (result.OK || !strings.Contains(result.Error, "missing.conf")) {
+			t.Errorf("unexpected config_valid result %+v", result)
+		}
+	}
+}
+
+// peeredTestConfig returns a config that listens on listenPort and peers
+// with the config for peerSeed listening on peerPort
+func peeredTestConfig(t *testing.T, seed, peerSeed byte, address, peerIP string, listenPort, peerPort int) *wrapguard.WireGuardConfig {
+	t.Helper()
+
+	private, _ := base64.StdEncoding.DecodeString(testKey(peerSeed))
+	peerKey, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		t.Fatalf("invalid test key: %v", err)
+	}
+
+	config, err := wrapguard.ParseConfigReader(strings.NewReader(fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = %s/24
+ListenPort = %d
+
+[Peer]
+PublicKey = %s
+Endpoint = 127.0.0.1:%d
+AllowedIPs = %s/32
+PersistentKeepalive = 1`, testKey(seed), address, listenPort, base64.StdEncoding.EncodeToString(peerKey.PublicKey().Bytes()), peerPort, peerIP)))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	return config
+}
+
+// freeUDPPort returns a UDP port that was free a moment ago
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free UDP port: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestWaitUntilReady(t *testing.T) {
+	var logs syncBuffer
+	logger := wrapguard.NewLogger(wrapguard.LogLevelInfo, &logs)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	agent := &wrapguard.Agent{ProxyMode: "socks5"}
+	if err := agent.Start(ctx, peeredTestConfig(t, 1, 2, "10.162.0.1", "10.162.0.2", portA, portB)); err != nil {
+		t.Fatalf("failed to start agent: %v", err)
+	}
+	defer agent.Stop()
+
+	probe, err := wrapguard.NewReadinessServer("127.0.0.1:0/ready")
+	if err != nil {
+		t.Fatalf("failed to start readiness probe: %v", err)
+	}
+	defer probe.Close()
+	probeURL := fmt.Sprintf("http://127.0.0.1:%d/ready", probe.Port())
+
+	readinessFile := filepath.Join(t.TempDir(), "wrapguard-ready")
+
+	// Without a peer there is no handshake, so nothing is marked ready
+	err = waitUntilReady(ctx, agent, 300*time.Millisecond, readinessFile, probe, time.Now(), logger)
+	if err == nil || !strings.Contains(err.Error(), "no WireGuard handshake within 300ms") {
+		t.Fatalf("expected a handshake timeout, got %v", err)
+	}
+	if _, err := os.Stat(readinessFile); !os.IsNotExist(err) {
+		t.Errorf("readiness file created before the handshake: %v", err)
+	}
+	if resp, err := http.Get(probeURL); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 before the handshake, got %d", resp.StatusCode)
+		}
+	}
+
+	// Bring up the peer so the handshake can complete
+	peer, err := wrapguard.NewTunnel(ctx, peeredTestConfig(t, 2, 1, "10.162.0.2", "10.162.0.1", portB, portA), wrapguard.TunnelOptions{})
+	if err != nil {
+		t.Fatalf("failed to start peer tunnel: %v", err)
+	}
+	defer peer.Close()
+
+	if err := waitUntilReady(ctx, agent, 10*time.Second, readinessFile, probe, time.Now(), logger); err != nil {
+		t.Fatalf("waitUntilReady failed: %v", err)
+	}
+
+	info, err := os.Stat(readinessFile)
+	if err != nil {
+		t.Fatalf("expected readiness file after the handshake: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("expected an empty readiness file, got %d bytes", info.Size())
+	}
+
+	resp, err := http.Get(probeURL)
+	if err != nil {
+		t.Fatalf("probe request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 once ready, got %d", resp.StatusCode)
+	}
+
+	if !strings.Contains(logs.String(), `"event":"ready"`) || !strings.Contains(logs.String(), `"elapsed_ms":`) {
+		t.Errorf("expected a ready event in the log, got:\n%s", logs.String())
+	}
+}
+
+func TestMainWithReadinessTimeout(t *testing.T) {
+	if os.Getenv("TEST_MAIN_READINESS") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		readinessFile := os.Getenv("TEST_READINESS_FILE")
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=error", "--readiness-file=" + readinessFile, "--readiness-timeout=300ms", "--", "echo", "child-started"}
+		main()
+		return
+	}
+
+	readinessFile := filepath.Join(t.TempDir(), "wrapguard-ready")
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithReadinessTimeout")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_READINESS=1", "TEST_READINESS_FILE="+readinessFile)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected exit code 1 without a handshake, got %v", err)
+	}
+	if strings.Contains(string(output), "child-started") {
+		t.Error("child started although wrapguard never became ready")
+	}
+	if !strings.Contains(stderr.String(), "no WireGuard handshake within 300ms") {
+		t.Errorf("expected a readiness timeout error, got:\n%s", stderr.String())
+	}
+	if _, err := os.Stat(readinessFile); !os.IsNotExist(err) {
+		t.Errorf("expected no readiness file, got %v", err)
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, map[string]*string, *[]string) {
+		fs := flag.NewFlagSet("wrapguard", flag.ContinueOnError)
+		values := make(map[string]*string)
+		for _, name := range []string{"log-level", "log-file", "exit-node", "on-connected", "on-disconnected"} {
+			values[name] = fs.String(name, "", "")
+		}
+		var routes []string
+		fs.Func("route", "", func(value string) error {
+			routes = append(routes, value)
+			return nil
+		})
+		return fs, values, &routes
+	}
+
+	settings := &wrapguard.Settings{
+		LogLevel:       "debug",
+		LogFile:        "/var/log/wrapguard.log",
+		ExitNode:       "10.150.0.3",
+		Routes:         []string{"192.168.1.0/24:10.150.0.3", "10.0.0.0/8:10.150.0.4"},
+		OnConnected:    "./register.sh",
+		OnDisconnected: "./deregister.sh",
+	}
+
+	t.Run("settings fill unset flags", func(t *testing.T) {
+		fs, values, routes := newFlags()
+		fs.Parse(nil)
+		if err := applySettings(fs, settings); err != nil {
+			t.Fatalf("applySettings failed: %v", err)
+		}
+
+		expected := map[string]string{
+			"log-level":       "debug",
+			"log-file":        "/var/log/wrapguard.log",
+			"exit-node":       "10.150.0.3",
+			"on-connected":    "./register.sh",
+			"on-disconnected": "./deregister.sh",
+		}
+		for name, value := range expected {
+			if *values[name] != value {
+				t.Errorf("expected --%s=%s, got %q", name, value, *values[name])
+			}
+		}
+		if !reflect.DeepEqual(*routes, settings.Routes) {
+			t.Errorf("expected routes %v, got %v", settings.Routes, *routes)
+		}
+	})
+
+	t.Run("flags take precedence", func(t *testing.T) {
+		fs, values, routes := newFlags()
+		fs.Parse([]string{"--log-level=error", "--route=172.16.0.0/12:10.150.0.5"})
+		if err := applySettings(fs, settings); err != nil {
+			t.Fatalf("applySettings failed: %v", err)
+		}
+
+		if *values["log-level"] != "error" {
+			t.Errorf("expected --log-level from the command line, got %q", *values["log-level"])
+		}
+		if *values["exit-node"] != "10.150.0.3" {
+			t.Errorf("expected exit node from the settings, got %q", *values["exit-node"])
+		}
+		if !reflect.DeepEqual(*routes, []string{"172.16.0.0/12:10.150.0.5"}) {
+			t.Errorf("expected only the command line route, got %v", *routes)
+		}
+	})
+}
+
+func TestMainWithWrapguardConfig(t *testing.T) {
+	if os.Getenv("TEST_MAIN_WRAPGUARD_CONFIG") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		settings := filepath.Join(t.TempDir(), "wg0.toml")
+		os.WriteFile(settings, []byte("[wrapguard]\nlog_level = \"debug\"\nmetrics_addr = \"127.0.0.1:9100\"\n"), 0600)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--wrapguard-config=" + settings}
+		if level := os.Getenv("TEST_LOG_LEVEL"); level != "" {
+			os.Args = append(os.Args, "--log-level="+level)
+		}
+		os.Args = append(os.Args, "--", "true")
+		main()
+		return
+	}
+
+	run := func(logLevel string) string {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMainWithWrapguardConfig")
+		cmd.Env = append(os.Environ(), "TEST_MAIN_WRAPGUARD_CONFIG=1", "TEST_LOG_LEVEL="+logLevel)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("wrapguard failed: %v\n%s", err, stderr.String())
+		}
+		return stderr.String()
+	}
+
+	// log_level from the TOML file applies
+	if stderr := run(""); !strings.Contains(stderr, `"level":"debug"`) {
+		t.Errorf("expected debug logs from the settings file, got:\n%s", stderr)
+	} else if !strings.Contains(stderr, "ignoring metrics_addr") {
+		t.Errorf("expected a warning about metrics_addr, got:\n%s", stderr)
+	}
+
+	// --log-level overrides it
+	if stderr := run("error"); strings.Contains(stderr, `"level":"debug"`) || strings.Contains(stderr, `"level":"info"`) {
+		t.Errorf("expected --log-level=error to override the settings file, got:\n%s", stderr)
+	}
+}
+
+func TestMainWithWrapGuardSection(t *testing.T) {
+	if os.Getenv("TEST_MAIN_WRAPGUARD_SECTION") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		file, _ := os.OpenFile(tempConfig, os.O_WRONLY|os.O_APPEND, 0)
+		file.WriteString("\n\n[WrapGuard]\nLogLevel = debug\nMetricsAddr = 127.0.0.1:9100\n")
+		file.Close()
+
+		os.Args = []string{"wrapguard"}
+
+		// A template that would fail to expand, read with expansion off
+		if os.Getenv("TEST_NO_ENV_EXPAND") == "1" {
+			content, _ := os.ReadFile(tempConfig)
+			template := tempConfig + ".tmpl"
+			os.WriteFile(template, append([]byte("# ${WRAPGUARD_TEST_UNSET_VAR}\n"), content...), 0600)
+			defer os.Remove(template)
+			tempConfig = template
+			os.Args = append(os.Args, "--no-env-expand")
+		}
+
+		os.Args = append(os.Args, "--config="+tempConfig)
+		if settings := os.Getenv("TEST_SETTINGS"); settings != "" {
+			os.Args = append(os.Args, "--wrapguard-config="+settings)
+		}
+		os.Args = append(os.Args, "--", "true")
+		main()
+		return
+	}
+
+	run := func(settings string, env ...string) string {
+		cmd := exec.Command(os.Args[0], "-test.run=TestMainWithWrapGuardSection")
+		cmd.Env = append(os.Environ(), "TEST_MAIN_WRAPGUARD_SECTION=1", "TEST_SETTINGS="+settings)
+		cmd.Env = append(cmd.Env, env...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("wrapguard failed: %v\n%s", err, stderr.String())
+		}
+		return stderr.String()
+	}
+
+	// LogLevel from the config's [WrapGuard] section applies
+	if stderr := run(""); !strings.Contains(stderr, `"level":"debug"`) {
+		t.Errorf("expected debug logs from the [WrapGuard] section, got:\n%s", stderr)
+	} else if !strings.Contains(stderr, "ignoring MetricsAddr") {
+		t.Errorf("expected a warning about MetricsAddr, got:\n%s", stderr)
+	}
+
+	// A --wrapguard-config file takes precedence over the section
+	settings := filepath.Join(t.TempDir(), "wg0.toml")
+	os.WriteFile(settings, []byte("[wrapguard]\nlog_level = \"error\"\n"), 0600)
+	if stderr := run(settings); strings.Contains(stderr, `"level":"debug"`) || strings.Contains(stderr, `"level":"info"`) {
+		t.Errorf("expected the settings file to override the [WrapGuard] section, got:\n%s", stderr)
+	}
+
+	// --no-env-expand applies to reading the section too
+	if stderr := run("", "TEST_NO_ENV_EXPAND=1"); !strings.Contains(stderr, `"level":"debug"`) {
+		t.Errorf("expected debug logs from the [WrapGuard] section of an unexpanded template, got:\n%s", stderr)
+	}
+}
+
+func TestMainWithRestartOnFail(t *testing.T) {
+	if os.Getenv("TEST_MAIN_RESTART") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=warn", "--restart-on-fail",
+			"--restart-delay=10ms", "--", os.Getenv("TEST_RESTART_SCRIPT"), os.Getenv("TEST_RESTART_COUNTER")}
+		main()
+		return
+	}
+
+	// The script fails the first two times it runs and succeeds on the third
+	dir := t.TempDir()
+	script := filepath.Join(dir, "flaky.sh")
+	counter := filepath.Join(dir, "count")
+	content := "#!/bin/sh\nn=$(cat \"$1\" 2>/dev/null || echo 0)\nn=$((n+1))\necho $n > \"$1\"\n[ $n -ge 3 ]\n"
+	if err := os.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithRestartOnFail")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_RESTART=1", "TEST_RESTART_SCRIPT="+script, "TEST_RESTART_COUNTER="+counter)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("expected success after restarts, got %v\n%s", err, stderr.String())
+	}
+
+	data, _ := os.ReadFile(counter)
+	if strings.TrimSpace(string(data)) != "3" {
+		t.Errorf("expected the child to run 3 times, ran %q", strings.TrimSpace(string(data)))
+	}
+
+	for _, attempt := range []string{"attempt 1 of 5", "attempt 2 of 5"} {
+		if !strings.Contains(stderr.String(), attempt) {
+			t.Errorf("expected restart log containing %q, got %s", attempt, stderr.String())
+		}
+	}
+}
+
+func TestMainWithRestartAttemptsExhausted(t *testing.T) {
+	if os.Getenv("TEST_MAIN_RESTART_EXHAUSTED") == "1" {
+		// We're in the subprocess
+		tempConfig := createValidTempConfig(t)
+		defer os.Remove(tempConfig)
+
+		os.Args = []string{"wrapguard", "--config=" + tempConfig, "--log-level=error", "--restart-on-fail",
+			"--restart-max-attempts=2", "--restart-delay=10ms", "--", "sh", "-c", "echo run >> " + os.Getenv("TEST_RESTART_COUNTER") + "; exit 7"}
+		main()
+		return
+	}
+
+	counter := filepath.Join(t.TempDir(), "runs")
+	cmd := exec.Command(os.Args[0], "-test.run=TestMainWithRestartAttemptsExhausted")
+	cmd.Env = append(os.Environ(), "TEST_MAIN_RESTART_EXHAUSTED=1", "TEST_RESTART_COUNTER="+counter)
+
+	err := cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("expected exit error, got %v", err)
+	}
+	if exitErr.ExitCode() != 7 {
+		t.Errorf("expected the last child exit code 7, got %d", exitErr.ExitCode())
+	}
+
+	data, _ := os.ReadFile(counter)
+	if runs := strings.Count(string(data), "run"); runs != 3 {
+		t.Errorf("expected 1 run plus 2 restarts, got %d runs", runs)
+	}
+}
+
+// Test global logger setup in main
+func TestMainLoggerSetup(t *testing.T) {
+	// Test that the logger is set up correctly in main
+	// We can't easily test this without running main, but we can test
+	// the logger creation logic
+
+	tests := []struct {
+		name     string
+		logLevel string
+		logFile  string
+		wantErr  bool
+	}{
+		{"valid info level", "info", "", false},
+		{"valid debug level", "debug", "", false},
+		{"valid error level", "error", "", false},
+		{"valid warn level", "warn", "", false},
+		{"invalid level", "invalid", "", true},
+		{"valid with file", "info", "/tmp/test.log", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logLevel, err := wrapguard.ParseLogLevel(tt.logLevel)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error for invalid log level")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
 
 			// Test logger creation
 			var output bytes.Buffer
-			logger := NewLogger(logLevel, &output)
+			logger := wrapguard.NewLogger(logLevel, &output)
 
 			if logger == nil {
-				t.Error("NewLogger returned nil")
+				t.Error("wrapguard.NewLogger returned nil")
 			}
 
 			// Test logging
 			logger.Infof("test message")
 
 			// Only expect output for levels that should produce output
-			if output.Len() == 0 && logLevel >= LogLevelInfo {
+			if output.Len() == 0 && logLevel >= wrapguard.LogLevelInfo {
 				t.Error("expected log output")
 			}
 		})
@@ -494,8 +2176,8 @@ func TestMainLoggerSetup(t *testing.T) {
 // Test version constant consistency
 func TestVersionConsistency(t *testing.T) {
 	// The version in main.go should be consistent
-	mainVersion := version   // from main.go
-	moduleVersion := Version // from version.go
+	mainVersion := version             // from main.go
+	moduleVersion := wrapguard.Version // from pkg/wrapguard/version.go
 
 	// They might be different (main.go has its own constant)
 	// but we test that they're both non-empty
@@ -534,3 +2216,91 @@ func BenchmarkFlagParsing(b *testing.B) {
 		flag.CommandLine.Parse(args)
 	}
 }
+
+func TestWatchSuspend(t *testing.T) {
+	var buf syncBuffer
+	logger := wrapguard.NewLogger(wrapguard.LogLevelInfo, &buf)
+	wrapguard.SetGlobalLogger(logger)
+	defer wrapguard.SetGlobalLogger(wrapguard.NewLogger(wrapguard.LogLevelInfo, os.Stderr))
+
+	oldTimeout := wrapguard.ResumeHandshakeTimeout
+	wrapguard.ResumeHandshakeTimeout = 50 * time.Millisecond
+	defer func() { wrapguard.ResumeHandshakeTimeout = oldTimeout }()
+
+	tempConfig := createValidTempConfig(t)
+	defer os.Remove(tempConfig)
+	config, err := wrapguard.ParseConfig(tempConfig)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	agent := &wrapguard.Agent{ProxyMode: "socks5"}
+	if err := agent.Start(context.Background(), config); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer agent.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal)
+	done := make(chan struct{})
+	go func() {
+		watchSuspend(ctx, agent, signals, logger)
+		close(done)
+	}()
+
+	waitForLog := func(text string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !strings.Contains(buf.String(), text) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %q in:\n%s", text, buf.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The first signal suspends and the next resumes
+	signals <- syscall.SIGUSR1
+	waitForLog("Suspending WireGuard tunnel")
+	signals <- syscall.SIGUSR1
+	waitForLog("Resuming WireGuard tunnel")
+	waitForLog("Resume incomplete")
+
+	// And the cycle starts again
+	signals <- syscall.SIGUSR1
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(buf.String(), "Suspending WireGuard tunnel") != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if strings.Count(buf.String(), "Suspending WireGuard tunnel") != 2 {
+		t.Errorf("expected a second suspend:\n%s", buf.String())
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("watchSuspend did not return after cancel")
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to share with a logger writing
+// from other goroutines
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.String()
+}
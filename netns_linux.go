@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
+	"golang.org/x/sys/unix"
+)
+
+// childNetns is a network namespace for the child process with nothing but
+// a loopback interface. The proxy ports are bridged onto that loopback, so
+// the child reaches the network through the LD_PRELOAD library or not at
+// all.
+type childNetns struct {
+	ns        *os.File
+	listeners []net.Listener
+	logger    *wrapguard.Logger
+	wg        sync.WaitGroup
+}
+
+// newChildNetns creates the namespace and listens on 127.0.0.1 inside it on
+// each of ports, relaying connections to the same port on wrapguard's own
+// loopback. It needs CAP_SYS_ADMIN.
+func newChildNetns(ports []int, logger *wrapguard.Logger) (*childNetns, error) {
+	n := &childNetns{logger: logger}
+	err := withNetns(func() error {
+		return unix.Unshare(unix.CLONE_NEWNET)
+	}, func() error {
+		ns, err := os.Open(threadNetnsPath())
+		if err != nil {
+			return err
+		}
+		n.ns = ns
+		if err := setLoopbackUp(); err != nil {
+			return fmt.Errorf("failed to bring up loopback: %w", err)
+		}
+		for _, port := range ports {
+			listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				return fmt.Errorf("failed to bridge port %d: %w", port, err)
+			}
+			n.listeners = append(n.listeners, listener)
+		}
+		return nil
+	})
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("failed to create child network namespace: %w", err)
+	}
+
+	for i, listener := range n.listeners {
+		n.wg.Add(1)
+		go n.bridge(listener, ports[i])
+	}
+	return n, nil
+}
+
+// start starts cmd inside the namespace. The child inherits the namespace
+// of the thread that forks it.
+func (n *childNetns) start(cmd *exec.Cmd) error {
+	return withNetns(func() error {
+		return unix.Setns(int(n.ns.Fd()), unix.CLONE_NEWNET)
+	}, cmd.Start)
+}
+
+// bridge relays connections accepted inside the namespace to port on
+// wrapguard's loopback
+func (n *childNetns) bridge(listener net.Listener, port int) {
+	defer n.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+			if err != nil {
+				n.logger.Warnf("Child network namespace: failed to reach port %d: %v", port, err)
+				return
+			}
+			defer upstream.Close()
+
+			done := make(chan struct{})
+			go func() {
+				io.Copy(upstream, conn)
+				upstream.(*net.TCPConn).CloseWrite()
+				close(done)
+			}()
+			io.Copy(conn, upstream)
+			conn.(*net.TCPConn).CloseWrite()
+			<-done
+		}()
+	}
+}
+
+// Close stops bridging and releases the namespace. The namespace itself
+// lives on until the last process in it exits.
+func (n *childNetns) Close() error {
+	var errs []error
+	for _, listener := range n.listeners {
+		errs = append(errs, listener.Close())
+	}
+	n.wg.Wait()
+	if n.ns != nil {
+		errs = append(errs, n.ns.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// withNetns runs fn on an OS thread that enter has moved into another
+// network namespace, then moves the thread back. A thread that cannot be
+// moved back is discarded rather than returned to the scheduler.
+func withNetns(enter func() error, fn func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		orig, err := os.Open(threadNetnsPath())
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- err
+			return
+		}
+		defer orig.Close()
+
+		if err := enter(); err != nil {
+			runtime.UnlockOSThread()
+			result <- err
+			return
+		}
+
+		err = fn()
+		if restoreErr := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); restoreErr != nil {
+			// Returning while still locked terminates the thread
+			result <- errors.Join(err, fmt.Errorf("failed to leave network namespace: %w", restoreErr))
+			return
+		}
+		runtime.UnlockOSThread()
+		result <- err
+	}()
+	return <-result
+}
+
+// threadNetnsPath is the network namespace of the calling thread, which can
+// differ from the rest of the process
+func threadNetnsPath() string {
+	return fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid())
+}
+
+// setLoopbackUp brings up lo in the calling thread's network namespace
+func setLoopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
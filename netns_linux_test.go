@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
+	"golang.org/x/sys/unix"
+)
+
+// newTestChildNetns creates a child namespace bridging ports, skipping the
+// test where namespaces cannot be created
+func newTestChildNetns(t *testing.T, ports ...int) *childNetns {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating a network namespace needs root")
+	}
+	netns, err := newChildNetns(ports, wrapguard.NewLogger(wrapguard.LogLevelError, &bytes.Buffer{}))
+	if err != nil {
+		t.Skipf("network namespaces unavailable: %v", err)
+	}
+	t.Cleanup(func() { netns.Close() })
+	return netns
+}
+
+// startEchoServer listens on a free loopback port and echoes lines back
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprint(conn, "echo: "+line)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestChildNetns_Bridge(t *testing.T) {
+	bridged, other := startEchoServer(t), startEchoServer(t)
+	netns := newTestChildNetns(t, bridged)
+
+	var reply string
+	var otherErr error
+	err := withNetns(func() error {
+		return unix.Setns(int(netns.ns.Fd()), unix.CLONE_NEWNET)
+	}, func() error {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", bridged))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "hello\n")
+		reply, err = bufio.NewReader(conn).ReadString('\n')
+
+		// Ports that are not bridged only exist outside the namespace
+		if conn, dialErr := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", other)); dialErr == nil {
+			conn.Close()
+		} else {
+			otherErr = dialErr
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to use the bridged port: %v", err)
+	}
+	if reply != "echo: hello\n" {
+		t.Errorf("unexpected reply through the bridge: %q", reply)
+	}
+	if otherErr == nil {
+		t.Error("expected a port that is not bridged to be unreachable from the namespace")
+	}
+
+	// The calling threads are back in our own namespace
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", other)); err != nil {
+		t.Errorf("expected to reach other ports outside the namespace: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestChildNetns_Start(t *testing.T) {
+	netns := newTestChildNetns(t)
+
+	ours, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Fatalf("failed to read our network namespace: %v", err)
+	}
+
+	cmd := exec.Command("readlink", "/proc/self/ns/net")
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if err := netns.start(cmd); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("child failed: %v", err)
+	}
+
+	childNs := strings.TrimSpace(output.String())
+	if childNs == "" || childNs == ours {
+		t.Errorf("expected the child in another namespace than %s, got %q", ours, childNs)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
+)
+
+// childNetns is unavailable where there are no network namespaces
+type childNetns struct{}
+
+func newChildNetns(ports []int, logger *wrapguard.Logger) (*childNetns, error) {
+	return nil, fmt.Errorf("--child-netns is only supported on Linux")
+}
+
+func (n *childNetns) start(cmd *exec.Cmd) error { return cmd.Start() }
+
+func (n *childNetns) Close() error { return nil }
@@ -0,0 +1,57 @@
+// Package testenv runs wrapguard in-process for the duration of a test, so
+// that code which talks to a WireGuard network can be tested through the
+// same SOCKS5 proxy and IPC socket the wrapguard binary provides.
+package testenv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
+)
+
+// TestEnv is a running tunnel for config with its SOCKS5 server, IPC server
+// and port forwarder
+type TestEnv struct {
+	agent     *wrapguard.Agent
+	socksAddr string
+	ipcPath   string
+	closeOnce sync.Once
+}
+
+// NewTestEnv starts a TestEnv for config, failing the test if anything does
+// not start. Callers should register t.Cleanup(env.Close).
+func NewTestEnv(t *testing.T, config *wrapguard.WireGuardConfig) *TestEnv {
+	t.Helper()
+
+	agent := &wrapguard.Agent{ProxyMode: "socks5"}
+	if err := agent.Start(context.Background(), config); err != nil {
+		t.Fatalf("failed to start wrapguard: %v", err)
+	}
+
+	return &TestEnv{
+		agent:     agent,
+		socksAddr: fmt.Sprintf("127.0.0.1:%d", agent.SOCKSPort()),
+		ipcPath:   agent.IPCSocketPath(),
+	}
+}
+
+// SOCKSAddr returns the host:port of the SOCKS5 server
+func (e *TestEnv) SOCKSAddr() string {
+	return e.socksAddr
+}
+
+// IPCSocketPath returns the path of the IPC socket used by the LD_PRELOAD
+// library
+func (e *TestEnv) IPCSocketPath() string {
+	return e.ipcPath
+}
+
+// Close stops the servers and the tunnel. It is safe to call more than once.
+func (e *TestEnv) Close() {
+	e.closeOnce.Do(func() {
+		e.agent.Stop()
+	})
+}
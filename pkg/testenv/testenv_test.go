@@ -0,0 +1,89 @@
+package testenv_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/puzed/wrapguard/pkg/testenv"
+	"github.com/puzed/wrapguard/pkg/wrapguard"
+)
+
+// testConfig returns a config with fixed test keys whose peer is not running
+func testConfig(t *testing.T) *wrapguard.WireGuardConfig {
+	t.Helper()
+
+	key := func(seed byte) string {
+		b := make([]byte, 32)
+		for i := range b {
+			b[i] = byte(i) + seed
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+
+	config, err := wrapguard.ParseConfigReader(strings.NewReader(`[Interface]
+PrivateKey = ` + key(1) + `
+Address = 10.151.0.2/24
+
+[Peer]
+PublicKey = ` + key(2) + `
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 10.151.0.0/24`))
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	return config
+}
+
+// A local HTTP server is reachable through the TestEnv's SOCKS5 proxy, as
+// destinations outside AllowedIPs are dialed directly
+func TestNewTestEnv_HTTPThroughSOCKS(t *testing.T) {
+	env := testenv.NewTestEnv(t, testConfig(t))
+	t.Cleanup(env.Close)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "hello through wrapguard")
+	}))
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("socks5://" + env.SOCKSAddr())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request through SOCKS5 failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello through wrapguard" {
+		t.Errorf("unexpected response %q", body)
+	}
+}
+
+func TestTestEnv_Close(t *testing.T) {
+	env := testenv.NewTestEnv(t, testConfig(t))
+
+	if _, err := os.Stat(env.IPCSocketPath()); err != nil {
+		t.Fatalf("expected the IPC socket to exist: %v", err)
+	}
+	conn, err := net.Dial("tcp", env.SOCKSAddr())
+	if err != nil {
+		t.Fatalf("failed to reach SOCKS5 proxy: %v", err)
+	}
+	conn.Close()
+
+	env.Close()
+	env.Close()
+
+	if _, err := net.Dial("tcp", env.SOCKSAddr()); err == nil {
+		t.Error("expected the SOCKS5 proxy to be closed")
+	}
+}
@@ -0,0 +1,389 @@
+package wrapguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent runs everything wrapguard needs on the WireGuard side: a tunnel per
+// config, the SOCKS5 and HTTP CONNECT proxies that route through them, the
+// IPC server used by the LD_PRELOAD library and the port forwarder for
+// incoming connections. It lets Go programs embed wrapguard without the
+// binary; errors are returned rather than exiting the process.
+type Agent struct {
+	// ProxyMode selects the proxy servers to start: "socks5", "http" or
+	// "both". Empty means both.
+	ProxyMode string
+
+	// EndpointDNSTTL is how often peer endpoint hostnames are re-resolved.
+	// Zero disables re-resolution.
+	EndpointDNSTTL time.Duration
+
+	// ForwardPorts are forwarded from the first tunnel as soon as it is up,
+	// in addition to the ports the child binds through the LD_PRELOAD
+	// library
+	ForwardPorts []ForwardedPort
+
+	// ForwardPortDir is a directory of *.port files naming more ports to
+	// forward, watched for changes while the agent runs; see
+	// PortForwarder.WatchDir
+	ForwardPortDir string
+
+	// ForwardHTTP exposes services reached through the first tunnel on
+	// local ports; see PortForwarder.ForwardHTTP
+	ForwardHTTP []HTTPForwardConfig
+
+	// Tunnel, Proxy and IPC configure each tunnel, the SOCKS5 and HTTP
+	// CONNECT proxies, and the IPC server
+	Tunnel TunnelOptions
+	Proxy  ProxyOptions
+	IPC    IPCOptions
+
+	// Forwarder configures the port forwarder. Its AllowedNetworks and
+	// UpstreamDial are taken from Proxy.
+	Forwarder ForwarderOptions
+
+	mutex        sync.Mutex
+	cancel       context.CancelFunc
+	ipcServer    *IPCServer
+	tunnels      []*Tunnel
+	socksServers []*SOCKS5Server
+	httpServer   *HTTPConnectServer
+	forwarder    *PortForwarder
+	exeNames     *exeNameTable // Shared by the IPC server and SOCKS5 servers
+	env          []string
+}
+
+// Start brings up a single tunnel for config and the servers around it
+func (a *Agent) Start(ctx context.Context, config *WireGuardConfig) error {
+	return a.StartTunnels(ctx, []*WireGuardConfig{config})
+}
+
+// StartTunnels brings up one tunnel per config, as with repeated --config
+// files that each have an [Interface] section. The first tunnel serves the
+// HTTP proxy and incoming connections. If anything fails to start, what was
+// started is stopped again.
+func (a *Agent) StartTunnels(ctx context.Context, configs []*WireGuardConfig) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.cancel != nil {
+		return fmt.Errorf("agent already started")
+	}
+	if len(configs) == 0 {
+		return fmt.Errorf("no tunnel configs given")
+	}
+	if len(configs) > maxTunnels {
+		return fmt.Errorf("too many tunnels: %d given, at most %d are supported", len(configs), maxTunnels)
+	}
+
+	proxyMode := a.ProxyMode
+	switch proxyMode {
+	case "":
+		proxyMode = "both"
+	case "socks5", "http", "both":
+	default:
+		return fmt.Errorf("invalid proxy mode: %s (expected socks5, http or both)", proxyMode)
+	}
+
+	ctx, a.cancel = context.WithCancel(ctx)
+	if err := a.start(ctx, configs, proxyMode); err != nil {
+		a.stop()
+		return err
+	}
+	return nil
+}
+
+func (a *Agent) start(ctx context.Context, configs []*WireGuardConfig, proxyMode string) error {
+	// Create IPC server for communication with LD_PRELOAD library
+	a.exeNames = newExeNameTable()
+	ipcServer, err := newIPCServer(a.IPC, a.exeNames)
+	if err != nil {
+		return fmt.Errorf("failed to start IPC server: %w", err)
+	}
+	a.ipcServer = ipcServer
+	a.env = []string{
+		fmt.Sprintf("WRAPGUARD_IPC_PATH=%s", ipcServer.SocketPath()),
+		fmt.Sprintf("WRAPGUARD_IPC_TOKEN=%s", ipcServer.Token()),
+	}
+
+	// Start one WireGuard tunnel per config
+	var tunnelRoutes []TunnelRoute
+	for _, config := range configs {
+		logger.Infof("Creating WireGuard tunnel...")
+		tunnel, err := NewTunnel(ctx, config, a.Tunnel)
+		if err != nil {
+			return fmt.Errorf("failed to create tunnel: %w", err)
+		}
+		a.tunnels = append(a.tunnels, tunnel)
+		logger.Infof("WireGuard tunnel created successfully")
+
+		// Follow DNS changes for peers whose endpoint is a hostname
+		tunnel.StartEndpointRefresh(ctx, a.EndpointDNSTTL, net.DefaultResolver)
+
+		tunnelRoutes = append(tunnelRoutes, TunnelRoute{Tunnel: tunnel, Config: config})
+	}
+
+	// Start a SOCKS5 server per tunnel; the LD_PRELOAD library picks one by destination
+	if proxyMode == "socks5" || proxyMode == "both" {
+		var socksPorts []string
+		for _, tunnel := range a.tunnels {
+			logger.Infof("Starting SOCKS5 server...")
+			socksServer, err := newSOCKS5Server(tunnel, a.Proxy, a.exeNames)
+			if err != nil {
+				return fmt.Errorf("failed to start SOCKS5 server: %w", err)
+			}
+			a.socksServers = append(a.socksServers, socksServer)
+			logger.Infof("SOCKS5 server started on port %d", socksServer.Port())
+			socksPorts = append(socksPorts, strconv.Itoa(socksServer.Port()))
+		}
+		a.env = append(a.env, fmt.Sprintf("WRAPGUARD_SOCKS_PORT=%s", strings.Join(socksPorts, ",")))
+		if len(a.tunnels) > 1 {
+			a.env = append(a.env, fmt.Sprintf("WRAPGUARD_SOCKS_ROUTES=%s", NewTunnelRouter(tunnelRoutes).EnvRoutes()))
+		}
+	}
+
+	// Start HTTP CONNECT proxy for clients without SOCKS5 support
+	if proxyMode == "http" || proxyMode == "both" {
+		logger.Infof("Starting HTTP CONNECT proxy...")
+		httpServer, err := NewHTTPConnectServer(a.tunnels[0], a.Proxy)
+		if err != nil {
+			return fmt.Errorf("failed to start HTTP CONNECT proxy: %w", err)
+		}
+		a.httpServer = httpServer
+		logger.Infof("HTTP CONNECT proxy started on port %d", httpServer.Port())
+		a.env = append(a.env, fmt.Sprintf("WRAPGUARD_HTTP_PROXY_PORT=%d", httpServer.Port()))
+	}
+
+	// Start port forwarder for incoming connections
+	forwarderOpts := a.Forwarder
+	forwarderOpts.AllowedNetworks = a.Proxy.AllowedNetworks
+	forwarderOpts.UpstreamDial = a.Proxy.UpstreamDial
+	forwarder := NewPortForwarder(a.tunnels[0], ipcServer.MessageChan(), forwarderOpts)
+	a.forwarder = forwarder
+	go forwarder.Run(ctx)
+	for _, forwarded := range a.ForwardPorts {
+		if err := forwarder.RegisterPort(forwarded.Port, forwarded.Protocol); err != nil {
+			return fmt.Errorf("failed to forward port %d/%s: %w", forwarded.Port, forwarded.Protocol, err)
+		}
+	}
+	if a.ForwardPortDir != "" {
+		if err := forwarder.WatchDir(ctx, a.ForwardPortDir); err != nil {
+			return err
+		}
+	}
+	for _, forward := range a.ForwardHTTP {
+		if err := forwarder.ForwardHTTP(forward); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stop shuts down the servers and tunnels, running PostDown hooks. It is
+// safe to call more than once.
+func (a *Agent) Stop() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.stop()
+}
+
+func (a *Agent) stop() error {
+	if a.cancel != nil {
+		a.cancel()
+		a.cancel = nil
+	}
+
+	var errs []error
+	for _, socksServer := range a.socksServers {
+		if err := socksServer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close SOCKS5 server: %w", err))
+		}
+	}
+	if a.httpServer != nil {
+		if err := a.httpServer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close HTTP CONNECT proxy: %w", err))
+		}
+	}
+	for _, tunnel := range a.tunnels {
+		if err := tunnel.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close tunnel: %w", err))
+		}
+	}
+	if a.ipcServer != nil {
+		if err := a.ipcServer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close IPC server: %w", err))
+		}
+	}
+
+	a.socksServers = nil
+	a.httpServer = nil
+	a.tunnels = nil
+	a.ipcServer = nil
+	a.exeNames = nil
+	a.forwarder = nil
+	a.env = nil
+	return errors.Join(errs...)
+}
+
+// Suspend takes every tunnel down, for example before the machine
+// hibernates, leaving the proxy servers and child process running
+func (a *Agent) Suspend() error {
+	var errs []error
+	for _, tunnel := range a.Tunnels() {
+		if err := tunnel.Suspend(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Down takes every tunnel's device down ahead of Stop, leaving the proxy
+// servers running until then
+func (a *Agent) Down() error {
+	var errs []error
+	for _, tunnel := range a.Tunnels() {
+		if err := tunnel.Down(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Resume brings every suspended tunnel back up and waits for each to
+// complete a fresh handshake
+func (a *Agent) Resume(ctx context.Context) error {
+	var errs []error
+	for _, tunnel := range a.Tunnels() {
+		if err := tunnel.Resume(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WaitForHandshake blocks until every tunnel has completed a handshake, or
+// until ctx is done
+func (a *Agent) WaitForHandshake(ctx context.Context) error {
+	for _, tunnel := range a.Tunnels() {
+		if err := tunnel.WaitForHandshake(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Env returns the environment variables that tell the LD_PRELOAD library
+// and child processes where the IPC socket and proxy servers are, and the
+// token for the IPC socket. It does not include LD_PRELOAD itself.
+func (a *Agent) Env() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]string(nil), a.env...)
+}
+
+// ChownIPCSocket gives the IPC socket to uid and gid, so that a child
+// running as another user can connect to it
+func (a *Agent) ChownIPCSocket(uid, gid int) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.ipcServer == nil {
+		return fmt.Errorf("agent not started")
+	}
+	return os.Chown(a.ipcServer.SocketPath(), uid, gid)
+}
+
+// Reload applies re-read configs to the running tunnels, one per tunnel in
+// the order given to StartTunnels; see Tunnel.Reload. Adding or removing a
+// tunnel needs a restart.
+func (a *Agent) Reload(configs []*WireGuardConfig) error {
+	tunnels := a.Tunnels()
+	if len(tunnels) == 0 {
+		return fmt.Errorf("agent not started")
+	}
+	if len(configs) != len(tunnels) {
+		return fmt.Errorf("config gives %d tunnels but %d are running, restart to change the number of tunnels", len(configs), len(tunnels))
+	}
+
+	var errs []error
+	for i, tunnel := range tunnels {
+		if err := tunnel.Reload(configs[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ScanForwardPortDir rescans ForwardPortDir at once rather than at the next
+// periodic scan
+func (a *Agent) ScanForwardPortDir() {
+	a.mutex.Lock()
+	forwarder := a.forwarder
+	a.mutex.Unlock()
+	if forwarder != nil {
+		forwarder.ScanDir()
+	}
+}
+
+// IPCSocketPath returns the path of the IPC socket used by the LD_PRELOAD
+// library, or "" if the agent is not running
+func (a *Agent) IPCSocketPath() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.ipcServer == nil {
+		return ""
+	}
+	return a.ipcServer.SocketPath()
+}
+
+// SOCKSPort returns the port of the first tunnel's SOCKS5 server, or 0 if
+// it is not running
+func (a *Agent) SOCKSPort() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.socksServers) == 0 {
+		return 0
+	}
+	return a.socksServers[0].Port()
+}
+
+// HTTPProxyPort returns the port of the HTTP CONNECT proxy, or 0 if it is
+// not running
+func (a *Agent) HTTPProxyPort() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.httpServer == nil {
+		return 0
+	}
+	return a.httpServer.Port()
+}
+
+// ProxyPorts returns the ports of every running SOCKS5 server, in tunnel
+// order, followed by the HTTP CONNECT proxy's port if it is running
+func (a *Agent) ProxyPorts() []int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var ports []int
+	for _, socksServer := range a.socksServers {
+		ports = append(ports, socksServer.Port())
+	}
+	if a.httpServer != nil {
+		ports = append(ports, a.httpServer.Port())
+	}
+	return ports
+}
+
+// Tunnels returns the running tunnels in config order
+func (a *Agent) Tunnels() []*Tunnel {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]*Tunnel(nil), a.tunnels...)
+}
@@ -0,0 +1,342 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envValue(env []string, name string) (string, bool) {
+	for _, entry := range env {
+		if key, value, ok := strings.Cut(entry, "="); ok && key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func TestAgent_StartStop(t *testing.T) {
+	agent := &Agent{}
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	if agent.SOCKSPort() == 0 {
+		t.Error("expected SOCKS5 server to be running")
+	}
+	if agent.HTTPProxyPort() == 0 {
+		t.Error("expected HTTP CONNECT proxy to be running")
+	}
+	if len(agent.Tunnels()) != 1 {
+		t.Errorf("expected 1 tunnel, got %d", len(agent.Tunnels()))
+	}
+	if ports := agent.ProxyPorts(); !slices.Equal(ports, []int{agent.SOCKSPort(), agent.HTTPProxyPort()}) {
+		t.Errorf("expected the SOCKS5 then HTTP proxy port, got %v", ports)
+	}
+
+	env := agent.Env()
+	for _, name := range []string{"WRAPGUARD_IPC_PATH", "WRAPGUARD_IPC_TOKEN", "WRAPGUARD_SOCKS_PORT", "WRAPGUARD_HTTP_PROXY_PORT"} {
+		if _, ok := envValue(env, name); !ok {
+			t.Errorf("expected %s in %v", name, env)
+		}
+	}
+	if _, ok := envValue(env, "WRAPGUARD_SOCKS_ROUTES"); ok {
+		t.Error("WRAPGUARD_SOCKS_ROUTES should only be set with several tunnels")
+	}
+
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err == nil {
+		t.Error("expected error starting an agent twice")
+	}
+
+	if err := agent.Stop(); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	if err := agent.Stop(); err != nil {
+		t.Errorf("second Stop failed: %v", err)
+	}
+
+	if agent.SOCKSPort() != 0 || len(agent.Env()) != 0 || len(agent.ProxyPorts()) != 0 {
+		t.Error("expected agent state to be cleared after Stop")
+	}
+
+	// A stopped agent can be started again
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	agent.Stop()
+}
+
+func TestAgent_ProxyMode(t *testing.T) {
+	agent := &Agent{ProxyMode: "socks5"}
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer agent.Stop()
+
+	if agent.SOCKSPort() == 0 {
+		t.Error("expected SOCKS5 server in socks5 mode")
+	}
+	if agent.HTTPProxyPort() != 0 {
+		t.Error("expected no HTTP CONNECT proxy in socks5 mode")
+	}
+	if _, ok := envValue(agent.Env(), "WRAPGUARD_HTTP_PROXY_PORT"); ok {
+		t.Error("WRAPGUARD_HTTP_PROXY_PORT should not be set in socks5 mode")
+	}
+}
+
+func TestAgent_MultipleTunnels(t *testing.T) {
+	agent := &Agent{ProxyMode: "socks5"}
+	err := agent.StartTunnels(context.Background(), []*WireGuardConfig{
+		newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.1.0.0/16"}}}),
+		newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "0.0.0.0/0"}}}),
+	})
+	if err != nil {
+		t.Fatalf("StartTunnels failed: %v", err)
+	}
+	defer agent.Stop()
+
+	ports, _ := envValue(agent.Env(), "WRAPGUARD_SOCKS_PORT")
+	if len(strings.Split(ports, ",")) != 2 {
+		t.Errorf("expected two SOCKS5 ports, got %q", ports)
+	}
+
+	routes, _ := envValue(agent.Env(), "WRAPGUARD_SOCKS_ROUTES")
+	if routes != "10.1.0.0/16=0,0.0.0.0/0=1" {
+		t.Errorf("unexpected WRAPGUARD_SOCKS_ROUTES %q", routes)
+	}
+}
+
+func TestAgent_ForwardPorts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	agent := &Agent{ProxyMode: "socks5", ForwardPorts: []ForwardedPort{{Port: port, Protocol: "tcp"}}}
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	// Without an interface for the WireGuard IP the forwarder falls back to localhost
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 2*time.Second)
+	if err != nil {
+		t.Errorf("expected the forwarded port to accept connections: %v", err)
+	} else {
+		conn.Close()
+	}
+	agent.Stop()
+
+	agent = &Agent{ProxyMode: "socks5", ForwardPorts: []ForwardedPort{{Port: 53, Protocol: "udp"}}}
+	err = agent.Start(context.Background(), newTestConfig(t, testConfig{}))
+	if err == nil || !strings.Contains(err.Error(), "failed to forward port 53/udp") {
+		t.Errorf("expected a UDP forwarding error, got %v", err)
+	}
+	if agent.SOCKSPort() != 0 {
+		t.Error("expected the agent to be stopped after the failed start")
+	}
+}
+
+func TestAgent_ForwardPortDir(t *testing.T) {
+	agent := &Agent{ProxyMode: "socks5", ForwardPortDir: t.TempDir()}
+	agent.ScanForwardPortDir() // Does nothing before Start
+
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer agent.Stop()
+
+	// Without a WireGuard interface the forwarder falls back to 127.0.0.1,
+	// so the file points the port at a service on another port
+	service := startEchoService(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	writePortFile(t, agent.ForwardPortDir, "service.port", fmt.Sprintf(`{"port": %d, "target": "127.0.0.1:%d"}`, port, service))
+	agent.ScanForwardPortDir()
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), 2*time.Second)
+	if err != nil {
+		t.Fatalf("expected the port from the directory to be forwarded: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("expected the service to echo ping, got %q, %v", reply, err)
+	}
+}
+
+func TestAgent_StartErrors(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelError, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	config := newTestConfig(t, testConfig{})
+
+	tests := []struct {
+		name        string
+		agent       *Agent
+		configs     []*WireGuardConfig
+		errContains string
+	}{
+		{"no configs", &Agent{}, nil, "no tunnel configs"},
+		{"invalid proxy mode", &Agent{ProxyMode: "ftp"}, []*WireGuardConfig{config}, "invalid proxy mode"},
+		{"too many tunnels", &Agent{}, make([]*WireGuardConfig, maxTunnels+1), "too many tunnels"},
+		{"invalid address", &Agent{}, []*WireGuardConfig{{Interface: InterfaceConfig{Address: []string{"bad"}}}}, "failed to create tunnel"},
+		{"missing port directory", &Agent{ForwardPortDir: "/nonexistent/wrapguard-ports"}, []*WireGuardConfig{config}, "failed to watch port directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.agent.StartTunnels(context.Background(), tt.configs)
+			if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("expected error containing %q, got %v", tt.errContains, err)
+			}
+
+			// A failed start leaves nothing running
+			if tt.agent.SOCKSPort() != 0 || len(tt.agent.Tunnels()) != 0 {
+				t.Error("expected no servers after a failed start")
+			}
+		})
+	}
+}
+
+func TestAgent_SuspendResume(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelWarn, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	oldTimeout := ResumeHandshakeTimeout
+	ResumeHandshakeTimeout = 50 * time.Millisecond
+	defer func() { ResumeHandshakeTimeout = oldTimeout }()
+
+	agent := &Agent{ProxyMode: "socks5"}
+	err := agent.StartTunnels(context.Background(), []*WireGuardConfig{
+		newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.1.0.0/16"}}}),
+		newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "10.2.0.0/16"}}}),
+	})
+	if err != nil {
+		t.Fatalf("StartTunnels failed: %v", err)
+	}
+	defer agent.Stop()
+
+	if err := agent.Suspend(); err != nil {
+		t.Fatalf("Suspend failed: %v", err)
+	}
+	if count := strings.Count(buf.String(), "Suspending WireGuard tunnel"); count != 2 {
+		t.Errorf("expected both tunnels to be suspended, got %d", count)
+	}
+
+	// The SOCKS5 servers keep running while suspended
+	if agent.SOCKSPort() == 0 {
+		t.Error("expected SOCKS5 server to keep running")
+	}
+
+	// No peer answers, so both tunnels report the missing handshake
+	err = agent.Resume(context.Background())
+	if err == nil || strings.Count(err.Error(), "no handshake within") != 2 {
+		t.Errorf("expected a handshake timeout per tunnel, got %v", err)
+	}
+	if count := strings.Count(buf.String(), "Resuming WireGuard tunnel"); count != 2 {
+		t.Errorf("expected both tunnels to be resumed, got %d", count)
+	}
+}
+
+func TestAgent_Down(t *testing.T) {
+	agent := &Agent{ProxyMode: "socks5"}
+	err := agent.StartTunnels(context.Background(), []*WireGuardConfig{
+		newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.1.0.0/16"}}}),
+		newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "10.2.0.0/16"}}}),
+	})
+	if err != nil {
+		t.Fatalf("StartTunnels failed: %v", err)
+	}
+
+	if err := agent.Down(); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	for i, tunnel := range agent.Tunnels() {
+		if !tunnel.suspended {
+			t.Errorf("expected tunnel %d to be down", i)
+		}
+	}
+
+	// The proxy servers keep running until Stop
+	if agent.SOCKSPort() == 0 {
+		t.Error("expected SOCKS5 server to keep running until Stop")
+	}
+	if err := agent.Stop(); err != nil {
+		t.Errorf("Stop after Down failed: %v", err)
+	}
+}
+
+func TestAgent_WaitForHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	agent := &Agent{ProxyMode: "socks5"}
+	if err := agent.Start(ctx, newPeeredConfig(t, 1, 2, "10.161.0.1", "10.161.0.2", portA, portB)); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer agent.Stop()
+
+	// Nothing answers yet, so the wait runs into its deadline
+	waitCtx, waitCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	err := agent.WaitForHandshake(waitCtx)
+	waitCancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error without a peer, got %v", err)
+	}
+
+	newPeeredTunnel(t, ctx, 2, 1, "10.161.0.2", "10.161.0.1", portB, portA)
+
+	waitCtx, waitCancel = context.WithTimeout(ctx, 10*time.Second)
+	defer waitCancel()
+	if err := agent.WaitForHandshake(waitCtx); err != nil {
+		t.Fatalf("WaitForHandshake failed once the peer was up: %v", err)
+	}
+}
+
+func TestAgent_Reload(t *testing.T) {
+	agent := &Agent{ProxyMode: "socks5"}
+	if err := agent.Reload(nil); err == nil {
+		t.Error("expected Reload before Start to fail")
+	}
+
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer agent.Stop()
+
+	err := agent.Reload([]*WireGuardConfig{
+		newTestConfig(t, testConfig{}),
+		newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "10.2.0.0/16"}}}),
+	})
+	if err == nil || !strings.Contains(err.Error(), "restart to change the number of tunnels") {
+		t.Errorf("expected an error for a new tunnel, got %v", err)
+	}
+
+	if err := agent.Reload([]*WireGuardConfig{newTestConfig(t, testConfig{peers: []testPeer{{allowedIPs: "10.151.0.0/24"}}})}); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if _, idx := agent.Tunnels()[0].router.Load().FindPeerForDestination(net.ParseIP("10.151.0.5"), 80, 0, "tcp", ""); idx != 0 {
+		t.Errorf("expected the reloaded AllowedIPs to route, got peer %d", idx)
+	}
+}
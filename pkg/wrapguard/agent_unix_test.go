@@ -0,0 +1,41 @@
+//go:build unix
+
+package wrapguard
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestAgent_ChownIPCSocket(t *testing.T) {
+	agent := &Agent{ProxyMode: "socks5"}
+	if err := agent.ChownIPCSocket(os.Getuid(), os.Getgid()); err == nil {
+		t.Error("expected an error before Start")
+	}
+	if path := agent.IPCSocketPath(); path != "" {
+		t.Errorf("expected no IPC socket path before Start, got %s", path)
+	}
+
+	if err := agent.Start(context.Background(), newTestConfig(t, testConfig{})); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer agent.Stop()
+
+	// Giving the socket to ourselves works without root
+	if err := agent.ChownIPCSocket(os.Getuid(), os.Getgid()); err != nil {
+		t.Fatalf("ChownIPCSocket failed: %v", err)
+	}
+	path, _ := envValue(agent.Env(), "WRAPGUARD_IPC_PATH")
+	if agent.IPCSocketPath() != path {
+		t.Errorf("expected IPCSocketPath %s, got %s", path, agent.IPCSocketPath())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && (int(stat.Uid) != os.Getuid() || int(stat.Gid) != os.Getgid()) {
+		t.Errorf("expected the socket to be owned by %d:%d, got %d:%d", os.Getuid(), os.Getgid(), stat.Uid, stat.Gid)
+	}
+}
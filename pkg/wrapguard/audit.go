@@ -0,0 +1,124 @@
+package wrapguard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Timestamp   string `json:"ts"`
+	Event       string `json:"event"`
+	By          string `json:"by"`
+	Hash        string `json:"hash,omitempty"`
+	OldHash     string `json:"old_hash,omitempty"`
+	NewHash     string `json:"new_hash,omitempty"`
+	DiffSummary string `json:"diff_summary,omitempty"`
+}
+
+// AuditLogger records config changes as JSON lines, for compliance. It is
+// kept apart from Logger so that no log level or output setting can
+// silence it, and it only ever appends.
+type AuditLogger struct {
+	mutex  sync.Mutex
+	output io.Writer
+}
+
+// NewAuditLogger returns an audit logger writing to output
+func NewAuditLogger(output io.Writer) *AuditLogger {
+	return &AuditLogger{output: output}
+}
+
+// OpenAuditLog opens path for appending, creating it if needed. Writes are
+// synchronous, so an entry is on disk by the time it has been logged.
+func OpenAuditLog(path string) (*AuditLogger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_SYNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return NewAuditLogger(file), nil
+}
+
+// ConfigLoaded records the config that was loaded, by whom, and the
+// SHA-256 of its content
+func (a *AuditLogger) ConfigLoaded(by, hash string) error {
+	return a.write(AuditEntry{Event: "config_loaded", By: by, Hash: hash})
+}
+
+// ConfigReloaded records a config replacing another while running
+func (a *AuditLogger) ConfigReloaded(by, oldHash, newHash, diffSummary string) error {
+	return a.write(AuditEntry{Event: "config_reloaded", By: by, OldHash: oldHash, NewHash: newHash, DiffSummary: diffSummary})
+}
+
+func (a *AuditLogger) write(entry AuditEntry) error {
+	entry.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if _, err := a.output.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// Close closes the audit log's file, if it has one
+func (a *AuditLogger) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if closer, ok := a.output.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// HashConfigFiles returns the hex SHA-256 of the content of the config
+// files, in order, as they are on disk
+func HashConfigFiles(paths []string) (string, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash config: %w", err)
+		}
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// SummarizeConfigDiffs describes what changed between the configs of each
+// tunnel, such as "2 peers changed", without naming keys or values
+func SummarizeConfigDiffs(old, new []*WireGuardConfig) string {
+	peers := 0
+	interfaces := 0
+	for i := range min(len(old), len(new)) {
+		diff := DiffConfigs(old[i], new[i])
+		peers += len(diff.PeersAdded) + len(diff.PeersRemoved) + len(diff.PeersModified)
+		if diff.InterfaceChanged {
+			interfaces++
+		}
+	}
+
+	parts := []string{fmt.Sprintf("%d %s changed", peers, plural(peers, "peer", "peers"))}
+	if interfaces > 0 {
+		parts = append(parts, fmt.Sprintf("%d %s changed", interfaces, plural(interfaces, "interface", "interfaces")))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
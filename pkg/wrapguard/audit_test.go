@@ -0,0 +1,187 @@
+package wrapguard
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAuditLog returns the entries in an audit log file
+func readAuditLog(t *testing.T, path string) []AuditEntry {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	var entries []AuditEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid audit entry %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLog, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	before := time.Now().UTC().Add(-time.Second)
+	if err := auditLog.ConfigLoaded("startup", "aaaa"); err != nil {
+		t.Fatalf("ConfigLoaded failed: %v", err)
+	}
+	if err := auditLog.ConfigReloaded("config_watch", "aaaa", "bbbb", "1 peer changed"); err != nil {
+		t.Fatalf("ConfigReloaded failed: %v", err)
+	}
+	if err := auditLog.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", entries)
+	}
+	for _, entry := range entries {
+		ts, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+		if err != nil || ts.Before(before) {
+			t.Errorf("expected a current timestamp, got %q", entry.Timestamp)
+		}
+	}
+	if e := entries[0]; e.Event != "config_loaded" || e.By != "startup" || e.Hash != "aaaa" || e.OldHash != "" || e.NewHash != "" || e.DiffSummary != "" {
+		t.Errorf("unexpected config_loaded entry %+v", e)
+	}
+	if e := entries[1]; e.Event != "config_reloaded" || e.By != "config_watch" || e.Hash != "" || e.OldHash != "aaaa" || e.NewHash != "bbbb" || e.DiffSummary != "1 peer changed" {
+		t.Errorf("unexpected config_reloaded entry %+v", e)
+	}
+
+	// Unset fields are left out rather than written empty
+	data, _ := os.ReadFile(path)
+	if first, _, _ := strings.Cut(string(data), "\n"); strings.Contains(first, "old_hash") || strings.Contains(first, "diff_summary") {
+		t.Errorf("expected only the fields of a config_loaded entry, got %s", first)
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Errorf("failed to stat audit log: %v", err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the audit log to be created with mode 0600, got %v", info.Mode().Perm())
+	}
+}
+
+func TestAuditLogger_AppendOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	existing := `{"ts":"2020-01-01T00:00:00Z","event":"config_loaded","by":"startup","hash":"0000"}` + "\n"
+	if err := os.WriteFile(path, []byte(existing), 0600); err != nil {
+		t.Fatalf("failed to write audit log: %v", err)
+	}
+
+	// Reopening, as on every start, adds to what was recorded before
+	for _, hash := range []string{"1111", "2222"} {
+		auditLog, err := OpenAuditLog(path)
+		if err != nil {
+			t.Fatalf("OpenAuditLog failed: %v", err)
+		}
+		if err := auditLog.ConfigLoaded("startup", hash); err != nil {
+			t.Fatalf("ConfigLoaded failed: %v", err)
+		}
+		auditLog.Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	if !strings.HasPrefix(string(data), existing) {
+		t.Errorf("expected the existing entries to be kept as they were, got %q", data)
+	}
+	entries := readAuditLog(t, path)
+	if len(entries) != 3 || entries[0].Hash != "0000" || entries[1].Hash != "1111" || entries[2].Hash != "2222" {
+		t.Errorf("expected the entries appended in order, got %+v", entries)
+	}
+
+	// A write lands at the end even if the file grew since it was opened
+	auditLog, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("OpenAuditLog failed: %v", err)
+	}
+	defer auditLog.Close()
+	other, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	other.WriteString(`{"ts":"2020-01-01T00:00:00Z","event":"config_loaded","by":"startup","hash":"3333"}` + "\n")
+	other.Close()
+	auditLog.ConfigLoaded("startup", "4444")
+	if entries := readAuditLog(t, path); len(entries) != 5 || entries[3].Hash != "3333" || entries[4].Hash != "4444" {
+		t.Errorf("expected the entry after the other writer's, got %+v", entries)
+	}
+}
+
+func TestOpenAuditLogError(t *testing.T) {
+	if _, err := OpenAuditLog(filepath.Join(t.TempDir(), "missing", "audit.log")); err == nil || !strings.Contains(err.Error(), "failed to open audit log") {
+		t.Errorf("expected an error for a missing directory, got %v", err)
+	}
+}
+
+func TestHashConfigFiles(t *testing.T) {
+	a := writeTempConfig(t, "[Interface]\n")
+	b := writeTempConfig(t, "[Peer]\n")
+
+	hash, err := HashConfigFiles([]string{a, b})
+	if err != nil {
+		t.Fatalf("HashConfigFiles failed: %v", err)
+	}
+	sum := sha256.Sum256([]byte("[Interface]\n[Peer]\n"))
+	if expected := hex.EncodeToString(sum[:]); hash != expected {
+		t.Errorf("expected the SHA-256 of the files' content %s, got %s", expected, hash)
+	}
+
+	if single, _ := HashConfigFiles([]string{a}); single == hash {
+		t.Error("expected a different hash for different content")
+	}
+	if _, err := HashConfigFiles([]string{a, filepath.Join(t.TempDir(), "missing.conf")}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestSummarizeConfigDiffs(t *testing.T) {
+	old := newTestConfig(t, testConfig{})
+	other := newTestConfig(t, testConfig{seed: 10, address: "10.151.0.2/24", peers: []testPeer{{allowedIPs: "10.151.0.0/24"}}})
+
+	unchanged := *old
+	modified := *old
+	modified.Peers = []PeerConfig{old.Peers[0]}
+	modified.Peers[0].PersistentKeepalive = 25
+	added := modified
+	added.Peers = append(added.Peers, PeerConfig{PublicKey: generateTestKeyWithSeed(20), AllowedIPs: []string{"10.150.1.0/24"}})
+	moved := added
+	moved.Interface.ListenPort = 51821
+
+	tests := []struct {
+		name     string
+		new      []*WireGuardConfig
+		expected string
+	}{
+		{"unchanged", []*WireGuardConfig{&unchanged, other}, "0 peers changed"},
+		{"one peer", []*WireGuardConfig{&modified, other}, "1 peer changed"},
+		{"two peers", []*WireGuardConfig{&added, other}, "2 peers changed"},
+		{"interface", []*WireGuardConfig{&moved, other}, "2 peers changed, 1 interface changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if summary := SummarizeConfigDiffs([]*WireGuardConfig{old, other}, tt.new); summary != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, summary)
+			}
+		})
+	}
+}
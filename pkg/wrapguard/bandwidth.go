@@ -0,0 +1,49 @@
+package wrapguard
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// BandwidthCounter accumulates the bytes relayed for one forwarded port.
+// BytesIn counts data from WireGuard peers to the child, BytesOut data from
+// the child back to the peers.
+type BandwidthCounter struct {
+	BytesIn  atomic.Uint64
+	BytesOut atomic.Uint64
+}
+
+// BandwidthStats is a snapshot of a BandwidthCounter
+type BandwidthStats struct {
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// Stats returns the current totals
+func (c *BandwidthCounter) Stats() BandwidthStats {
+	return BandwidthStats{BytesIn: c.BytesIn.Load(), BytesOut: c.BytesOut.Load()}
+}
+
+// CountingReader adds the number of bytes read from Reader to Count
+type CountingReader struct {
+	Reader io.Reader
+	Count  *atomic.Uint64
+}
+
+func (r *CountingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.Count.Add(uint64(n))
+	return n, err
+}
+
+// CountingWriter adds the number of bytes written to Writer to Count
+type CountingWriter struct {
+	Writer io.Writer
+	Count  *atomic.Uint64
+}
+
+func (w *CountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.Count.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,63 @@
+package wrapguard
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCountingReader(t *testing.T) {
+	var counter BandwidthCounter
+	reader := &CountingReader{Reader: strings.NewReader("hello, world"), Count: &counter.BytesIn}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(data) != "hello, world" {
+		t.Errorf("unexpected data %q", data)
+	}
+	if got := counter.Stats(); got != (BandwidthStats{BytesIn: 12}) {
+		t.Errorf("expected 12 bytes in, got %+v", got)
+	}
+}
+
+func TestCountingWriter(t *testing.T) {
+	var counter BandwidthCounter
+	var buf bytes.Buffer
+	writer := &CountingWriter{Writer: &buf, Count: &counter.BytesOut}
+
+	for i := 0; i < 3; i++ {
+		if _, err := writer.Write([]byte("abcd")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if buf.String() != "abcdabcdabcd" {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+	if got := counter.Stats(); got != (BandwidthStats{BytesOut: 12}) {
+		t.Errorf("expected 12 bytes out, got %+v", got)
+	}
+}
+
+func TestBandwidthCounter_Concurrent(t *testing.T) {
+	var counter BandwidthCounter
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writer := &CountingWriter{Writer: io.Discard, Count: &counter.BytesOut}
+			for j := 0; j < 100; j++ {
+				writer.Write(make([]byte, 10))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := counter.Stats().BytesOut; got != 8000 {
+		t.Errorf("expected 8000 bytes out, got %d", got)
+	}
+}
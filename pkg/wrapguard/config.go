@@ -0,0 +1,1285 @@
+package wrapguard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type InterfaceConfig struct {
+	PrivateKey string
+	Address    []string // CIDRs in config order, e.g. an IPv4 and an IPv6 address for dual-stack
+	DNS        []string
+	ListenPort int
+	MTU        int // 0 for the default of 1420
+	PostUp     []string
+	PostDown   []string
+
+	// wg-quick directives that are parsed so configs can be shared with
+	// wg-quick, but have no effect in userspace
+	Table   string
+	PreUp   []string
+	PreDown []string
+}
+
+type PeerConfig struct {
+	PublicKey           string
+	PresharedKey        string
+	Endpoint            string
+	AllowedIPs          []string
+	PersistentKeepalive int
+	RoutingPolicies     []RoutingPolicy // New field for policy-based routing
+	OriginalHostname    string          // Endpoint as written in the config, when it named a host
+	ResolvedAt          time.Time       // When OriginalHostname was last resolved into Endpoint
+}
+
+// WrapGuardConfig holds wrapguard's own options from a [WrapGuard] section
+// of the WireGuard config, the same ones a --wrapguard-config file can set.
+// Empty fields were not set.
+type WrapGuardConfig struct {
+	LogLevel       string
+	LogFile        string
+	MetricsAddr    string
+	ExitNode       string
+	OnConnected    string
+	OnDisconnected string
+}
+
+// Settings returns the section as Settings, to be applied like a
+// --wrapguard-config file
+func (c WrapGuardConfig) Settings() *Settings {
+	return &Settings{
+		LogLevel:       c.LogLevel,
+		LogFile:        c.LogFile,
+		MetricsAddr:    c.MetricsAddr,
+		ExitNode:       c.ExitNode,
+		OnConnected:    c.OnConnected,
+		OnDisconnected: c.OnDisconnected,
+	}
+}
+
+type WireGuardConfig struct {
+	Interface InterfaceConfig
+	Peers     []PeerConfig
+	WrapGuard WrapGuardConfig
+
+	// Comments holds the config file's comment lines, as written, so Marshal
+	// can emit them again. See commentKey for the keys.
+	Comments map[string]string
+}
+
+// ConfigErrors collects every problem found while parsing and validating a
+// config so they can all be reported at once
+type ConfigErrors []error
+
+// newConfigErrors flattens joined errors into a ConfigErrors, returning nil
+// when there is nothing to report
+func newConfigErrors(errs ...error) error {
+	var flat ConfigErrors
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			flat = append(flat, joined.Unwrap()...)
+			continue
+		}
+		flat = append(flat, err)
+	}
+
+	if len(flat) == 0 {
+		return nil
+	}
+	return flat
+}
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d config errors:", len(e))
+	for _, err := range e {
+		b.WriteString("\n  - ")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Unwrap allows errors.Is and errors.As to match any of the collected errors
+func (e ConfigErrors) Unwrap() []error {
+	return e
+}
+
+// ConfigOptions changes how config files are read. The zero value expands
+// .tmpl templates and rejects peers with overlapping AllowedIPs, as the
+// package-level parse functions do.
+type ConfigOptions struct {
+	// NoEnvExpand reads .tmpl config files as they are, without expanding
+	// environment variables
+	NoEnvExpand bool
+
+	// AllowOverlappingRoutes downgrades AllowedIPs overlaps between peers
+	// from a validation error to a warning, for configs with redundant
+	// failover peers
+	AllowOverlappingRoutes bool
+}
+
+func ParseConfig(filename string) (*WireGuardConfig, error) {
+	return ConfigOptions{}.ParseConfig(filename)
+}
+
+// ParseConfig is like the package-level ParseConfig, with these options
+func (o ConfigOptions) ParseConfig(filename string) (*WireGuardConfig, error) {
+	config, _, err := o.parseFile(filename)
+	if config == nil {
+		return nil, err
+	}
+
+	if err := newConfigErrors(err, o.validate(config)); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ParseConfigReader parses and validates a config in wg-quick format from r,
+// for programs that hold the config in memory rather than in a file
+func ParseConfigReader(r io.Reader) (*WireGuardConfig, error) {
+	config, _, err := parseConfigReader(r)
+	if config == nil {
+		return nil, err
+	}
+
+	if err := newConfigErrors(err, validateConfig(config)); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ParseConfigs parses several config files into a single configuration. The
+// first file supplies the [Interface] and [WrapGuard] sections and every file
+// may contribute [Peer] sections, which are appended in the order the files
+// are given.
+func ParseConfigs(filenames []string) (*WireGuardConfig, error) {
+	return ConfigOptions{}.ParseConfigs(filenames)
+}
+
+// ParseConfigs is like the package-level ParseConfigs, with these options
+func (o ConfigOptions) ParseConfigs(filenames []string) (*WireGuardConfig, error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no config files specified")
+	}
+
+	files := make([]parsedFile, 0, len(filenames))
+	for _, filename := range filenames {
+		file, err := o.parseNamedFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return o.merge(files)
+}
+
+// parsedFile is a config file read by parseFile, before validation
+type parsedFile struct {
+	name         string
+	config       *WireGuardConfig
+	hasInterface bool
+	err          error // Fields that failed to parse
+}
+
+// parseNamedFile reads filename with parseFile, returning an error only if
+// the file could not be read at all
+func (o ConfigOptions) parseNamedFile(filename string) (parsedFile, error) {
+	config, hasInterface, err := o.parseFile(filename)
+	if config == nil {
+		return parsedFile{}, err
+	}
+	return parsedFile{name: filename, config: config, hasInterface: hasInterface, err: err}, nil
+}
+
+// merge combines parsed files into one config as ParseConfigs describes, and
+// validates it. The first file's config is modified.
+func (o ConfigOptions) merge(files []parsedFile) (*WireGuardConfig, error) {
+	config := files[0].config
+	errs := []error{files[0].err}
+
+	seen := make(map[string]string)
+	for _, peer := range config.Peers {
+		seen[peer.PublicKey] = files[0].name
+	}
+
+	for _, file := range files[1:] {
+		if file.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file.name, file.err))
+		}
+
+		if file.hasInterface {
+			return nil, fmt.Errorf("%s: only the first config file may contain an [Interface] section", file.name)
+		}
+		if file.config.WrapGuard != (WrapGuardConfig{}) {
+			return nil, fmt.Errorf("%s: only the first config file may contain a [WrapGuard] section", file.name)
+		}
+
+		for _, peer := range file.config.Peers {
+			if previous, exists := seen[peer.PublicKey]; exists && logger != nil {
+				logger.Warnf("Duplicate peer public key in %s (first defined in %s)", file.name, previous)
+			} else {
+				seen[peer.PublicKey] = file.name
+			}
+			config.Peers = append(config.Peers, peer)
+		}
+	}
+
+	if err := newConfigErrors(append(errs, o.validate(config))...); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// maxTunnels is the maximum number of independent tunnels that may be
+// configured with --config
+const maxTunnels = 8
+
+// ParseTunnelConfigs parses config files into one config per tunnel. Each
+// file with an [Interface] section starts a new tunnel, and files without
+// one add their peers to the tunnel before them, as with ParseConfigs.
+func ParseTunnelConfigs(filenames []string) ([]*WireGuardConfig, error) {
+	return ConfigOptions{}.ParseTunnelConfigs(filenames)
+}
+
+// ParseTunnelConfigs is like the package-level ParseTunnelConfigs, with these
+// options
+func (o ConfigOptions) ParseTunnelConfigs(filenames []string) ([]*WireGuardConfig, error) {
+	if len(filenames) == 0 {
+		return nil, fmt.Errorf("no config files specified")
+	}
+
+	// Each file is parsed once, so templates are expanded and problems
+	// logged once however the files are grouped
+	var groups [][]parsedFile
+	for _, filename := range filenames {
+		file, err := o.parseNamedFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if file.hasInterface || len(groups) == 0 {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], file)
+	}
+
+	if len(groups) > maxTunnels {
+		return nil, fmt.Errorf("too many tunnels: %d config files contain an [Interface] section, at most %d are supported", len(groups), maxTunnels)
+	}
+
+	configs := make([]*WireGuardConfig, 0, len(groups))
+	for _, group := range groups {
+		config, err := o.merge(group)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// ReadWrapGuardConfig returns the [WrapGuard] section of a config file, so
+// that its logging options can be applied before the config is parsed in
+// full. Problems with the file are left for that parse to report, and give
+// an empty section here.
+func ReadWrapGuardConfig(filename string) WrapGuardConfig {
+	return ConfigOptions{}.ReadWrapGuardConfig(filename)
+}
+
+// ReadWrapGuardConfig is like the package-level ReadWrapGuardConfig, with
+// these options
+func (o ConfigOptions) ReadWrapGuardConfig(filename string) WrapGuardConfig {
+	config, _, _ := o.parseFile(filename)
+	if config == nil {
+		return WrapGuardConfig{}
+	}
+	return config.WrapGuard
+}
+
+// ParseConfigTemplate parses a config file after expanding ${VAR} and $VAR
+// references from the environment, so secrets such as the private key can be
+// injected without writing them to disk
+func ParseConfigTemplate(path string) (*WireGuardConfig, error) {
+	content, err := readConfigTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := parseConfigReader(strings.NewReader(content))
+	if config == nil {
+		return nil, err
+	}
+
+	if err := newConfigErrors(err, validateConfig(config)); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// readConfigTemplate reads a config template and expands environment
+// variables in it. Referencing an unset variable is an error, since an empty
+// key or address would otherwise fail later with a less helpful message.
+func readConfigTemplate(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", openConfigError(path, err)
+	}
+
+	var missing []string
+	expanded := os.Expand(string(data), func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%s: undefined environment variables: %s", path, strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
+
+// parseConfigFile reads a single config file without validating it. It also
+// reports whether the file contained an [Interface] section. Invalid fields
+// do not stop parsing; the returned config is non-nil whenever the file could
+// be read, and the error joins every field that failed to parse.
+func parseConfigFile(filename string) (*WireGuardConfig, bool, error) {
+	return ConfigOptions{}.parseFile(filename)
+}
+
+// parseFile is parseConfigFile with these options
+func (o ConfigOptions) parseFile(filename string) (*WireGuardConfig, bool, error) {
+	// Config templates have environment variables expanded before parsing
+	if !o.NoEnvExpand && strings.HasSuffix(filename, ".tmpl") {
+		content, err := readConfigTemplate(filename)
+		if err != nil {
+			return nil, false, err
+		}
+		return parseConfigReader(strings.NewReader(content))
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, false, openConfigError(filename, err)
+	}
+	defer file.Close()
+
+	return parseConfigReader(file)
+}
+
+// parseConfigReader parses config text in WireGuard INI format; see parseConfigFile
+func parseConfigReader(r io.Reader) (*WireGuardConfig, bool, error) {
+	config := &WireGuardConfig{}
+	scanner := bufio.NewScanner(r)
+	var currentSection string
+	var currentPeer *PeerConfig
+	hasInterface := false
+	lineNum := 0
+	var errs []error
+
+	// Comment lines wait for the line they precede
+	var pending []string
+	var sectionKey string
+	occurrences := make(map[string]int)
+	attachComments := func(key, inline string) {
+		if len(pending) > 0 {
+			config.setComment(key, strings.Join(pending, "\n"))
+			pending = nil
+		}
+		if inline != "" {
+			config.setComment(key+"#", inline)
+		}
+	}
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and keep comments for Marshal
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			pending = append(pending, line)
+			continue
+		}
+		line, inline := splitInlineComment(line)
+
+		// Check for section headers
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			currentSection = strings.ToLower(line[1 : len(line)-1])
+			sectionKey = line[1 : len(line)-1]
+			if currentSection == "interface" {
+				hasInterface = true
+				sectionKey = "Interface"
+			}
+			if currentSection == "peer" {
+				if currentPeer != nil {
+					config.Peers = append(config.Peers, *currentPeer)
+				}
+				currentPeer = &PeerConfig{}
+				sectionKey = fmt.Sprintf("Peer.%d", len(config.Peers))
+			}
+			if currentSection == "wrapguard" {
+				sectionKey = "WrapGuard"
+			}
+			clear(occurrences)
+			attachComments(sectionKey, inline)
+			continue
+		}
+
+		// Parse key-value pairs
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		field := canonicalFieldName(key)
+		attachComments(commentKey(sectionKey, field, occurrences[field]), inline)
+		occurrences[field]++
+
+		switch currentSection {
+		case "interface":
+			if err := parseInterfaceField(&config.Interface, key, value); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: error parsing interface field %s: %w", lineNum, key, err))
+			}
+		case "peer":
+			if currentPeer != nil {
+				if err := parsePeerField(currentPeer, key, value); err != nil {
+					errs = append(errs, fmt.Errorf("line %d: error parsing peer field %s: %w", lineNum, key, err))
+				}
+			}
+		case "wrapguard":
+			if err := parseWrapGuardField(&config.WrapGuard, key, value); err != nil {
+				errs = append(errs, fmt.Errorf("line %d: error parsing wrapguard field %s: %w", lineNum, key, err))
+			}
+		}
+	}
+
+	// Add the last peer if exists
+	if currentPeer != nil {
+		config.Peers = append(config.Peers, *currentPeer)
+	}
+	if len(pending) > 0 {
+		config.setComment("End", strings.Join(pending, "\n"))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, false, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	return config, hasInterface, errors.Join(errs...)
+}
+
+// splitInlineComment separates a trailing comment from line. As in a shell,
+// a comment starts at a # preceded by whitespace, so values such as $# in
+// hook commands are left alone.
+func splitInlineComment(line string) (string, string) {
+	for i := 1; i < len(line); i++ {
+		if line[i] == '#' && (line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i]), line[i:]
+		}
+	}
+	return line, ""
+}
+
+// canonicalFieldNames maps lowercase config keys to the spelling Marshal uses
+var canonicalFieldNames = map[string]string{
+	"privatekey":          "PrivateKey",
+	"address":             "Address",
+	"dns":                 "DNS",
+	"listenport":          "ListenPort",
+	"mtu":                 "MTU",
+	"postup":              "PostUp",
+	"postdown":            "PostDown",
+	"table":               "Table",
+	"preup":               "PreUp",
+	"predown":             "PreDown",
+	"publickey":           "PublicKey",
+	"presharedkey":        "PresharedKey",
+	"endpoint":            "Endpoint",
+	"allowedips":          "AllowedIPs",
+	"persistentkeepalive": "PersistentKeepalive",
+	"route":               "Route",
+	"loglevel":            "LogLevel",
+	"logfile":             "LogFile",
+	"metricsaddr":         "MetricsAddr",
+	"exitnode":            "ExitNode",
+	"onconnected":         "OnConnected",
+	"ondisconnected":      "OnDisconnected",
+}
+
+func canonicalFieldName(key string) string {
+	if name, ok := canonicalFieldNames[strings.ToLower(key)]; ok {
+		return name
+	}
+	return key
+}
+
+// commentKey returns the Comments key for the comment above the nth line
+// (from 0) setting field in section, for example "Interface.PrivateKey" or
+// "Peer.1.PostUp[2]". Sections are "Interface", "Peer.<index>" and
+// "WrapGuard". The
+// section name alone holds the comment above its header, a "#" suffix marks
+// an inline comment, and "End" holds comments after the last line.
+func commentKey(section, field string, n int) string {
+	key := section + "." + field
+	if n > 0 {
+		key += fmt.Sprintf("[%d]", n)
+	}
+	return key
+}
+
+func (c *WireGuardConfig) setComment(key, comment string) {
+	if c.Comments == nil {
+		c.Comments = make(map[string]string)
+	}
+	c.Comments[key] = comment
+}
+
+func parseInterfaceField(iface *InterfaceConfig, key, value string) error {
+	switch strings.ToLower(key) {
+	case "privatekey":
+		// Convert base64 private key to hex for wireguard-go IPC
+		hexKey, err := base64ToHex(value)
+		if err != nil {
+			return invalidKeyError("PrivateKey", "invalid private key format: %w", err)
+		}
+		iface.PrivateKey = hexKey
+	case "address":
+		// Repeated Address lines add more addresses
+		iface.Address = append(iface.Address, splitAddresses(value)...)
+	case "dns":
+		// Parse comma-separated DNS servers
+		dns := strings.Split(value, ",")
+		for i, d := range dns {
+			dns[i] = strings.TrimSpace(d)
+		}
+		iface.DNS = dns
+	case "listenport":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid listen port: %w", err)
+		}
+		iface.ListenPort = port
+	case "mtu":
+		mtu, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid MTU: %w", err)
+		}
+		// wg-quick configs may set jumbo MTUs the tunnel cannot carry, so
+		// clamp rather than refuse them
+		if clamped := min(max(mtu, minTunnelMTU), maxTunnelMTU); clamped != mtu {
+			logger.Warnf("MTU %d is outside the supported range of %d to %d, using %d", mtu, minTunnelMTU, maxTunnelMTU, clamped)
+			mtu = clamped
+		}
+		iface.MTU = mtu
+	case "postup":
+		iface.PostUp = append(iface.PostUp, splitHookCommands(value)...)
+	case "postdown":
+		iface.PostDown = append(iface.PostDown, splitHookCommands(value)...)
+	case "table":
+		iface.Table = value
+		logUnsupportedDirective("Table")
+	case "preup":
+		iface.PreUp = append(iface.PreUp, splitHookCommands(value)...)
+		logUnsupportedDirective("PreUp")
+	case "predown":
+		iface.PreDown = append(iface.PreDown, splitHookCommands(value)...)
+		logUnsupportedDirective("PreDown")
+	}
+	return nil
+}
+
+// logUnsupportedDirective notes a wg-quick directive that is kept in the
+// config but not acted on
+func logUnsupportedDirective(name string) {
+	if logger != nil {
+		logger.Debugf("ignoring unsupported directive %s", name)
+	}
+}
+
+// splitHookCommands splits a PostUp/PostDown value into individual shell
+// commands separated by semicolons or newlines, dropping empty entries
+func splitHookCommands(value string) []string {
+	var commands []string
+	for _, command := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '\n' }) {
+		if command = strings.TrimSpace(command); command != "" {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+// parseWrapGuardField sets a [WrapGuard] option. Unlike the WireGuard
+// sections, unknown keys are an error, since nothing else reads the section.
+func parseWrapGuardField(wg *WrapGuardConfig, key, value string) error {
+	fields := map[string]*string{
+		"loglevel":       &wg.LogLevel,
+		"logfile":        &wg.LogFile,
+		"metricsaddr":    &wg.MetricsAddr,
+		"exitnode":       &wg.ExitNode,
+		"onconnected":    &wg.OnConnected,
+		"ondisconnected": &wg.OnDisconnected,
+	}
+	field, ok := fields[strings.ToLower(key)]
+	if !ok {
+		return fmt.Errorf("unknown option")
+	}
+	*field = value
+	return nil
+}
+
+func parsePeerField(peer *PeerConfig, key, value string) error {
+	switch strings.ToLower(key) {
+	case "publickey":
+		// Convert base64 public key to hex for wireguard-go IPC
+		hexKey, err := base64ToHex(value)
+		if err != nil {
+			return invalidKeyError("PublicKey", "invalid public key format: %w", err)
+		}
+		peer.PublicKey = hexKey
+	case "presharedkey":
+		// Convert base64 preshared key to hex for wireguard-go IPC
+		hexKey, err := base64ToHex(value)
+		if err != nil {
+			return invalidKeyError("PresharedKey", "invalid preshared key format: %w", err)
+		}
+		peer.PresharedKey = hexKey
+	case "endpoint":
+		// Resolve hostname in endpoint to IP address
+		resolvedEndpoint, err := resolveEndpoint(value)
+		if err != nil {
+			// Keep the hostname so the partial config still names it
+			peer.OriginalHostname = value
+			return invalidPeerError("failed to resolve endpoint %s: %w", value, err)
+		}
+		peer.Endpoint = resolvedEndpoint
+		if resolvedEndpoint != value {
+			peer.OriginalHostname = value
+			peer.ResolvedAt = time.Now()
+		}
+	case "allowedips":
+		// Parse comma-separated allowed IPs
+		ips := strings.Split(value, ",")
+		for i, ip := range ips {
+			ips[i] = strings.TrimSpace(ip)
+		}
+		peer.AllowedIPs = ips
+	case "persistentkeepalive":
+		keepalive, err := strconv.Atoi(value)
+		if err != nil {
+			return invalidPeerError("invalid persistent keepalive: %w", err)
+		}
+		peer.PersistentKeepalive = keepalive
+	case "route":
+		// Parse routing policy with auto-incrementing priority
+		priority := len(peer.RoutingPolicies)
+		policy, err := ParseRoutingPolicy(value, priority)
+		if err != nil {
+			return invalidPeerError("invalid routing policy: %w", err)
+		}
+		peer.RoutingPolicies = append(peer.RoutingPolicies, *policy)
+	}
+	return nil
+}
+
+func validateConfig(config *WireGuardConfig) error {
+	return ConfigOptions{}.validate(config)
+}
+
+// validate is validateConfig with these options
+func (o ConfigOptions) validate(config *WireGuardConfig) error {
+	var errs []error
+
+	// Validate interface
+	if config.Interface.PrivateKey == "" {
+		errs = append(errs, invalidKeyError("PrivateKey", "interface private key is required"))
+	} else if err := ValidatePrivateKey(config.Interface.PrivateKey); err != nil {
+		errs = append(errs, invalidKeyError("PrivateKey", "interface private key: %w", err))
+	}
+
+	if len(config.Interface.Address) == 0 {
+		errs = append(errs, invalidAddressError("interface address is required"))
+	}
+	for _, address := range config.Interface.Address {
+		// Validate address format
+		if _, err := netip.ParsePrefix(address); err != nil {
+			errs = append(errs, invalidAddressError("invalid interface address format: %w", err))
+		}
+	}
+
+	// Validate at least one peer
+	if len(config.Peers) == 0 {
+		errs = append(errs, ErrNoPeers{newConfigError(CodeNoPeers, "at least one peer is required")})
+	}
+
+	// Validate peers
+	for i, peer := range config.Peers {
+		if peer.PublicKey == "" {
+			errs = append(errs, invalidKeyError("PublicKey", "peer %d: public key is required", i))
+		} else if err := ValidatePublicKey(peer.PublicKey); err != nil {
+			errs = append(errs, invalidKeyError("PublicKey", "peer %d: public key: %w", i, err))
+		}
+
+		if len(peer.AllowedIPs) == 0 {
+			errs = append(errs, invalidPeerError("peer %d: at least one allowed IP is required", i))
+		}
+
+		// Validate allowed IPs format
+		for _, allowedIP := range peer.AllowedIPs {
+			if _, err := netip.ParsePrefix(allowedIP); err != nil {
+				errs = append(errs, invalidPeerError("peer %d: invalid allowed IP format %s: %w", i, allowedIP, err))
+			}
+		}
+	}
+
+	// Validate that no two peers claim overlapping AllowedIPs
+	if overlaps := findAllowedIPOverlaps(config.Peers); len(overlaps) > 0 {
+		if !o.AllowOverlappingRoutes {
+			errs = append(errs, invalidPeerError("overlapping allowed IPs between peers: %s", strings.Join(overlaps, "; ")))
+		} else if logger != nil {
+			for _, overlap := range overlaps {
+				logger.Warnf("Overlapping allowed IPs between peers: %s", overlap)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// findAllowedIPOverlaps compares the AllowedIPs of every pair of peers and
+// describes each pair of prefixes that overlap
+func findAllowedIPOverlaps(peers []PeerConfig) []string {
+	prefixes := make([][]netip.Prefix, len(peers))
+	for i, peer := range peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			if prefix, err := netip.ParsePrefix(allowedIP); err == nil {
+				prefixes[i] = append(prefixes[i], prefix.Masked())
+			}
+		}
+	}
+
+	var overlaps []string
+	for i := 0; i < len(prefixes); i++ {
+		for j := i + 1; j < len(prefixes); j++ {
+			for _, a := range prefixes[i] {
+				for _, b := range prefixes[j] {
+					if a.Overlaps(b) {
+						overlaps = append(overlaps, fmt.Sprintf("peer %d %s overlaps peer %d %s", i, a, j, b))
+					}
+				}
+			}
+		}
+	}
+
+	return overlaps
+}
+
+// splitAddresses parses a comma-separated Address value, dropping empty entries
+func splitAddresses(value string) []string {
+	var addresses []string
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// GetInterfaceIP extracts the IP address from the interface address (without
+// CIDR). With several addresses the first IPv4 address is used, or the first
+// IPv6 address if there is no IPv4 one.
+func (c *WireGuardConfig) GetInterfaceIP() (netip.Addr, error) {
+	prefix, err := c.GetInterfacePrefix()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return prefix.Addr(), nil
+}
+
+// GetInterfaceIPv4 returns the first IPv4 interface address
+func (c *WireGuardConfig) GetInterfaceIPv4() (netip.Addr, error) {
+	prefix, err := c.interfacePrefix("IPv4", netip.Addr.Is4)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return prefix.Addr(), nil
+}
+
+// GetInterfaceIPv6 returns the first IPv6 interface address
+func (c *WireGuardConfig) GetInterfaceIPv6() (netip.Addr, error) {
+	prefix, err := c.interfacePrefix("IPv6", netip.Addr.Is6)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return prefix.Addr(), nil
+}
+
+// GetInterfacePrefix returns the interface address GetInterfaceIP uses as a
+// prefix
+func (c *WireGuardConfig) GetInterfacePrefix() (netip.Prefix, error) {
+	if prefix, err := c.interfacePrefix("IPv4", netip.Addr.Is4); err == nil {
+		return prefix, nil
+	}
+	return c.interfacePrefix("IPv6", netip.Addr.Is6)
+}
+
+// interfacePrefix returns the first interface address whose IP is in family
+func (c *WireGuardConfig) interfacePrefix(name string, family func(netip.Addr) bool) (netip.Prefix, error) {
+	if len(c.Interface.Address) == 0 {
+		return netip.Prefix{}, fmt.Errorf("no interface address")
+	}
+	for _, address := range c.Interface.Address {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if family(prefix.Addr()) {
+			return prefix, nil
+		}
+	}
+	return netip.Prefix{}, fmt.Errorf("no %s interface address in %s", name, strings.Join(c.Interface.Address, ", "))
+}
+
+// Marshal serializes the configuration back into canonical WireGuard INI format.
+// The [Interface] section is emitted first with keys in a fixed order, followed
+// by [Peer] sections sorted by public key and any [WrapGuard] section. Keys
+// are re-encoded to base64.
+// Comments are emitted above or after the lines they were attached to; those
+// whose line no longer exists end up at the end of their section.
+func (c *WireGuardConfig) Marshal() ([]byte, error) {
+	m := &configMarshaler{comments: c.Comments, emitted: make(map[string]bool)}
+
+	m.section("Interface", "[Interface]")
+	if c.Interface.PrivateKey != "" {
+		key, err := hexToBase64(c.Interface.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface private key: %w", err)
+		}
+		m.field("PrivateKey", key)
+	}
+	if len(c.Interface.Address) > 0 {
+		m.field("Address", strings.Join(c.Interface.Address, ", "))
+	}
+	if len(c.Interface.DNS) > 0 {
+		m.field("DNS", strings.Join(c.Interface.DNS, ", "))
+	}
+	if c.Interface.ListenPort > 0 {
+		m.field("ListenPort", strconv.Itoa(c.Interface.ListenPort))
+	}
+	if c.Interface.MTU > 0 {
+		m.field("MTU", strconv.Itoa(c.Interface.MTU))
+	}
+	for _, command := range c.Interface.PostUp {
+		m.field("PostUp", command)
+	}
+	for _, command := range c.Interface.PostDown {
+		m.field("PostDown", command)
+	}
+	if c.Interface.Table != "" {
+		m.field("Table", c.Interface.Table)
+	}
+	for _, command := range c.Interface.PreUp {
+		m.field("PreUp", command)
+	}
+	for _, command := range c.Interface.PreDown {
+		m.field("PreDown", command)
+	}
+
+	// Sort peer indexes so comments stay keyed by position in c.Peers
+	order := make([]int, len(c.Peers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return c.Peers[order[i]].PublicKey < c.Peers[order[j]].PublicKey
+	})
+
+	for i, idx := range order {
+		peer := c.Peers[idx]
+		m.section(fmt.Sprintf("Peer.%d", idx), "[Peer]")
+		if peer.PublicKey != "" {
+			key, err := hexToBase64(peer.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid public key: %w", i, err)
+			}
+			m.field("PublicKey", key)
+		}
+		if peer.PresharedKey != "" {
+			key, err := hexToBase64(peer.PresharedKey)
+			if err != nil {
+				return nil, fmt.Errorf("peer %d: invalid preshared key: %w", i, err)
+			}
+			m.field("PresharedKey", key)
+		}
+		if peer.OriginalHostname != "" {
+			m.field("Endpoint", peer.OriginalHostname)
+		} else if peer.Endpoint != "" {
+			m.field("Endpoint", peer.Endpoint)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			m.field("AllowedIPs", strings.Join(peer.AllowedIPs, ", "))
+		}
+		if peer.PersistentKeepalive > 0 {
+			m.field("PersistentKeepalive", strconv.Itoa(peer.PersistentKeepalive))
+		}
+		for _, policy := range peer.RoutingPolicies {
+			m.field("Route", policy.String())
+		}
+	}
+
+	if wg := c.WrapGuard; wg != (WrapGuardConfig{}) {
+		m.section("WrapGuard", "[WrapGuard]")
+		for _, f := range []struct{ name, value string }{
+			{"LogLevel", wg.LogLevel},
+			{"LogFile", wg.LogFile},
+			{"MetricsAddr", wg.MetricsAddr},
+			{"ExitNode", wg.ExitNode},
+			{"OnConnected", wg.OnConnected},
+			{"OnDisconnected", wg.OnDisconnected},
+		} {
+			if f.value != "" {
+				m.field(f.name, f.value)
+			}
+		}
+	}
+	m.endSection()
+
+	// Comments from sections that were not emitted, then the file's tail
+	m.remainingComments("")
+	if end, ok := c.Comments["End"]; ok {
+		m.buf.WriteString(end + "\n")
+	}
+
+	return m.buf.Bytes(), nil
+}
+
+// configMarshaler writes config lines together with their comments
+type configMarshaler struct {
+	buf         bytes.Buffer
+	comments    map[string]string
+	emitted     map[string]bool
+	current     string // Comments key of the section being written
+	occurrences map[string]int
+}
+
+// section starts a section, ending the previous one and separating the two
+// with a blank line
+func (m *configMarshaler) section(key, header string) {
+	m.endSection()
+	if m.buf.Len() > 0 {
+		m.buf.WriteString("\n")
+	}
+	m.current = key
+	m.occurrences = make(map[string]int)
+	m.line(key, header)
+}
+
+// field writes "name = value" under the current section
+func (m *configMarshaler) field(name, value string) {
+	key := commentKey(m.current, name, m.occurrences[name])
+	m.occurrences[name]++
+	m.line(key, name+" = "+value)
+}
+
+// line writes text with the block comment above it and the inline comment
+// after it
+func (m *configMarshaler) line(key, text string) {
+	if block, ok := m.comments[key]; ok {
+		m.buf.WriteString(block + "\n")
+		m.emitted[key] = true
+	}
+	m.buf.WriteString(text)
+	if inline, ok := m.comments[key+"#"]; ok {
+		m.buf.WriteString(" " + inline)
+		m.emitted[key+"#"] = true
+	}
+	m.buf.WriteString("\n")
+}
+
+// endSection writes the current section's comments whose lines are gone
+func (m *configMarshaler) endSection() {
+	if m.current != "" {
+		m.remainingComments(m.current + ".")
+	}
+}
+
+// remainingComments writes the comments not yet emitted whose keys start
+// with prefix, in key order. The file's tail under "End" is left to Marshal.
+func (m *configMarshaler) remainingComments(prefix string) {
+	var keys []string
+	for key := range m.comments {
+		if !m.emitted[key] && key != "End" && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m.buf.WriteString(m.comments[key] + "\n")
+		m.emitted[key] = true
+	}
+}
+
+// base64ToHex converts a base64-encoded WireGuard key to lowercase hex format
+// required by wireguard-go IPC protocol
+func base64ToHex(base64Key string) (string, error) {
+	// Decode base64 key
+	keyBytes, err := base64.StdEncoding.DecodeString(base64Key)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64 key: %w", err)
+	}
+
+	// WireGuard keys should be exactly 32 bytes
+	if len(keyBytes) != 32 {
+		return "", fmt.Errorf("key must be 32 bytes, got %d", len(keyBytes))
+	}
+
+	// Convert to lowercase hex
+	return hex.EncodeToString(keyBytes), nil
+}
+
+// ValidatePrivateKey checks that a private key is a usable WireGuard key.
+// It accepts the hex form stored after parsing or the base64 form used in
+// config files.
+func ValidatePrivateKey(key string) error {
+	return validateKey(key)
+}
+
+// ValidatePublicKey checks that a public key is a usable WireGuard key.
+// Like ValidatePrivateKey it accepts hex or base64.
+func ValidatePublicKey(key string) error {
+	return validateKey(key)
+}
+
+// validateKey rejects keys that are not 32 bytes and the all-zero and
+// all-ones keys, which only ever appear as placeholders
+func validateKey(key string) error {
+	var keyBytes []byte
+	var err error
+	if isHexString(key) {
+		keyBytes, err = hex.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("failed to decode hex key: %w", err)
+		}
+	} else {
+		keyBytes, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return fmt.Errorf("failed to decode base64 key: %w", err)
+		}
+	}
+
+	if len(keyBytes) != 32 {
+		return fmt.Errorf("key must be 32 bytes, got %d", len(keyBytes))
+	}
+
+	allZero, allOnes := true, true
+	for _, b := range keyBytes {
+		if b != 0x00 {
+			allZero = false
+		}
+		if b != 0xff {
+			allOnes = false
+		}
+	}
+	if allZero {
+		return fmt.Errorf("zero key is not a valid WireGuard key")
+	}
+	if allOnes {
+		return fmt.Errorf("all-ones key is not a valid WireGuard key")
+	}
+
+	return nil
+}
+
+// isHexString reports whether s is non-empty and made only of hex digits
+func isHexString(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// hexToBase64 converts a hex-encoded WireGuard key back to the standard base64
+// format used in configuration files
+func hexToBase64(hexKey string) (string, error) {
+	keyBytes, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode hex key: %w", err)
+	}
+
+	if len(keyBytes) != 32 {
+		return "", fmt.Errorf("key must be 32 bytes, got %d", len(keyBytes))
+	}
+
+	return base64.StdEncoding.EncodeToString(keyBytes), nil
+}
+
+// resolveEndpoint resolves a hostname:port endpoint to IP:port format
+// required by wireguard-go which expects IP addresses, not hostnames
+func resolveEndpoint(endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint format: %w", err)
+	}
+
+	// Check if host is already an IP address
+	if ip := net.ParseIP(host); ip != nil {
+		return endpoint, nil // Already an IP, return as-is
+	}
+
+	// Resolve hostname to IP
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve hostname %s: %w", host, err)
+	}
+
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no IP addresses found for hostname %s", host)
+	}
+
+	// Use the first IP address (prefer IPv4)
+	resolvedIP := pickEndpointIP(ips)
+	return net.JoinHostPort(resolvedIP.String(), port), nil
+}
+
+// pickEndpointIP chooses the address to use for an endpoint, preferring the
+// first IPv4 address and otherwise using the first address
+func pickEndpointIP(ips []net.IP) net.IP {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+// ApplyCLIRoutesToTunnels applies CLI routing options when several tunnels
+// are configured. Each route goes to the first config with a peer that can
+// reach its peer IP.
+func ApplyCLIRoutesToTunnels(configs []*WireGuardConfig, exitNode string, routes []string) error {
+	if exitNode != "" {
+		routes = append([]string{fmt.Sprintf("0.0.0.0/0:%s", exitNode)}, routes...)
+	}
+
+	for _, route := range routes {
+		var err error
+		for _, config := range configs {
+			if err = ApplyCLIRoutes(config, "", []string{route}); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ApplyCLIRoutes applies routing policies from CLI arguments to the configuration
+func ApplyCLIRoutes(config *WireGuardConfig, exitNode string, routes []string) error {
+	// Handle exit node (shorthand for routing all traffic through a peer)
+	if exitNode != "" {
+		routes = append([]string{fmt.Sprintf("0.0.0.0/0:%s", exitNode)}, routes...)
+	}
+
+	// Process each route
+	for _, route := range routes {
+		parts := strings.Split(route, ":")
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid route format '%s', expected CIDR:peerIP", route)
+		}
+
+		cidr := strings.TrimSpace(parts[0])
+		peerIP := strings.TrimSpace(parts[1])
+
+		// Validate CIDR
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR in route '%s': %w", route, err)
+		}
+
+		// Find the peer with the matching IP
+		peerFound := false
+		for i := range config.Peers {
+			peer := &config.Peers[i]
+
+			// Check if this peer can route to the specified IP
+			for _, allowedIP := range peer.AllowedIPs {
+				prefix, err := netip.ParsePrefix(allowedIP)
+				if err != nil {
+					continue
+				}
+
+				// Check if the peer IP is within this peer's allowed IPs
+				addr, err := netip.ParseAddr(peerIP)
+				if err != nil {
+					continue
+				}
+
+				if prefix.Contains(addr) {
+					// Add routing policy to this peer
+					priority := len(peer.RoutingPolicies)
+					policy := RoutingPolicy{
+						DestinationCIDR: cidr,
+						Protocol:        "any",
+						PortRange:       PortRange{Start: 1, End: 65535},
+						SrcPortRange:    PortRange{Start: 1, End: 65535},
+						Priority:        priority,
+					}
+					peer.RoutingPolicies = append(peer.RoutingPolicies, policy)
+					peerFound = true
+
+					if logger != nil {
+						logger.Infof("Added route %s via peer %s", cidr, peerIP)
+					}
+					break
+				}
+			}
+
+			if peerFound {
+				break
+			}
+		}
+
+		if !peerFound {
+			return fmt.Errorf("no peer found that can route to %s", peerIP)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,2164 @@
+package wrapguard
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		expectError bool
+		validate    func(*WireGuardConfig) error
+	}{
+		{
+			name: "valid basic config",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: false,
+			validate: func(c *WireGuardConfig) error {
+				if !slices.Equal(c.Interface.Address, []string{"10.0.0.2/24"}) {
+					t.Errorf("expected address 10.0.0.2/24, got %v", c.Interface.Address)
+				}
+				if len(c.Peers) != 1 {
+					t.Errorf("expected 1 peer, got %d", len(c.Peers))
+				}
+				if c.Peers[0].Endpoint != "192.168.1.1:51820" {
+					t.Errorf("expected endpoint 192.168.1.1:51820, got %s", c.Peers[0].Endpoint)
+				}
+				return nil
+			},
+		},
+		{
+			name: "config with DNS",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+DNS = 1.1.1.1, 8.8.8.8
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: false,
+			validate: func(c *WireGuardConfig) error {
+				if len(c.Interface.DNS) != 2 {
+					t.Errorf("expected 2 DNS servers, got %d", len(c.Interface.DNS))
+				}
+				if c.Interface.DNS[0] != "1.1.1.1" || c.Interface.DNS[1] != "8.8.8.8" {
+					t.Errorf("unexpected DNS servers: %v", c.Interface.DNS)
+				}
+				return nil
+			},
+		},
+		{
+			name: "config with listen port",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+ListenPort = 51820
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: false,
+			validate: func(c *WireGuardConfig) error {
+				if c.Interface.ListenPort != 51820 {
+					t.Errorf("expected listen port 51820, got %d", c.Interface.ListenPort)
+				}
+				return nil
+			},
+		},
+		{
+			name: "config with preshared key",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+PresharedKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: false,
+			validate: func(c *WireGuardConfig) error {
+				if c.Peers[0].PresharedKey == "" {
+					t.Error("expected preshared key to be set")
+				}
+				return nil
+			},
+		},
+		{
+			name: "config with keepalive",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0
+PersistentKeepalive = 25`,
+			expectError: false,
+			validate: func(c *WireGuardConfig) error {
+				if c.Peers[0].PersistentKeepalive != 25 {
+					t.Errorf("expected keepalive 25, got %d", c.Peers[0].PersistentKeepalive)
+				}
+				return nil
+			},
+		},
+		{
+			name: "config with multiple peers",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 10.0.0.0/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.2:51820
+AllowedIPs = 10.1.0.0/24`,
+			expectError: false,
+			validate: func(c *WireGuardConfig) error {
+				if len(c.Peers) != 2 {
+					t.Errorf("expected 2 peers, got %d", len(c.Peers))
+				}
+				return nil
+			},
+		},
+		{
+			name: "config with comments and empty lines",
+			config: `# This is a comment
+[Interface]
+# Interface configuration
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+# Peer configuration
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0
+# End of config`,
+			expectError: false,
+			validate: func(c *WireGuardConfig) error {
+				if !slices.Equal(c.Interface.Address, []string{"10.0.0.2/24"}) {
+					t.Errorf("expected address 10.0.0.2/24, got %v", c.Interface.Address)
+				}
+				return nil
+			},
+		},
+		{
+			name: "missing private key",
+			config: `[Interface]
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: true,
+		},
+		{
+			name: "missing address",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: true,
+		},
+		{
+			name: "missing peer",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24`,
+			expectError: true,
+		},
+		{
+			name: "missing peer public key",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: true,
+		},
+		{
+			name: "missing peer allowed IPs",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820`,
+			expectError: true,
+		},
+		{
+			name: "invalid private key",
+			config: `[Interface]
+PrivateKey = invalid-key
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: true,
+		},
+		{
+			name: "invalid address format",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = invalid-address
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: true,
+		},
+		{
+			name: "invalid allowed IP format",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = invalid-ip`,
+			expectError: true,
+		},
+		{
+			name: "invalid listen port",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+ListenPort = invalid-port
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`,
+			expectError: true,
+		},
+		{
+			name: "invalid keepalive",
+			config: `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0
+PersistentKeepalive = invalid-keepalive`,
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create temporary config file
+			tempFile, err := os.CreateTemp("", "wg-test-*.conf")
+			if err != nil {
+				t.Fatalf("failed to create temp file: %v", err)
+			}
+			defer os.Remove(tempFile.Name())
+
+			if _, err := tempFile.WriteString(tt.config); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			tempFile.Close()
+
+			// Parse config
+			config, err := ParseConfig(tempFile.Name())
+
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if config == nil {
+				t.Error("config is nil")
+				return
+			}
+
+			// Run validation if provided
+			if tt.validate != nil {
+				if err := tt.validate(config); err != nil {
+					t.Errorf("validation failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigFileNotFound(t *testing.T) {
+	_, err := ParseConfig("/nonexistent/file.conf")
+	if err == nil {
+		t.Error("expected error for nonexistent file")
+	}
+}
+
+func TestGetInterfaceIP(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.0.0.2/24"},
+		},
+	}
+
+	ip, err := config.GetInterfaceIP()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	expected, _ := netip.ParseAddr("10.0.0.2")
+	if ip != expected {
+		t.Errorf("expected IP %v, got %v", expected, ip)
+	}
+}
+
+func TestGetInterfaceIPInvalid(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"invalid-address"},
+		},
+	}
+
+	_, err := config.GetInterfaceIP()
+	if err == nil {
+		t.Error("expected error for invalid address")
+	}
+}
+
+func TestGetInterfacePrefix(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.0.0.2/24"},
+		},
+	}
+
+	prefix, err := config.GetInterfacePrefix()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	expected, _ := netip.ParsePrefix("10.0.0.2/24")
+	if prefix != expected {
+		t.Errorf("expected prefix %v, got %v", expected, prefix)
+	}
+}
+
+func TestGetInterfaceIP_DualStack(t *testing.T) {
+	tests := []struct {
+		name     string
+		address  []string
+		ip       string
+		ipv4     string
+		ipv6     string
+		noIPv4   bool
+		noIPv6   bool
+		prefixOf string
+	}{
+		{"IPv4 first", []string{"10.0.0.2/24", "fd00::2/64"}, "10.0.0.2", "10.0.0.2", "fd00::2", false, false, "10.0.0.2/24"},
+		{"IPv6 first", []string{"fd00::2/64", "10.0.0.2/24"}, "10.0.0.2", "10.0.0.2", "fd00::2", false, false, "10.0.0.2/24"},
+		{"IPv6 only", []string{"fd00::2/64", "fd00::3/64"}, "fd00::2", "", "fd00::2", true, false, "fd00::2/64"},
+		{"IPv4 only", []string{"10.0.0.2/24"}, "10.0.0.2", "10.0.0.2", "", false, true, "10.0.0.2/24"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &WireGuardConfig{Interface: InterfaceConfig{Address: tt.address}}
+
+			if ip, err := config.GetInterfaceIP(); err != nil || ip.String() != tt.ip {
+				t.Errorf("GetInterfaceIP: expected %s, got %v, %v", tt.ip, ip, err)
+			}
+			if prefix, err := config.GetInterfacePrefix(); err != nil || prefix.String() != tt.prefixOf {
+				t.Errorf("GetInterfacePrefix: expected %s, got %v, %v", tt.prefixOf, prefix, err)
+			}
+
+			ipv4, err := config.GetInterfaceIPv4()
+			if tt.noIPv4 {
+				if err == nil {
+					t.Errorf("GetInterfaceIPv4: expected an error, got %v", ipv4)
+				}
+			} else if err != nil || ipv4.String() != tt.ipv4 {
+				t.Errorf("GetInterfaceIPv4: expected %s, got %v, %v", tt.ipv4, ipv4, err)
+			}
+
+			ipv6, err := config.GetInterfaceIPv6()
+			if tt.noIPv6 {
+				if err == nil {
+					t.Errorf("GetInterfaceIPv6: expected an error, got %v", ipv6)
+				}
+			} else if err != nil || ipv6.String() != tt.ipv6 {
+				t.Errorf("GetInterfaceIPv6: expected %s, got %v, %v", tt.ipv6, ipv6, err)
+			}
+		})
+	}
+
+	if _, err := (&WireGuardConfig{}).GetInterfaceIP(); err == nil {
+		t.Error("expected an error without an address")
+	}
+}
+
+func TestParseConfig_DualStackAddress(t *testing.T) {
+	config, err := ParseConfigReader(strings.NewReader(`[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24, fd00::2/64
+Address = 10.1.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKeyWithSeed(1) + `
+AllowedIPs = 10.0.0.0/24`))
+	if err != nil {
+		t.Fatalf("ParseConfigReader failed: %v", err)
+	}
+
+	expected := []string{"10.0.0.2/24", "fd00::2/64", "10.1.0.2/24"}
+	if !slices.Equal(config.Interface.Address, expected) {
+		t.Errorf("expected addresses %v, got %v", expected, config.Interface.Address)
+	}
+	if ipv6, err := config.GetInterfaceIPv6(); err != nil || ipv6.String() != "fd00::2" {
+		t.Errorf("expected IPv6 address fd00::2, got %v, %v", ipv6, err)
+	}
+
+	// Marshal writes the addresses back on one line
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !strings.Contains(string(data), "Address = 10.0.0.2/24, fd00::2/64, 10.1.0.2/24\n") {
+		t.Errorf("expected the addresses on one line:\n%s", data)
+	}
+
+	// Every address is validated
+	_, err = ParseConfigReader(strings.NewReader(`[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24, not-an-address
+
+[Peer]
+PublicKey = ` + generateTestKeyWithSeed(1) + `
+AllowedIPs = 10.0.0.0/24`))
+	if !errors.As(err, &ErrInvalidAddress{}) {
+		t.Errorf("expected an invalid address error for the second address, got %v", err)
+	}
+}
+
+func TestBase64ToHex(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expectError bool
+		expectedLen int
+	}{
+		{
+			name:        "valid key",
+			input:       generateTestKey(),
+			expectError: false,
+			expectedLen: 64, // 32 bytes = 64 hex chars
+		},
+		{
+			name:        "invalid base64",
+			input:       "invalid-base64!@#",
+			expectError: true,
+		},
+		{
+			name:        "wrong length",
+			input:       base64.StdEncoding.EncodeToString([]byte("short")),
+			expectError: true,
+		},
+		{
+			name:        "empty key",
+			input:       "",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := base64ToHex(tt.input)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if len(result) != tt.expectedLen {
+				t.Errorf("expected length %d, got %d", tt.expectedLen, len(result))
+			}
+		})
+	}
+}
+
+func TestResolveEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		endpoint    string
+		expectError bool
+	}{
+		{
+			name:        "IP endpoint",
+			endpoint:    "192.168.1.1:51820",
+			expectError: false,
+		},
+		{
+			name:        "localhost endpoint",
+			endpoint:    "localhost:51820",
+			expectError: false,
+		},
+		{
+			name:        "invalid format",
+			endpoint:    "invalid-endpoint",
+			expectError: true,
+		},
+		{
+			name:        "nonexistent hostname",
+			endpoint:    "nonexistent-hostname-12345.invalid:51820",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := resolveEndpoint(tt.endpoint)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if result == "" {
+				t.Error("expected non-empty result")
+			}
+		})
+	}
+}
+
+func TestParseInterfaceField(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         string
+		value       string
+		expectError bool
+		validate    func(*InterfaceConfig) error
+	}{
+		{
+			name:        "private key",
+			key:         "PrivateKey",
+			value:       generateTestKey(),
+			expectError: false,
+			validate: func(iface *InterfaceConfig) error {
+				if iface.PrivateKey == "" {
+					t.Error("private key not set")
+				}
+				return nil
+			},
+		},
+		{
+			name:        "address",
+			key:         "Address",
+			value:       "10.0.0.2/24",
+			expectError: false,
+			validate: func(iface *InterfaceConfig) error {
+				if !slices.Equal(iface.Address, []string{"10.0.0.2/24"}) {
+					t.Errorf("expected address 10.0.0.2/24, got %v", iface.Address)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "DNS",
+			key:         "DNS",
+			value:       "1.1.1.1, 8.8.8.8",
+			expectError: false,
+			validate: func(iface *InterfaceConfig) error {
+				if len(iface.DNS) != 2 {
+					t.Errorf("expected 2 DNS servers, got %d", len(iface.DNS))
+				}
+				return nil
+			},
+		},
+		{
+			name:        "listen port",
+			key:         "ListenPort",
+			value:       "51820",
+			expectError: false,
+			validate: func(iface *InterfaceConfig) error {
+				if iface.ListenPort != 51820 {
+					t.Errorf("expected listen port 51820, got %d", iface.ListenPort)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "post up",
+			key:         "PostUp",
+			value:       "echo up; touch /tmp/flag ;",
+			expectError: false,
+			validate: func(iface *InterfaceConfig) error {
+				expected := []string{"echo up", "touch /tmp/flag"}
+				if !reflect.DeepEqual(iface.PostUp, expected) {
+					t.Errorf("expected PostUp %v, got %v", expected, iface.PostUp)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "post down",
+			key:         "PostDown",
+			value:       "echo down",
+			expectError: false,
+			validate: func(iface *InterfaceConfig) error {
+				if len(iface.PostDown) != 1 || iface.PostDown[0] != "echo down" {
+					t.Errorf("expected PostDown [echo down], got %v", iface.PostDown)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "invalid private key",
+			key:         "PrivateKey",
+			value:       "invalid-key",
+			expectError: true,
+		},
+		{
+			name:        "invalid listen port",
+			key:         "ListenPort",
+			value:       "invalid-port",
+			expectError: true,
+		},
+		{
+			name:        "mtu",
+			key:         "MTU",
+			value:       "1280",
+			expectError: false,
+			validate: func(iface *InterfaceConfig) error {
+				if iface.MTU != 1280 {
+					t.Errorf("expected MTU 1280, got %d", iface.MTU)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "invalid mtu",
+			key:         "MTU",
+			value:       "jumbo",
+			expectError: true,
+		},
+		{
+			name:  "mtu too large",
+			key:   "MTU",
+			value: "9000",
+			validate: func(iface *InterfaceConfig) error {
+				if iface.MTU != maxTunnelMTU {
+					t.Errorf("expected MTU clamped to %d, got %d", maxTunnelMTU, iface.MTU)
+				}
+				return nil
+			},
+		},
+		{
+			name:  "mtu too small",
+			key:   "MTU",
+			value: "100",
+			validate: func(iface *InterfaceConfig) error {
+				if iface.MTU != minTunnelMTU {
+					t.Errorf("expected MTU clamped to %d, got %d", minTunnelMTU, iface.MTU)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iface := &InterfaceConfig{}
+			err := parseInterfaceField(iface, tt.key, tt.value)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if tt.validate != nil {
+				if err := tt.validate(iface); err != nil {
+					t.Errorf("validation failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePeerField(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         string
+		value       string
+		expectError bool
+		validate    func(*PeerConfig) error
+	}{
+		{
+			name:        "public key",
+			key:         "PublicKey",
+			value:       generateTestKey(),
+			expectError: false,
+			validate: func(peer *PeerConfig) error {
+				if peer.PublicKey == "" {
+					t.Error("public key not set")
+				}
+				return nil
+			},
+		},
+		{
+			name:        "preshared key",
+			key:         "PresharedKey",
+			value:       generateTestKey(),
+			expectError: false,
+			validate: func(peer *PeerConfig) error {
+				if peer.PresharedKey == "" {
+					t.Error("preshared key not set")
+				}
+				return nil
+			},
+		},
+		{
+			name:        "endpoint",
+			key:         "Endpoint",
+			value:       "192.168.1.1:51820",
+			expectError: false,
+			validate: func(peer *PeerConfig) error {
+				if peer.Endpoint != "192.168.1.1:51820" {
+					t.Errorf("expected endpoint 192.168.1.1:51820, got %s", peer.Endpoint)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "allowed IPs",
+			key:         "AllowedIPs",
+			value:       "0.0.0.0/0, 10.0.0.0/24",
+			expectError: false,
+			validate: func(peer *PeerConfig) error {
+				if len(peer.AllowedIPs) != 2 {
+					t.Errorf("expected 2 allowed IPs, got %d", len(peer.AllowedIPs))
+				}
+				return nil
+			},
+		},
+		{
+			name:        "persistent keepalive",
+			key:         "PersistentKeepalive",
+			value:       "25",
+			expectError: false,
+			validate: func(peer *PeerConfig) error {
+				if peer.PersistentKeepalive != 25 {
+					t.Errorf("expected keepalive 25, got %d", peer.PersistentKeepalive)
+				}
+				return nil
+			},
+		},
+		{
+			name:        "invalid public key",
+			key:         "PublicKey",
+			value:       "invalid-key",
+			expectError: true,
+		},
+		{
+			name:        "invalid endpoint",
+			key:         "Endpoint",
+			value:       "invalid-endpoint",
+			expectError: true,
+		},
+		{
+			name:        "invalid keepalive",
+			key:         "PersistentKeepalive",
+			value:       "invalid-keepalive",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := &PeerConfig{}
+			err := parsePeerField(peer, tt.key, tt.value)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+
+			if tt.validate != nil {
+				if err := tt.validate(peer); err != nil {
+					t.Errorf("validation failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      *WireGuardConfig
+		expectError bool
+	}{
+		{
+			name: "valid config",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					PrivateKey: generateTestKeyWithSeed(1),
+					Address:    []string{"10.0.0.2/24"},
+				},
+				Peers: []PeerConfig{
+					{
+						PublicKey:  generateTestKeyWithSeed(2),
+						AllowedIPs: []string{"0.0.0.0/0"},
+					},
+				},
+			},
+			expectError: false,
+		},
+		{
+			name: "missing private key",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					Address: []string{"10.0.0.2/24"},
+				},
+				Peers: []PeerConfig{
+					{
+						PublicKey:  generateTestKeyWithSeed(2),
+						AllowedIPs: []string{"0.0.0.0/0"},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "missing address",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					PrivateKey: generateTestKeyWithSeed(1),
+				},
+				Peers: []PeerConfig{
+					{
+						PublicKey:  generateTestKeyWithSeed(2),
+						AllowedIPs: []string{"0.0.0.0/0"},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "invalid address format",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					PrivateKey: generateTestKeyWithSeed(1),
+					Address:    []string{"invalid-address"},
+				},
+				Peers: []PeerConfig{
+					{
+						PublicKey:  generateTestKeyWithSeed(2),
+						AllowedIPs: []string{"0.0.0.0/0"},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "no peers",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					PrivateKey: generateTestKeyWithSeed(1),
+					Address:    []string{"10.0.0.2/24"},
+				},
+				Peers: []PeerConfig{},
+			},
+			expectError: true,
+		},
+		{
+			name: "peer missing public key",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					PrivateKey: generateTestKeyWithSeed(1),
+					Address:    []string{"10.0.0.2/24"},
+				},
+				Peers: []PeerConfig{
+					{
+						AllowedIPs: []string{"0.0.0.0/0"},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "peer missing allowed IPs",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					PrivateKey: generateTestKeyWithSeed(1),
+					Address:    []string{"10.0.0.2/24"},
+				},
+				Peers: []PeerConfig{
+					{
+						PublicKey: generateTestKeyWithSeed(2),
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "peer invalid allowed IP",
+			config: &WireGuardConfig{
+				Interface: InterfaceConfig{
+					PrivateKey: generateTestKeyWithSeed(1),
+					Address:    []string{"10.0.0.2/24"},
+				},
+				Peers: []PeerConfig{
+					{
+						PublicKey:  generateTestKeyWithSeed(2),
+						AllowedIPs: []string{"invalid-ip"},
+					},
+				},
+			},
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(tt.config)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+				}
+			} else {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateKeys(t *testing.T) {
+	zeroBase64 := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	onesBase64 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, 32))
+
+	tests := []struct {
+		name        string
+		key         string
+		errContains string
+	}{
+		{"valid base64", generateTestKeyWithSeed(1), ""},
+		{"valid hex", strings.Repeat("01", 32), ""},
+		{"valid uppercase hex", strings.Repeat("AB", 32), ""},
+		{"zero key hex", strings.Repeat("00", 32), "zero key"},
+		{"zero key base64", zeroBase64, "zero key"},
+		{"all-ones key hex", strings.Repeat("ff", 32), "all-ones key"},
+		{"all-ones key base64", onesBase64, "all-ones key"},
+		{"short hex", strings.Repeat("01", 16), "key must be 32 bytes"},
+		{"short base64", base64.StdEncoding.EncodeToString([]byte("short")), "key must be 32 bytes"},
+		{"odd length hex", "abc", "failed to decode hex key"},
+		{"invalid base64", "not a key!", "failed to decode base64 key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, validate := range map[string]func(string) error{
+				"ValidatePrivateKey": ValidatePrivateKey,
+				"ValidatePublicKey":  ValidatePublicKey,
+			} {
+				err := validate(tt.key)
+				if tt.errContains == "" {
+					if err != nil {
+						t.Errorf("%s: unexpected error: %v", name, err)
+					}
+					continue
+				}
+				if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+					t.Errorf("%s: expected error containing %q, got %v", name, tt.errContains, err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfig_RejectsZeroKeys(t *testing.T) {
+	zeroKey := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+zeroKey+`
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = `+zeroKey+`
+AllowedIPs = 10.0.0.0/24`)
+
+	_, err := ParseConfig(path)
+	if err == nil {
+		t.Fatal("expected error for zero keys")
+	}
+
+	for _, part := range []string{
+		"interface private key: zero key",
+		"peer 0: public key: zero key",
+	} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("error %q should mention %q", err.Error(), part)
+		}
+	}
+}
+
+func TestWireGuardConfig_MarshalRoundTrip(t *testing.T) {
+	original := `[Interface]
+PrivateKey = ` + generateTestKeyWithSeed(1) + `
+Address = 10.0.0.2/24
+DNS = 1.1.1.1, 8.8.8.8
+ListenPort = 51820
+
+[Peer]
+PublicKey = ` + generateTestKeyWithSeed(2) + `
+PresharedKey = ` + generateTestKeyWithSeed(3) + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 10.0.0.0/24, 10.1.0.0/24
+PersistentKeepalive = 25
+Route = 192.168.0.0/16
+Route = 172.16.0.0/12:tcp:443
+
+[Peer]
+PublicKey = ` + generateTestKeyWithSeed(4) + `
+Endpoint = 192.168.1.2:51820
+AllowedIPs = 10.2.0.0/24
+Route = 10.3.0.0/16:udp
+`
+
+	path := writeTempConfig(t, original)
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	if string(data) != original {
+		t.Errorf("marshaled config does not match original.\ngot:\n%s\nwant:\n%s", data, original)
+	}
+
+	reparsed, err := ParseConfig(writeTempConfig(t, string(data)))
+	if err != nil {
+		t.Fatalf("ParseConfig of marshaled output failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(config, reparsed) {
+		t.Errorf("round-tripped config differs:\noriginal: %+v\nreparsed: %+v", config, reparsed)
+	}
+}
+
+func TestWireGuardConfig_MarshalSortsPeers(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			PrivateKey: strings.Repeat("01", 32),
+			Address:    []string{"10.0.0.2/24"},
+		},
+		Peers: []PeerConfig{
+			{PublicKey: strings.Repeat("ff", 32), AllowedIPs: []string{"10.0.2.0/24"}},
+			{PublicKey: strings.Repeat("0a", 32), AllowedIPs: []string{"10.0.1.0/24"}},
+		},
+	}
+
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	output := string(data)
+	first := strings.Index(output, "10.0.1.0/24")
+	second := strings.Index(output, "10.0.2.0/24")
+	if first < 0 || second < 0 || first > second {
+		t.Errorf("expected peers sorted by public key, got:\n%s", output)
+	}
+
+	if !strings.HasPrefix(output, "[Interface]\n") {
+		t.Errorf("expected [Interface] section first, got:\n%s", output)
+	}
+}
+
+func TestWireGuardConfig_MarshalInvalidKey(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			PrivateKey: "not-hex",
+			Address:    []string{"10.0.0.2/24"},
+		},
+	}
+
+	if _, err := config.Marshal(); err == nil {
+		t.Error("expected error for invalid private key")
+	}
+}
+
+func TestHexToBase64(t *testing.T) {
+	key := generateTestKey()
+	hexKey, err := base64ToHex(key)
+	if err != nil {
+		t.Fatalf("base64ToHex failed: %v", err)
+	}
+
+	result, err := hexToBase64(hexKey)
+	if err != nil {
+		t.Fatalf("hexToBase64 failed: %v", err)
+	}
+
+	if result != key {
+		t.Errorf("hexToBase64(%s) = %s, want %s", hexKey, result, key)
+	}
+
+	if _, err := hexToBase64("abcd"); err == nil {
+		t.Error("expected error for short key")
+	}
+
+	if _, err := hexToBase64("zz"); err == nil {
+		t.Error("expected error for invalid hex")
+	}
+}
+
+func TestParseConfigs(t *testing.T) {
+	dir := t.TempDir()
+
+	base := dir + "/base.conf"
+	os.WriteFile(base, []byte(`[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 10.0.0.0/24`), 0600)
+
+	prod := dir + "/prod-peers.conf"
+	os.WriteFile(prod, []byte(`[Peer]
+PublicKey = `+generateTestKeyWithSeed(3)+`
+Endpoint = 192.168.1.2:51820
+AllowedIPs = 10.1.0.0/24`), 0600)
+
+	staging := dir + "/staging-peers.conf"
+	os.WriteFile(staging, []byte(`[Peer]
+PublicKey = `+generateTestKeyWithSeed(4)+`
+Endpoint = 192.168.1.3:51820
+AllowedIPs = 10.2.0.0/24`), 0600)
+
+	config, err := ParseConfigs([]string{base, prod, staging})
+	if err != nil {
+		t.Fatalf("ParseConfigs failed: %v", err)
+	}
+
+	if !slices.Equal(config.Interface.Address, []string{"10.0.0.2/24"}) {
+		t.Errorf("expected interface from first file, got address %v", config.Interface.Address)
+	}
+
+	if len(config.Peers) != 3 {
+		t.Fatalf("expected 3 peers, got %d", len(config.Peers))
+	}
+
+	expectedIPs := []string{"10.0.0.0/24", "10.1.0.0/24", "10.2.0.0/24"}
+	for i, expected := range expectedIPs {
+		if config.Peers[i].AllowedIPs[0] != expected {
+			t.Errorf("peer %d: expected AllowedIPs %s, got %v", i, expected, config.Peers[i].AllowedIPs)
+		}
+	}
+}
+
+func TestParseConfigs_InterfaceInLaterFile(t *testing.T) {
+	first := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24`)
+
+	second := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(3)+`
+Address = 10.1.0.2/24`)
+
+	_, err := ParseConfigs([]string{first, second})
+	if err == nil {
+		t.Fatal("expected error when a later file contains an [Interface] section")
+	}
+
+	if !strings.Contains(err.Error(), "[Interface]") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestParseConfig_WrapGuardSection(t *testing.T) {
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+ListenPort = 51820
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 10.0.0.0/24
+
+[wrapguard]
+loglevel = debug
+LogFile = /var/log/wrapguard.log
+MetricsAddr = 127.0.0.1:9100
+ExitNode = 10.0.0.3
+OnConnected = ./register.sh
+OnDisconnected = ./deregister.sh
+`)
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	if config.Interface.PrivateKey == "" || config.Interface.ListenPort != 51820 {
+		t.Errorf("expected the interface, got %+v", config.Interface)
+	}
+	if len(config.Peers) != 1 || config.Peers[0].Endpoint != "192.168.1.1:51820" {
+		t.Errorf("expected the peer, got %+v", config.Peers)
+	}
+	expected := WrapGuardConfig{
+		LogLevel:       "debug",
+		LogFile:        "/var/log/wrapguard.log",
+		MetricsAddr:    "127.0.0.1:9100",
+		ExitNode:       "10.0.0.3",
+		OnConnected:    "./register.sh",
+		OnDisconnected: "./deregister.sh",
+	}
+	if config.WrapGuard != expected {
+		t.Errorf("expected %+v, got %+v", expected, config.WrapGuard)
+	}
+	if got := ReadWrapGuardConfig(path); got != expected {
+		t.Errorf("ReadWrapGuardConfig: expected %+v, got %+v", expected, got)
+	}
+	if settings := config.WrapGuard.Settings(); settings.LogLevel != "debug" || settings.ExitNode != "10.0.0.3" || settings.MetricsAddr != "127.0.0.1:9100" {
+		t.Errorf("unexpected settings %+v", settings)
+	}
+
+	// Marshal writes the section back with the canonical key names
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if !strings.Contains(string(data), "\n[WrapGuard]\nLogLevel = debug\nLogFile = /var/log/wrapguard.log\n") {
+		t.Errorf("expected a [WrapGuard] section, got:\n%s", data)
+	}
+	reparsed, err := ParseConfig(writeTempConfig(t, string(data)))
+	if err != nil {
+		t.Fatalf("ParseConfig of marshaled output failed: %v", err)
+	}
+	if reparsed.WrapGuard != expected {
+		t.Errorf("round-tripped section differs: %+v", reparsed.WrapGuard)
+	}
+}
+
+func TestParseConfig_WrapGuardSectionErrors(t *testing.T) {
+	_, err := ParseConfig(writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24
+
+[WrapGuard]
+LogLevel = debug
+ListenPort = 51820
+`))
+	if err == nil || !strings.Contains(err.Error(), "line 11: error parsing wrapguard field ListenPort: unknown option") {
+		t.Errorf("expected an error for an unknown key, got %v", err)
+	}
+
+	// Only the first file of a tunnel may set wrapguard's options
+	first := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24`)
+	second := writeTempConfig(t, `[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24
+
+[WrapGuard]
+LogLevel = debug`)
+	if _, err := ParseConfigs([]string{first, second}); err == nil || !strings.Contains(err.Error(), "[WrapGuard]") {
+		t.Errorf("expected an error for a [WrapGuard] section in a later file, got %v", err)
+	}
+
+	if got := ReadWrapGuardConfig(filepath.Join(t.TempDir(), "missing.conf")); got != (WrapGuardConfig{}) {
+		t.Errorf("expected an empty section for a missing file, got %+v", got)
+	}
+}
+
+func TestParseConfigs_DuplicatePeerWarning(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelWarn, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	first := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24`)
+
+	second := writeTempConfig(t, `[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.1.0.0/24`)
+
+	config, err := ParseConfigs([]string{first, second})
+	if err != nil {
+		t.Fatalf("duplicate peer should not be an error: %v", err)
+	}
+
+	if len(config.Peers) != 2 {
+		t.Errorf("expected 2 peers, got %d", len(config.Peers))
+	}
+
+	if !strings.Contains(buf.String(), "Duplicate peer public key") {
+		t.Errorf("expected duplicate peer warning, got %q", buf.String())
+	}
+}
+
+func TestParseConfigs_NoFiles(t *testing.T) {
+	if _, err := ParseConfigs(nil); err == nil {
+		t.Error("expected error for empty file list")
+	}
+}
+
+func TestParseTunnelConfigs(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelDebug, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	corp := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+Table = off
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24`)
+
+	corpPeers := writeTempConfig(t, `[Peer]
+PublicKey = `+generateTestKeyWithSeed(3)+`
+AllowedIPs = 10.1.0.0/24`)
+
+	vpn := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(4)+`
+Address = 10.9.0.2/24
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(5)+`
+AllowedIPs = 0.0.0.0/0`)
+
+	configs, err := ParseTunnelConfigs([]string{corp, corpPeers, vpn})
+	if err != nil {
+		t.Fatalf("ParseTunnelConfigs failed: %v", err)
+	}
+
+	if len(configs) != 2 {
+		t.Fatalf("expected 2 tunnel configs, got %d", len(configs))
+	}
+
+	if !slices.Equal(configs[0].Interface.Address, []string{"10.0.0.2/24"}) || len(configs[0].Peers) != 2 {
+		t.Errorf("first tunnel should have the corp interface and both corp peers, got %s with %d peers",
+			configs[0].Interface.Address, len(configs[0].Peers))
+	}
+
+	if !slices.Equal(configs[1].Interface.Address, []string{"10.9.0.2/24"}) || len(configs[1].Peers) != 1 {
+		t.Errorf("second tunnel should have the vpn interface and one peer, got %s with %d peers",
+			configs[1].Interface.Address, len(configs[1].Peers))
+	}
+
+	// Each file is parsed once, not again when its tunnel is assembled
+	if count := strings.Count(buf.String(), `ignoring unsupported directive Table"`); count != 1 {
+		t.Errorf("expected one debug line for Table, got %d in:\n%s", count, buf.String())
+	}
+
+	// A single file still gives a single tunnel
+	configs, err = ParseTunnelConfigs([]string{corp})
+	if err != nil || len(configs) != 1 {
+		t.Errorf("expected 1 tunnel config, got %d (%v)", len(configs), err)
+	}
+}
+
+func TestParseTunnelConfigs_Errors(t *testing.T) {
+	if _, err := ParseTunnelConfigs(nil); err == nil {
+		t.Error("expected error for empty file list")
+	}
+
+	peersOnly := writeTempConfig(t, `[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24`)
+
+	if _, err := ParseTunnelConfigs([]string{peersOnly}); err == nil || !strings.Contains(err.Error(), "interface private key is required") {
+		t.Errorf("expected missing interface error, got %v", err)
+	}
+
+	if _, err := ParseTunnelConfigs([]string{"/nonexistent/file.conf"}); err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	var files []string
+	for i := 0; i <= maxTunnels; i++ {
+		files = append(files, writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(byte(2*i+1))+`
+Address = 10.0.`+itoa(i)+`.2/24
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(byte(2*i+2))+`
+AllowedIPs = 10.0.`+itoa(i)+`.0/24`))
+	}
+
+	if _, err := ParseTunnelConfigs(files); err == nil || !strings.Contains(err.Error(), "too many tunnels") {
+		t.Errorf("expected too many tunnels error, got %v", err)
+	}
+
+	if configs, err := ParseTunnelConfigs(files[:maxTunnels]); err != nil || len(configs) != maxTunnels {
+		t.Errorf("expected %d tunnels to be accepted, got %d (%v)", maxTunnels, len(configs), err)
+	}
+}
+
+func TestValidateConfig_OverlappingAllowedIPs(t *testing.T) {
+	newConfig := func() *WireGuardConfig {
+		return &WireGuardConfig{
+			Interface: InterfaceConfig{
+				PrivateKey: generateTestKeyWithSeed(1),
+				Address:    []string{"10.0.0.2/24"},
+			},
+			Peers: []PeerConfig{
+				{PublicKey: generateTestKeyWithSeed(2), AllowedIPs: []string{"0.0.0.0/0"}},
+				{PublicKey: generateTestKeyWithSeed(3), AllowedIPs: []string{"10.1.0.0/24", "192.168.0.0/16"}},
+			},
+		}
+	}
+
+	err := validateConfig(newConfig())
+	if err == nil {
+		t.Fatal("expected error for overlapping allowed IPs")
+	}
+
+	for _, part := range []string{"peer 0 0.0.0.0/0", "peer 1 10.1.0.0/24", "peer 1 192.168.0.0/16"} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("error %q should mention %q", err.Error(), part)
+		}
+	}
+
+	// With overlapping routes allowed, the overlap is only a warning
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelWarn, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	if err := (ConfigOptions{AllowOverlappingRoutes: true}).validate(newConfig()); err != nil {
+		t.Errorf("expected no error with overlapping routes allowed, got %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "Overlapping allowed IPs") {
+		t.Errorf("expected overlap warning, got %q", buf.String())
+	}
+}
+
+func TestFindAllowedIPOverlaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		peers    []PeerConfig
+		expected int
+	}{
+		{
+			name: "disjoint peers",
+			peers: []PeerConfig{
+				{AllowedIPs: []string{"10.0.0.0/24"}},
+				{AllowedIPs: []string{"10.0.1.0/24"}},
+			},
+			expected: 0,
+		},
+		{
+			name: "identical default routes",
+			peers: []PeerConfig{
+				{AllowedIPs: []string{"0.0.0.0/0"}},
+				{AllowedIPs: []string{"0.0.0.0/0"}},
+			},
+			expected: 1,
+		},
+		{
+			name: "overlap within a single peer is allowed",
+			peers: []PeerConfig{
+				{AllowedIPs: []string{"10.0.0.0/8", "10.1.0.0/16"}},
+			},
+			expected: 0,
+		},
+		{
+			name: "unmasked prefix",
+			peers: []PeerConfig{
+				{AllowedIPs: []string{"10.0.0.5/24"}},
+				{AllowedIPs: []string{"10.0.0.128/25"}},
+			},
+			expected: 1,
+		},
+		{
+			name: "IPv4 and IPv6 do not overlap",
+			peers: []PeerConfig{
+				{AllowedIPs: []string{"0.0.0.0/0"}},
+				{AllowedIPs: []string{"::/0"}},
+			},
+			expected: 0,
+		},
+		{
+			name: "three peers",
+			peers: []PeerConfig{
+				{AllowedIPs: []string{"10.0.0.0/8"}},
+				{AllowedIPs: []string{"10.1.0.0/16"}},
+				{AllowedIPs: []string{"10.2.0.0/16"}},
+			},
+			expected: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			overlaps := findAllowedIPOverlaps(tt.peers)
+			if len(overlaps) != tt.expected {
+				t.Errorf("expected %d overlaps, got %d: %v", tt.expected, len(overlaps), overlaps)
+			}
+		})
+	}
+}
+
+func TestParseConfig_ReportsAllErrors(t *testing.T) {
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+ListenPort = not-a-port
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24
+PersistentKeepalive = soon
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(3)+`
+AllowedIPs = not-a-cidr`)
+
+	_, err := ParseConfig(path)
+	if err == nil {
+		t.Fatal("expected error for config with multiple problems")
+	}
+
+	for _, part := range []string{
+		"line 4: error parsing interface field ListenPort",
+		"line 9: error parsing peer field PersistentKeepalive",
+		"peer 1: invalid allowed IP format not-a-cidr",
+	} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("error %q should mention %q", err.Error(), part)
+		}
+	}
+
+	var configErrs ConfigErrors
+	if !errors.As(err, &configErrs) {
+		t.Fatalf("expected ConfigErrors, got %T", err)
+	}
+	if len(configErrs) != 3 {
+		t.Errorf("expected 3 errors, got %d: %v", len(configErrs), configErrs)
+	}
+}
+
+func TestValidateConfig_AccumulatesErrors(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"invalid-address"},
+		},
+		Peers: []PeerConfig{
+			{AllowedIPs: []string{"10.0.0.0/24"}},
+			{PublicKey: "test-public-key"},
+		},
+	}
+
+	err := validateConfig(config)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	for _, part := range []string{
+		"interface private key is required",
+		"invalid interface address format",
+		"peer 0: public key is required",
+		"peer 1: at least one allowed IP is required",
+	} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("error %q should mention %q", err.Error(), part)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	if err := newConfigErrors(nil, nil); err != nil {
+		t.Errorf("expected nil for no errors, got %v", err)
+	}
+
+	single := newConfigErrors(errors.New("only problem"))
+	if single.Error() != "only problem" {
+		t.Errorf("single error should be reported as-is, got %q", single.Error())
+	}
+
+	sentinel := errors.New("second problem")
+	err := newConfigErrors(errors.Join(errors.New("first problem"), sentinel), errors.New("third problem"))
+
+	expected := "3 config errors:\n  - first problem\n  - second problem\n  - third problem"
+	if err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+
+	if !errors.Is(err, sentinel) {
+		t.Error("errors.Is should match a collected error")
+	}
+}
+
+func TestParseConfig_MultiplePostUpLines(t *testing.T) {
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+PostUp = echo one; echo two
+PostUp = echo three
+PostDown = echo down
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+AllowedIPs = 10.0.0.0/24`)
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	expected := []string{"echo one", "echo two", "echo three"}
+	if !reflect.DeepEqual(config.Interface.PostUp, expected) {
+		t.Errorf("expected PostUp %v, got %v", expected, config.Interface.PostUp)
+	}
+
+	if !reflect.DeepEqual(config.Interface.PostDown, []string{"echo down"}) {
+		t.Errorf("unexpected PostDown: %v", config.Interface.PostDown)
+	}
+}
+
+func TestParseConfig_WgQuickDirectives(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelDebug, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	// A config written for wg-quick, using every directive it understands
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.0.0.2/24
+DNS = 1.1.1.1
+ListenPort = 51820
+MTU = 1420
+Table = off
+FwMark = 0x1234
+SaveConfig = false
+PreUp = echo pre-up
+PostUp = echo post-up
+PreDown = echo pre-down; echo pre-down again
+PostDown = echo post-down
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 10.0.0.0/24
+PersistentKeepalive = 25`)
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	iface := config.Interface
+	if iface.MTU != 1420 {
+		t.Errorf("expected MTU 1420, got %d", iface.MTU)
+	}
+	if iface.Table != "off" {
+		t.Errorf("expected Table off, got %q", iface.Table)
+	}
+	if !reflect.DeepEqual(iface.PreUp, []string{"echo pre-up"}) {
+		t.Errorf("unexpected PreUp: %v", iface.PreUp)
+	}
+	if !reflect.DeepEqual(iface.PreDown, []string{"echo pre-down", "echo pre-down again"}) {
+		t.Errorf("unexpected PreDown: %v", iface.PreDown)
+	}
+	if !reflect.DeepEqual(iface.PostUp, []string{"echo post-up"}) || !reflect.DeepEqual(iface.PostDown, []string{"echo post-down"}) {
+		t.Errorf("unexpected PostUp/PostDown: %v %v", iface.PostUp, iface.PostDown)
+	}
+
+	for _, name := range []string{"Table", "PreUp", "PreDown"} {
+		if count := strings.Count(buf.String(), "ignoring unsupported directive "+name+`"`); count != 1 {
+			t.Errorf("expected one debug line for %s, got %d in:\n%s", name, count, buf.String())
+		}
+	}
+
+	// The directives survive a Marshal round trip
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	reparsed, err := ParseConfig(writeTempConfig(t, string(data)))
+	if err != nil {
+		t.Fatalf("ParseConfig of marshaled output failed: %v", err)
+	}
+	if !reflect.DeepEqual(config.Interface, reparsed.Interface) {
+		t.Errorf("round-tripped interface differs:\noriginal: %+v\nreparsed: %+v", config.Interface, reparsed.Interface)
+	}
+}
+
+func TestParsePeerField_EndpointHostname(t *testing.T) {
+	peer := &PeerConfig{}
+	if err := parsePeerField(peer, "Endpoint", "localhost:51820"); err != nil {
+		t.Fatalf("parsePeerField failed: %v", err)
+	}
+
+	if peer.OriginalHostname != "localhost:51820" {
+		t.Errorf("expected OriginalHostname localhost:51820, got %q", peer.OriginalHostname)
+	}
+	if peer.ResolvedAt.IsZero() {
+		t.Error("ResolvedAt should be set for hostname endpoints")
+	}
+	if host, _, _ := net.SplitHostPort(peer.Endpoint); net.ParseIP(host) == nil {
+		t.Errorf("expected resolved IP endpoint, got %s", peer.Endpoint)
+	}
+
+	// IP endpoints have nothing to re-resolve
+	peer = &PeerConfig{}
+	parsePeerField(peer, "Endpoint", "192.0.2.1:51820")
+	if peer.OriginalHostname != "" || !peer.ResolvedAt.IsZero() {
+		t.Errorf("IP endpoint should not record a hostname: %+v", peer)
+	}
+}
+
+func TestMarshal_PrefersOriginalHostname(t *testing.T) {
+	config := &WireGuardConfig{
+		Peers: []PeerConfig{{
+			Endpoint:         "127.0.0.1:51820",
+			OriginalHostname: "vpn.example.com:51820",
+		}},
+	}
+
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	if !strings.Contains(string(data), "Endpoint = vpn.example.com:51820") {
+		t.Errorf("expected hostname endpoint, got:\n%s", data)
+	}
+}
+
+func TestParseConfigTemplate(t *testing.T) {
+	privateKey := generateTestKeyWithSeed(1)
+	t.Setenv("WG_PRIVATE_KEY", privateKey)
+	t.Setenv("WG_ADDRESS", "10.0.0.2/24")
+
+	path := filepath.Join(t.TempDir(), "wg0.conf.tmpl")
+	content := `[Interface]
+PrivateKey = ${WG_PRIVATE_KEY}
+Address = $WG_ADDRESS
+
+[Peer]
+PublicKey = ` + generateTestKeyWithSeed(2) + `
+AllowedIPs = 10.0.0.0/24`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+
+	config, err := ParseConfigTemplate(path)
+	if err != nil {
+		t.Fatalf("ParseConfigTemplate failed: %v", err)
+	}
+
+	expectedKey, _ := base64ToHex(privateKey)
+	if config.Interface.PrivateKey != expectedKey {
+		t.Errorf("expected private key %s, got %s", expectedKey, config.Interface.PrivateKey)
+	}
+	if !slices.Equal(config.Interface.Address, []string{"10.0.0.2/24"}) {
+		t.Errorf("expected address 10.0.0.2/24, got %v", config.Interface.Address)
+	}
+
+	// Templates passed to ParseConfigs are expanded too
+	config, err = ParseConfigs([]string{path})
+	if err != nil {
+		t.Fatalf("ParseConfigs failed for template: %v", err)
+	}
+	if config.Interface.PrivateKey != expectedKey {
+		t.Errorf("ParseConfigs did not expand the template")
+	}
+}
+
+func TestParseConfigTemplate_UndefinedVariable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.conf.tmpl")
+	content := `[Interface]
+PrivateKey = ${WRAPGUARD_TEST_UNSET_KEY}
+Address = 10.0.0.2/24`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+
+	_, err := ParseConfigTemplate(path)
+	if err == nil {
+		t.Fatal("expected error for undefined variable")
+	}
+	if !strings.Contains(err.Error(), "WRAPGUARD_TEST_UNSET_KEY") {
+		t.Errorf("error should name the undefined variable: %v", err)
+	}
+
+	if _, err := ParseConfigTemplate(filepath.Join(t.TempDir(), "missing.tmpl")); err == nil {
+		t.Error("expected error for missing template file")
+	}
+}
+
+func TestParseConfigs_NoEnvExpand(t *testing.T) {
+	t.Setenv("WG_PRIVATE_KEY", generateTestKeyWithSeed(1))
+
+	path := filepath.Join(t.TempDir(), "wg0.conf.tmpl")
+	content := `[Interface]
+PrivateKey = ${WG_PRIVATE_KEY}
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKeyWithSeed(2) + `
+AllowedIPs = 10.0.0.0/24`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write template: %v", err)
+	}
+
+	// The literal ${WG_PRIVATE_KEY} is not a valid key
+	_, err := ConfigOptions{NoEnvExpand: true}.ParseConfigs([]string{path})
+	if err == nil || !strings.Contains(err.Error(), "invalid private key format") {
+		t.Errorf("expected the unexpanded key to be rejected, got %v", err)
+	}
+}
+
+// Helper function to write config content to a temporary file
+func writeTempConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	file, err := os.CreateTemp(t.TempDir(), "wg-test-*.conf")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	file.Close()
+
+	path := file.Name()
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+// Helper function to generate a distinct test WireGuard key from a seed
+func generateTestKeyWithSeed(seed byte) string {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i) + seed
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// testConfig describes a config for newTestConfig. The zero value is an
+// interface at 10.150.0.2/24 with one peer routing 10.150.0.0/24.
+type testConfig struct {
+	seed       byte   // Seed of the interface key, 1 if zero
+	address    string // Interface address, 10.150.0.2/24 if empty
+	listenPort int
+	peers      []testPeer // A single peer routing 10.150.0.0/24 if empty
+}
+
+// testPeer describes the [Peer] section at index i of a testConfig
+type testPeer struct {
+	publicKey           string // The key of seed+1+i if empty
+	endpoint            string // 127.0.0.1:51820+i if empty
+	allowedIPs          string
+	persistentKeepalive int
+}
+
+// newTestConfig parses the config described by opts
+func newTestConfig(t *testing.T, opts testConfig) *WireGuardConfig {
+	t.Helper()
+
+	seed := cmp.Or(opts.seed, 1)
+	peers := opts.peers
+	if len(peers) == 0 {
+		peers = []testPeer{{allowedIPs: "10.150.0.0/24"}}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\nAddress = %s\n", generateTestKeyWithSeed(seed), cmp.Or(opts.address, "10.150.0.2/24"))
+	if opts.listenPort != 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", opts.listenPort)
+	}
+	for i, peer := range peers {
+		fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\nEndpoint = %s\nAllowedIPs = %s\n",
+			cmp.Or(peer.publicKey, generateTestKeyWithSeed(seed+1+byte(i))),
+			cmp.Or(peer.endpoint, fmt.Sprintf("127.0.0.1:%d", 51820+i)),
+			peer.allowedIPs)
+		if peer.persistentKeepalive != 0 {
+			fmt.Fprintf(&b, "PersistentKeepalive = %d\n", peer.persistentKeepalive)
+		}
+	}
+
+	config, err := ParseConfigReader(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	return config
+}
+
+// Helper function to generate a test WireGuard key
+func generateTestKey() string {
+	// Generate 32 random bytes and encode as base64
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Benchmark tests for performance
+func BenchmarkParseConfig(b *testing.B) {
+	config := `[Interface]
+PrivateKey = ` + generateTestKey() + `
+Address = 10.0.0.2/24
+
+[Peer]
+PublicKey = ` + generateTestKey() + `
+Endpoint = 192.168.1.1:51820
+AllowedIPs = 0.0.0.0/0`
+
+	tempFile, err := os.CreateTemp("", "wg-bench-*.conf")
+	if err != nil {
+		b.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.WriteString(config); err != nil {
+		b.Fatalf("failed to write config: %v", err)
+	}
+	tempFile.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ParseConfig(tempFile.Name())
+		if err != nil {
+			b.Fatalf("parse error: %v", err)
+		}
+	}
+}
+
+func BenchmarkBase64ToHex(b *testing.B) {
+	key := generateTestKey()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := base64ToHex(key)
+		if err != nil {
+			b.Fatalf("conversion error: %v", err)
+		}
+	}
+}
+
+func TestSplitInlineComment(t *testing.T) {
+	tests := []struct {
+		line, value, comment string
+	}{
+		{"Address = 10.0.0.2/24", "Address = 10.0.0.2/24", ""},
+		{"Address = 10.0.0.2/24 # office", "Address = 10.0.0.2/24", "# office"},
+		{"[Peer]\t# exit node", "[Peer]", "# exit node"},
+		{"PostUp = echo $# args # count", "PostUp = echo $# args", "# count"},
+		{"PostUp = echo a#b", "PostUp = echo a#b", ""},
+	}
+
+	for _, tt := range tests {
+		value, comment := splitInlineComment(tt.line)
+		if value != tt.value || comment != tt.comment {
+			t.Errorf("splitInlineComment(%q) = %q, %q; expected %q, %q", tt.line, value, comment, tt.value, tt.comment)
+		}
+	}
+}
+
+func TestParseConfig_Comments(t *testing.T) {
+	config, err := ParseConfigReader(strings.NewReader(`# wg0 for the office
+# managed by ops
+[Interface]
+PrivateKey = ` + generateTestKeyWithSeed(1) + `
+address = 10.0.0.2/24 # our address
+PostUp = echo one
+# second hook
+PostUp = echo two
+
+[Peer] # exit node
+PublicKey = ` + generateTestKeyWithSeed(2) + `
+AllowedIPs = 0.0.0.0/0
+# trailing note`))
+	if err != nil {
+		t.Fatalf("ParseConfigReader failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"Interface":           "# wg0 for the office\n# managed by ops",
+		"Interface.Address#":  "# our address",
+		"Interface.PostUp[1]": "# second hook",
+		"Peer.0#":             "# exit node",
+		"End":                 "# trailing note",
+	}
+	if !reflect.DeepEqual(config.Comments, expected) {
+		t.Errorf("expected comments %v, got %v", expected, config.Comments)
+	}
+
+	// The inline comment is not part of the value
+	if !slices.Equal(config.Interface.Address, []string{"10.0.0.2/24"}) {
+		t.Errorf("expected address without its comment, got %v", config.Interface.Address)
+	}
+
+	// A config without comments has no map
+	plain := newTestConfig(t, testConfig{})
+	if plain.Comments != nil {
+		t.Errorf("expected no comments, got %v", plain.Comments)
+	}
+}
+
+func TestWireGuardConfig_MarshalComments(t *testing.T) {
+	keyA, keyB := generateTestKeyWithSeed(2), generateTestKeyWithSeed(3)
+	if keyA > keyB {
+		keyA, keyB = keyB, keyA
+	}
+
+	// Peers are written in the opposite order, so Marshal sorts them
+	input := `# wg0 for the office
+[Interface]
+PrivateKey = ` + generateTestKeyWithSeed(1) + `
+# where we live
+Address = 10.0.0.2/24 # our address
+MTU = 1280 # smaller for the office link
+
+# second peer in the file
+[Peer]
+PublicKey = ` + keyB + ` # backup
+AllowedIPs = 10.0.2.0/24
+
+[Peer]
+PublicKey = ` + keyA + `
+# office network
+AllowedIPs = 10.0.1.0/24
+# end of file`
+
+	config, err := ParseConfigReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseConfigReader failed: %v", err)
+	}
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	expected := `# wg0 for the office
+[Interface]
+PrivateKey = ` + generateTestKeyWithSeed(1) + `
+# where we live
+Address = 10.0.0.2/24 # our address
+MTU = 1280 # smaller for the office link
+
+[Peer]
+PublicKey = ` + keyA + `
+# office network
+AllowedIPs = 10.0.1.0/24
+
+# second peer in the file
+[Peer]
+PublicKey = ` + keyB + ` # backup
+AllowedIPs = 10.0.2.0/24
+# end of file
+`
+	if string(data) != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", data, expected)
+	}
+
+	// The output parses back to the same config and comments
+	again, err := ParseConfigReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("marshalled config does not parse: %v", err)
+	}
+	if again.Comments["Peer.0.AllowedIPs"] != "# office network" || again.Comments["End"] != "# end of file" {
+		t.Errorf("comments did not survive a second round trip: %v", again.Comments)
+	}
+}
@@ -0,0 +1,134 @@
+package wrapguard
+
+import (
+	"reflect"
+	"slices"
+)
+
+// PeerDiff pairs the old and new config of a peer whose settings changed
+type PeerDiff struct {
+	OldPeer PeerConfig
+	NewPeer PeerConfig
+}
+
+// ConfigDiff is what changed between two configs. Peers are matched by
+// public key.
+type ConfigDiff struct {
+	PeersAdded       []PeerConfig
+	PeersRemoved     []PeerConfig
+	PeersModified    []PeerDiff
+	InterfaceChanged bool
+}
+
+// Empty reports whether the configs were equivalent
+func (d ConfigDiff) Empty() bool {
+	return len(d.PeersAdded) == 0 && len(d.PeersRemoved) == 0 && len(d.PeersModified) == 0 && !d.InterfaceChanged
+}
+
+// DiffConfigs compares the config in use with a reloaded one. Endpoints are
+// compared as written in the config, so re-resolving a hostname does not
+// count as a change.
+func DiffConfigs(old, new *WireGuardConfig) ConfigDiff {
+	var diff ConfigDiff
+	diff.InterfaceChanged = len(interfaceChanges(old.Interface, new.Interface)) > 0
+
+	oldPeers := make(map[string]PeerConfig, len(old.Peers))
+	for _, peer := range old.Peers {
+		oldPeers[peer.PublicKey] = peer
+	}
+
+	seen := make(map[string]bool, len(new.Peers))
+	for _, peer := range new.Peers {
+		seen[peer.PublicKey] = true
+		oldPeer, ok := oldPeers[peer.PublicKey]
+		switch {
+		case !ok:
+			diff.PeersAdded = append(diff.PeersAdded, peer)
+		case len(peerChanges(oldPeer, peer)) > 0:
+			diff.PeersModified = append(diff.PeersModified, PeerDiff{OldPeer: oldPeer, NewPeer: peer})
+		}
+	}
+
+	for _, peer := range old.Peers {
+		if !seen[peer.PublicKey] {
+			diff.PeersRemoved = append(diff.PeersRemoved, peer)
+		}
+	}
+
+	return diff
+}
+
+// LogConfigDiff logs a config reload at INFO level. Only the names of changed
+// fields are logged, never their values, so keys do not end up in the log.
+func LogConfigDiff(old, new *WireGuardConfig, diff ConfigDiff) {
+	fields := map[string]interface{}{
+		"event":          "config_reload",
+		"peers_added":    len(diff.PeersAdded),
+		"peers_removed":  len(diff.PeersRemoved),
+		"peers_modified": len(diff.PeersModified),
+	}
+	if diff.InterfaceChanged {
+		fields["interface_changed"] = interfaceChanges(old.Interface, new.Interface)
+	}
+	logger.WithFields(fields).Infof("Config reloaded")
+
+	for _, peer := range diff.PeersAdded {
+		logger.WithFields(map[string]interface{}{"public_key": peer.PublicKey}).Infof("Peer added")
+	}
+	for _, peer := range diff.PeersRemoved {
+		logger.WithFields(map[string]interface{}{"public_key": peer.PublicKey}).Infof("Peer removed")
+	}
+	for _, peerDiff := range diff.PeersModified {
+		logger.WithFields(map[string]interface{}{
+			"public_key": peerDiff.NewPeer.PublicKey,
+			"changed":    peerChanges(peerDiff.OldPeer, peerDiff.NewPeer),
+		}).Infof("Peer modified")
+	}
+}
+
+// interfaceChanges returns the names of the interface fields that differ
+func interfaceChanges(old, new InterfaceConfig) []string {
+	var changed []string
+	check := func(name string, differ bool) {
+		if differ {
+			changed = append(changed, name)
+		}
+	}
+
+	check("PrivateKey", old.PrivateKey != new.PrivateKey)
+	check("Address", !slices.Equal(old.Address, new.Address))
+	check("DNS", !slices.Equal(old.DNS, new.DNS))
+	check("ListenPort", old.ListenPort != new.ListenPort)
+	check("MTU", old.MTU != new.MTU)
+	check("PostUp", !slices.Equal(old.PostUp, new.PostUp))
+	check("PostDown", !slices.Equal(old.PostDown, new.PostDown))
+	check("Table", old.Table != new.Table)
+	check("PreUp", !slices.Equal(old.PreUp, new.PreUp))
+	check("PreDown", !slices.Equal(old.PreDown, new.PreDown))
+	return changed
+}
+
+// peerChanges returns the names of the peer fields that differ
+func peerChanges(old, new PeerConfig) []string {
+	var changed []string
+	check := func(name string, differ bool) {
+		if differ {
+			changed = append(changed, name)
+		}
+	}
+
+	check("PresharedKey", old.PresharedKey != new.PresharedKey)
+	check("Endpoint", configuredEndpoint(old) != configuredEndpoint(new))
+	check("AllowedIPs", !slices.Equal(old.AllowedIPs, new.AllowedIPs))
+	check("PersistentKeepalive", old.PersistentKeepalive != new.PersistentKeepalive)
+	check("RoutingPolicies", !reflect.DeepEqual(old.RoutingPolicies, new.RoutingPolicies))
+	return changed
+}
+
+// configuredEndpoint returns the endpoint as written in the config
+func configuredEndpoint(peer PeerConfig) string {
+	if peer.OriginalHostname != "" {
+		return peer.OriginalHostname
+	}
+	return peer.Endpoint
+}
@@ -0,0 +1,152 @@
+package wrapguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cloneConfig returns a deep copy of config by marshalling and parsing it
+func cloneConfig(t *testing.T, config *WireGuardConfig) *WireGuardConfig {
+	t.Helper()
+
+	data, err := config.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	clone, err := ParseConfigReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse marshalled config: %v", err)
+	}
+	return clone
+}
+
+// diffTestConfig is a config with two peers, to diff against its edits
+var diffTestConfig = testConfig{peers: []testPeer{
+	{allowedIPs: "10.150.0.0/24"},
+	{allowedIPs: "10.160.0.0/24"},
+}}
+
+func TestDiffConfigs_Unchanged(t *testing.T) {
+	config := newTestConfig(t, diffTestConfig)
+
+	diff := DiffConfigs(config, cloneConfig(t, config))
+	if !diff.Empty() {
+		t.Errorf("expected no changes, got %+v", diff)
+	}
+}
+
+func TestDiffConfigs(t *testing.T) {
+	old := newTestConfig(t, diffTestConfig)
+	new := cloneConfig(t, old)
+
+	// Modify the first peer, remove the second and add a third
+	new.Peers[0].AllowedIPs = []string{"10.150.0.0/16"}
+	removed := new.Peers[1]
+	added := PeerConfig{PublicKey: generateTestKeyWithSeed(4), Endpoint: "127.0.0.1:51822", AllowedIPs: []string{"10.170.0.0/24"}}
+	new.Peers = []PeerConfig{new.Peers[0], added}
+
+	diff := DiffConfigs(old, new)
+
+	if diff.InterfaceChanged {
+		t.Error("expected the interface to be unchanged")
+	}
+	if !reflect.DeepEqual(diff.PeersAdded, []PeerConfig{added}) {
+		t.Errorf("expected peer %s added, got %+v", added.PublicKey, diff.PeersAdded)
+	}
+	if len(diff.PeersRemoved) != 1 || diff.PeersRemoved[0].PublicKey != removed.PublicKey {
+		t.Errorf("expected peer %s removed, got %+v", removed.PublicKey, diff.PeersRemoved)
+	}
+	if len(diff.PeersModified) != 1 {
+		t.Fatalf("expected one modified peer, got %+v", diff.PeersModified)
+	}
+	modified := diff.PeersModified[0]
+	if !reflect.DeepEqual(modified.OldPeer.AllowedIPs, []string{"10.150.0.0/24"}) ||
+		!reflect.DeepEqual(modified.NewPeer.AllowedIPs, []string{"10.150.0.0/16"}) {
+		t.Errorf("unexpected modified peer %+v", modified)
+	}
+}
+
+func TestDiffConfigs_Interface(t *testing.T) {
+	old := newTestConfig(t, diffTestConfig)
+	new := cloneConfig(t, old)
+	new.Interface.PrivateKey = generateTestKeyWithSeed(9)
+	new.Interface.DNS = []string{"10.150.0.1"}
+	new.Interface.MTU = 1280
+
+	diff := DiffConfigs(old, new)
+	if !diff.InterfaceChanged {
+		t.Error("expected the interface change to be detected")
+	}
+	if len(diff.PeersAdded)+len(diff.PeersRemoved)+len(diff.PeersModified) != 0 {
+		t.Errorf("expected no peer changes, got %+v", diff)
+	}
+	if got := interfaceChanges(old.Interface, new.Interface); !reflect.DeepEqual(got, []string{"PrivateKey", "DNS", "MTU"}) {
+		t.Errorf("expected PrivateKey, DNS and MTU to change, got %v", got)
+	}
+}
+
+func TestDiffConfigs_ResolvedEndpoint(t *testing.T) {
+	old := newTestConfig(t, diffTestConfig)
+	old.Peers[0].OriginalHostname = "vpn.example.test:51820"
+
+	// Copied by hand, since marshalling would try to resolve the hostname
+	new := &WireGuardConfig{Interface: old.Interface, Peers: append([]PeerConfig(nil), old.Peers...)}
+
+	// Re-resolving the hostname to another address is not a config change
+	new.Peers[0].Endpoint = "192.0.2.10:51820"
+	if diff := DiffConfigs(old, new); !diff.Empty() {
+		t.Errorf("expected a re-resolved endpoint not to count, got %+v", diff)
+	}
+
+	new.Peers[0].OriginalHostname = "vpn2.example.test:51820"
+	if diff := DiffConfigs(old, new); len(diff.PeersModified) != 1 {
+		t.Errorf("expected a changed hostname to count, got %+v", diff)
+	}
+}
+
+func TestLogConfigDiff(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelInfo, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	old := newTestConfig(t, diffTestConfig)
+	new := cloneConfig(t, old)
+	new.Interface.PrivateKey = generateTestKeyWithSeed(9)
+	new.Peers[0].PresharedKey = generateTestKeyWithSeed(10)
+	new.Peers = append(new.Peers, PeerConfig{PublicKey: generateTestKeyWithSeed(4), AllowedIPs: []string{"10.170.0.0/24"}})
+
+	LogConfigDiff(old, new, DiffConfigs(old, new))
+
+	// Keys must never appear in the log
+	for _, secret := range []string{old.Interface.PrivateKey, new.Interface.PrivateKey, new.Peers[0].PresharedKey} {
+		if strings.Contains(buf.String(), secret) {
+			t.Fatalf("secret key leaked into the log:\n%s", buf.String())
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	var entry struct {
+		Fields map[string]interface{} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("failed to parse log entry %q: %v", lines[0], err)
+	}
+	summary := entry.Fields
+	if summary["event"] != "config_reload" || summary["peers_added"] != 1.0 || summary["peers_removed"] != 0.0 || summary["peers_modified"] != 1.0 {
+		t.Errorf("unexpected reload summary %v", summary)
+	}
+	if changed, _ := summary["interface_changed"].([]interface{}); len(changed) != 1 || changed[0] != "PrivateKey" {
+		t.Errorf("expected interface_changed [PrivateKey], got %v", summary["interface_changed"])
+	}
+
+	if !strings.Contains(buf.String(), `"changed":["PresharedKey"]`) {
+		t.Errorf("expected the modified peer's changed fields, got:\n%s", buf.String())
+	}
+	if len(lines) != 3 {
+		t.Errorf("expected a summary and two peer entries, got %d lines:\n%s", len(lines), buf.String())
+	}
+}
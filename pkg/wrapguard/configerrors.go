@@ -0,0 +1,90 @@
+package wrapguard
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// Codes carried by the typed config errors, for callers that report or
+// compare errors without depending on the Go types
+const (
+	CodeConfigNotFound = "config_not_found"
+	CodeInvalidKey     = "invalid_key"
+	CodeInvalidAddress = "invalid_address"
+	CodeNoPeers        = "no_peers"
+	CodeInvalidPeer    = "invalid_peer"
+)
+
+// configError holds what the typed config errors have in common: a code, the
+// full message and the underlying error, if any
+type configError struct {
+	Code string
+	msg  string
+	Err  error
+}
+
+// newConfigError formats a message as fmt.Errorf does, keeping the error
+// wrapped with %w for Unwrap
+func newConfigError(code, format string, args ...interface{}) configError {
+	err := fmt.Errorf(format, args...)
+	return configError{Code: code, msg: err.Error(), Err: errors.Unwrap(err)}
+}
+
+func (e configError) Error() string {
+	return e.msg
+}
+
+func (e configError) Unwrap() error {
+	return e.Err
+}
+
+// ErrConfigNotFound reports a config file that does not exist
+type ErrConfigNotFound struct {
+	configError
+	Path string
+}
+
+// ErrInvalidKey reports a missing or malformed key. Key names the directive,
+// e.g. "PrivateKey"; Err is nil when the key is missing.
+type ErrInvalidKey struct {
+	configError
+	Key string
+}
+
+// ErrInvalidAddress reports a missing or malformed interface Address
+type ErrInvalidAddress struct {
+	configError
+}
+
+// ErrNoPeers reports a config without any [Peer] section
+type ErrNoPeers struct {
+	configError
+}
+
+// ErrInvalidPeer reports a [Peer] section that can't be used, such as one
+// without AllowedIPs or with an endpoint that doesn't resolve
+type ErrInvalidPeer struct {
+	configError
+}
+
+// openConfigError describes a config file that could not be opened,
+// returning ErrConfigNotFound if it does not exist
+func openConfigError(path string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrConfigNotFound{newConfigError(CodeConfigNotFound, "failed to open config file: %w", err), path}
+	}
+	return fmt.Errorf("failed to open config file: %w", err)
+}
+
+func invalidKeyError(key, format string, args ...interface{}) error {
+	return ErrInvalidKey{newConfigError(CodeInvalidKey, format, args...), key}
+}
+
+func invalidAddressError(format string, args ...interface{}) error {
+	return ErrInvalidAddress{newConfigError(CodeInvalidAddress, format, args...)}
+}
+
+func invalidPeerError(format string, args ...interface{}) error {
+	return ErrInvalidPeer{newConfigError(CodeInvalidPeer, format, args...)}
+}
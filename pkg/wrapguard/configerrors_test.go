@@ -0,0 +1,161 @@
+package wrapguard
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigErrors_Typed(t *testing.T) {
+	validPeer := "\n[Peer]\nPublicKey = " + generateTestKeyWithSeed(2) + "\nAllowedIPs = 10.150.0.0/24\n"
+
+	tests := []struct {
+		name    string
+		config  string
+		check   func(err error) bool
+		code    string
+		message string
+	}{
+		{
+			name:   "invalid private key",
+			config: "[Interface]\nPrivateKey = not-a-key\nAddress = 10.150.0.2/24\n" + validPeer,
+			check: func(err error) bool {
+				var keyErr ErrInvalidKey
+				return errors.As(err, &keyErr) && keyErr.Key == "PrivateKey" && keyErr.Err != nil
+			},
+			code:    CodeInvalidKey,
+			message: "invalid private key format",
+		},
+		{
+			name:   "missing private key",
+			config: "[Interface]\nAddress = 10.150.0.2/24\n" + validPeer,
+			check: func(err error) bool {
+				var keyErr ErrInvalidKey
+				return errors.As(err, &keyErr) && keyErr.Key == "PrivateKey" && keyErr.Err == nil
+			},
+			code:    CodeInvalidKey,
+			message: "interface private key is required",
+		},
+		{
+			name:   "invalid public key",
+			config: "[Interface]\nPrivateKey = " + generateTestKeyWithSeed(1) + "\nAddress = 10.150.0.2/24\n\n[Peer]\nPublicKey = " + strings.Repeat("A", 43) + "=\nAllowedIPs = 10.150.0.0/24\n",
+			check: func(err error) bool {
+				var keyErr ErrInvalidKey
+				return errors.As(err, &keyErr) && keyErr.Key == "PublicKey"
+			},
+			code:    CodeInvalidKey,
+			message: "peer 0: public key",
+		},
+		{
+			name:   "invalid address",
+			config: "[Interface]\nPrivateKey = " + generateTestKeyWithSeed(1) + "\nAddress = 10.150.0.2\n" + validPeer,
+			check: func(err error) bool {
+				return errors.As(err, &ErrInvalidAddress{})
+			},
+			code:    CodeInvalidAddress,
+			message: "invalid interface address format",
+		},
+		{
+			name:   "no peers",
+			config: "[Interface]\nPrivateKey = " + generateTestKeyWithSeed(1) + "\nAddress = 10.150.0.2/24\n",
+			check: func(err error) bool {
+				return errors.As(err, &ErrNoPeers{})
+			},
+			code:    CodeNoPeers,
+			message: "at least one peer is required",
+		},
+		{
+			name:   "peer without allowed IPs",
+			config: "[Interface]\nPrivateKey = " + generateTestKeyWithSeed(1) + "\nAddress = 10.150.0.2/24\n\n[Peer]\nPublicKey = " + generateTestKeyWithSeed(2) + "\n",
+			check: func(err error) bool {
+				return errors.As(err, &ErrInvalidPeer{})
+			},
+			code:    CodeInvalidPeer,
+			message: "peer 0: at least one allowed IP is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfigReader(strings.NewReader(tt.config))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.check(err) {
+				t.Errorf("error has the wrong type: %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("expected %q in %q", tt.message, err.Error())
+			}
+
+			var codes []string
+			for _, e := range err.(ConfigErrors) {
+				if code, ok := configErrorCode(e); ok {
+					codes = append(codes, code)
+				}
+			}
+			if !strings.Contains(strings.Join(codes, ","), tt.code) {
+				t.Errorf("expected code %s among %v", tt.code, codes)
+			}
+		})
+	}
+}
+
+// configErrorCode returns the Code of the first typed config error in err
+func configErrorCode(err error) (string, bool) {
+	var (
+		notFound ErrConfigNotFound
+		key      ErrInvalidKey
+		address  ErrInvalidAddress
+		noPeers  ErrNoPeers
+		peer     ErrInvalidPeer
+	)
+	switch {
+	case errors.As(err, &notFound):
+		return notFound.Code, true
+	case errors.As(err, &key):
+		return key.Code, true
+	case errors.As(err, &address):
+		return address.Code, true
+	case errors.As(err, &noPeers):
+		return noPeers.Code, true
+	case errors.As(err, &peer):
+		return peer.Code, true
+	}
+	return "", false
+}
+
+func TestConfigErrors_NotFound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.conf")
+
+	for name, parse := range map[string]func() error{
+		"ParseConfig":         func() error { _, err := ParseConfig(path); return err },
+		"ParseTunnelConfigs":  func() error { _, err := ParseTunnelConfigs([]string{path}); return err },
+		"ParseConfigTemplate": func() error { _, err := ParseConfigTemplate(path + ".tmpl"); return err },
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := parse()
+
+			var notFound ErrConfigNotFound
+			if !errors.As(err, &notFound) {
+				t.Fatalf("expected ErrConfigNotFound, got %v", err)
+			}
+			if notFound.Code != CodeConfigNotFound || !strings.HasPrefix(notFound.Path, path) {
+				t.Errorf("unexpected error fields %+v", notFound)
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Error("expected the error to unwrap to fs.ErrNotExist")
+			}
+			if !strings.Contains(err.Error(), "failed to open config file") {
+				t.Errorf("unexpected message %q", err.Error())
+			}
+		})
+	}
+
+	// Other read failures are not reported as missing files
+	if _, err := ParseConfig(t.TempDir()); err == nil || errors.As(err, &ErrConfigNotFound{}) {
+		t.Errorf("expected a directory not to be reported as missing, got %v", err)
+	}
+}
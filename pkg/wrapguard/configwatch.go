@@ -0,0 +1,66 @@
+package wrapguard
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// configWatchInterval is how often watched config files are checked for
+// changes
+var configWatchInterval = 100 * time.Millisecond
+
+// configWatchDebounce is how long config files must stay unchanged before
+// reload is called, so that an editor's save is picked up as one change
+var configWatchDebounce = 500 * time.Millisecond
+
+// WatchConfigFiles calls reload whenever one of paths is written, replaced
+// or removed, until ctx is done. Changes within configWatchDebounce of each
+// other lead to a single call. The files are polled rather than watched
+// through inotify, so this works on any filesystem, including bind mounts
+// whose files are replaced from outside a container.
+func WatchConfigFiles(ctx context.Context, paths []string, reload func()) {
+	states := make([]os.FileInfo, len(paths))
+	for i, path := range paths {
+		states[i], _ = os.Stat(path)
+	}
+
+	go func() {
+		ticker := time.NewTicker(configWatchInterval)
+		defer ticker.Stop()
+
+		var debounce <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for i, path := range paths {
+					info, _ := os.Stat(path)
+					if !fileChanged(states[i], info) {
+						continue
+					}
+					states[i] = info
+					if info == nil {
+						logger.Debugf("Config watch: %s was removed", path)
+					} else {
+						logger.Debugf("Config watch: %s was modified", path)
+					}
+					debounce = time.After(configWatchDebounce)
+				}
+			case <-debounce:
+				debounce = nil
+				reload()
+			}
+		}
+	}()
+}
+
+// fileChanged reports whether a file was written, replaced, created or
+// removed between two stats, either of which is nil if the file was missing
+func fileChanged(old, new os.FileInfo) bool {
+	if old == nil || new == nil {
+		return (old == nil) != (new == nil)
+	}
+	return !os.SameFile(old, new) || !old.ModTime().Equal(new.ModTime()) || old.Size() != new.Size()
+}
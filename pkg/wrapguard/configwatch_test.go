@@ -0,0 +1,91 @@
+package wrapguard
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfigFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := "[Interface]\nPrivateKey = " + generateTestKeyWithSeed(1) + "\nAddress = 10.150.0.2/24\n"
+	path := writeTempConfig(t, config)
+	reloads := make(chan struct{}, 10)
+	WatchConfigFiles(ctx, []string{path}, func() { reloads <- struct{}{} })
+
+	expectReload := func(within time.Duration) {
+		t.Helper()
+		select {
+		case <-reloads:
+		case <-time.After(within):
+			t.Fatalf("expected a reload within %v", within)
+		}
+	}
+	expectNoReload := func(within time.Duration) {
+		t.Helper()
+		select {
+		case <-reloads:
+			t.Fatal("unexpected reload")
+		case <-time.After(within):
+		}
+	}
+
+	// A modified config is reloaded within a second
+	modified := config + "ListenPort = 51821\n"
+	if err := os.WriteFile(path, []byte(modified), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	expectReload(time.Second)
+
+	// An editor replacing the file with several writes leads to one reload
+	replacement := filepath.Join(filepath.Dir(path), "replacement.conf")
+	for i := 0; i < 3; i++ {
+		os.WriteFile(path, []byte(modified+"\n"), 0600)
+		time.Sleep(configWatchInterval * 2)
+	}
+	os.WriteFile(replacement, []byte(modified), 0600)
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatalf("failed to replace config: %v", err)
+	}
+	expectReload(time.Second)
+	expectNoReload(configWatchDebounce + configWatchInterval*2)
+
+	// Nothing is reloaded after ctx is done
+	cancel()
+	time.Sleep(configWatchInterval * 2)
+	os.WriteFile(path, []byte(config), 0600)
+	expectNoReload(time.Second)
+}
+
+func TestFileChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wg0.conf")
+	os.WriteFile(path, []byte("a"), 0600)
+	before, _ := os.Stat(path)
+
+	if fileChanged(before, before) || fileChanged(nil, nil) {
+		t.Error("expected no change for the same stat")
+	}
+	if !fileChanged(before, nil) || !fileChanged(nil, before) {
+		t.Error("expected removing and creating the file to be a change")
+	}
+
+	os.WriteFile(path, []byte("ab"), 0600)
+	after, _ := os.Stat(path)
+	if !fileChanged(before, after) {
+		t.Error("expected a write to be a change")
+	}
+
+	other := filepath.Join(dir, "other.conf")
+	os.WriteFile(other, []byte("ab"), 0600)
+	os.Chtimes(other, after.ModTime(), after.ModTime())
+	os.Rename(other, path)
+	replaced, _ := os.Stat(path)
+	if !fileChanged(after, replaced) {
+		t.Error("expected replacing the file to be a change")
+	}
+}
@@ -0,0 +1,244 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// DefaultDiagnoseTimeout is how long Diagnose waits for each peer to answer
+// its handshake initiation
+const DefaultDiagnoseTimeout = 5 * time.Second
+
+// DiagnosticResult is the outcome of one check run by Diagnose. Peer holds
+// the public key of the peer the check is about, if any.
+type DiagnosticResult struct {
+	Check string `json:"check"`
+	Peer  string `json:"peer,omitempty"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// DiagnoseOptions configures Diagnose. The zero value uses the system
+// resolver and DefaultDiagnoseTimeout, and skips the library check.
+type DiagnoseOptions struct {
+	// Resolver looks up peer endpoint hostnames
+	Resolver endpointResolver
+	// Timeout is the wait for each peer's handshake response
+	Timeout time.Duration
+	// LibraryPath is where the LD_PRELOAD library is expected
+	LibraryPath string
+}
+
+// Diagnose checks the things that most often stop a tunnel from coming up:
+// the OS, the config at configPath, the LD_PRELOAD library, and for each peer
+// with an endpoint, that its hostname resolves and that it answers a
+// handshake initiation. Every check is run and reported, even after one fails.
+func Diagnose(ctx context.Context, configPath string, opts DiagnoseOptions) []DiagnosticResult {
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultDiagnoseTimeout
+	}
+
+	var results []DiagnosticResult
+	report := func(check, peer string, err error) {
+		result := DiagnosticResult{Check: check, Peer: peer, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	report("os_supported", "", checkOSSupported())
+
+	config, _, err := parseConfigFile(configPath)
+	if config != nil {
+		err = newConfigErrors(err, validateConfig(config))
+	}
+	report("config_valid", "", err)
+
+	if opts.LibraryPath != "" {
+		report("preload_library", "", checkPreloadLibrary(opts.LibraryPath))
+	}
+
+	if config == nil {
+		return results
+	}
+
+	for i, peer := range config.Peers {
+		label, err := hexToBase64(peer.PublicKey)
+		if err != nil {
+			label = fmt.Sprintf("peer %d", i)
+		}
+
+		endpoint := peer.Endpoint
+		if peer.OriginalHostname != "" {
+			endpoint, err = resolveDiagnoseEndpoint(ctx, opts.Resolver, peer.OriginalHostname)
+			report("endpoint_resolves", label, err)
+			if err != nil {
+				report("peer_reachable", label, fmt.Errorf("endpoint %s did not resolve", peer.OriginalHostname))
+				continue
+			}
+		}
+		if endpoint == "" {
+			// The peer connects to us, so there is nothing to reach
+			continue
+		}
+
+		report("peer_reachable", label, probePeer(ctx, config, peer, endpoint, opts.Timeout))
+	}
+
+	return results
+}
+
+// checkOSSupported reports whether the LD_PRELOAD library is built for this OS
+func checkOSSupported() error {
+	switch runtime.GOOS {
+	case "linux", "darwin":
+		return nil
+	}
+	return fmt.Errorf("%s is not supported, wrapguard runs on linux and darwin", runtime.GOOS)
+}
+
+// checkPreloadLibrary reports whether the library at path can be preloaded
+func checkPreloadLibrary(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// resolveDiagnoseEndpoint resolves the host of a host:port endpoint with
+// resolver, the way the endpoint refresh does
+func resolveDiagnoseEndpoint(ctx context.Context, resolver endpointResolver, endpoint string) (string, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid endpoint format: %w", err)
+	}
+
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve hostname %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("no IP addresses found for hostname %s", host)
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return net.JoinHostPort(pickEndpointIP(ips).String(), port), nil
+}
+
+// probePeer sends peer a handshake initiation from the interface in config
+// and waits for its response. A cookie reply counts too, as it means the
+// peer accepted the initiation but is under load.
+func probePeer(ctx context.Context, config *WireGuardConfig, peer PeerConfig, endpoint string, timeout time.Duration) error {
+	packet, sender, err := handshakeInitiation(config, peer)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	udpConn, err := dialer.DialContext(ctx, "udp", endpoint)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		udpConn.SetDeadline(deadline)
+	} else {
+		udpConn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if _, err := udpConn.Write(packet); err != nil {
+		return fmt.Errorf("failed to send handshake initiation to %s: %w", endpoint, err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := udpConn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return fmt.Errorf("no handshake response from %s within %s: the endpoint is unreachable, or the peer does not know this interface's public key", endpoint, timeout)
+			}
+			return fmt.Errorf("no handshake response from %s: %w", endpoint, err)
+		}
+		if isHandshakeReply(buf[:n], sender) {
+			return nil
+		}
+	}
+}
+
+// isHandshakeReply reports whether packet answers the initiation with the
+// given sender index
+func isHandshakeReply(packet []byte, sender uint32) bool {
+	if len(packet) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(packet) {
+	case device.MessageResponseType:
+		return len(packet) == device.MessageResponseSize && binary.LittleEndian.Uint32(packet[8:12]) == sender
+	case device.MessageCookieReplyType:
+		return len(packet) == device.MessageCookieReplySize && binary.LittleEndian.Uint32(packet[4:8]) == sender
+	}
+	return false
+}
+
+// handshakeInitiation builds the first handshake message of the interface in
+// config to peer, using a device that is configured but never brought up, and
+// returns it with its sender index
+func handshakeInitiation(config *WireGuardConfig, peer PeerConfig) ([]byte, uint32, error) {
+	logger := device.NewLogger(device.LogLevelSilent, "")
+	dev := device.NewDevice(NewMemoryTUN("diagnose", 1420), conn.NewDefaultBind(), logger)
+	defer dev.Close()
+
+	ipcConfig := fmt.Sprintf("private_key=%s\npublic_key=%s\n", config.Interface.PrivateKey, peer.PublicKey)
+	if peer.PresharedKey != "" {
+		ipcConfig += fmt.Sprintf("preshared_key=%s\n", peer.PresharedKey)
+	}
+	if err := dev.IpcSet(ipcConfig); err != nil {
+		return nil, 0, fmt.Errorf("failed to configure handshake: %w", err)
+	}
+
+	var publicKey device.NoisePublicKey
+	if err := publicKey.FromHex(peer.PublicKey); err != nil {
+		return nil, 0, fmt.Errorf("invalid peer public key: %w", err)
+	}
+	wgPeer := dev.LookupPeer(publicKey)
+	if wgPeer == nil {
+		return nil, 0, fmt.Errorf("peer was not added to the handshake device")
+	}
+
+	msg, err := dev.CreateMessageInitiation(wgPeer)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create handshake initiation: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, msg); err != nil {
+		return nil, 0, err
+	}
+	packet := buf.Bytes()
+
+	var cookies device.CookieGenerator
+	cookies.Init(publicKey)
+	cookies.AddMacs(packet)
+	return packet, msg.Sender, nil
+}
@@ -0,0 +1,176 @@
+package wrapguard
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// silentUDPListener accepts packets on a free port and never answers, like a
+// WireGuard peer that does not know the sender's key
+func silentUDPListener(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// diagnoseChecks returns the check, peer and ok fields of results, with the
+// error text only checked for presence
+func diagnoseChecks(t *testing.T, results []DiagnosticResult) []string {
+	t.Helper()
+
+	var checks []string
+	for _, result := range results {
+		if result.OK == (result.Error != "") {
+			t.Errorf("result %+v should have an error exactly when it failed", result)
+		}
+		checks = append(checks, fmt.Sprintf("%s %s %v", result.Check, result.Peer, result.OK))
+	}
+	return checks
+}
+
+func TestDiagnose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A real tunnel that peers with seed 1 answers the handshake
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	newPeeredTunnel(t, ctx, 2, 1, "10.163.0.2", "10.163.0.1", portB, portA)
+	silentPort := silentUDPListener(t)
+
+	reachable, silent, passive := testPublicKey(t, 2), testPublicKey(t, 3), testPublicKey(t, 4)
+	path := writeTempConfig(t, fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.163.0.1/24
+
+[Peer]
+PublicKey = %s
+Endpoint = localhost:%d
+AllowedIPs = 10.163.0.2/32
+
+[Peer]
+PublicKey = %s
+Endpoint = 127.0.0.1:%d
+AllowedIPs = 10.163.0.3/32
+
+[Peer]
+PublicKey = %s
+AllowedIPs = 10.163.0.4/32`, generateTestKeyWithSeed(1), reachable, portB, silent, silentPort, passive))
+
+	library := filepath.Join(t.TempDir(), "libwrapguard.so")
+	if err := os.WriteFile(library, nil, 0644); err != nil {
+		t.Fatalf("failed to write library: %v", err)
+	}
+
+	resolver := &fakeEndpointResolver{addrs: map[string][]net.IPAddr{
+		"localhost": {{IP: net.ParseIP("127.0.0.1")}},
+	}}
+	results := Diagnose(ctx, path, DiagnoseOptions{Resolver: resolver, Timeout: 500 * time.Millisecond, LibraryPath: library})
+
+	expected := []string{
+		"os_supported  true",
+		"config_valid  true",
+		"preload_library  true",
+		"endpoint_resolves " + reachable + " true",
+		"peer_reachable " + reachable + " true",
+		"peer_reachable " + silent + " false",
+	}
+	if checks := diagnoseChecks(t, results); !reflect.DeepEqual(checks, expected) {
+		t.Fatalf("expected checks\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(checks, "\n"))
+	}
+	if !strings.Contains(results[5].Error, "no handshake response") {
+		t.Errorf("unexpected error for the silent peer: %s", results[5].Error)
+	}
+	if resolver.calls != 1 {
+		t.Errorf("expected the endpoint hostname to be resolved once, got %d", resolver.calls)
+	}
+}
+
+func TestDiagnose_Failures(t *testing.T) {
+	path := writeTempConfig(t, fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 10.164.0.1/24
+
+[Peer]
+PublicKey = %s
+Endpoint = vpn.invalid:51820
+AllowedIPs = 10.164.0.2/32`, generateTestKeyWithSeed(1), testPublicKey(t, 2)))
+
+	resolver := &fakeEndpointResolver{addrs: make(map[string][]net.IPAddr)}
+	results := Diagnose(context.Background(), path, DiagnoseOptions{
+		Resolver:    resolver,
+		LibraryPath: filepath.Join(t.TempDir(), "libwrapguard.so"),
+	})
+
+	peer := testPublicKey(t, 2)
+	expected := []string{
+		"os_supported  true",
+		"config_valid  false",
+		"preload_library  false",
+		"endpoint_resolves " + peer + " false",
+		"peer_reachable " + peer + " false",
+	}
+	if checks := diagnoseChecks(t, results); !reflect.DeepEqual(checks, expected) {
+		t.Fatalf("expected checks\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(checks, "\n"))
+	}
+	if !strings.Contains(results[1].Error, "failed to resolve endpoint vpn.invalid:51820") {
+		t.Errorf("unexpected config error: %s", results[1].Error)
+	}
+	if !strings.Contains(results[3].Error, "no such host") {
+		t.Errorf("expected the resolver error, got %s", results[3].Error)
+	}
+
+	// An unreadable config stops at the config check
+	results = Diagnose(context.Background(), filepath.Join(t.TempDir(), "missing.conf"), DiagnoseOptions{})
+	if checks := diagnoseChecks(t, results); !reflect.DeepEqual(checks, []string{"os_supported  true", "config_valid  false"}) {
+		t.Errorf("unexpected checks for a missing config: %v", checks)
+	}
+}
+
+func TestIsHandshakeReply(t *testing.T) {
+	response := make([]byte, device.MessageResponseSize)
+	binary.LittleEndian.PutUint32(response, device.MessageResponseType)
+	binary.LittleEndian.PutUint32(response[8:12], 42)
+
+	cookie := make([]byte, device.MessageCookieReplySize)
+	binary.LittleEndian.PutUint32(cookie, device.MessageCookieReplyType)
+	binary.LittleEndian.PutUint32(cookie[4:8], 42)
+
+	initiation := make([]byte, device.MessageInitiationSize)
+	binary.LittleEndian.PutUint32(initiation, device.MessageInitiationType)
+
+	tests := []struct {
+		name     string
+		packet   []byte
+		sender   uint32
+		expected bool
+	}{
+		{"response", response, 42, true},
+		{"response to another initiation", response, 7, false},
+		{"truncated response", response[:40], 42, false},
+		{"cookie reply", cookie, 42, true},
+		{"cookie reply to another initiation", cookie, 7, false},
+		{"initiation", initiation, 0, false},
+		{"too short", []byte{2, 0}, 0, false},
+	}
+
+	for _, tt := range tests {
+		if got := isHandshakeReply(tt.packet, tt.sender); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package wrapguard
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// TunnelEvent is a change in WireGuard peer state reported by Tunnel.Events:
+// a HandshakeEvent, PeerUpEvent or PeerDownEvent
+type TunnelEvent interface {
+	tunnelEvent()
+}
+
+// HandshakeEvent reports a completed handshake with the peer at PeerIdx in
+// the tunnel's config
+type HandshakeEvent struct {
+	PeerIdx int
+	At      time.Time
+}
+
+// PeerUpEvent reports the first handshake with a peer, or the first since it
+// went down
+type PeerUpEvent struct {
+	PeerIdx int
+}
+
+// PeerDownEvent reports that a peer's session has expired, RejectAfterTime
+// after its last handshake. Idle peers without PersistentKeepalive go down
+// this way too.
+type PeerDownEvent struct {
+	PeerIdx int
+}
+
+func (HandshakeEvent) tunnelEvent() {}
+func (PeerUpEvent) tunnelEvent()    {}
+func (PeerDownEvent) tunnelEvent()  {}
+
+// TunnelEventPollInterval is how often the device is checked for peer state
+// changes once Events has been called
+var TunnelEventPollInterval = 5 * time.Second
+
+// tunnelEventBuffer is the capacity of the Events channel; events that do not
+// fit are dropped
+const tunnelEventBuffer = 64
+
+// peerState is what the event poller last saw of a peer
+type peerState struct {
+	handshake time.Time
+	up        bool
+}
+
+// Events returns a channel of peer state changes. Polling the device starts
+// on the first call, and the channel is closed when the tunnel is closed.
+// Events are dropped with a warning if the channel is not drained.
+func (t *Tunnel) Events() <-chan TunnelEvent {
+	t.eventsOnce.Do(func() {
+		t.events = make(chan TunnelEvent, tunnelEventBuffer)
+		if t.eventsCtx != nil {
+			go t.pollEvents()
+		}
+	})
+	return t.events
+}
+
+// pollEvents compares peer handshakes with the previous poll until the
+// tunnel is closed
+func (t *Tunnel) pollEvents() {
+	defer close(t.events)
+
+	ticker := time.NewTicker(TunnelEventPollInterval)
+	defer ticker.Stop()
+
+	states := make(map[string]*peerState)
+	for {
+		select {
+		case <-t.eventsCtx.Done():
+			return
+		case <-ticker.C:
+			t.mutex.RLock()
+			dev := t.device
+			t.mutex.RUnlock()
+			if dev == nil {
+				// Reset is replacing the device
+				continue
+			}
+
+			state, err := dev.IpcGet()
+			if err != nil {
+				continue
+			}
+			for _, event := range t.diffPeerStates(states, peerHandshakes(state), time.Now()) {
+				t.emitEvent(event)
+			}
+		}
+	}
+}
+
+// diffPeerStates updates states from the latest handshake times, both keyed
+// by hex public key so that a reload reordering the peers keeps their state,
+// and returns the resulting events
+func (t *Tunnel) diffPeerStates(states map[string]*peerState, handshakes map[string]time.Time, now time.Time) []TunnelEvent {
+	config := t.config.Load()
+	if config == nil {
+		return nil
+	}
+
+	var events []TunnelEvent
+	current := make(map[string]bool, len(config.Peers))
+	for i, peer := range config.Peers {
+		current[peer.PublicKey] = true
+		state, ok := states[peer.PublicKey]
+		if !ok {
+			state = &peerState{}
+			states[peer.PublicKey] = state
+		}
+
+		if at := handshakes[peer.PublicKey]; at.After(state.handshake) {
+			state.handshake = at
+			events = append(events, HandshakeEvent{PeerIdx: i, At: at})
+			if !state.up {
+				state.up = true
+				events = append(events, PeerUpEvent{PeerIdx: i})
+			}
+		} else if state.up && now.Sub(state.handshake) > device.RejectAfterTime {
+			state.up = false
+			events = append(events, PeerDownEvent{PeerIdx: i})
+		}
+	}
+
+	// Forget peers a reload removed, so that one added back starts afresh
+	for key := range states {
+		if !current[key] {
+			delete(states, key)
+		}
+	}
+	return events
+}
+
+// emitEvent queues event without blocking the poller
+func (t *Tunnel) emitEvent(event TunnelEvent) {
+	select {
+	case t.events <- event:
+	default:
+		logger.Warnf("Dropping tunnel event %T: events channel is full", event)
+	}
+}
+
+// peerHandshakes returns the last handshake time of each peer in the IpcGet
+// output, keyed by hex public key. Peers without a handshake are left out.
+func peerHandshakes(state string) map[string]time.Time {
+	handshakes := make(map[string]time.Time)
+
+	// Each peer starts with public_key and reports last_handshake_time_sec
+	// followed by _nsec
+	var publicKey string
+	var secs int64
+	scanner := bufio.NewScanner(strings.NewReader(state))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "public_key":
+			publicKey, secs = value, 0
+		case "last_handshake_time_sec":
+			secs, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsecs, _ := strconv.ParseInt(value, 10, 64)
+			if secs > 0 {
+				handshakes[publicKey] = time.Unix(secs, nsecs)
+			}
+		}
+	}
+	return handshakes
+}
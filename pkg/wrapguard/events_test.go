@@ -0,0 +1,183 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+func TestPeerHandshakes(t *testing.T) {
+	state := `private_key=aa
+listen_port=51820
+public_key=11
+endpoint=127.0.0.1:51820
+last_handshake_time_sec=1700000000
+last_handshake_time_nsec=500
+public_key=22
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+public_key=33
+last_handshake_time_sec=1700000100
+last_handshake_time_nsec=0
+`
+	expected := map[string]time.Time{
+		"11": time.Unix(1700000000, 500),
+		"33": time.Unix(1700000100, 0),
+	}
+	if got := peerHandshakes(state); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestTunnel_DiffPeerStates(t *testing.T) {
+	config := newTestConfig(t, testConfig{})
+	tunnel := &Tunnel{}
+	tunnel.config.Store(config)
+	key := config.Peers[0].PublicKey
+
+	start := time.Unix(1700000000, 0)
+	first, second, third := start, start.Add(2*time.Minute), start.Add(10*time.Minute)
+	states := make(map[string]*peerState)
+
+	steps := []struct {
+		name       string
+		handshakes map[string]time.Time
+		now        time.Time
+		expected   []TunnelEvent
+	}{
+		{"no handshake yet", nil, start, nil},
+		{"first handshake", map[string]time.Time{key: first}, first, []TunnelEvent{HandshakeEvent{PeerIdx: 0, At: first}, PeerUpEvent{PeerIdx: 0}}},
+		{"unchanged", map[string]time.Time{key: first}, first.Add(time.Minute), nil},
+		{"rekey", map[string]time.Time{key: second}, second, []TunnelEvent{HandshakeEvent{PeerIdx: 0, At: second}}},
+		{"session expired", map[string]time.Time{key: second}, second.Add(device.RejectAfterTime + time.Second), []TunnelEvent{PeerDownEvent{PeerIdx: 0}}},
+		{"still down", map[string]time.Time{key: second}, third, nil},
+		{"back up", map[string]time.Time{key: third}, third, []TunnelEvent{HandshakeEvent{PeerIdx: 0, At: third}, PeerUpEvent{PeerIdx: 0}}},
+		{"unknown peer", map[string]time.Time{key: third, "ff": third.Add(time.Second)}, third, nil},
+	}
+
+	for _, step := range steps {
+		if got := tunnel.diffPeerStates(states, step.handshakes, step.now); !reflect.DeepEqual(got, step.expected) {
+			t.Errorf("%s: expected %v, got %v", step.name, step.expected, got)
+		}
+	}
+
+	if events := (&Tunnel{}).diffPeerStates(states, nil, start); events != nil {
+		t.Errorf("expected no events without a config, got %v", events)
+	}
+}
+
+func TestTunnel_DiffPeerStatesReordered(t *testing.T) {
+	config := newTestConfig(t, testConfig{})
+	config.Peers = append(config.Peers, PeerConfig{PublicKey: "ff", AllowedIPs: []string{"10.151.0.0/24"}})
+	tunnel := &Tunnel{}
+	tunnel.config.Store(config)
+	key := config.Peers[0].PublicKey
+
+	at := time.Unix(1700000000, 0)
+	handshakes := map[string]time.Time{key: at}
+	states := make(map[string]*peerState)
+	tunnel.diffPeerStates(states, handshakes, at)
+
+	// A reload that reorders the peers is no news for a peer that is up
+	reordered := *config
+	reordered.Peers = []PeerConfig{config.Peers[1], config.Peers[0]}
+	tunnel.config.Store(&reordered)
+	if events := tunnel.diffPeerStates(states, handshakes, at.Add(time.Second)); events != nil {
+		t.Errorf("expected no events after reordering the peers, got %v", events)
+	}
+
+	// and a peer that is removed and added back starts afresh
+	removed := *config
+	removed.Peers = config.Peers[1:]
+	tunnel.config.Store(&removed)
+	tunnel.diffPeerStates(states, handshakes, at.Add(2*time.Second))
+	tunnel.config.Store(&reordered)
+	expected := []TunnelEvent{HandshakeEvent{PeerIdx: 1, At: at}, PeerUpEvent{PeerIdx: 1}}
+	if events := tunnel.diffPeerStates(states, handshakes, at.Add(3*time.Second)); !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %v for the re-added peer, got %v", expected, events)
+	}
+}
+
+func TestTunnel_EmitEventDropsWhenFull(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelWarn, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	// A tunnel without a device never starts the poller
+	tunnel := &Tunnel{}
+	events := tunnel.Events()
+	for i := 0; i < tunnelEventBuffer+1; i++ {
+		tunnel.emitEvent(PeerUpEvent{PeerIdx: i})
+	}
+
+	if len(events) != tunnelEventBuffer {
+		t.Errorf("expected %d queued events, got %d", tunnelEventBuffer, len(events))
+	}
+	if first := <-events; first != (PeerUpEvent{PeerIdx: 0}) {
+		t.Errorf("expected the oldest event to be kept, got %v", first)
+	}
+	if count := strings.Count(buf.String(), "Dropping tunnel event wrapguard.PeerUpEvent"); count != 1 {
+		t.Errorf("expected one drop warning, got %d:\n%s", count, buf.String())
+	}
+	if tunnel.Events() != events {
+		t.Error("expected Events to return the same channel each time")
+	}
+}
+
+func TestTunnel_Events(t *testing.T) {
+	oldInterval := TunnelEventPollInterval
+	TunnelEventPollInterval = 50 * time.Millisecond
+	defer func() { TunnelEventPollInterval = oldInterval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	tunnelA := newPeeredTunnel(t, ctx, 1, 2, "10.162.0.1", "10.162.0.2", portA, portB)
+	events := tunnelA.Events()
+	newPeeredTunnel(t, ctx, 2, 1, "10.162.0.2", "10.162.0.1", portB, portA)
+
+	var handshake, up bool
+	timeout := time.After(10 * time.Second)
+	for !handshake || !up {
+		select {
+		case event := <-events:
+			switch event := event.(type) {
+			case HandshakeEvent:
+				if event.PeerIdx != 0 || event.At.IsZero() {
+					t.Errorf("unexpected handshake event %+v", event)
+				}
+				handshake = true
+			case PeerUpEvent:
+				if !handshake {
+					t.Error("expected the handshake event before the peer up event")
+				}
+				up = true
+			default:
+				t.Errorf("unexpected event %T", event)
+			}
+		case <-timeout:
+			t.Fatalf("no handshake and peer up events (handshake %v, up %v)", handshake, up)
+		}
+	}
+
+	// Closing the tunnel stops the poller and closes the channel
+	tunnelA.Close()
+	timeout = time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("events channel was not closed with the tunnel")
+		}
+	}
+}
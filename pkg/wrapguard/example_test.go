@@ -0,0 +1,93 @@
+package wrapguard_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/puzed/wrapguard/pkg/wrapguard"
+)
+
+// exampleConfig is a wg-quick config with fixed test keys
+func exampleConfig() string {
+	key := func(seed byte) string {
+		b := make([]byte, 32)
+		for i := range b {
+			b[i] = byte(i) + seed
+		}
+		return base64.StdEncoding.EncodeToString(b)
+	}
+
+	return `[Interface]
+PrivateKey = ` + key(1) + `
+Address = 10.150.0.2/24
+
+[Peer]
+PublicKey = ` + key(2) + `
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 10.150.0.0/24`
+}
+
+// Start an agent from an in-memory config and point a client at its SOCKS5
+// proxy
+func ExampleAgent() {
+	config, err := wrapguard.ParseConfigReader(strings.NewReader(exampleConfig()))
+	if err != nil {
+		fmt.Println("invalid config:", err)
+		return
+	}
+
+	agent := &wrapguard.Agent{ProxyMode: "socks5"}
+	if err := agent.Start(context.Background(), config); err != nil {
+		fmt.Println("failed to start:", err)
+		return
+	}
+	defer agent.Stop()
+
+	// Clients can use the SOCKS5 proxy at 127.0.0.1:agent.SOCKSPort()
+	fmt.Println("SOCKS5 proxy running:", agent.SOCKSPort() > 0)
+	// Output: SOCKS5 proxy running: true
+}
+
+// startTestAgent shows how a test can run an agent for its own duration
+func startTestAgent(t *testing.T) *wrapguard.Agent {
+	t.Helper()
+
+	config, err := wrapguard.ParseConfigReader(strings.NewReader(exampleConfig()))
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	agent := &wrapguard.Agent{}
+	if err := agent.Start(context.Background(), config); err != nil {
+		t.Fatalf("failed to start agent: %v", err)
+	}
+	t.Cleanup(func() { agent.Stop() })
+
+	return agent
+}
+
+func TestAgent_EmbeddedInTest(t *testing.T) {
+	agent := startTestAgent(t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", agent.SOCKSPort()))
+	if err != nil {
+		t.Fatalf("failed to reach SOCKS5 proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// SOCKS5 greeting offering no authentication
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatalf("failed to write greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := conn.Read(reply); err != nil {
+		t.Fatalf("failed to read greeting reply: %v", err)
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 {
+		t.Errorf("unexpected SOCKS5 greeting reply %v", reply)
+	}
+}
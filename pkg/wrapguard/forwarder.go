@@ -0,0 +1,442 @@
+package wrapguard
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the ForwarderOptions timeouts left at zero
+const (
+	DefaultForwarderConnectTimeout = 10 * time.Second
+	DefaultForwarderIdleTimeout    = 300 * time.Second
+)
+
+// ForwarderOptions configures NewPortForwarder. The zero value uses the
+// default timeouts and sends no PROXY protocol header.
+type ForwarderOptions struct {
+	// ConnectTimeout is how long an incoming connection waits for its local
+	// port to become ready before it is reset; negative does not wait
+	ConnectTimeout time.Duration
+
+	// IdleTimeout is how long a forwarded connection may carry no data in
+	// either direction before both sides are closed; negative disables it
+	IdleTimeout time.Duration
+
+	// ProxyProtocol makes the forwarder send a PROXY protocol header to the
+	// local service on each forwarded connection, so it can see the peer's
+	// address. Only "v2" is supported; empty disables it.
+	ProxyProtocol string
+
+	// NoProxyProtocolPorts lists local ports that never get a PROXY protocol
+	// header, e.g. for services like SSH that don't understand it
+	NoProxyProtocolPorts []int
+
+	// AllowedNetworks and UpstreamDial apply to ForwardHTTP targets as they
+	// do to the proxy servers' destinations
+	AllowedNetworks []netip.Prefix
+	UpstreamDial    DialFunc
+}
+
+// forwarderHealthInterval is how often bound local ports are health checked
+var forwarderHealthInterval = 500 * time.Millisecond
+
+type PortForwarder struct {
+	tunnel         *Tunnel
+	msgChan        <-chan IPCMessage
+	listeners      map[int]net.Listener
+	targets        map[int]string // Addresses other than 127.0.0.1:port to forward to
+	httpListeners  []net.Listener // Local ports forwarded with ForwardHTTP
+	portDir        *portDirWatcher
+	counters       map[int]*BandwidthCounter
+	health         *HealthChecker
+	connectTimeout time.Duration
+	idleTimeout    time.Duration
+	proxyProtocol  bool         // Send a PROXY protocol v2 header to the local service
+	noProxyPorts   map[int]bool // Ports excluded from proxyProtocol
+	httpAllowed    []netip.Prefix
+	httpUpstream   DialFunc
+	mutex          sync.RWMutex
+}
+
+func NewPortForwarder(tunnel *Tunnel, msgChan <-chan IPCMessage, opts ForwarderOptions) *PortForwarder {
+	noProxyPorts := make(map[int]bool, len(opts.NoProxyProtocolPorts))
+	for _, port := range opts.NoProxyProtocolPorts {
+		noProxyPorts[port] = true
+	}
+
+	connectTimeout := cmp.Or(opts.ConnectTimeout, DefaultForwarderConnectTimeout)
+	idleTimeout := cmp.Or(opts.IdleTimeout, DefaultForwarderIdleTimeout)
+
+	return &PortForwarder{
+		tunnel:         tunnel,
+		msgChan:        msgChan,
+		listeners:      make(map[int]net.Listener),
+		targets:        make(map[int]string),
+		counters:       make(map[int]*BandwidthCounter),
+		health:         NewHealthChecker("127.0.0.1", forwarderHealthInterval),
+		connectTimeout: max(connectTimeout, 0),
+		idleTimeout:    max(idleTimeout, 0),
+		proxyProtocol:  opts.ProxyProtocol == "v2",
+		noProxyPorts:   noProxyPorts,
+		httpAllowed:    opts.AllowedNetworks,
+		httpUpstream:   opts.UpstreamDial,
+	}
+}
+
+func (pf *PortForwarder) Run(ctx context.Context) {
+	healthDone := make(chan struct{})
+	go func() {
+		defer close(healthDone)
+		pf.health.Run(ctx)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			pf.closeAllListeners()
+			// Leave no health checks running once the forwarder has stopped
+			<-healthDone
+			pf.health.WaitAll()
+			return
+		case msg := <-pf.msgChan:
+			if msg.Type == "BIND" {
+				err := pf.handleChildBind(msg.Port)
+				if err != nil {
+					logger.Errorf("Failed to handle bind for port %d: %v", msg.Port, err)
+				}
+				msg.Reply(err)
+			}
+		}
+	}
+}
+
+// ForwardedPort is a port forwarded to the child without a BIND from the
+// LD_PRELOAD library, as with --forward-port
+type ForwardedPort struct {
+	Port     int
+	Protocol string // "tcp" or "udp"
+}
+
+// ParseForwardedPorts parses a --forward-port value such as "8080/tcp",
+// "53/udp" or "8080-8090/tcp" into one entry per port. Without a protocol
+// the ports are TCP.
+func ParseForwardedPorts(spec string) ([]ForwardedPort, error) {
+	ports, protocol, found := strings.Cut(strings.TrimSpace(spec), "/")
+	if !found {
+		protocol = "tcp"
+	}
+	protocol = strings.ToLower(protocol)
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, fmt.Errorf("invalid protocol %q in forwarded port %s (expected tcp or udp)", protocol, spec)
+	}
+	if ports == "" || ports == "any" {
+		return nil, fmt.Errorf("missing port in forwarded port %s", spec)
+	}
+
+	portRange, err := ParsePortRange(ports)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarded := make([]ForwardedPort, 0, portRange.End-portRange.Start+1)
+	for port := portRange.Start; port <= portRange.End; port++ {
+		forwarded = append(forwarded, ForwardedPort{Port: port, Protocol: protocol})
+	}
+	return forwarded, nil
+}
+
+// RegisterPort forwards port as if the child had bound it, for programs run
+// without the LD_PRELOAD library. Registering a port that is already
+// forwarded does nothing. Only TCP can be forwarded.
+func (pf *PortForwarder) RegisterPort(port int, protocol string) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port out of range: %d", port)
+	}
+	switch strings.ToLower(protocol) {
+	case "tcp":
+		return pf.handleBind(port)
+	case "udp":
+		return fmt.Errorf("UDP port forwarding is not supported")
+	default:
+		return fmt.Errorf("invalid protocol %q (expected tcp or udp)", protocol)
+	}
+}
+
+func (pf *PortForwarder) handleBind(port int) error {
+	_, err := pf.listen(port, "", true)
+	return err
+}
+
+// handleChildBind forwards a port the child has just bound. There is no
+// fallback to localhost: the child is about to listen on that port, and
+// waits for the reply to its BIND before it can.
+func (pf *PortForwarder) handleChildBind(port int) error {
+	_, err := pf.listen(port, "", false)
+	return err
+}
+
+// listen forwards port to target, or to 127.0.0.1:port if target is empty.
+// It returns false if the port was already forwarded, leaving it as it was.
+// With fallback, a port that cannot be opened on the WireGuard IP is opened
+// on localhost instead.
+func (pf *PortForwarder) listen(port int, target string, fallback bool) (bool, error) {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	// Check if we're already listening on this port
+	if _, exists := pf.listeners[port]; exists {
+		return false, nil // Already listening
+	}
+
+	// Create a listener on the WireGuard IP
+	// For now, listen on all interfaces since we don't have a proper WireGuard interface
+	// In a full implementation, this would listen specifically on the WireGuard IP
+	wgIP := pf.tunnel.ourIP.String()
+	listenAddr := fmt.Sprintf("%s:%d", wgIP, port)
+
+	logger.Debugf("Port forwarder: attempting to listen on %s", listenAddr)
+
+	// Try to listen on the WireGuard IP - this will likely fail without a real interface
+	// but it demonstrates the correct approach
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil && !fallback {
+		return false, fmt.Errorf("failed to create port forwarder listener: %w", err)
+	}
+	if err != nil {
+		// Fallback: listen on localhost for testing
+		logger.Debugf("Port forwarder: failed to listen on WireGuard IP (%v), falling back to localhost", err)
+		listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return false, fmt.Errorf("failed to create port forwarder listener: %w", err)
+		}
+		logger.Infof("Port forwarder: listening on 127.0.0.1:%d (fallback)", port)
+	} else {
+		logger.Infof("Port forwarder: successfully listening on %s", listenAddr)
+
+		// Only health check when the local port is free for the child; in
+		// fallback mode the check would connect to our own listener
+		if target == "" {
+			pf.health.Register(port)
+		}
+	}
+
+	pf.listeners[port] = listener
+	if target != "" {
+		pf.targets[port] = target
+	}
+
+	// Start accepting connections in background
+	go pf.acceptConnections(listener, port)
+
+	return true, nil
+}
+
+// unbind stops forwarding port. Connections already relayed stay open.
+func (pf *PortForwarder) unbind(port int) {
+	pf.mutex.Lock()
+	listener, exists := pf.listeners[port]
+	if exists {
+		listener.Close()
+		delete(pf.listeners, port)
+		delete(pf.targets, port)
+		pf.health.Unregister(port)
+		logger.Infof("Port forwarder: stopped forwarding port %d", port)
+	}
+	pf.mutex.Unlock()
+
+	// Wait outside the lock for a first check of the port still in flight
+	if exists {
+		pf.health.Wait(port)
+	}
+}
+
+// target returns the address connections to port are forwarded to
+func (pf *PortForwarder) target(port int) string {
+	pf.mutex.RLock()
+	defer pf.mutex.RUnlock()
+	if target, ok := pf.targets[port]; ok {
+		return target
+	}
+	return fmt.Sprintf("127.0.0.1:%d", port)
+}
+
+func (pf *PortForwarder) acceptConnections(listener net.Listener, port int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// Listener was closed
+			break
+		}
+
+		// Handle connection in background
+		go pf.handleConnection(conn, port)
+	}
+}
+
+func (pf *PortForwarder) handleConnection(wgConn net.Conn, port int) {
+	defer wgConn.Close()
+
+	connLogger := logger.WithFields(map[string]interface{}{"peer_addr": wgConn.RemoteAddr().String()})
+	connLogger.Debugf("Port forwarder: accepted connection on port %d", port)
+
+	// Hold the connection until the local process is accepting
+	if pf.health.Registered(port) && !pf.health.Ready(port) {
+		connLogger.Warnf("Port forwarder: localhost:%d not ready, queueing connection for up to %v", port, pf.connectTimeout)
+		if !pf.health.WaitReady(port, pf.connectTimeout) {
+			connLogger.Errorf("Port forwarder: localhost:%d not ready after %v, resetting connection", port, pf.connectTimeout)
+			resetConn(wgConn)
+			return
+		}
+		connLogger.Infof("Port forwarder: localhost:%d ready, releasing queued connection", port)
+	}
+
+	// Connect to localhost port, or the port's target
+	target := pf.target(port)
+	localConn, err := net.Dial("tcp", target)
+	if err != nil {
+		connLogger.Errorf("Failed to connect to %s: %v", target, err)
+		return
+	}
+	defer localConn.Close()
+
+	// Tell the local service who the peer is before any of its data
+	if pf.proxyProtocol && !pf.noProxyPorts[port] {
+		if _, err := localConn.Write(proxyHeaderV2(wgConn.RemoteAddr(), wgConn.LocalAddr())); err != nil {
+			connLogger.Errorf("Failed to send PROXY protocol header to %s: %v", target, err)
+			return
+		}
+	}
+
+	// Close both sides of a connection that stops carrying data, so a stuck
+	// child cannot pile up half-closed connections
+	var wgReader, localReader io.Reader = wgConn, localConn
+	if pf.idleTimeout > 0 {
+		idle := newIdleTimer(pf.idleTimeout, func() {
+			connLogger.Debugf("Port forwarder: closing connection on port %d after %v idle", port, pf.idleTimeout)
+			wgConn.Close()
+			localConn.Close()
+		})
+		defer idle.stop()
+		wgReader = &idleReader{Reader: wgConn, idle: idle}
+		localReader = &idleReader{Reader: localConn, idle: idle}
+	}
+
+	// Relay data bidirectionally, counting it for the port
+	counter := pf.counter(port)
+	go func() {
+		io.Copy(localConn, &CountingReader{Reader: wgReader, Count: &counter.BytesIn})
+		localConn.Close()
+	}()
+
+	io.Copy(&CountingWriter{Writer: wgConn, Count: &counter.BytesOut}, localReader)
+}
+
+// idleTimer calls onIdle once timeout passes without a touch, unless it is
+// stopped first
+type idleTimer struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	done    bool
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.mutex.Lock()
+		fired := !t.done
+		t.done = true
+		t.mutex.Unlock()
+		if fired {
+			onIdle()
+		}
+	})
+	return t
+}
+
+// touch restarts the timeout
+func (t *idleTimer) touch() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.done {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.done = true
+	t.timer.Stop()
+}
+
+// idleReader touches idle whenever data is read from Reader. Both directions
+// of a connection share one timer, so it only fires once neither has carried
+// data for the timeout.
+type idleReader struct {
+	Reader io.Reader
+	idle   *idleTimer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.idle.touch()
+	}
+	return n, err
+}
+
+// counter returns the bandwidth counter for port, creating it on first use
+func (pf *PortForwarder) counter(port int) *BandwidthCounter {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	counter, ok := pf.counters[port]
+	if !ok {
+		counter = &BandwidthCounter{}
+		pf.counters[port] = counter
+	}
+	return counter
+}
+
+// PortStats returns the bytes relayed so far for each forwarded port that
+// has carried a connection
+func (pf *PortForwarder) PortStats() map[int]BandwidthStats {
+	pf.mutex.RLock()
+	defer pf.mutex.RUnlock()
+
+	stats := make(map[int]BandwidthStats, len(pf.counters))
+	for port, counter := range pf.counters {
+		stats[port] = counter.Stats()
+	}
+	return stats
+}
+
+// resetConn closes a TCP connection with an RST instead of a FIN
+func resetConn(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (pf *PortForwarder) closeAllListeners() {
+	pf.mutex.Lock()
+	defer pf.mutex.Unlock()
+
+	for port, listener := range pf.listeners {
+		listener.Close()
+		delete(pf.listeners, port)
+	}
+	for _, listener := range pf.httpListeners {
+		listener.Close()
+	}
+	pf.httpListeners = nil
+}
@@ -0,0 +1,829 @@
+package wrapguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPortForwarder(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	if forwarder == nil {
+		t.Fatal("NewPortForwarder returned nil")
+	}
+
+	if forwarder.tunnel != tunnel {
+		t.Error("tunnel not set correctly")
+	}
+
+	if forwarder.msgChan != msgChan {
+		t.Error("message channel not set correctly")
+	}
+
+	if forwarder.listeners == nil {
+		t.Error("listeners map not initialized")
+	}
+
+	if len(forwarder.listeners) != 0 {
+		t.Error("listeners map should be empty initially")
+	}
+
+	if forwarder.idleTimeout != DefaultForwarderIdleTimeout {
+		t.Errorf("expected idle timeout %v, got %v", DefaultForwarderIdleTimeout, forwarder.idleTimeout)
+	}
+
+	// Negative timeouts turn off the wait and the idle timer
+	forwarder = NewPortForwarder(tunnel, msgChan, ForwarderOptions{ConnectTimeout: -1, IdleTimeout: -1})
+	if forwarder.connectTimeout != 0 || forwarder.idleTimeout != 0 {
+		t.Errorf("expected no timeouts, got connect %v and idle %v", forwarder.connectTimeout, forwarder.idleTimeout)
+	}
+}
+
+func TestPortForwarder_HandleBind(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	// Test binding to a port
+	port := 8080
+	err := forwarder.handleBind(port)
+
+	// In test environment, this might fail to bind to the WireGuard IP
+	// but should fall back to localhost
+	if err != nil {
+		t.Logf("handleBind failed (expected in test env): %v", err)
+		return
+	}
+
+	// Check that listener was created
+	if _, exists := forwarder.listeners[port]; !exists {
+		t.Error("listener not created for port")
+	}
+
+	// Clean up
+	forwarder.closeAllListeners()
+}
+
+func TestPortForwarder_HandleBindDuplicate(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+	defer forwarder.closeAllListeners()
+
+	port := 8081
+
+	// First bind should succeed or fail gracefully
+	err1 := forwarder.handleBind(port)
+
+	// Second bind to same port should not create duplicate listener
+	err2 := forwarder.handleBind(port)
+
+	// Both should either succeed or fail gracefully
+	if err1 != nil && err2 != nil {
+		t.Logf("Both bind attempts failed (expected in test env): %v, %v", err1, err2)
+		return
+	}
+
+	// Should only have one listener for the port
+	count := 0
+	for p := range forwarder.listeners {
+		if p == port {
+			count++
+		}
+	}
+
+	if count > 1 {
+		t.Errorf("found %d listeners for port %d, want at most 1", count, port)
+	}
+}
+
+func TestPortForwarder_Run(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start the forwarder in a goroutine
+	done := make(chan bool)
+	go func() {
+		forwarder.Run(ctx)
+		done <- true
+	}()
+
+	// Send a BIND message
+	bindMsg := IPCMessage{
+		Type: "BIND",
+		Port: 8082,
+	}
+
+	msgChan <- bindMsg
+
+	// Give some time for message processing
+	time.Sleep(50 * time.Millisecond)
+
+	// Cancel context to stop the forwarder
+	cancel()
+
+	// Wait for forwarder to stop
+	select {
+	case <-done:
+		// Good, forwarder stopped
+	case <-time.After(1 * time.Second):
+		t.Error("forwarder did not stop within timeout")
+	}
+
+	// All listeners should be closed
+	if len(forwarder.listeners) != 0 {
+		t.Errorf("expected 0 listeners after close, got %d", len(forwarder.listeners))
+	}
+}
+
+func TestPortForwarder_RunWithNonBindMessage(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Start the forwarder
+	done := make(chan bool)
+	go func() {
+		forwarder.Run(ctx)
+		done <- true
+	}()
+
+	// Send a non-BIND message
+	connectMsg := IPCMessage{
+		Type: "CONNECT",
+		Port: 8083,
+	}
+
+	msgChan <- connectMsg
+
+	// Wait for context timeout
+	<-done
+
+	// Should not have created any listeners
+	if len(forwarder.listeners) != 0 {
+		t.Errorf("expected 0 listeners for CONNECT message, got %d", len(forwarder.listeners))
+	}
+}
+
+func TestPortForwarder_CloseAllListeners(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	// Create mock listeners (using real listeners would require available ports)
+	listener1, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener 1: %v", err)
+	}
+
+	listener2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		listener1.Close()
+		t.Fatalf("failed to create test listener 2: %v", err)
+	}
+
+	port1 := listener1.Addr().(*net.TCPAddr).Port
+	port2 := listener2.Addr().(*net.TCPAddr).Port
+
+	forwarder.listeners[port1] = listener1
+	forwarder.listeners[port2] = listener2
+
+	// Close all listeners
+	forwarder.closeAllListeners()
+
+	// Listeners map should be empty
+	if len(forwarder.listeners) != 0 {
+		t.Errorf("expected 0 listeners after closeAll, got %d", len(forwarder.listeners))
+	}
+
+	// Listeners should be closed (attempting to accept should fail)
+	_, err = listener1.Accept()
+	if err == nil {
+		t.Error("listener1 should be closed")
+	}
+
+	_, err = listener2.Accept()
+	if err == nil {
+		t.Error("listener2 should be closed")
+	}
+}
+
+func TestPortForwarder_AcceptConnections(t *testing.T) {
+	// This test is complex to implement without real network setup
+	// We'll test the basic structure and error handling
+
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	// Create a listener on an available port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create test listener: %v", err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	// Start accepting connections in a goroutine
+	done := make(chan bool)
+	go func() {
+		forwarder.acceptConnections(listener, port)
+		done <- true
+	}()
+
+	// Close the listener to stop accepting
+	listener.Close()
+
+	// Wait for acceptConnections to exit
+	select {
+	case <-done:
+		// Good, acceptConnections stopped
+	case <-time.After(1 * time.Second):
+		t.Error("acceptConnections did not stop within timeout")
+	}
+}
+
+func TestPortForwarder_HandleConnection(t *testing.T) {
+	// This test requires a more complex setup with actual network connections
+	// For now, we'll test the basic structure
+
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	// Create a mock connection pair
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Test that handleConnection doesn't panic
+	// In a real scenario, this would connect to localhost:port
+	// but that requires a server running on that port
+
+	done := make(chan bool)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Errorf("handleConnection panicked: %v", r)
+			}
+			done <- true
+		}()
+		forwarder.handleConnection(server, 8080)
+	}()
+
+	// Close connections to trigger exit
+	server.Close()
+	client.Close()
+
+	// Wait for completion
+	select {
+	case <-done:
+		// Good, no panic
+	case <-time.After(1 * time.Second):
+		t.Error("handleConnection did not complete within timeout")
+	}
+}
+
+func TestPortForwarder_ConcurrentAccess(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 100)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	// Test concurrent access to the listeners map
+	done := make(chan bool, 10)
+
+	// Start multiple goroutines trying to bind to different ports
+	for i := 0; i < 10; i++ {
+		go func(port int) {
+			defer func() {
+				done <- true
+			}()
+			// This will likely fail in test environment, but tests concurrency
+			forwarder.handleBind(8000 + port)
+		}(i)
+	}
+
+	// Wait for all goroutines to complete
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+			// Good
+		case <-time.After(2 * time.Second):
+			t.Error("goroutine did not complete within timeout")
+			return
+		}
+	}
+
+	// Clean up
+	forwarder.closeAllListeners()
+}
+
+func TestPortForwarder_MessageChannelClosed(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start the forwarder
+	done := make(chan bool)
+	go func() {
+		forwarder.Run(ctx)
+		done <- true
+	}()
+
+	// Close the message channel
+	close(msgChan)
+
+	// Give some time for the forwarder to handle the closed channel
+	time.Sleep(50 * time.Millisecond)
+
+	// Cancel context
+	cancel()
+
+	// Wait for forwarder to stop
+	select {
+	case <-done:
+		// Good, forwarder handled closed channel gracefully
+	case <-time.After(1 * time.Second):
+		t.Error("forwarder did not stop after channel close")
+	}
+}
+
+// Test IP address validation
+func TestPortForwarder_IPValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"IPv4", "10.150.0.2"},
+		{"IPv6", "::1"},
+		{"nil", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ip netip.Addr
+			if tt.ip != "" {
+				var err error
+				ip, err = netip.ParseAddr(tt.ip)
+				if err != nil {
+					t.Fatalf("invalid test IP: %v", err)
+				}
+			}
+
+			tunnel := &Tunnel{
+				ourIP: ip,
+			}
+
+			msgChan := make(chan IPCMessage, 10)
+			forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+
+			// Should not panic with any IP configuration
+			if forwarder == nil {
+				t.Error("NewPortForwarder returned nil")
+			}
+		})
+	}
+}
+
+// Benchmark test for port forwarder creation
+func BenchmarkNewPortForwarder(b *testing.B) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+		_ = forwarder
+	}
+}
+
+// Benchmark test for bind handling
+func BenchmarkPortForwarder_HandleBind(b *testing.B) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	msgChan := make(chan IPCMessage, 10)
+	forwarder := NewPortForwarder(tunnel, msgChan, ForwarderOptions{})
+	defer forwarder.closeAllListeners()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Use different ports to avoid conflicts
+		port := 8000 + (i % 1000)
+		forwarder.handleBind(port)
+	}
+}
+
+func TestPortForwarder_HandleConnectionQueuesUntilReady(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	forwarder := NewPortForwarder(tunnel, make(chan IPCMessage), ForwarderOptions{})
+	forwarder.health = NewHealthChecker("127.0.0.1", 20*time.Millisecond)
+	forwarder.connectTimeout = 2 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go forwarder.health.Run(ctx)
+
+	port := freePort(t)
+	forwarder.health.Register(port)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go forwarder.handleConnection(server, port)
+
+	// The local process starts after the connection has been queued
+	time.Sleep(100 * time.Millisecond)
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", itoa(port)))
+	if err != nil {
+		t.Fatalf("failed to start local server: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	assertEcho(t, client)
+}
+
+func TestPortForwarder_HandleConnectionResetsWhenNotReady(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: netip.MustParseAddr("10.150.0.2"),
+	}
+
+	forwarder := NewPortForwarder(tunnel, make(chan IPCMessage), ForwarderOptions{})
+	forwarder.health = NewHealthChecker("127.0.0.1", 20*time.Millisecond)
+	forwarder.connectTimeout = 100 * time.Millisecond
+
+	port := freePort(t)
+	forwarder.health.Register(port)
+
+	// Accept a real TCP connection so the reset goes over the wire
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to create listener: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+
+	start := time.Now()
+	forwarder.handleConnection(server, port)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("connection was not queued for the connect timeout (returned after %v)", elapsed)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	if err == nil || err == io.EOF {
+		t.Errorf("expected connection reset, got %v", err)
+	}
+}
+
+func TestPortForwarder_CountsBandwidth(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer local.Close()
+	port := local.Addr().(*net.TCPAddr).Port
+
+	// The local service reads the request and answers with a larger reply
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadFull(conn, make([]byte, 1000))
+		conn.Write(make([]byte, 2500))
+	}()
+
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}, make(chan IPCMessage), ForwarderOptions{})
+
+	server, client := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		forwarder.handleConnection(server, port)
+		close(done)
+	}()
+
+	if _, err := client.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if len(reply) != 2500 {
+		t.Fatalf("expected 2500 bytes of reply, got %d", len(reply))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("handleConnection did not return")
+	}
+
+	stats := forwarder.PortStats()
+	if got := stats[port]; got != (BandwidthStats{BytesIn: 1000, BytesOut: 2500}) {
+		t.Errorf("expected 1000 bytes in and 2500 out, got %+v", got)
+	}
+	if len(stats) != 1 {
+		t.Errorf("expected stats for one port, got %v", stats)
+	}
+}
+
+// startIdleTestService accepts one connection on a local port and reports
+// when the forwarder closes it
+func startIdleTestService(t *testing.T) (int, <-chan struct{}) {
+	t.Helper()
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { local.Close() })
+
+	closed := make(chan struct{})
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	return local.Addr().(*net.TCPAddr).Port, closed
+}
+
+func TestPortForwarder_IdleTimeout(t *testing.T) {
+	output := &recordingOutput{}
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelDebug, output))
+	defer SetGlobalLogger(oldLogger)
+
+	port, serviceClosed := startIdleTestService(t)
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}, make(chan IPCMessage), ForwarderOptions{})
+	forwarder.idleTimeout = 100 * time.Millisecond
+
+	server, client := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		forwarder.handleConnection(server, port)
+		close(done)
+	}()
+
+	if _, err := client.Write([]byte{1}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	// Nothing more is sent, so both sides are closed after the timeout
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the idle connection to be closed, got %v", err)
+	}
+	select {
+	case <-serviceClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local connection was not closed")
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConnection did not return")
+	}
+
+	_, entries := output.snapshot()
+	if !strings.Contains(strings.Join(entries, "\n"), fmt.Sprintf("closing connection on port %d after 100ms idle", port)) {
+		t.Errorf("expected an idle debug entry, got %v", entries)
+	}
+}
+
+func TestPortForwarder_IdleTimeoutKeepsActiveConnections(t *testing.T) {
+	port, serviceClosed := startIdleTestService(t)
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}, make(chan IPCMessage), ForwarderOptions{})
+	forwarder.idleTimeout = 150 * time.Millisecond
+
+	server, client := net.Pipe()
+	go forwarder.handleConnection(server, port)
+
+	// Data in one direction keeps the whole connection alive
+	for i := 0; i < 10; i++ {
+		if _, err := client.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("write %d failed on an active connection: %v", i, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-serviceClosed:
+		t.Fatal("active connection was closed as idle")
+	default:
+	}
+
+	client.Close()
+	select {
+	case <-serviceClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("local connection was not closed with the client")
+	}
+}
+
+func TestParseForwardedPorts(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected []ForwardedPort
+		wantErr  bool
+	}{
+		{"8080/tcp", []ForwardedPort{{8080, "tcp"}}, false},
+		{"53/udp", []ForwardedPort{{53, "udp"}}, false},
+		{"8080", []ForwardedPort{{8080, "tcp"}}, false},
+		{" 443/TCP ", []ForwardedPort{{443, "tcp"}}, false},
+		{"8080-8082/tcp", []ForwardedPort{{8080, "tcp"}, {8081, "tcp"}, {8082, "tcp"}}, false},
+		{"8080/sctp", nil, true},
+		{"/tcp", nil, true},
+		{"any/tcp", nil, true},
+		{"70000/tcp", nil, true},
+		{"8090-8080/tcp", nil, true},
+		{"http/tcp", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			ports, err := ParseForwardedPorts(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %v", ports)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(ports, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, ports)
+			}
+		})
+	}
+}
+
+func TestPortForwarder_RegisterPort(t *testing.T) {
+	// The local service listens on 127.0.0.1 and the forwarder on another
+	// loopback address standing in for the WireGuard IP
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer local.Close()
+	port := local.Addr().(*net.TCPAddr).Port
+
+	if probe, err := net.Listen("tcp", fmt.Sprintf("127.0.0.2:%d", port)); err != nil {
+		t.Skipf("127.0.0.2 is not usable here: %v", err)
+	} else {
+		probe.Close()
+	}
+
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("127.0.0.2")}, make(chan IPCMessage), ForwarderOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go forwarder.Run(ctx)
+
+	if err := forwarder.RegisterPort(port, "tcp"); err != nil {
+		t.Fatalf("RegisterPort failed: %v", err)
+	}
+	if err := forwarder.RegisterPort(port, "tcp"); err != nil {
+		t.Errorf("registering a port twice failed: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.2:%d", port), 2*time.Second)
+	if err != nil {
+		t.Fatalf("failed to connect to the forwarded port: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read the echo: %v", err)
+	}
+	if string(reply) != "ping" {
+		t.Errorf("expected the local service to echo ping, got %q", reply)
+	}
+}
+
+func TestPortForwarder_RegisterPortErrors(t *testing.T) {
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}, make(chan IPCMessage), ForwarderOptions{})
+	defer forwarder.closeAllListeners()
+
+	tests := []struct {
+		port     int
+		protocol string
+	}{
+		{53, "udp"},
+		{8080, "sctp"},
+		{0, "tcp"},
+		{70000, "tcp"},
+	}
+	for _, tt := range tests {
+		if err := forwarder.RegisterPort(tt.port, tt.protocol); err == nil {
+			t.Errorf("expected error registering %d/%s", tt.port, tt.protocol)
+		}
+	}
+	if len(forwarder.listeners) != 0 {
+		t.Errorf("expected no listeners after failed registrations, got %d", len(forwarder.listeners))
+	}
+}
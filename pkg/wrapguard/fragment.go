@@ -0,0 +1,149 @@
+package wrapguard
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// fragmentReapTimeout is how long the fragments of a packet are kept while
+// waiting for the rest, as RFC 791 suggests
+const fragmentReapTimeout = 30 * time.Second
+
+// maxFragmentGroups limits how many partly received packets are held at
+// once; fragments of further packets are dropped
+const maxFragmentGroups = 64
+
+// fragmentKey identifies the fragments of one IPv4 packet
+type fragmentKey struct {
+	src, dst [4]byte
+	protocol byte
+	id       uint16
+}
+
+// fragmentGroup collects the fragments of one packet
+type fragmentGroup struct {
+	header    []byte         // IP header of the first fragment, once seen
+	payloads  map[int][]byte // Fragment payloads by byte offset
+	totalLen  int            // Payload length from the last fragment, -1 until seen
+	firstSeen time.Time
+}
+
+// fragmentBuffer reassembles fragmented IPv4 packets from WireGuard. The zero
+// value is ready to use.
+type fragmentBuffer struct {
+	mutex  sync.Mutex
+	groups map[fragmentKey]*fragmentGroup
+}
+
+// add stores an IPv4 fragment and returns the reassembled packet once every
+// fragment has arrived, or nil while some are missing
+func (b *fragmentBuffer) add(packet []byte, now time.Time) []byte {
+	if len(packet) < 20 {
+		return nil
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerLen < 20 || totalLen < headerLen || totalLen > len(packet) {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint16(packet[6:8])
+	moreFragments := flags&0x2000 != 0
+	offset := int(flags&0x1fff) * 8
+	payload := packet[headerLen:totalLen]
+
+	// Every fragment but the last carries a multiple of 8 bytes
+	if moreFragments && len(payload)%8 != 0 || offset+len(payload) > 0xffff-headerLen {
+		return nil
+	}
+
+	key := fragmentKey{protocol: packet[9], id: binary.BigEndian.Uint16(packet[4:6])}
+	copy(key.src[:], packet[12:16])
+	copy(key.dst[:], packet[16:20])
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.reap(now)
+
+	group, ok := b.groups[key]
+	if !ok {
+		if len(b.groups) >= maxFragmentGroups {
+			return nil
+		}
+		if b.groups == nil {
+			b.groups = make(map[fragmentKey]*fragmentGroup)
+		}
+		group = &fragmentGroup{payloads: make(map[int][]byte), totalLen: -1, firstSeen: now}
+		b.groups[key] = group
+	}
+
+	group.payloads[offset] = payload
+	if offset == 0 {
+		group.header = packet[:headerLen]
+	}
+	if !moreFragments {
+		group.totalLen = offset + len(payload)
+	}
+
+	reassembled, complete := group.reassemble()
+	if complete {
+		delete(b.groups, key)
+	}
+	return reassembled
+}
+
+// reap drops packets whose fragments have been waiting too long
+func (b *fragmentBuffer) reap(now time.Time) {
+	for key, group := range b.groups {
+		if now.Sub(group.firstSeen) > fragmentReapTimeout {
+			delete(b.groups, key)
+		}
+	}
+}
+
+// reassemble joins the fragments in offset order. It reports complete once
+// all fragments are in; overlapping fragments also complete the group but
+// return no packet, so it is dropped.
+func (g *fragmentGroup) reassemble() (packet []byte, complete bool) {
+	if g.header == nil || g.totalLen < 0 {
+		return nil, false
+	}
+
+	offsets := make([]int, 0, len(g.payloads))
+	for offset := range g.payloads {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	covered := 0
+	for _, offset := range offsets {
+		if offset > covered {
+			return nil, false // A gap: still waiting
+		}
+		if offset < covered {
+			return nil, true // Overlapping fragments
+		}
+		covered += len(g.payloads[offset])
+	}
+	if covered != g.totalLen {
+		return nil, covered > g.totalLen
+	}
+
+	headerLen := len(g.header)
+	packet = make([]byte, headerLen, headerLen+g.totalLen)
+	copy(packet, g.header)
+	for _, offset := range offsets {
+		packet = append(packet, g.payloads[offset]...)
+	}
+
+	// The reassembled packet is whole: no fragment flags, new length and checksum
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[6:8], binary.BigEndian.Uint16(packet[6:8])&0x4000)
+	binary.BigEndian.PutUint16(packet[10:12], 0)
+	binary.BigEndian.PutUint16(packet[10:12], internetChecksum(packet[:headerLen]))
+
+	return packet, true
+}
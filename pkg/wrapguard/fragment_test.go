@@ -0,0 +1,170 @@
+package wrapguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// testIPPacket builds an IPv4 packet from 10.150.0.3 to 10.150.0.2 around payload
+func testIPPacket(protocol byte, id uint16, payload []byte) []byte {
+	packet := make([]byte, 20+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:6], id)
+	packet[8] = 64
+	packet[9] = protocol
+	copy(packet[12:16], net.ParseIP("10.150.0.3").To4())
+	copy(packet[16:20], net.ParseIP("10.150.0.2").To4())
+	copy(packet[20:], payload)
+	binary.BigEndian.PutUint16(packet[10:12], internetChecksum(packet[:20]))
+	return packet
+}
+
+// fragmentIPPacket splits packet into fragments whose payloads start at
+// the given byte offsets, each a multiple of 8
+func fragmentIPPacket(packet []byte, offsets ...int) [][]byte {
+	payload := packet[20:]
+	var fragments [][]byte
+	for i, offset := range offsets {
+		end := len(payload)
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+
+		fragment := append(append([]byte(nil), packet[:20]...), payload[offset:end]...)
+		binary.BigEndian.PutUint16(fragment[2:4], uint16(len(fragment)))
+		flags := binary.BigEndian.Uint16(packet[6:8])&0x4000 | uint16(offset/8)
+		if end < len(payload) {
+			flags |= 0x2000
+		}
+		binary.BigEndian.PutUint16(fragment[6:8], flags)
+		binary.BigEndian.PutUint16(fragment[10:12], 0)
+		binary.BigEndian.PutUint16(fragment[10:12], internetChecksum(fragment[:20]))
+		fragments = append(fragments, fragment)
+	}
+	return fragments
+}
+
+func TestTunnel_ReassemblesFragmentedTCP(t *testing.T) {
+	client := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.2"), connMap: make(map[string]*TunnelConn)}
+	conn := &TunnelConn{readChan: make(chan []byte, 4)}
+	client.connMap["10.150.0.3:80->10.150.0.2:12345"] = conn
+
+	// A TCP segment from port 80 to 12345 with a 3000 byte payload
+	segment := make([]byte, 20+3000)
+	binary.BigEndian.PutUint16(segment[0:2], 80)
+	binary.BigEndian.PutUint16(segment[2:4], 12345)
+	segment[12] = 0x50
+	segment[13] = 0x18 // PSH+ACK
+	for i := 20; i < len(segment); i++ {
+		segment[i] = byte(i)
+	}
+	fragments := fragmentIPPacket(testIPPacket(6, 42, segment), 0, 1000, 2000)
+	if len(fragments) != 3 {
+		t.Fatalf("expected three fragments, got %d", len(fragments))
+	}
+
+	// Out of order: nothing is delivered until the last piece arrives
+	for _, fragment := range [][]byte{fragments[2], fragments[0]} {
+		client.handleIncomingPacket(fragment)
+		select {
+		case got := <-conn.readChan:
+			t.Fatalf("delivered %d bytes before all fragments arrived", len(got))
+		default:
+		}
+	}
+	client.handleIncomingPacket(fragments[1])
+
+	select {
+	case got := <-conn.readChan:
+		if !bytes.Equal(got, segment) {
+			t.Errorf("reassembled segment differs: got %d bytes, expected %d", len(got), len(segment))
+		}
+	default:
+		t.Fatal("expected the reassembled segment to be delivered")
+	}
+	if len(client.fragments.groups) != 0 {
+		t.Errorf("expected no fragments left over, got %d groups", len(client.fragments.groups))
+	}
+}
+
+func TestFragmentBuffer_Reassemble(t *testing.T) {
+	packet := testIPPacket(17, 7, bytes.Repeat([]byte("wrapguard"), 100))
+	binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Keep DF on the reassembled packet
+	binary.BigEndian.PutUint16(packet[10:12], 0)
+	binary.BigEndian.PutUint16(packet[10:12], internetChecksum(packet[:20]))
+
+	var buffer fragmentBuffer
+	now := time.Now()
+	var reassembled []byte
+	for _, fragment := range fragmentIPPacket(packet, 0, 296, 600) {
+		reassembled = buffer.add(fragment, now)
+	}
+
+	if !bytes.Equal(reassembled, packet) {
+		t.Fatalf("expected the original packet back, got %x", reassembled)
+	}
+	if internetChecksum(reassembled[:20]) != 0 {
+		t.Error("expected a valid header checksum")
+	}
+}
+
+func TestFragmentBuffer_Reap(t *testing.T) {
+	var buffer fragmentBuffer
+	now := time.Now()
+
+	fragments := fragmentIPPacket(testIPPacket(17, 1, make([]byte, 64)), 0, 32)
+	buffer.add(fragments[0], now)
+
+	// The rest arrives too late; the first fragment has been dropped
+	if got := buffer.add(fragments[1], now.Add(fragmentReapTimeout+time.Second)); got != nil {
+		t.Error("expected no packet from fragments older than the reap timeout")
+	}
+	if got := buffer.add(fragments[0], now.Add(fragmentReapTimeout+2*time.Second)); got == nil {
+		t.Error("expected the packet once the first fragment was resent")
+	}
+}
+
+func TestFragmentBuffer_Invalid(t *testing.T) {
+	now := time.Now()
+	fragments := fragmentIPPacket(testIPPacket(17, 1, make([]byte, 64)), 0, 32)
+
+	t.Run("overlapping fragments are dropped", func(t *testing.T) {
+		var buffer fragmentBuffer
+		overlap := fragmentIPPacket(testIPPacket(17, 1, make([]byte, 64)), 0, 24)[1]
+		buffer.add(fragments[0], now)
+		buffer.add(fragments[1], now)
+		if got := buffer.add(overlap, now); got != nil {
+			t.Error("expected no packet from overlapping fragments")
+		}
+	})
+
+	t.Run("unaligned fragment", func(t *testing.T) {
+		var buffer fragmentBuffer
+		unaligned := fragmentIPPacket(testIPPacket(17, 1, make([]byte, 64)), 0, 30)[0]
+		if got := buffer.add(unaligned, now); got != nil || len(buffer.groups) != 0 {
+			t.Error("expected a non-final fragment that is not a multiple of 8 bytes to be dropped")
+		}
+	})
+
+	t.Run("too many packets", func(t *testing.T) {
+		var buffer fragmentBuffer
+		for id := 0; id < maxFragmentGroups+10; id++ {
+			buffer.add(fragmentIPPacket(testIPPacket(17, uint16(id), make([]byte, 64)), 0, 32)[0], now)
+		}
+		if len(buffer.groups) != maxFragmentGroups {
+			t.Errorf("expected at most %d pending packets, got %d", maxFragmentGroups, len(buffer.groups))
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		var buffer fragmentBuffer
+		if got := buffer.add(fragments[0][:10], now); got != nil {
+			t.Error("expected a truncated packet to be ignored")
+		}
+	})
+}
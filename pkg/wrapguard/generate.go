@@ -0,0 +1,96 @@
+package wrapguard
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// GenerateConfigOptions describes a single-peer config for GenerateConfig.
+// Keys are base64, as printed by wg genkey and wg pubkey.
+type GenerateConfigOptions struct {
+	PrivateKey     string
+	Address        string // Interface addresses with prefix length, e.g. 10.0.0.2/24 or 10.0.0.2/24, fd00::2/64
+	PeerPublicKey  string
+	PeerEndpoint   string // host:port; left empty for peers that connect to us
+	PeerAllowedIPs []string
+}
+
+// GenerateKeyPair returns a new base64 WireGuard private key and its public
+// key. The private key is clamped the way wireguard-go and wg genkey do it.
+func GenerateKeyPair() (privateKey, publicKey string, err error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	raw[0] &= 248
+	raw[31] = (raw[31] & 127) | 64
+
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.Bytes()), base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// PublicKey returns the base64 public key for a base64 private key
+func PublicKey(privateKey string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode base64 key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid private key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// GenerateConfig builds a wg-quick config with an [Interface] and one
+// [Peer] section and validates it as ParseConfig would. The endpoint is
+// written as given and not resolved.
+func GenerateConfig(opts GenerateConfigOptions) ([]byte, error) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{Address: splitAddresses(opts.Address)},
+		Peers:     []PeerConfig{{Endpoint: strings.TrimSpace(opts.PeerEndpoint)}},
+	}
+	peer := &config.Peers[0]
+
+	var errs []error
+	if opts.PrivateKey != "" {
+		hexKey, err := base64ToHex(strings.TrimSpace(opts.PrivateKey))
+		if err != nil {
+			errs = append(errs, invalidKeyError("PrivateKey", "invalid private key format: %w", err))
+		}
+		config.Interface.PrivateKey = hexKey
+	}
+	if opts.PeerPublicKey != "" {
+		hexKey, err := base64ToHex(strings.TrimSpace(opts.PeerPublicKey))
+		if err != nil {
+			errs = append(errs, invalidKeyError("PublicKey", "invalid public key format: %w", err))
+		}
+		peer.PublicKey = hexKey
+	}
+	if peer.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(peer.Endpoint); err != nil {
+			errs = append(errs, invalidPeerError("invalid endpoint %s: %w", peer.Endpoint, err))
+		}
+	}
+	for _, allowedIP := range opts.PeerAllowedIPs {
+		if allowedIP = strings.TrimSpace(allowedIP); allowedIP != "" {
+			peer.AllowedIPs = append(peer.AllowedIPs, allowedIP)
+		}
+	}
+
+	// Malformed values would otherwise be reported again as missing
+	if len(errs) > 0 {
+		return nil, newConfigErrors(errs...)
+	}
+	if err := newConfigErrors(validateConfig(config)); err != nil {
+		return nil, err
+	}
+	return config.Marshal()
+}
@@ -0,0 +1,171 @@
+package wrapguard
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	private, public, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+
+	derived, err := PublicKey(private)
+	if err != nil {
+		t.Fatalf("PublicKey failed: %v", err)
+	}
+	if derived != public {
+		t.Errorf("expected public key %s, derived %s", public, derived)
+	}
+
+	other, _, _ := GenerateKeyPair()
+	if other == private {
+		t.Error("expected a new key each time")
+	}
+
+	if _, err := PublicKey("not base64"); err == nil {
+		t.Error("expected an error for an invalid private key")
+	}
+}
+
+func TestGenerateKeyPair_KeyLengths(t *testing.T) {
+	private, public, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+
+	for name, key := range map[string]string{"private": private, "public": public} {
+		hexKey, err := base64ToHex(key)
+		if err != nil {
+			t.Fatalf("%s key is not valid base64: %v", name, err)
+		}
+		if raw, _ := hex.DecodeString(hexKey); len(raw) != 32 {
+			t.Errorf("expected a 32 byte %s key, got %d bytes", name, len(raw))
+		}
+	}
+
+	// The private key is clamped like wg genkey does it
+	raw, _ := base64.StdEncoding.DecodeString(private)
+	if raw[0]&7 != 0 || raw[31]&128 != 0 || raw[31]&64 == 0 {
+		t.Errorf("private key is not clamped: %x", raw)
+	}
+}
+
+func TestPublicKey_MatchesTestHelper(t *testing.T) {
+	public, err := PublicKey(generateTestKeyWithSeed(1))
+	if err != nil {
+		t.Fatalf("PublicKey failed: %v", err)
+	}
+	if expected := testPublicKey(t, 1); public != expected {
+		t.Errorf("expected %s, got %s", expected, public)
+	}
+}
+
+func TestGenerateConfig(t *testing.T) {
+	private, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+	opts := GenerateConfigOptions{
+		PrivateKey:     private,
+		Address:        "10.0.0.2/24",
+		PeerPublicKey:  testPublicKey(t, 2),
+		PeerEndpoint:   "127.0.0.1:51820",
+		PeerAllowedIPs: []string{"0.0.0.0/0", " 10.10.0.0/16"},
+	}
+
+	data, err := GenerateConfig(opts)
+	if err != nil {
+		t.Fatalf("GenerateConfig failed: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "wg0.conf")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("generated config does not parse: %v\n%s", err, data)
+	}
+
+	privateHex, _ := base64ToHex(private)
+	publicHex, _ := base64ToHex(opts.PeerPublicKey)
+	if config.Interface.PrivateKey != privateHex || !slices.Equal(config.Interface.Address, []string{"10.0.0.2/24"}) {
+		t.Errorf("unexpected interface %+v", config.Interface)
+	}
+	if len(config.Peers) != 1 {
+		t.Fatalf("expected one peer, got %d", len(config.Peers))
+	}
+	peer := config.Peers[0]
+	if peer.PublicKey != publicHex || peer.Endpoint != "127.0.0.1:51820" {
+		t.Errorf("unexpected peer %+v", peer)
+	}
+	if !reflect.DeepEqual(peer.AllowedIPs, []string{"0.0.0.0/0", "10.10.0.0/16"}) {
+		t.Errorf("unexpected AllowedIPs %v", peer.AllowedIPs)
+	}
+}
+
+func TestGenerateConfig_Hostname(t *testing.T) {
+	// Hostnames are written as given rather than resolved
+	data, err := GenerateConfig(GenerateConfigOptions{
+		PrivateKey:     generateTestKeyWithSeed(1),
+		Address:        "10.0.0.2/24",
+		PeerPublicKey:  testPublicKey(t, 2),
+		PeerEndpoint:   "vpn.example.test:51820",
+		PeerAllowedIPs: []string{"10.0.0.0/24"},
+	})
+	if err != nil {
+		t.Fatalf("GenerateConfig failed: %v", err)
+	}
+	if !strings.Contains(string(data), "Endpoint = vpn.example.test:51820\n") {
+		t.Errorf("expected the hostname endpoint, got:\n%s", data)
+	}
+}
+
+func TestGenerateConfig_Errors(t *testing.T) {
+	valid := GenerateConfigOptions{
+		PrivateKey:     generateTestKeyWithSeed(1),
+		Address:        "10.0.0.2/24",
+		PeerPublicKey:  testPublicKey(t, 2),
+		PeerAllowedIPs: []string{"10.0.0.0/24"},
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*GenerateConfigOptions)
+		check   func(error) bool
+		message string
+	}{
+		{"missing private key", func(o *GenerateConfigOptions) { o.PrivateKey = "" }, func(err error) bool { return errors.As(err, &ErrInvalidKey{}) }, "interface private key is required"},
+		{"invalid private key", func(o *GenerateConfigOptions) { o.PrivateKey = "nope" }, func(err error) bool { return errors.As(err, &ErrInvalidKey{}) }, "invalid private key format"},
+		{"invalid peer key", func(o *GenerateConfigOptions) { o.PeerPublicKey = "nope" }, func(err error) bool { return errors.As(err, &ErrInvalidKey{}) }, "invalid public key format"},
+		{"missing address", func(o *GenerateConfigOptions) { o.Address = "" }, func(err error) bool { return errors.As(err, &ErrInvalidAddress{}) }, "interface address is required"},
+		{"invalid endpoint", func(o *GenerateConfigOptions) { o.PeerEndpoint = "vpn.example.test" }, func(err error) bool { return errors.As(err, &ErrInvalidPeer{}) }, "invalid endpoint"},
+		{"no allowed IPs", func(o *GenerateConfigOptions) { o.PeerAllowedIPs = []string{" "} }, func(err error) bool { return errors.As(err, &ErrInvalidPeer{}) }, "at least one allowed IP is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := valid
+			tt.modify(&opts)
+			_, err := GenerateConfig(opts)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.check(err) || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if strings.Count(err.Error(), "private key") > 1 {
+				t.Errorf("expected the private key to be reported once, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package wrapguard
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// handshakeMessage describes one of wireguard-go's verbose messages about
+// handshakes. A handshake the peer started is inbound, one started here is
+// outbound.
+type handshakeMessage struct {
+	direction string
+	kind      string // "initiation" or "response"
+	sent      bool
+}
+
+var handshakeMessages = map[string]handshakeMessage{
+	"Received handshake initiation": {"inbound", "initiation", false},
+	"Sending handshake response":    {"inbound", "response", true},
+	"Sending handshake initiation":  {"outbound", "initiation", true},
+	"Received handshake response":   {"outbound", "response", false},
+}
+
+// HandshakeLogger wraps a wireguard-go logger, picking the handshake
+// messages out of its verbose output and logging each one as an entry with
+// the fields event, peer_pubkey, direction, type and at. Every message is
+// still passed on to the wrapped logger.
+type HandshakeLogger struct {
+	wrapped *device.Logger
+	log     *Logger
+	keys    map[string]string // wireguard-go's abbreviated peer keys -> full base64 keys
+}
+
+// NewHandshakeLogger returns a logger that writes handshake entries to log
+// and passes everything on to wrapped. wireguard-go only names peers by an
+// abbreviated key, so the full keys are looked up in peers.
+func NewHandshakeLogger(wrapped *device.Logger, log *Logger, peers []PeerConfig) *HandshakeLogger {
+	h := &HandshakeLogger{wrapped: wrapped, log: log, keys: make(map[string]string)}
+	for _, peer := range peers {
+		key := peer.PublicKey
+		if isHexString(key) {
+			var err error
+			if key, err = hexToBase64(key); err != nil {
+				continue
+			}
+		}
+		if len(key) != 44 {
+			continue
+		}
+		abbreviated := key[0:4] + "…" + key[39:43]
+		if _, exists := h.keys[abbreviated]; exists {
+			// Two peers share an abbreviation, so neither can be named
+			h.keys[abbreviated] = ""
+			continue
+		}
+		h.keys[abbreviated] = key
+	}
+	return h
+}
+
+// DeviceLogger returns the logger to hand to device.NewDevice. Its verbose
+// messages are always on, since they carry the handshakes.
+func (h *HandshakeLogger) DeviceLogger() *device.Logger {
+	return &device.Logger{Verbosef: h.Verbosef, Errorf: h.wrapped.Errorf}
+}
+
+// Verbosef logs an entry if the message is about a handshake, such as
+// "peer(AbCd…WxYz) - Received handshake initiation", and passes it on
+func (h *HandshakeLogger) Verbosef(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if peer, text, ok := strings.Cut(message, " - "); ok {
+		if handshake, ok := handshakeMessages[text]; ok {
+			h.logHandshake(peer, handshake)
+		}
+	}
+	h.wrapped.Verbosef(format, args...)
+}
+
+func (h *HandshakeLogger) logHandshake(peer string, handshake handshakeMessage) {
+	abbreviated := strings.TrimSuffix(strings.TrimPrefix(peer, "peer("), ")")
+	key := h.keys[abbreviated]
+	if key == "" {
+		key = abbreviated
+	}
+
+	verb, preposition := "Received", "from"
+	if handshake.sent {
+		verb, preposition = "Sent", "to"
+	}
+	h.log.WithFields(map[string]interface{}{
+		"event":       "handshake",
+		"peer_pubkey": key,
+		"direction":   handshake.direction,
+		"type":        handshake.kind,
+		"at":          time.Now().UTC().Format(time.RFC3339Nano),
+	}).Infof("WireGuard handshake: %s %s %s %s", verb, handshake.kind, preposition, key)
+}
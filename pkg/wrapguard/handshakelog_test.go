@@ -0,0 +1,111 @@
+package wrapguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/device"
+)
+
+// abbreviatedKey is how wireguard-go names the peer with a base64 key
+func abbreviatedKey(key string) string {
+	return key[0:4] + "…" + key[39:43]
+}
+
+func TestHandshakeLogger(t *testing.T) {
+	known := testPublicKey(t, 2)
+	hexKey, err := base64ToHex(known)
+	if err != nil {
+		t.Fatalf("base64ToHex failed: %v", err)
+	}
+	unknown := abbreviatedKey(testPublicKey(t, 3))
+
+	var verbose []string
+	wrapped := &device.Logger{
+		Verbosef: func(format string, args ...any) {
+			verbose = append(verbose, format)
+		},
+		Errorf: device.DiscardLogf,
+	}
+	var buf bytes.Buffer
+	// Keys from a parsed config are hex, those built by hand may be base64
+	peers := []PeerConfig{{PublicKey: hexKey}, {PublicKey: testPublicKey(t, 4)}}
+	wgLogger := NewHandshakeLogger(wrapped, NewLogger(LogLevelInfo, &buf), peers).DeviceLogger()
+
+	tests := []struct {
+		message   string
+		peer      string
+		pubkey    string
+		direction string
+		kind      string
+		text      string
+	}{
+		{"Received handshake initiation", abbreviatedKey(known), known, "inbound", "initiation", "Received initiation from " + known},
+		{"Sending handshake response", abbreviatedKey(known), known, "inbound", "response", "Sent response to " + known},
+		{"Sending handshake initiation", abbreviatedKey(testPublicKey(t, 4)), testPublicKey(t, 4), "outbound", "initiation", "Sent initiation to " + testPublicKey(t, 4)},
+		{"Received handshake response", unknown, unknown, "outbound", "response", "Received response from " + unknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			buf.Reset()
+			before := time.Now().UTC().Add(-time.Second)
+			wgLogger.Verbosef("%v - "+tt.message, "peer("+tt.peer+")")
+
+			var entry LogEntry
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("expected one JSON entry, got %q: %v", buf.String(), err)
+			}
+			if entry.Level != "info" || entry.Message != "WireGuard handshake: "+tt.text {
+				t.Errorf("unexpected entry %+v", entry)
+			}
+			expected := map[string]interface{}{
+				"event":       "handshake",
+				"peer_pubkey": tt.pubkey,
+				"direction":   tt.direction,
+				"type":        tt.kind,
+			}
+			for field, value := range expected {
+				if entry.Fields[field] != value {
+					t.Errorf("expected %s %q, got %v", field, value, entry.Fields[field])
+				}
+			}
+			at, err := time.Parse(time.RFC3339Nano, entry.Fields["at"].(string))
+			if err != nil || at.Before(before) {
+				t.Errorf("expected a current timestamp in at, got %v", entry.Fields["at"])
+			}
+		})
+	}
+
+	// Other messages are passed on without an entry
+	buf.Reset()
+	wgLogger.Verbosef("%v - Receiving keepalive packet", "peer("+abbreviatedKey(known)+")")
+	wgLogger.Verbosef("Routine: receive incoming %s - started", "v4")
+	if buf.Len() != 0 {
+		t.Errorf("expected no entries for other messages, got %q", buf.String())
+	}
+	if len(verbose) != len(tests)+2 || !strings.Contains(verbose[len(verbose)-1], "Routine: receive incoming") {
+		t.Errorf("expected every message passed to the wrapped logger, got %q", verbose)
+	}
+}
+
+func TestHandshakeLogger_AmbiguousKeys(t *testing.T) {
+	// Two keys with the same abbreviation cannot be told apart
+	a := testPublicKey(t, 2)
+	b := a[:10] + strings.Repeat("A", 25) + a[35:]
+	var buf bytes.Buffer
+	wgLogger := NewHandshakeLogger(&device.Logger{Verbosef: device.DiscardLogf, Errorf: device.DiscardLogf},
+		NewLogger(LogLevelInfo, &buf), []PeerConfig{{PublicKey: a}, {PublicKey: b}}).DeviceLogger()
+
+	wgLogger.Verbosef("%v - Received handshake initiation", "peer("+abbreviatedKey(a)+")")
+	var entry LogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON entry, got %q: %v", buf.String(), err)
+	}
+	if entry.Fields["peer_pubkey"] != abbreviatedKey(a) {
+		t.Errorf("expected the abbreviated key for an ambiguous peer, got %v", entry.Fields["peer_pubkey"])
+	}
+}
@@ -0,0 +1,170 @@
+package wrapguard
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// healthPollInterval is how often WaitReady re-checks the readiness state
+const healthPollInterval = 50 * time.Millisecond
+
+// HealthChecker periodically dials registered local ports and tracks
+// whether something is accepting connections on each of them.
+type HealthChecker struct {
+	host     string
+	interval time.Duration
+	ports    map[int]bool
+	mutex    sync.RWMutex
+	pending  map[int]chan struct{} // Closed when Register's check of the port returns
+}
+
+func NewHealthChecker(host string, interval time.Duration) *HealthChecker {
+	return &HealthChecker{
+		host:     host,
+		interval: interval,
+		ports:    make(map[int]bool),
+		pending:  make(map[int]chan struct{}),
+	}
+}
+
+// Register starts tracking a port. It is marked not ready until the first
+// check succeeds; that check runs immediately in the background.
+func (hc *HealthChecker) Register(port int) {
+	hc.mutex.Lock()
+	if _, exists := hc.ports[port]; exists {
+		hc.mutex.Unlock()
+		return
+	}
+	hc.ports[port] = false
+	done := make(chan struct{})
+	hc.pending[port] = done
+	hc.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+		hc.check(port)
+
+		hc.mutex.Lock()
+		if hc.pending[port] == done {
+			delete(hc.pending, port)
+		}
+		hc.mutex.Unlock()
+	}()
+}
+
+// Wait blocks until the check started by Register for the port has finished
+func (hc *HealthChecker) Wait(port int) {
+	hc.mutex.RLock()
+	done, exists := hc.pending[port]
+	hc.mutex.RUnlock()
+	if exists {
+		<-done
+	}
+}
+
+// WaitAll blocks until every check started by Register has finished
+func (hc *HealthChecker) WaitAll() {
+	hc.mutex.RLock()
+	pending := make([]chan struct{}, 0, len(hc.pending))
+	for _, done := range hc.pending {
+		pending = append(pending, done)
+	}
+	hc.mutex.RUnlock()
+
+	for _, done := range pending {
+		<-done
+	}
+}
+
+// Unregister stops tracking a port
+func (hc *HealthChecker) Unregister(port int) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	delete(hc.ports, port)
+}
+
+// Registered reports whether the port is being tracked
+func (hc *HealthChecker) Registered(port int) bool {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	_, exists := hc.ports[port]
+	return exists
+}
+
+// Ready reports whether the last check of the port succeeded
+func (hc *HealthChecker) Ready(port int) bool {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	return hc.ports[port]
+}
+
+// WaitReady polls the readiness of a port until it is ready or the timeout
+// expires, and reports whether it became ready.
+func (hc *HealthChecker) WaitReady(port int, timeout time.Duration) bool {
+	if hc.Ready(port) {
+		return true
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(healthPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-deadline.C:
+			return hc.Ready(port)
+		case <-ticker.C:
+			if hc.Ready(port) {
+				return true
+			}
+		}
+	}
+}
+
+// Run checks every registered port at the configured interval until the
+// context is cancelled.
+func (hc *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hc.mutex.RLock()
+			ports := make([]int, 0, len(hc.ports))
+			for port := range hc.ports {
+				ports = append(ports, port)
+			}
+			hc.mutex.RUnlock()
+
+			for _, port := range ports {
+				hc.check(port)
+			}
+		}
+	}
+}
+
+func (hc *HealthChecker) check(port int) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(hc.host, fmt.Sprint(port)), hc.interval)
+	ready := err == nil
+	if ready {
+		conn.Close()
+	}
+
+	hc.mutex.Lock()
+	previous, exists := hc.ports[port]
+	if exists {
+		hc.ports[port] = ready
+	}
+	hc.mutex.Unlock()
+
+	if exists && previous != ready {
+		logger.Debugf("Health check: port %d ready=%v", port, ready)
+	}
+}
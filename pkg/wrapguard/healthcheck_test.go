@@ -0,0 +1,149 @@
+package wrapguard
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// freePort returns a localhost port with nothing listening on it
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func listenOn(t *testing.T, port int) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", itoa(port)))
+	if err != nil {
+		t.Fatalf("failed to listen on port %d: %v", port, err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestHealthChecker_Register(t *testing.T) {
+	listener := listenOn(t, 0)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	hc := NewHealthChecker("127.0.0.1", 50*time.Millisecond)
+	if hc.Registered(port) {
+		t.Error("port should not be registered before Register")
+	}
+
+	hc.Register(port)
+	hc.Register(port) // Duplicate registration is a no-op
+
+	if !hc.Registered(port) {
+		t.Error("port should be registered")
+	}
+	if !hc.WaitReady(port, time.Second) {
+		t.Error("port with a listener should become ready after the initial check")
+	}
+}
+
+func TestHealthChecker_Wait(t *testing.T) {
+	listener := listenOn(t, 0)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	hc := NewHealthChecker("127.0.0.1", 50*time.Millisecond)
+	hc.Register(port)
+	hc.Wait(port)
+
+	// Wait returns only once the first check has recorded its result
+	if !hc.Ready(port) {
+		t.Error("port with a listener should be ready once its first check is done")
+	}
+
+	other := freePort(t)
+	hc.Register(other)
+	hc.WaitAll()
+
+	hc.mutex.RLock()
+	pending := len(hc.pending)
+	hc.mutex.RUnlock()
+	if pending != 0 {
+		t.Errorf("expected no checks pending after WaitAll, got %d", pending)
+	}
+}
+
+func TestHealthChecker_NotReady(t *testing.T) {
+	port := freePort(t)
+
+	hc := NewHealthChecker("127.0.0.1", 50*time.Millisecond)
+	hc.Register(port)
+
+	if hc.WaitReady(port, 150*time.Millisecond) {
+		t.Error("port without a listener should not be ready")
+	}
+
+	// Unregistered ports are never ready
+	if hc.Ready(port + 1) {
+		t.Error("unregistered port should not be ready")
+	}
+}
+
+func TestHealthChecker_RunTracksChanges(t *testing.T) {
+	port := freePort(t)
+
+	hc := NewHealthChecker("127.0.0.1", 50*time.Millisecond)
+	hc.Register(port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hc.Run(ctx)
+
+	time.Sleep(100 * time.Millisecond)
+	if hc.Ready(port) {
+		t.Fatal("port should not be ready before the listener starts")
+	}
+
+	listener := listenOn(t, port)
+	if !hc.WaitReady(port, time.Second) {
+		t.Fatal("port should become ready once the listener starts")
+	}
+
+	listener.Close()
+	deadline := time.Now().Add(time.Second)
+	for hc.Ready(port) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if hc.Ready(port) {
+		t.Error("port should become not ready once the listener stops")
+	}
+}
+
+func TestHealthChecker_RunStopsOnCancel(t *testing.T) {
+	hc := NewHealthChecker("127.0.0.1", 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hc.Run(ctx)
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Run did not return after cancel")
+	}
+}
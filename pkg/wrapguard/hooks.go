@@ -0,0 +1,96 @@
+package wrapguard
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// handshakePollInterval is how often the device is checked for the first
+// handshake while an on-connected hook is waiting
+const handshakePollInterval = 100 * time.Millisecond
+
+// watchFirstHandshake marks the tunnel connected and runs command, unless
+// it is empty, once any peer has completed a handshake, giving up when ctx
+// is cancelled
+func (t *Tunnel) watchFirstHandshake(ctx context.Context, command string) {
+	go func() {
+		ticker := time.NewTicker(handshakePollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if t.hasHandshake() {
+					t.connected.Store(true)
+					if command != "" {
+						t.runLifecycleHook("on-connected", command)
+					}
+					return
+				}
+			}
+		}
+	}()
+}
+
+// hasHandshake reports whether the device has completed a handshake with
+// any peer
+func (t *Tunnel) hasHandshake() bool {
+	return !t.lastHandshake().IsZero()
+}
+
+// lastHandshake returns the time of the most recent handshake with any peer,
+// or the zero time if there has been none
+func (t *Tunnel) lastHandshake() time.Time {
+	t.mutex.RLock()
+	dev := t.device
+	t.mutex.RUnlock()
+	if dev == nil {
+		return time.Time{}
+	}
+
+	state, err := dev.IpcGet()
+	if err != nil {
+		return time.Time{}
+	}
+
+	var latest time.Time
+	for _, at := range peerHandshakes(state) {
+		if at.After(latest) {
+			latest = at
+		}
+	}
+	return latest
+}
+
+// runLifecycleHook starts command without waiting for it to finish. The
+// hook learns about the tunnel from WRAPGUARD_PEER_ENDPOINT,
+// WRAPGUARD_INTERFACE_IP and WRAPGUARD_VERSION.
+func (t *Tunnel) runLifecycleHook(name, command string) {
+	var endpoint string
+	if config := t.config.Load(); config != nil && len(config.Peers) > 0 {
+		endpoint = config.Peers[0].Endpoint
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"WRAPGUARD_PEER_ENDPOINT="+endpoint,
+		"WRAPGUARD_INTERFACE_IP="+t.ourIP.String(),
+		"WRAPGUARD_VERSION="+GetVersion(),
+	)
+
+	if err := cmd.Start(); err != nil {
+		logger.Warnf("Failed to run %s hook: %v", name, err)
+		return
+	}
+	logger.Debugf("Started %s hook %q", name, command)
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.Warnf("%s hook %q failed: %v", name, command, err)
+		}
+	}()
+}
@@ -0,0 +1,214 @@
+package wrapguard
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPublicKey returns the base64 public key for generateTestKeyWithSeed(seed)
+func testPublicKey(t *testing.T, seed byte) string {
+	t.Helper()
+
+	private, err := base64.StdEncoding.DecodeString(generateTestKeyWithSeed(seed))
+	if err != nil {
+		t.Fatalf("failed to decode test key: %v", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		t.Fatalf("invalid test key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+// freeUDPPort returns a UDP port that was free a moment ago
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free UDP port: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// writeHookScript returns a command that records the hook environment in path
+func writeHookScript(t *testing.T, path string) string {
+	t.Helper()
+
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	content := "#!/bin/sh\necho \"$WRAPGUARD_INTERFACE_IP $WRAPGUARD_PEER_ENDPOINT $WRAPGUARD_VERSION\" > \"$1.$$\" && mv \"$1.$$\" \"$1\"\n"
+	if err := os.WriteFile(script, []byte(content), 0700); err != nil {
+		t.Fatalf("failed to write hook script: %v", err)
+	}
+	return script + " " + path
+}
+
+// waitForFile polls for path to appear and returns its contents
+func waitForFile(t *testing.T, path string, timeout time.Duration) (string, bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if data, err := os.ReadFile(path); err == nil {
+			return strings.TrimSpace(string(data)), true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return "", false
+}
+
+// newPeeredConfig returns a config that listens on listenPort and peers with
+// the tunnel listening on peerPort
+func newPeeredConfig(t *testing.T, seed, peerSeed byte, address, peerIP string, listenPort, peerPort int) *WireGuardConfig {
+	t.Helper()
+
+	return newTestConfig(t, testConfig{
+		seed:       seed,
+		address:    address + "/24",
+		listenPort: listenPort,
+		peers: []testPeer{{
+			publicKey:           testPublicKey(t, peerSeed),
+			endpoint:            fmt.Sprintf("127.0.0.1:%d", peerPort),
+			allowedIPs:          peerIP + "/32",
+			persistentKeepalive: 1,
+		}},
+	})
+}
+
+// newPeeredTunnel starts a tunnel that listens on listenPort and peers with
+// the tunnel listening on peerPort
+func newPeeredTunnel(t *testing.T, ctx context.Context, seed, peerSeed byte, address, peerIP string, listenPort, peerPort int) *Tunnel {
+	t.Helper()
+	return newPeeredTunnelWithOptions(t, ctx, TunnelOptions{}, seed, peerSeed, address, peerIP, listenPort, peerPort)
+}
+
+// newPeeredTunnelWithOptions is like newPeeredTunnel, starting the tunnel
+// with opts
+func newPeeredTunnelWithOptions(t *testing.T, ctx context.Context, opts TunnelOptions, seed, peerSeed byte, address, peerIP string, listenPort, peerPort int) *Tunnel {
+	t.Helper()
+
+	tunnel, err := NewTunnel(ctx, newPeeredConfig(t, seed, peerSeed, address, peerIP, listenPort, peerPort), opts)
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	t.Cleanup(func() { tunnel.Close() })
+	return tunnel
+}
+
+func TestTunnel_OnConnectedAfterHandshake(t *testing.T) {
+	connected := filepath.Join(t.TempDir(), "connected")
+
+	opts := TunnelOptions{OnConnected: writeHookScript(t, connected)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	tunnelA := newPeeredTunnelWithOptions(t, ctx, opts, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)
+
+	// Without a peer to answer there is no handshake, so the hook waits
+	if _, ok := waitForFile(t, connected, 300*time.Millisecond); ok {
+		t.Fatal("on-connected hook ran before the first handshake")
+	}
+	if tunnelA.hasHandshake() {
+		t.Fatal("expected no handshake before the peer is up")
+	}
+
+	newPeeredTunnelWithOptions(t, ctx, opts, 2, 1, "10.160.0.2", "10.160.0.1", portB, portA)
+
+	contents, ok := waitForFile(t, connected, 10*time.Second)
+	if !ok {
+		t.Fatal("on-connected hook did not run after the handshake")
+	}
+	if !tunnelA.hasHandshake() {
+		t.Error("expected a handshake once the hook has run")
+	}
+
+	// Both tunnels run the hook; either one may have written the file last
+	expected := []string{
+		fmt.Sprintf("10.160.0.1 127.0.0.1:%d %s", portB, GetVersion()),
+		fmt.Sprintf("10.160.0.2 127.0.0.1:%d %s", portA, GetVersion()),
+	}
+	if contents != expected[0] && contents != expected[1] {
+		t.Errorf("unexpected hook environment %q, expected one of %q", contents, expected)
+	}
+}
+
+func TestTunnel_OnDisconnected(t *testing.T) {
+	disconnected := filepath.Join(t.TempDir(), "disconnected")
+
+	opts := TunnelOptions{OnDisconnected: writeHookScript(t, disconnected)}
+
+	// A tunnel that never had a handshake does not run the hook
+	tunnel, err := NewTunnel(context.Background(), newTestConfig(t, testConfig{}), opts)
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	tunnel.Close()
+	if _, ok := waitForFile(t, disconnected, 300*time.Millisecond); ok {
+		t.Fatal("on-disconnected hook ran for a tunnel that never connected")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	tunnelA := newPeeredTunnelWithOptions(t, ctx, opts, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)
+	tunnelB := newPeeredTunnelWithOptions(t, ctx, opts, 2, 1, "10.160.0.2", "10.160.0.1", portB, portA)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !tunnelA.connected.Load() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !tunnelA.connected.Load() {
+		t.Fatal("expected the tunnel to connect")
+	}
+	if _, ok := waitForFile(t, disconnected, 100*time.Millisecond); ok {
+		t.Fatal("on-disconnected hook ran before Close")
+	}
+
+	tunnelA.Close()
+
+	contents, ok := waitForFile(t, disconnected, 5*time.Second)
+	if !ok {
+		t.Fatal("on-disconnected hook did not run after Close")
+	}
+	if expected := fmt.Sprintf("10.160.0.1 127.0.0.1:%d %s", portB, GetVersion()); contents != expected {
+		t.Errorf("expected hook environment %q, got %q", expected, contents)
+	}
+
+	// A second Close does not run the hook again
+	os.Remove(disconnected)
+	tunnelA.Close()
+	if _, ok := waitForFile(t, disconnected, 100*time.Millisecond); ok {
+		t.Error("on-disconnected hook ran again on a second Close")
+	}
+
+	// Let the other tunnel's hook finish before the temp dir is removed
+	tunnelB.Close()
+	waitForFile(t, disconnected, 5*time.Second)
+}
+
+func TestTunnel_WatchFirstHandshakeStopsOnCancel(t *testing.T) {
+	connected := filepath.Join(t.TempDir(), "connected")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tunnel := &Tunnel{}
+	tunnel.watchFirstHandshake(ctx, writeHookScript(t, connected))
+	cancel()
+
+	if tunnel.hasHandshake() {
+		t.Error("a tunnel without a device has no handshake")
+	}
+	if _, ok := waitForFile(t, connected, 3*handshakePollInterval); ok {
+		t.Error("on-connected hook ran for a tunnel without a device")
+	}
+}
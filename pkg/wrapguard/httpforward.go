@@ -0,0 +1,226 @@
+package wrapguard
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTPForwardConfig exposes a service reached through the tunnel on a local
+// port, as with --forward-http
+type HTTPForwardConfig struct {
+	LocalPort  int
+	TargetHost string
+	TargetPort int
+
+	// RewriteHost replaces the Host header of each HTTP request with the
+	// target, for services that pick a virtual host by name
+	RewriteHost bool
+}
+
+// ParseHTTPForward parses a --forward-http value of the form
+// localPort:targetHost:targetPort[:rewriteHost], such as
+// "8080:internal.corp:80:true". IPv6 target hosts go in brackets.
+func ParseHTTPForward(spec string) (HTTPForwardConfig, error) {
+	local, target, found := strings.Cut(strings.TrimSpace(spec), ":")
+	if !found {
+		return HTTPForwardConfig{}, fmt.Errorf("invalid HTTP forward %q (expected localPort:targetHost:targetPort[:rewriteHost])", spec)
+	}
+
+	var config HTTPForwardConfig
+	var err error
+	if config.LocalPort, err = strconv.Atoi(local); err != nil || config.LocalPort < 1 || config.LocalPort > 65535 {
+		return HTTPForwardConfig{}, fmt.Errorf("invalid local port %q in HTTP forward %s", local, spec)
+	}
+
+	// A last part that is not a port is the rewriteHost flag
+	if i := strings.LastIndex(target, ":"); i >= 0 {
+		if last := target[i+1:]; last != "" && strings.Trim(last, "0123456789") != "" {
+			if config.RewriteHost, err = strconv.ParseBool(last); err != nil {
+				return HTTPForwardConfig{}, fmt.Errorf("invalid rewriteHost %q in HTTP forward %s (expected true or false)", last, spec)
+			}
+			target = target[:i]
+		}
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return HTTPForwardConfig{}, fmt.Errorf("invalid target %q in HTTP forward %s (expected targetHost:targetPort)", target, spec)
+	}
+	config.TargetHost = host
+	if config.TargetPort, err = strconv.Atoi(port); err != nil || config.TargetPort < 1 || config.TargetPort > 65535 {
+		return HTTPForwardConfig{}, fmt.Errorf("invalid target port %q in HTTP forward %s", port, spec)
+	}
+	return config, nil
+}
+
+// target returns the address connections are forwarded to
+func (c HTTPForwardConfig) target() string {
+	return net.JoinHostPort(c.TargetHost, strconv.Itoa(c.TargetPort))
+}
+
+// hostHeader returns the Host header for requests to the target, which
+// leaves out the default port
+func (c HTTPForwardConfig) hostHeader() string {
+	if c.TargetPort == 80 {
+		return c.TargetHost
+	}
+	return c.target()
+}
+
+// ForwardHTTP listens on 127.0.0.1 on config.LocalPort and relays each
+// connection to the target through the tunnel, like the proxies do. With
+// RewriteHost, connections that start with an HTTP request have the Host
+// header of every request rewritten; anything else is relayed unchanged.
+// The listener is closed with the forwarder.
+func (pf *PortForwarder) ForwardHTTP(config HTTPForwardConfig) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", config.LocalPort))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP forward listener: %w", err)
+	}
+
+	pf.mutex.Lock()
+	pf.httpListeners = append(pf.httpListeners, listener)
+	pf.mutex.Unlock()
+	logger.Infof("Port forwarder: forwarding 127.0.0.1:%d to %s through the tunnel", config.LocalPort, config.target())
+
+	dial := newTunnelDialer(pf.tunnel, "HTTP forward", pf.httpAllowed, pf.httpUpstream)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Listener was closed
+				return
+			}
+			go pf.handleHTTPForward(conn, config, dial)
+		}
+	}()
+	return nil
+}
+
+// httpMethods are the request methods a connection is recognised as HTTP
+// by. CONNECT is left out, since a tunnelled stream has no Host to rewrite.
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "TRACE", "PATCH"}
+
+// startsHTTPRequest reports whether data starts with a request method and
+// a space. more is true while data is too short to tell.
+func startsHTTPRequest(data []byte) (ok, more bool) {
+	for _, method := range httpMethods {
+		prefix := method + " "
+		if strings.HasPrefix(string(data), prefix) {
+			return true, false
+		}
+		if len(data) < len(prefix) && strings.HasPrefix(prefix, string(data)) {
+			more = true
+		}
+	}
+	return false, more
+}
+
+func (pf *PortForwarder) handleHTTPForward(localConn net.Conn, config HTTPForwardConfig, dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	defer localConn.Close()
+
+	connLogger := logger.WithFields(map[string]interface{}{"client_addr": localConn.RemoteAddr().String()})
+	target := config.target()
+
+	// Connect first, so that protocols where the server speaks first work
+	remoteConn, err := dial(context.Background(), "tcp", target)
+	if err != nil {
+		connLogger.Errorf("HTTP forward: failed to connect to %s: %v", target, err)
+		return
+	}
+	defer remoteConn.Close()
+
+	// Close both sides of a connection that stops carrying data
+	var localReader, remoteReader io.Reader = localConn, remoteConn
+	if pf.idleTimeout > 0 {
+		idle := newIdleTimer(pf.idleTimeout, func() {
+			connLogger.Debugf("HTTP forward: closing connection to %s after %v idle", target, pf.idleTimeout)
+			localConn.Close()
+			remoteConn.Close()
+		})
+		defer idle.stop()
+		localReader = &idleReader{Reader: localConn, idle: idle}
+		remoteReader = &idleReader{Reader: remoteConn, idle: idle}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(localConn, remoteReader)
+		if tcpConn, ok := localConn.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		close(done)
+	}()
+
+	if config.RewriteHost {
+		relayRewritingHost(remoteConn, bufio.NewReader(localReader), config.hostHeader(), connLogger)
+	} else {
+		io.Copy(remoteConn, localReader)
+	}
+	if closer, ok := remoteConn.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	} else {
+		remoteConn.Close()
+	}
+	<-done
+}
+
+// relayRewritingHost copies requests from reader to remoteConn with their
+// Host set to host, until the client closes its side. If the connection
+// does not start with an HTTP request, or a request upgrades it to another
+// protocol, the rest is copied unchanged.
+func relayRewritingHost(remoteConn net.Conn, reader *bufio.Reader, host string, connLogger *Logger) {
+	for n := 1; ; n++ {
+		data, err := reader.Peek(n)
+		if err != nil {
+			return
+		}
+		isHTTP, more := startsHTTPRequest(data)
+		if isHTTP {
+			break
+		}
+		if !more {
+			connLogger.Debugf("HTTP forward: not an HTTP request, relaying the connection unchanged")
+			io.Copy(remoteConn, reader)
+			return
+		}
+	}
+
+	writer := bufio.NewWriter(remoteConn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				connLogger.Debugf("HTTP forward: failed to read request: %v", err)
+			}
+			return
+		}
+
+		connLogger.Debugf("HTTP forward: %s %s, rewriting Host %q to %q", req.Method, req.RequestURI, req.Host, host)
+		req.Host = host
+		// Request.Write would otherwise add Go's own User-Agent
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+		err = req.Write(writer)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil {
+			connLogger.Debugf("HTTP forward: failed to forward request: %v", err)
+			return
+		}
+
+		// What follows a protocol upgrade is no longer HTTP
+		if req.Header.Get("Upgrade") != "" {
+			io.Copy(remoteConn, reader)
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package wrapguard
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHTTPForward(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected HTTPForwardConfig
+		err      string
+	}{
+		{"8080:internal.corp:80", HTTPForwardConfig{LocalPort: 8080, TargetHost: "internal.corp", TargetPort: 80}, ""},
+		{"8080:internal.corp:80:true", HTTPForwardConfig{LocalPort: 8080, TargetHost: "internal.corp", TargetPort: 80, RewriteHost: true}, ""},
+		{"8080:internal.corp:8000:false", HTTPForwardConfig{LocalPort: 8080, TargetHost: "internal.corp", TargetPort: 8000}, ""},
+		{"8080:10.150.0.3:80", HTTPForwardConfig{LocalPort: 8080, TargetHost: "10.150.0.3", TargetPort: 80}, ""},
+		{"8080:[fd00::3]:80:true", HTTPForwardConfig{LocalPort: 8080, TargetHost: "fd00::3", TargetPort: 80, RewriteHost: true}, ""},
+		{"8080", HTTPForwardConfig{}, "expected localPort:targetHost:targetPort"},
+		{"x:internal.corp:80", HTTPForwardConfig{}, `invalid local port "x"`},
+		{"70000:internal.corp:80", HTTPForwardConfig{}, `invalid local port "70000"`},
+		{"8080:internal.corp", HTTPForwardConfig{}, `invalid target "internal.corp"`},
+		{"8080::80", HTTPForwardConfig{}, `invalid target ":80"`},
+		{"8080:internal.corp:0", HTTPForwardConfig{}, `invalid target port "0"`},
+		{"8080:internal.corp:80:maybe", HTTPForwardConfig{}, `invalid rewriteHost "maybe"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			config, err := ParseHTTPForward(tt.spec)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseHTTPForward failed: %v", err)
+			}
+			if config != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, config)
+			}
+		})
+	}
+}
+
+func TestStartsHTTPRequest(t *testing.T) {
+	tests := []struct {
+		data     string
+		ok, more bool
+	}{
+		{"GET / HTTP/1.1\r\n", true, false},
+		{"PATCH ", true, false},
+		{"G", false, true},
+		{"POS", false, true},
+		{"GETX", false, false},
+		{"CONNECT host:443 HTTP/1.1\r\n", false, false},
+		{"\x16\x03\x01", false, false},
+	}
+	for _, tt := range tests {
+		if ok, more := startsHTTPRequest([]byte(tt.data)); ok != tt.ok || more != tt.more {
+			t.Errorf("startsHTTPRequest(%q) = %v, %v; expected %v, %v", tt.data, ok, more, tt.ok, tt.more)
+		}
+	}
+}
+
+// startHTTPForward forwards a free local port to target and returns the
+// port
+func startHTTPForward(t *testing.T, target string, rewriteHost bool) int {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(target)
+	targetPort, _ := strconv.Atoi(port)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	forwarder := NewPortForwarder(newTestRoutingTunnel(), make(chan IPCMessage), ForwarderOptions{})
+	go forwarder.Run(ctx)
+
+	localPort := freePort(t)
+	config := HTTPForwardConfig{LocalPort: localPort, TargetHost: host, TargetPort: targetPort, RewriteHost: rewriteHost}
+	if err := forwarder.ForwardHTTP(config); err != nil {
+		t.Fatalf("ForwardHTTP failed: %v", err)
+	}
+	return localPort
+}
+
+// newHostEchoServer returns a backend that answers with the Host,
+// User-Agent and body of each request
+func newHostEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s|%s|%s", r.Host, r.Header.Get("User-Agent"), body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPortForwarder_ForwardHTTPRewriteHost(t *testing.T) {
+	backend := newHostEchoServer(t)
+	backendURL, _ := url.Parse(backend.URL)
+	_, backendPort, _ := net.SplitHostPort(backendURL.Host)
+	localPort := startHTTPForward(t, "localhost:"+backendPort, true)
+
+	// Every request on a kept-alive connection is rewritten, with its body
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	requests := []string{
+		"GET / HTTP/1.1\r\nHost: 127.0.0.1\r\nUser-Agent: test\r\n\r\n",
+		"POST /upload HTTP/1.1\r\nHost: 127.0.0.1\r\nContent-Length: 5\r\n\r\nhello",
+		"PUT /chunked HTTP/1.1\r\nHost: 127.0.0.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+	}
+	expected := []string{
+		"localhost:" + backendPort + "|test|",
+		"localhost:" + backendPort + "||hello",
+		"localhost:" + backendPort + "||abc",
+	}
+	for i, request := range requests {
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatalf("failed to send request %d: %v", i, err)
+		}
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("failed to read response %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != expected[i] {
+			t.Errorf("request %d: expected %q, got %q", i, expected[i], body)
+		}
+	}
+}
+
+func TestPortForwarder_ForwardHTTPKeepsHost(t *testing.T) {
+	backend := newHostEchoServer(t)
+	backendURL, _ := url.Parse(backend.URL)
+	localPort := startHTTPForward(t, backendURL.Host, false)
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", localPort))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if expected := fmt.Sprintf("127.0.0.1:%d|", localPort); !strings.HasPrefix(string(body), expected) {
+		t.Errorf("expected the Host to be left alone without RewriteHost, got %q", body)
+	}
+}
+
+func TestPortForwarder_ForwardHTTPPassesOtherTraffic(t *testing.T) {
+	echoPort := startEchoService(t)
+	localPort := startHTTPForward(t, fmt.Sprintf("127.0.0.1:%d", echoPort), true)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Not a request line, so the stream is relayed as it is
+	message := "Host: not a request\r\n"
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	reply := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != message {
+		t.Errorf("expected %q echoed back, got %q (%v)", message, reply, err)
+	}
+}
+
+func TestPortForwarder_ForwardHTTPServerFirst(t *testing.T) {
+	// The target is connected before the client sends anything
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("220 ready\r\n"))
+		io.Copy(io.Discard, conn)
+	}()
+	localPort := startHTTPForward(t, listener.Addr().String(), true)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "220 ready\r\n" {
+		t.Errorf("expected the server's greeting, got %q (%v)", line, err)
+	}
+}
+
+func TestPortForwarder_ForwardHTTPErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	forwarder := NewPortForwarder(newTestRoutingTunnel(), make(chan IPCMessage), ForwarderOptions{})
+	done := make(chan struct{})
+	go func() {
+		forwarder.Run(ctx)
+		close(done)
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	taken := listener.Addr().(*net.TCPAddr).Port
+	if err := forwarder.ForwardHTTP(HTTPForwardConfig{LocalPort: taken, TargetHost: "127.0.0.1", TargetPort: 80}); err == nil {
+		t.Error("expected an error for a local port in use")
+	}
+	listener.Close()
+
+	// The listener is closed with the forwarder
+	localPort := freePort(t)
+	if err := forwarder.ForwardHTTP(HTTPForwardConfig{LocalPort: localPort, TargetHost: "127.0.0.1", TargetPort: 80}); err != nil {
+		t.Fatalf("ForwardHTTP failed: %v", err)
+	}
+	cancel()
+	<-done
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort)); err == nil {
+		conn.Close()
+		t.Error("expected the local port to be closed with the forwarder")
+	}
+}
@@ -0,0 +1,197 @@
+package wrapguard
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MaxHopCount is the highest ProxyOptions.HopCount allowed, bounding how long
+// a chain of wrapguard instances can grow before a misconfiguration is
+// caught. Each instance's --socks-upstream points at the next one's HTTP
+// CONNECT proxy, which rejects longer chains, as well as requests that have
+// already passed through it.
+const MaxHopCount = 4
+
+// ValidateHopCount checks a value for ProxyOptions.HopCount
+func ValidateHopCount(hops int) error {
+	if hops < 1 || hops > MaxHopCount {
+		return fmt.Errorf("invalid hop count: %d (expected 1 to %d)", hops, MaxHopCount)
+	}
+	return nil
+}
+
+// viaHeader lists the public keys of the wrapguard instances a CONNECT
+// request has passed through, in order, separated by commas
+const viaHeader = "X-WrapGuard-Via"
+
+// viaKey is the context key holding the wrapguard instances a request has
+// passed through
+type viaKey struct{}
+
+// withVia attaches the public keys from a request's viaHeader to the dial
+// context
+func withVia(ctx context.Context, via []string) context.Context {
+	return context.WithValue(ctx, viaKey{}, via)
+}
+
+// viaChain returns the public keys attached by withVia
+func viaChain(ctx context.Context) []string {
+	via, _ := ctx.Value(viaKey{}).([]string)
+	return via
+}
+
+// parseVia splits the values of viaHeader into public keys
+func parseVia(values []string) []string {
+	var via []string
+	for _, value := range values {
+		for _, key := range strings.Split(value, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				via = append(via, key)
+			}
+		}
+	}
+	return via
+}
+
+// HTTPConnectServer is an HTTP/1.1 CONNECT proxy for clients that cannot speak SOCKS5
+type HTTPConnectServer struct {
+	listener net.Listener
+	port     int
+	tunnel   *Tunnel
+	dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	hopCount int
+	served   chan struct{} // Closed once the accept loop has returned
+}
+
+func NewHTTPConnectServer(tunnel *Tunnel, opts ProxyOptions) (*HTTPConnectServer, error) {
+	// Listen on localhost for proxy connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for HTTP proxy connections: %w", err)
+	}
+
+	s := &HTTPConnectServer{
+		listener: listener,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		tunnel:   tunnel,
+		dial:     newTunnelDialer(tunnel, "HTTP CONNECT", opts.AllowedNetworks, opts.UpstreamDial),
+		hopCount: opts.HopCount,
+		served:   make(chan struct{}),
+	}
+	if s.hopCount == 0 {
+		s.hopCount = MaxHopCount
+	}
+	proxyPorts.add(s.port)
+
+	// Start serving in background
+	go s.acceptConnections()
+
+	return s, nil
+}
+
+func (s *HTTPConnectServer) acceptConnections() {
+	defer close(s.served)
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// Server is shutting down
+			logger.Debugf("HTTP CONNECT server stopped: %v", err)
+			break
+		}
+
+		// Handle connection in background
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *HTTPConnectServer) handleConnection(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	reader := bufio.NewReader(clientConn)
+	clientConn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		logger.Debugf("HTTP CONNECT: failed to read request: %v", err)
+		return
+	}
+	clientConn.SetReadDeadline(time.Time{})
+
+	if req.Method != http.MethodConnect {
+		writeHTTPProxyError(clientConn, http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Refuse to take part in a loop of chained wrapguard instances
+	via := parseVia(req.Header.Values(viaHeader))
+	if key := s.tunnel.PublicKey(); key != "" && slices.Contains(via, key) {
+		logger.Warnf("HTTP CONNECT: rejecting connection to %s, it already passed through this wrapguard", req.Host)
+		writeHTTPProxyError(clientConn, http.StatusLoopDetected)
+		return
+	}
+	if len(via) >= s.hopCount {
+		logger.Warnf("HTTP CONNECT: rejecting connection to %s after %d wrapguard hops, at most %d are allowed", req.Host, len(via), s.hopCount)
+		writeHTTPProxyError(clientConn, http.StatusLoopDetected)
+		return
+	}
+
+	ctx := withVia(withClientAddr(context.Background(), clientConn.RemoteAddr().String()), via)
+	targetConn, err := s.dial(ctx, "tcp", req.Host)
+	if errors.Is(err, errDestinationNotAllowed) {
+		writeHTTPProxyError(clientConn, http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.Debugf("HTTP CONNECT: failed to dial %s: %v", req.Host, err)
+		writeHTTPProxyError(clientConn, http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// Forward any bytes the client sent after the request headers
+	if reader.Buffered() > 0 {
+		if _, err := io.CopyN(targetConn, reader, int64(reader.Buffered())); err != nil {
+			return
+		}
+	}
+
+	// Relay data bidirectionally
+	go func() {
+		io.Copy(targetConn, clientConn)
+		targetConn.Close()
+	}()
+
+	io.Copy(clientConn, targetConn)
+}
+
+func writeHTTPProxyError(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
+
+func (s *HTTPConnectServer) Port() int {
+	return s.port
+}
+
+// Close stops accepting connections and waits for the accept loop to exit
+func (s *HTTPConnectServer) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	proxyPorts.remove(s.port)
+	err := s.listener.Close()
+	if s.served != nil {
+		<-s.served
+	}
+	return err
+}
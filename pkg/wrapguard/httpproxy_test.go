@@ -0,0 +1,315 @@
+package wrapguard
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// newTestRoutingTunnel creates a tunnel with a routing engine but no WireGuard device
+func newTestRoutingTunnel() *Tunnel {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.150.0.2/24"},
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:  "test-public-key",
+				AllowedIPs: []string{"10.150.0.0/24"},
+			},
+		},
+	}
+
+	ourIP, _ := config.GetInterfaceIP()
+	tunnel := &Tunnel{ourIP: ourIP}
+	tunnel.config.Store(config)
+	tunnel.router.Store(NewRoutingEngine(config, RoutingOptions{}))
+	return tunnel
+}
+
+func TestNewHTTPConnectServer(t *testing.T) {
+	tunnel := newTestRoutingTunnel()
+
+	server, err := NewHTTPConnectServer(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+	defer server.Close()
+
+	if server.Port() == 0 {
+		t.Error("port should be set to non-zero value")
+	}
+
+	if server.tunnel != tunnel {
+		t.Error("tunnel reference not set correctly")
+	}
+
+	tcpAddr, ok := server.listener.Addr().(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("listener address is not TCP: %T", server.listener.Addr())
+	}
+
+	if !tcpAddr.IP.IsLoopback() {
+		t.Errorf("expected listener on loopback, got %s", tcpAddr.IP)
+	}
+}
+
+func TestHTTPConnectServer_ProxiesRequests(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello through proxy")
+	}))
+	defer backend.Close()
+
+	server, err := NewHTTPConnectServer(newTestRoutingTunnel(), ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+	defer server.Close()
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:" + strconv.Itoa(server.Port()))
+	transport := backend.Client().Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(backend.URL)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	if string(body) != "hello through proxy" {
+		t.Errorf("unexpected response body: %q", string(body))
+	}
+}
+
+func TestHTTPConnectServer_RejectsNonConnect(t *testing.T) {
+	server, err := NewHTTPConnectServer(newTestRoutingTunnel(), ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPConnectServer_DialFailure(t *testing.T) {
+	// Reserve a port and close it so the dial is refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve port: %v", err)
+	}
+	closedAddr := listener.Addr().String()
+	listener.Close()
+
+	server, err := NewHTTPConnectServer(newTestRoutingTunnel(), ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "CONNECT "+closedAddr+" HTTP/1.1\r\nHost: "+closedAddr+"\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status 502, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPConnectServer_Close(t *testing.T) {
+	server, err := NewHTTPConnectServer(newTestRoutingTunnel(), ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Errorf("Close() returned error: %v", err)
+	}
+
+	if _, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.Port())); err == nil {
+		t.Error("expected connection to closed proxy to fail")
+	}
+}
+
+func TestHTTPConnectServer_AllowNetwork(t *testing.T) {
+	opts := ProxyOptions{AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	server, err := NewHTTPConnectServer(newTestRoutingTunnel(), opts)
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "CONNECT 127.0.0.1:80 HTTP/1.1\r\nHost: 127.0.0.1:80\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403, got %d", resp.StatusCode)
+	}
+}
+
+// newChainedHTTPConnectServer starts an HTTP CONNECT proxy in front of a
+// tunnel whose interface key is generated from seed
+func newChainedHTTPConnectServer(t *testing.T, seed byte, opts ProxyOptions) *HTTPConnectServer {
+	t.Helper()
+
+	tunnel := newTestRoutingTunnel()
+	tunnel.config.Load().Interface.PrivateKey = generateTestKeyWithSeed(seed)
+	server, err := NewHTTPConnectServer(tunnel, opts)
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// connectThrough sends a CONNECT request for target to the proxy on port
+// and returns the connection and the response status
+func connectThrough(t *testing.T, port int, target string, via string) (net.Conn, int) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if via != "" {
+		request += viaHeader + ": " + via + "\r\n"
+	}
+	io.WriteString(conn, request+"\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return conn, resp.StatusCode
+}
+
+func TestHTTPConnectServer_Chain(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	second := newChainedHTTPConnectServer(t, 2, ProxyOptions{})
+
+	// The second wrapguard dials directly, recording where the request has been
+	seen := make(chan []string, 1)
+	second.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		seen <- viaChain(ctx)
+		return net.Dial(network, addr)
+	}
+	dial, err := NewUpstreamDialer("http://127.0.0.1:" + strconv.Itoa(second.Port()))
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer failed: %v", err)
+	}
+	first := newChainedHTTPConnectServer(t, 1, ProxyOptions{UpstreamDial: dial})
+
+	conn, status := connectThrough(t, first.Port(), echoAddr, "")
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200 through the chain, got %d", status)
+	}
+	assertEcho(t, conn)
+	if via := <-seen; !reflect.DeepEqual(via, []string{testPublicKey(t, 1)}) {
+		t.Errorf("expected the second hop to see the first one's key, got %q", via)
+	}
+
+	// A chain longer than the hop count is cut off at the hop that would
+	// exceed it
+	first.hopCount, second.hopCount = 1, 1
+	if _, status := connectThrough(t, first.Port(), echoAddr, ""); status != http.StatusBadGateway {
+		t.Errorf("expected status 502 when the next hop refuses, got %d", status)
+	}
+	if _, status := connectThrough(t, second.Port(), echoAddr, testPublicKey(t, 3)); status != http.StatusLoopDetected {
+		t.Errorf("expected status 508 for too many hops, got %d", status)
+	}
+}
+
+func TestHTTPConnectServer_Loop(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	server := newChainedHTTPConnectServer(t, 1, ProxyOptions{})
+
+	// A request that already passed through this wrapguard is refused
+	via := testPublicKey(t, 2) + ", " + testPublicKey(t, 1)
+	if _, status := connectThrough(t, server.Port(), echoAddr, via); status != http.StatusLoopDetected {
+		t.Errorf("expected status 508 for a loop, got %d", status)
+	}
+
+	// An upstream that leads back to the same wrapguard fails instead of
+	// going round forever
+	dial, err := NewUpstreamDialer("http://127.0.0.1:" + strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer failed: %v", err)
+	}
+	server.dial = newTunnelDialer(server.tunnel, "HTTP CONNECT", nil, dial)
+	if _, status := connectThrough(t, server.Port(), echoAddr, ""); status != http.StatusBadGateway {
+		t.Errorf("expected status 502 for an upstream loop, got %d", status)
+	}
+}
+
+func TestParseVia(t *testing.T) {
+	got := parseVia([]string{"a, b", " ", "c,,d "})
+	if !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("unexpected keys %q", got)
+	}
+	if parseVia(nil) != nil {
+		t.Error("expected no keys without the header")
+	}
+}
+
+func TestValidateHopCount(t *testing.T) {
+	for _, hops := range []int{1, 2, MaxHopCount} {
+		if err := ValidateHopCount(hops); err != nil {
+			t.Errorf("ValidateHopCount(%d) failed: %v", hops, err)
+		}
+	}
+	for _, hops := range []int{0, -1, MaxHopCount + 1} {
+		if err := ValidateHopCount(hops); err == nil {
+			t.Errorf("expected ValidateHopCount(%d) to fail", hops)
+		}
+	}
+}
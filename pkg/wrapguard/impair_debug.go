@@ -0,0 +1,36 @@
+//go:build debug
+
+package wrapguard
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// impairer holds a MemoryTUN's copy of its tunnel's Impairment
+type impairer struct {
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+}
+
+func newImpairer(impairment Impairment) impairer {
+	return impairer{latency: impairment.Latency, jitter: impairment.Jitter, loss: impairment.PacketLoss}
+}
+
+// impairment returns how long to hold back the next injected packet and
+// whether to drop it. ok is false when no impairment is configured.
+func (i impairer) impairment() (delay time.Duration, drop bool, ok bool) {
+	if i.latency <= 0 && i.jitter <= 0 && i.loss <= 0 {
+		return 0, false, false
+	}
+	if i.loss > 0 && rand.Float64() < i.loss {
+		return 0, true, true
+	}
+
+	delay = i.latency
+	if i.jitter > 0 {
+		delay += time.Duration(rand.Int64N(int64(2*i.jitter)+1)) - i.jitter
+	}
+	return max(delay, 0), false, true
+}
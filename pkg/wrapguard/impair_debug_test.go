@@ -0,0 +1,135 @@
+//go:build debug
+
+package wrapguard
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"testing"
+	"time"
+)
+
+// pingRTT sends one echo request from tunnel to dst with seq and returns the
+// time until the reply arrives, or false after timeout
+func pingRTT(tunnel *Tunnel, src, dst string, seq uint16, timeout time.Duration) (time.Duration, bool) {
+	request := newICMPEchoRequest(src, dst, 77, seq, []byte("rtt"))
+	deadline := time.After(timeout)
+
+	start := time.Now()
+	tunnel.tun.InjectInbound(request)
+	for {
+		select {
+		case packet := <-tunnel.tun.outbound:
+			if len(packet) >= 28 && packet[9] == 1 && packet[20] == 0 && binary.BigEndian.Uint16(packet[26:28]) == seq {
+				return time.Since(start), true
+			}
+		case <-deadline:
+			return 0, false
+		}
+	}
+}
+
+// medianRTT returns the median of count pings, failing the test if any is lost
+func medianRTT(t *testing.T, tunnel *Tunnel, src, dst string, firstSeq uint16, count int) time.Duration {
+	t.Helper()
+
+	rtts := make([]time.Duration, 0, count)
+	for i := 0; i < count; i++ {
+		rtt, ok := pingRTT(tunnel, src, dst, firstSeq+uint16(i), 5*time.Second)
+		if !ok {
+			t.Fatalf("ping %d got no reply", i)
+		}
+		rtts = append(rtts, rtt)
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	return rtts[count/2]
+}
+
+// newPingPair starts two peered tunnels with impairment and waits for their
+// handshake. Pings go from the returned tunnel to peerIP.
+func newPingPair(t *testing.T, ctx context.Context, subnet string, impairment Impairment) (tunnel *Tunnel, ourIP, peerIP string) {
+	t.Helper()
+
+	ourIP, peerIP = subnet+".2", subnet+".1"
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	opts := TunnelOptions{Impairment: impairment}
+	newPeeredTunnelWithOptions(t, ctx, opts, 1, 2, peerIP, ourIP, portA, portB)
+	tunnel = newPeeredTunnelWithOptions(t, ctx, opts, 2, 1, ourIP, peerIP, portB, portA)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := tunnel.WaitForHandshake(waitCtx); err != nil {
+		t.Fatalf("no handshake: %v", err)
+	}
+	return tunnel, ourIP, peerIP
+}
+
+func TestImpairer(t *testing.T) {
+	if _, _, ok := (impairer{}).impairment(); ok {
+		t.Error("expected no impairment by default")
+	}
+
+	impair := newImpairer(Impairment{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	for i := 0; i < 1000; i++ {
+		delay, drop, ok := impair.impairment()
+		if !ok || drop {
+			t.Fatalf("expected a delay without drops, got ok %v drop %v", ok, drop)
+		}
+		if delay < 40*time.Millisecond || delay > 60*time.Millisecond {
+			t.Fatalf("delay %v outside latency plus or minus jitter", delay)
+		}
+	}
+
+	// Jitter larger than the latency never gives a negative delay
+	impair = impairer{latency: time.Millisecond, jitter: 10 * time.Millisecond}
+	for i := 0; i < 1000; i++ {
+		if delay, _, _ := impair.impairment(); delay < 0 {
+			t.Fatalf("negative delay %v", delay)
+		}
+	}
+
+	impair = impairer{loss: 0.25}
+	drops := 0
+	for i := 0; i < 10000; i++ {
+		if _, drop, _ := impair.impairment(); drop {
+			drops++
+		}
+	}
+	if drops < 2000 || drops > 3000 {
+		t.Errorf("expected about 2500 of 10000 packets dropped, got %d", drops)
+	}
+}
+
+func TestImpairment_RoundTripLatency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel, src, dst := newPingPair(t, ctx, "10.163.0", Impairment{})
+	baseline := medianRTT(t, tunnel, src, dst, 100, 5)
+
+	// The request is delayed on one side and the reply on the other, so the
+	// round trip grows by twice the latency
+	const latency = 50 * time.Millisecond
+	tunnel, src, dst = newPingPair(t, ctx, "10.164.0", Impairment{Latency: latency})
+	impaired := medianRTT(t, tunnel, src, dst, 200, 5)
+
+	added := impaired - baseline
+	if expected := 2 * latency; added < expected*8/10 || added > expected*12/10 {
+		t.Errorf("expected the round trip to grow by %v ±20%%, got %v (baseline %v, impaired %v)", expected, added, baseline, impaired)
+	}
+}
+
+func TestImpairment_PacketLoss(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handshakes bypass InjectInbound, so the tunnel comes up but every ping
+	// is dropped
+	tunnel, src, dst := newPingPair(t, ctx, "10.165.0", Impairment{PacketLoss: 1})
+	for seq := uint16(1); seq <= 3; seq++ {
+		if _, ok := pingRTT(tunnel, src, dst, seq, 300*time.Millisecond); ok {
+			t.Fatal("expected no reply with 100% packet loss")
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !debug
+
+package wrapguard
+
+import "time"
+
+// impairer is empty outside debug builds, which never impair packets
+type impairer struct{}
+
+func newImpairer(Impairment) impairer {
+	return impairer{}
+}
+
+func (impairer) impairment() (delay time.Duration, drop bool, ok bool) {
+	return 0, false, false
+}
@@ -0,0 +1,469 @@
+package wrapguard
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPC protocol versions understood by the server
+const (
+	IPCVersion1 = 1
+	IPCVersion2 = 2
+
+	IPCCurrentVersion = IPCVersion2
+)
+
+type IPCMessage struct {
+	Version int    `json:"version,omitempty"` // Protocol version, 1 when omitted
+	Type    string `json:"type"`              // "CONNECT" or "BIND"
+	FD      int    `json:"fd"`
+	Port    int    `json:"port"`
+	Addr    string `json:"addr"`
+
+	// ID is chosen by the client to match the IPCResponse to the message.
+	// Messages without one get no response.
+	ID int64 `json:"id,omitempty"`
+
+	// Fields added in version 2 of the protocol
+	IPCMessageV2
+
+	conn *ipcConn // Connection the message arrived on, for Reply
+}
+
+// IPCMessageV2 holds the socket details sent by version 2 clients
+type IPCMessageV2 struct {
+	Proto       string `json:"proto,omitempty"` // "tcp" or "udp"
+	NonBlocking bool   `json:"non_blocking,omitempty"`
+	SocketType  int    `json:"socket_type,omitempty"`
+
+	// For CONNECT, the local port of the client's connection to the SOCKS5
+	// proxy and the name of the process that opened it
+	SrcPort int    `json:"src_port,omitempty"`
+	ExeName string `json:"exe_name,omitempty"`
+}
+
+// IPCAuthMessage is the first message a client sends on each connection
+type IPCAuthMessage struct {
+	Type  string `json:"type"` // "AUTH"
+	Token string `json:"token"`
+}
+
+// IPCError is the reply sent to a client whose message was rejected
+type IPCError struct {
+	Error string `json:"error"`
+}
+
+// IPCResponse is the reply to a message with an ID, once the message has
+// been handled: at once for CONNECT, and once the port forwarder has set up
+// the listener for BIND
+type IPCResponse struct {
+	ID    int64  `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// ipcConn serializes replies on a client connection, since BIND messages
+// are answered from the port forwarder's goroutine
+type ipcConn struct {
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+// Reply sends the client the outcome of handling the message, if it has an
+// ID. Replies to a client that has gone away are dropped.
+func (m IPCMessage) Reply(err error) {
+	if m.ID == 0 || m.conn == nil {
+		return
+	}
+
+	response := IPCResponse{ID: m.ID, OK: err == nil}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	data, _ := json.Marshal(response)
+
+	m.conn.mutex.Lock()
+	defer m.conn.mutex.Unlock()
+	m.conn.conn.Write(append(data, '\n'))
+}
+
+const (
+	// ipcDrainGrace is how long Close keeps reading from the socket so that
+	// connections and messages already queued by clients are not lost
+	ipcDrainGrace = 100 * time.Millisecond
+
+	// ipcShutdownTimeout bounds how long Close waits for connections to drain
+	ipcShutdownTimeout = 5 * time.Second
+)
+
+// DefaultIPCMaxConnections is the connection limit of an IPC server whose
+// IPCOptions.MaxConnections is zero
+const DefaultIPCMaxConnections = 256
+
+// IPCOptions configures NewIPCServer. The zero value generates a random
+// token, allows DefaultIPCMaxConnections clients and never warns about the
+// message rate.
+type IPCOptions struct {
+	// Token is the secret clients must send in an AUTH message before any
+	// other message. When empty, the server generates a random token.
+	Token string
+
+	// MaxConnections caps the number of simultaneous client connections;
+	// negative means no limit
+	MaxConnections int
+
+	// MessageRateWarning is the number of messages a second above which a
+	// warning is logged, since a flood of them usually means the child is
+	// leaking sockets. Zero or less disables the check.
+	MessageRateWarning int
+}
+
+// ipcRateInterval is how often the IPC message rate is checked
+var ipcRateInterval = time.Second
+
+// exeNameTTL is how long a process name reported in a CONNECT message waits
+// for the proxy connection it belongs to. The client sends the message just
+// before it uses the connection, so older entries are from connections that
+// never reached the proxy, and their source port may since have been reused.
+const exeNameTTL = 30 * time.Second
+
+// exeNameTable maps the source port of a proxy client connection to the
+// name of the process that reported it in a CONNECT message. An Agent shares
+// one between its IPC server and proxies; loopback source ports are unique
+// while a connection is open.
+type exeNameTable struct {
+	mutex sync.Mutex
+	names map[int]exeNameEntry
+}
+
+type exeNameEntry struct {
+	exeName    string
+	recordedAt time.Time
+}
+
+func newExeNameTable() *exeNameTable {
+	return &exeNameTable{names: make(map[int]exeNameEntry)}
+}
+
+// record remembers exeName for srcPort, dropping entries older than
+// exeNameTTL that were never taken
+func (t *exeNameTable) record(srcPort int, exeName string) {
+	now := time.Now()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for port, entry := range t.names {
+		if now.Sub(entry.recordedAt) > exeNameTTL {
+			delete(t.names, port)
+		}
+	}
+	t.names[srcPort] = exeNameEntry{exeName: exeName, recordedAt: now}
+}
+
+// take returns and forgets the process name for srcPort, or "" if unknown,
+// expired or t is nil
+func (t *exeNameTable) take(srcPort int) string {
+	if t == nil {
+		return ""
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry, ok := t.names[srcPort]
+	delete(t.names, srcPort)
+	if !ok || time.Since(entry.recordedAt) > exeNameTTL {
+		return ""
+	}
+	return entry.exeName
+}
+
+type IPCServer struct {
+	listener    net.Listener
+	socketPath  string
+	token       string
+	msgChan     chan IPCMessage
+	shutdown    chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup // Tracks acceptConnections and handleConnection goroutines
+	maxConns    int32
+	activeConns atomic.Int32
+	limitWarned atomic.Bool
+	messages    atomic.Int64 // Since the rate was last checked
+	rateWarned  atomic.Bool
+	exeNames    *exeNameTable // Process names from CONNECT messages
+}
+
+func NewIPCServer(opts IPCOptions) (*IPCServer, error) {
+	return newIPCServer(opts, newExeNameTable())
+}
+
+// newIPCServer creates an IPC server that records the process names clients
+// report in exeNames
+func newIPCServer(opts IPCOptions, exeNames *exeNameTable) (*IPCServer, error) {
+	// Create socket path in temp directory, unique to this server so that
+	// several servers in one process do not take each other's socket
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, fmt.Errorf("failed to generate IPC socket path: %w", err)
+	}
+	socketPath := filepath.Join(os.TempDir(), fmt.Sprintf("wrapguard-%d-%s.sock", os.Getpid(), hex.EncodeToString(suffix)))
+
+	token := opts.Token
+	if token == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate IPC token: %w", err)
+		}
+		token = hex.EncodeToString(secret)
+	}
+
+	maxConns := opts.MaxConnections
+	if maxConns == 0 {
+		maxConns = DefaultIPCMaxConnections
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create IPC socket: %w", err)
+	}
+
+	server := &IPCServer{
+		listener:   listener,
+		socketPath: socketPath,
+		token:      token,
+		msgChan:    make(chan IPCMessage, 100),
+		shutdown:   make(chan struct{}),
+		maxConns:   int32(maxConns),
+		exeNames:   exeNames,
+	}
+
+	// Start accepting connections
+	server.wg.Add(1)
+	go server.acceptConnections()
+	if opts.MessageRateWarning > 0 {
+		server.wg.Add(1)
+		go server.monitorRate(opts.MessageRateWarning, ipcRateInterval)
+	}
+
+	return server, nil
+}
+
+// monitorRate warns when clients send more than limit messages a second,
+// once each time the rate goes over, until the server is closed
+func (s *IPCServer) monitorRate(limit int, interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-ticker.C:
+			rate := float64(s.messages.Swap(0)) / interval.Seconds()
+			if rate <= float64(limit) {
+				s.rateWarned.Store(false)
+				continue
+			}
+			if !s.rateWarned.Swap(true) {
+				logger.Warnf("IPC: %.0f messages a second, over the expected %d; the child may be leaking file descriptors", rate, limit)
+			}
+		}
+	}
+}
+
+func (s *IPCServer) acceptConnections() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// Server is shutting down, or the queued connections have been
+			// drained after Close
+			select {
+			case <-s.shutdown:
+			default:
+				fmt.Printf("IPC: Accept failed: %v\n", err)
+			}
+			return
+		}
+
+		// Reject clients over the connection limit to avoid running out of file descriptors
+		if s.maxConns > 0 && s.activeConns.Load() >= s.maxConns {
+			if !s.limitWarned.Swap(true) {
+				logger.Warnf("IPC connection limit of %d reached, rejecting new connections", s.maxConns)
+			}
+			writeIPCError(conn, "connection limit reached")
+			conn.Close()
+			continue
+		}
+
+		// Handle connection in background
+		s.activeConns.Add(1)
+		s.wg.Add(1)
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *IPCServer) handleConnection(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.activeConns.Add(-1)
+	defer conn.Close()
+
+	// Once Close is called, finish reading whatever the client already sent
+	// instead of blocking until it disconnects
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.shutdown:
+			conn.SetReadDeadline(time.Now().Add(ipcDrainGrace))
+		case <-done:
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	replies := &ipcConn{conn: conn}
+
+	// The first message must carry the token, so that other local processes
+	// that find the socket path cannot trigger binds
+	if !scanner.Scan() {
+		return
+	}
+	if err := s.authenticate(scanner.Bytes()); err != nil {
+		logger.Warnf("IPC: Rejected connection: %v", err)
+		writeIPCError(conn, err.Error())
+		return
+	}
+
+	for scanner.Scan() {
+		s.messages.Add(1)
+		line := scanner.Text()
+
+		var msg IPCMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			fmt.Printf("IPC: Failed to parse message: %v\n", err)
+			continue
+		}
+
+		// Messages from clients predating versioning are version 1
+		if msg.Version == 0 {
+			msg.Version = IPCVersion1
+		}
+
+		switch msg.Version {
+		case IPCVersion1:
+			// Version 1 clients do not send socket details
+			msg.IPCMessageV2 = IPCMessageV2{}
+		case IPCVersion2:
+		default:
+			writeIPCError(conn, fmt.Sprintf("unsupported IPC message version %d", msg.Version))
+			continue
+		}
+
+		msg.conn = replies
+
+		// Remember which process opened the proxy connection so the SOCKS5
+		// server can route by application, before the client goes on to use
+		// the connection
+		if msg.Type == "CONNECT" {
+			if msg.SrcPort > 0 && msg.ExeName != "" {
+				s.exeNames.record(msg.SrcPort, msg.ExeName)
+			}
+			msg.Reply(nil)
+		}
+
+		// Send message to channel (non-blocking); whoever handles a BIND
+		// replies to it
+		select {
+		case s.msgChan <- msg:
+		default:
+			fmt.Printf("IPC: Message channel full, dropping message\n")
+			if msg.Type != "CONNECT" {
+				msg.Reply(fmt.Errorf("message channel full"))
+			}
+		}
+	}
+}
+
+// authenticate checks that line is an AUTH message with the server's token
+func (s *IPCServer) authenticate(line []byte) error {
+	var auth IPCAuthMessage
+	if err := json.Unmarshal(line, &auth); err != nil || auth.Type != "AUTH" {
+		return fmt.Errorf("authentication required")
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.Token), []byte(s.token)) != 1 {
+		return fmt.Errorf("invalid token")
+	}
+	return nil
+}
+
+// writeIPCError sends a JSON error reply to an IPC client
+func writeIPCError(conn net.Conn, message string) {
+	data, _ := json.Marshal(IPCError{Error: message})
+	conn.Write(append(data, '\n'))
+}
+
+func (s *IPCServer) SocketPath() string {
+	return s.socketPath
+}
+
+// Token returns the secret clients must authenticate with
+func (s *IPCServer) Token() string {
+	return s.token
+}
+
+func (s *IPCServer) MessageChan() <-chan IPCMessage {
+	return s.msgChan
+}
+
+// Close stops the server after draining in-flight messages. Connections the
+// kernel has already queued are still accepted for a short grace period, and
+// every active connection is read until it has no more buffered data, waiting
+// at most ipcShutdownTimeout in total.
+func (s *IPCServer) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.shutdown)
+
+		// Stop accepting after the grace period rather than immediately, so
+		// clients that connected just before Close are still served
+		if listener, ok := s.listener.(interface{ SetDeadline(time.Time) error }); ok {
+			listener.SetDeadline(time.Now().Add(ipcDrainGrace))
+		} else if s.listener != nil {
+			s.listener.Close()
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			s.wg.Wait()
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-time.After(ipcShutdownTimeout):
+			logger.Warnf("IPC: Timed out waiting for connections to drain")
+		}
+
+		if s.listener != nil {
+			s.listener.Close()
+		}
+
+		// Clean up socket file
+		if s.socketPath != "" {
+			os.Remove(s.socketPath)
+		}
+	})
+
+	return nil
+}
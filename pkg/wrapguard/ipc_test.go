@@ -0,0 +1,1157 @@
+package wrapguard
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewIPCServer(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	if server == nil {
+		t.Fatal("NewIPCServer returned nil")
+	}
+
+	if server.listener == nil {
+		t.Error("listener is nil")
+	}
+
+	if server.socketPath == "" {
+		t.Error("socket path is empty")
+	}
+
+	if server.msgChan == nil {
+		t.Error("message channel is nil")
+	}
+
+	// Check that socket path is in temp directory
+	expectedDir := os.TempDir()
+	actualDir := filepath.Dir(server.socketPath)
+	// Clean the paths to handle trailing slashes consistently
+	expectedDir = filepath.Clean(expectedDir)
+	actualDir = filepath.Clean(actualDir)
+	if actualDir != expectedDir {
+		t.Errorf("socket path not in temp dir: expected %s, got %s", expectedDir, actualDir)
+	}
+
+	// Check that socket file contains PID
+	if !containsPID(server.socketPath) {
+		t.Error("socket path should contain PID")
+	}
+}
+
+func TestIPCServer_SocketPathUnique(t *testing.T) {
+	first, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	second, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer second.Close()
+
+	if first.SocketPath() == second.SocketPath() {
+		t.Fatalf("expected servers in one process to use different sockets, both got %s", first.SocketPath())
+	}
+
+	// Closing one server leaves the other reachable
+	first.Close()
+	conn, err := dialIPC(second)
+	if err != nil {
+		t.Fatalf("failed to connect to the second server: %v", err)
+	}
+	conn.Close()
+}
+
+func TestIPCServer_SocketPath(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	path := server.SocketPath()
+	if path == "" {
+		t.Error("SocketPath returned empty string")
+	}
+
+	if path != server.socketPath {
+		t.Errorf("SocketPath() = %q, want %q", path, server.socketPath)
+	}
+}
+
+func TestIPCServer_MessageChan(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	msgChan := server.MessageChan()
+	if msgChan == nil {
+		t.Error("MessageChan returned nil")
+	}
+
+	// Test that it's the same channel
+	if msgChan != server.msgChan {
+		t.Error("MessageChan returned different channel")
+	}
+
+	// Test that it's read-only
+	select {
+	case <-msgChan:
+		// This is fine, channel is empty
+	default:
+		// This is expected
+	}
+}
+
+func TestIPCServer_Close(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+
+	socketPath := server.socketPath
+
+	// Socket file should exist
+	if _, err := os.Stat(socketPath); os.IsNotExist(err) {
+		t.Error("socket file should exist before close")
+	}
+
+	// Close the server
+	err = server.Close()
+	if err != nil {
+		t.Errorf("Close() returned error: %v", err)
+	}
+
+	// Socket file should be removed
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Error("socket file should be removed after close")
+	}
+
+	// Multiple closes should not panic
+	err = server.Close()
+	if err != nil {
+		t.Errorf("second Close() returned error: %v", err)
+	}
+}
+
+func TestIPCServer_MessageHandling(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give server time to start accepting connections
+	time.Sleep(10 * time.Millisecond)
+
+	// Connect to the IPC server
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	// Test message
+	msg := IPCMessage{
+		Type: "CONNECT",
+		FD:   42,
+		Port: 8080,
+		Addr: "127.0.0.1:8080",
+	}
+
+	// Send message
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+
+	_, err = conn.Write(append(msgBytes, '\n'))
+	if err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	// Receive message from channel
+	select {
+	case receivedMsg := <-server.msgChan:
+		if receivedMsg.Type != msg.Type {
+			t.Errorf("received Type = %q, want %q", receivedMsg.Type, msg.Type)
+		}
+		if receivedMsg.FD != msg.FD {
+			t.Errorf("received FD = %d, want %d", receivedMsg.FD, msg.FD)
+		}
+		if receivedMsg.Port != msg.Port {
+			t.Errorf("received Port = %d, want %d", receivedMsg.Port, msg.Port)
+		}
+		if receivedMsg.Addr != msg.Addr {
+			t.Errorf("received Addr = %q, want %q", receivedMsg.Addr, msg.Addr)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("timeout waiting for message")
+	}
+}
+
+func TestIPCServer_InvalidMessage(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give server time to start
+	time.Sleep(10 * time.Millisecond)
+
+	// Connect to the IPC server
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	// Send invalid JSON
+	_, err = conn.Write([]byte("invalid json\n"))
+	if err != nil {
+		t.Fatalf("failed to write invalid message: %v", err)
+	}
+
+	// Should not receive anything on message channel
+	select {
+	case msg := <-server.msgChan:
+		t.Errorf("received unexpected message: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+		// This is expected - invalid messages should be dropped
+	}
+}
+
+func TestIPCServer_MultipleConnections(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give server time to start
+	time.Sleep(10 * time.Millisecond)
+
+	// Create multiple connections
+	conns := make([]net.Conn, 3)
+	defer func() {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		conn, err := dialIPC(server)
+		if err != nil {
+			t.Fatalf("failed to connect %d to IPC server: %v", i, err)
+		}
+		conns[i] = conn
+	}
+
+	// Send messages from all connections
+	messages := []IPCMessage{
+		{Type: "CONNECT", FD: 1, Port: 8080, Addr: "127.0.0.1:8080"},
+		{Type: "BIND", FD: 2, Port: 8081, Addr: "127.0.0.1:8081"},
+		{Type: "CONNECT", FD: 3, Port: 8082, Addr: "127.0.0.1:8082"},
+	}
+
+	for i, msg := range messages {
+		msgBytes, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("failed to marshal message %d: %v", i, err)
+		}
+
+		_, err = conns[i].Write(append(msgBytes, '\n'))
+		if err != nil {
+			t.Fatalf("failed to write message %d: %v", i, err)
+		}
+	}
+
+	// Receive all messages
+	received := make(map[int]IPCMessage)
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-server.msgChan:
+			received[msg.FD] = msg
+		case <-time.After(1 * time.Second):
+			t.Errorf("timeout waiting for message %d", i)
+		}
+	}
+
+	// Verify all messages were received
+	for i, originalMsg := range messages {
+		receivedMsg, ok := received[originalMsg.FD]
+		if !ok {
+			t.Errorf("message %d not received", i)
+			continue
+		}
+
+		if receivedMsg.Type != originalMsg.Type {
+			t.Errorf("message %d: Type = %q, want %q", i, receivedMsg.Type, originalMsg.Type)
+		}
+		if receivedMsg.Port != originalMsg.Port {
+			t.Errorf("message %d: Port = %d, want %d", i, receivedMsg.Port, originalMsg.Port)
+		}
+		if receivedMsg.Addr != originalMsg.Addr {
+			t.Errorf("message %d: Addr = %q, want %q", i, receivedMsg.Addr, originalMsg.Addr)
+		}
+	}
+}
+
+func TestIPCServer_ChannelBuffering(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give server time to start
+	time.Sleep(10 * time.Millisecond)
+
+	// Connect to server
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	// Send many messages without reading from channel
+	// This tests the channel buffering (should be 100)
+	for i := 0; i < 50; i++ {
+		msg := IPCMessage{
+			Type: "CONNECT",
+			FD:   i,
+			Port: 8080 + i,
+			Addr: "127.0.0.1:8080",
+		}
+
+		msgBytes, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("failed to marshal message %d: %v", i, err)
+		}
+
+		_, err = conn.Write(append(msgBytes, '\n'))
+		if err != nil {
+			t.Fatalf("failed to write message %d: %v", i, err)
+		}
+	}
+
+	// Give time for messages to be processed
+	time.Sleep(100 * time.Millisecond)
+
+	// Now read messages from channel
+	count := 0
+	for {
+		select {
+		case <-server.msgChan:
+			count++
+		case <-time.After(100 * time.Millisecond):
+			// No more messages
+			goto done
+		}
+	}
+
+done:
+	if count != 50 {
+		t.Errorf("received %d messages, want 50", count)
+	}
+}
+
+func TestIPCMessage_JSONMarshaling(t *testing.T) {
+	msg := IPCMessage{
+		Type: "BIND",
+		FD:   42,
+		Port: 8080,
+		Addr: "192.168.1.1:8080",
+	}
+
+	// Marshal to JSON
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("failed to marshal IPCMessage: %v", err)
+	}
+
+	// Unmarshal from JSON
+	var unmarshaled IPCMessage
+	err = json.Unmarshal(data, &unmarshaled)
+	if err != nil {
+		t.Fatalf("failed to unmarshal IPCMessage: %v", err)
+	}
+
+	// Compare
+	if unmarshaled.Type != msg.Type {
+		t.Errorf("Type = %q, want %q", unmarshaled.Type, msg.Type)
+	}
+	if unmarshaled.FD != msg.FD {
+		t.Errorf("FD = %d, want %d", unmarshaled.FD, msg.FD)
+	}
+	if unmarshaled.Port != msg.Port {
+		t.Errorf("Port = %d, want %d", unmarshaled.Port, msg.Port)
+	}
+	if unmarshaled.Addr != msg.Addr {
+		t.Errorf("Addr = %q, want %q", unmarshaled.Addr, msg.Addr)
+	}
+}
+
+func TestIPCServer_VersionedMessages(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	messages := []string{
+		// Legacy client without a version field
+		`{"type":"BIND","fd":3,"port":8080,"addr":""}`,
+		// Explicit version 1 client sending fields it does not own
+		`{"version":1,"type":"BIND","fd":4,"port":8081,"addr":"","proto":"udp"}`,
+		// Version 2 client with socket details
+		`{"version":2,"type":"CONNECT","fd":5,"port":0,"addr":"10.0.0.1:80","proto":"tcp","non_blocking":true,"socket_type":1}`,
+	}
+	for _, m := range messages {
+		if _, err := conn.Write([]byte(m + "\n")); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+
+	var received []IPCMessage
+	for i := 0; i < len(messages); i++ {
+		select {
+		case msg := <-server.MessageChan():
+			received = append(received, msg)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+
+	if received[0].Version != IPCVersion1 || received[0].Port != 8080 {
+		t.Errorf("legacy message not treated as version 1: %+v", received[0])
+	}
+
+	if received[1].Version != IPCVersion1 || received[1].Proto != "" {
+		t.Errorf("version 1 message should not carry version 2 fields: %+v", received[1])
+	}
+
+	v2 := received[2]
+	if v2.Version != IPCVersion2 || v2.Proto != "tcp" || !v2.NonBlocking || v2.SocketType != 1 {
+		t.Errorf("version 2 fields not decoded: %+v", v2)
+	}
+	if v2.Type != "CONNECT" || v2.Addr != "10.0.0.1:80" {
+		t.Errorf("version 2 base fields not decoded: %+v", v2)
+	}
+}
+
+func TestIPCServer_RecordsExeName(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	messages := []string{
+		`{"version":2,"type":"CONNECT","fd":5,"port":0,"addr":"10.0.0.1:80","src_port":40001,"exe_name":"curl"}`,
+		// Version 1 clients cannot report a process name
+		`{"version":1,"type":"CONNECT","fd":6,"port":0,"addr":"10.0.0.1:80","src_port":40002,"exe_name":"wget"}`,
+	}
+	for _, m := range messages {
+		if _, err := conn.Write([]byte(m + "\n")); err != nil {
+			t.Fatalf("failed to write message: %v", err)
+		}
+	}
+
+	for i := 0; i < len(messages); i++ {
+		select {
+		case msg := <-server.MessageChan():
+			if i == 0 && (msg.SrcPort != 40001 || msg.ExeName != "curl") {
+				t.Errorf("version 2 process fields not decoded: %+v", msg)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf("timeout waiting for message %d", i)
+		}
+	}
+
+	if exeName := server.exeNames.take(40001); exeName != "curl" {
+		t.Errorf("expected curl recorded for source port 40001, got %q", exeName)
+	}
+	if exeName := server.exeNames.take(40002); exeName != "" {
+		t.Errorf("expected nothing recorded from a version 1 message, got %q", exeName)
+	}
+}
+
+// readIPCResponse reads the next reply on conn as an IPCResponse
+func readIPCResponse(t *testing.T, reader *bufio.Reader, conn net.Conn) IPCResponse {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	var response IPCResponse
+	if err := json.Unmarshal(line, &response); err != nil {
+		t.Fatalf("response is not valid JSON: %q: %v", line, err)
+	}
+	return response
+}
+
+func TestIPCServer_BindResponse(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	probe, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not usable here: %v", err)
+	}
+	port := probe.Addr().(*net.TCPAddr).Port
+	probe.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("127.0.0.2")}, server.MessageChan(), ForwarderOptions{})
+	go forwarder.Run(ctx)
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	fmt.Fprintf(conn, `{"version":2,"type":"BIND","fd":3,"port":%d,"id":7}`+"\n", port)
+	if response := readIPCResponse(t, reader, conn); response != (IPCResponse{ID: 7, OK: true}) {
+		t.Fatalf("expected an ok response for id 7, got %+v", response)
+	}
+
+	// The listener is up by the time the response arrives
+	if forwarded, err := net.Dial("tcp", fmt.Sprintf("127.0.0.2:%d", port)); err != nil {
+		t.Errorf("expected the forwarded port to accept connections: %v", err)
+	} else {
+		forwarded.Close()
+	}
+
+	// A port the forwarder cannot listen on gets an error
+	taken, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer taken.Close()
+	fmt.Fprintf(conn, `{"version":2,"type":"BIND","fd":4,"port":%d,"id":8}`+"\n", taken.Addr().(*net.TCPAddr).Port)
+	response := readIPCResponse(t, reader, conn)
+	if response.ID != 8 || response.OK || !strings.Contains(response.Error, "failed to create port forwarder listener") {
+		t.Errorf("expected an error response for id 8, got %+v", response)
+	}
+}
+
+func TestIPCServer_BindResponseWithoutWireGuardIP(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}, server.MessageChan(), ForwarderOptions{})
+	go forwarder.Run(ctx)
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	// The child has bound the port on localhost and is about to listen
+	child, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := child.Addr().(*net.TCPAddr).Port
+	child.Close()
+
+	fmt.Fprintf(conn, `{"version":2,"type":"BIND","fd":3,"port":%d,"id":1}`+"\n", port)
+	response := readIPCResponse(t, bufio.NewReader(conn), conn)
+	if response.ID != 1 || response.OK || !strings.Contains(response.Error, "10.150.0.2") {
+		t.Errorf("expected an error for the WireGuard IP, got %+v", response)
+	}
+
+	// The forwarder did not fall back to taking the child's port
+	child, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("expected the child's port to be left free: %v", err)
+	}
+	child.Close()
+}
+
+func TestIPCServer_ConnectResponse(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Messages without an ID get no response, as from older clients
+	conn.Write([]byte(`{"version":2,"type":"CONNECT","fd":5,"port":0,"addr":"10.0.0.1:80"}` + "\n"))
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if line, err := reader.ReadBytes('\n'); err == nil {
+		t.Errorf("expected no response to a message without an ID, got %q", line)
+	}
+	reader.Reset(conn)
+
+	// CONNECT is answered once the process name is recorded, without
+	// waiting for anyone to read the message channel
+	conn.Write([]byte(`{"version":2,"type":"CONNECT","fd":6,"port":0,"addr":"10.0.0.1:80","src_port":40003,"exe_name":"curl","id":9}` + "\n"))
+	if response := readIPCResponse(t, reader, conn); response != (IPCResponse{ID: 9, OK: true}) {
+		t.Fatalf("expected an ok response for id 9, got %+v", response)
+	}
+	if exeName := server.exeNames.take(40003); exeName != "curl" {
+		t.Errorf("expected curl recorded before the response, got %q", exeName)
+	}
+}
+
+func TestIPCServer_UnknownVersion(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(`{"version":99,"type":"BIND","fd":3,"port":8080}` + "\n")); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	reply, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("failed to read error reply: %v", err)
+	}
+
+	var ipcErr IPCError
+	if err := json.Unmarshal(reply, &ipcErr); err != nil {
+		t.Fatalf("error reply is not valid JSON: %v", err)
+	}
+
+	if !strings.Contains(ipcErr.Error, "unsupported IPC message version 99") {
+		t.Errorf("unexpected error reply: %q", ipcErr.Error)
+	}
+
+	select {
+	case msg := <-server.MessageChan():
+		t.Errorf("message with unknown version should not be dispatched: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestIPCServer_ConnectionClosed(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give server time to start
+	time.Sleep(10 * time.Millisecond)
+
+	// Connect and immediately close
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+
+	// Send a message and then close
+	msg := IPCMessage{Type: "CONNECT", FD: 1, Port: 8080, Addr: "127.0.0.1:8080"}
+	msgBytes, _ := json.Marshal(msg)
+	conn.Write(append(msgBytes, '\n'))
+	conn.Close()
+
+	// Should receive the message
+	select {
+	case receivedMsg := <-server.msgChan:
+		if receivedMsg.Type != msg.Type {
+			t.Errorf("received wrong message type: %s", receivedMsg.Type)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("timeout waiting for message")
+	}
+
+	// Server should handle the closed connection gracefully
+	// (no panic or error)
+}
+
+func TestIPCServer_SocketPermissions(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	// Check that socket file exists and has appropriate permissions
+	info, err := os.Stat(server.socketPath)
+	if err != nil {
+		t.Fatalf("failed to stat socket file: %v", err)
+	}
+
+	// Should be a socket
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Error("socket file is not a socket")
+	}
+}
+
+// dialIPC connects to server and authenticates with its token
+func dialIPC(server *IPCServer) (net.Conn, error) {
+	conn, err := net.Dial("unix", server.socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, _ := json.Marshal(IPCAuthMessage{Type: "AUTH", Token: server.Token()})
+	if _, err := conn.Write(append(auth, '\n')); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestExeNameTable_Expiry(t *testing.T) {
+	names := newExeNameTable()
+	stale := time.Now().Add(-exeNameTTL - time.Second)
+	names.names[40010] = exeNameEntry{exeName: "curl", recordedAt: stale}
+	names.names[40011] = exeNameEntry{exeName: "wget", recordedAt: stale}
+
+	// A stale entry is not handed to a connection that reuses the port
+	if exeName := names.take(40010); exeName != "" {
+		t.Errorf("expected an expired entry to be ignored, got %q", exeName)
+	}
+
+	// Recording drops entries that were never taken
+	names.record(40012, "ssh")
+	if _, ok := names.names[40011]; ok {
+		t.Error("expected record to drop the expired entry")
+	}
+	if exeName := names.take(40012); exeName != "ssh" {
+		t.Errorf("expected ssh for source port 40012, got %q", exeName)
+	}
+	if len(names.names) != 0 {
+		t.Errorf("expected an empty table, got %v", names.names)
+	}
+
+	var unset *exeNameTable
+	if exeName := unset.take(40012); exeName != "" {
+		t.Errorf("expected nothing from a nil table, got %q", exeName)
+	}
+}
+
+func TestIPCServer_Token(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	other, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer other.Close()
+
+	// A random 32-byte token is generated per server
+	if len(server.Token()) != 64 {
+		t.Errorf("expected a 64 character hex token, got %q", server.Token())
+	}
+	if server.Token() == other.Token() {
+		t.Error("expected each server to generate its own token")
+	}
+
+	configured, err := NewIPCServer(IPCOptions{Token: "configured-secret"})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer configured.Close()
+
+	if configured.Token() != "configured-secret" {
+		t.Errorf("expected configured token, got %q", configured.Token())
+	}
+}
+
+func TestIPCServer_Authentication(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelDebug, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	bind := `{"type":"BIND","fd":3,"port":8080}`
+
+	tests := []struct {
+		name     string
+		first    string
+		expected string
+	}{
+		{"wrong token", `{"type":"AUTH","token":"wrong"}`, "invalid token"},
+		{"empty token", `{"type":"AUTH","token":""}`, "invalid token"},
+		{"missing auth", bind, "authentication required"},
+		{"invalid JSON", `not json`, "authentication required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("unix", server.socketPath)
+			if err != nil {
+				t.Fatalf("failed to connect to IPC server: %v", err)
+			}
+			defer conn.Close()
+
+			conn.Write([]byte(tt.first + "\n" + bind + "\n"))
+
+			conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+			reader := bufio.NewReader(conn)
+			reply, err := reader.ReadBytes('\n')
+			if err != nil {
+				t.Fatalf("failed to read error reply: %v", err)
+			}
+
+			var ipcErr IPCError
+			if err := json.Unmarshal(reply, &ipcErr); err != nil || ipcErr.Error != tt.expected {
+				t.Errorf("expected error %q, got %q", tt.expected, reply)
+			}
+
+			// The server closes the connection after rejecting it
+			if _, err := reader.ReadByte(); err == nil {
+				t.Error("expected connection to be closed")
+			}
+
+			select {
+			case msg := <-server.MessageChan():
+				t.Errorf("message on an unauthenticated connection was dispatched: %+v", msg)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+
+	// An authenticated connection proceeds normally
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(bind + "\n"))
+
+	select {
+	case msg := <-server.MessageChan():
+		if msg.Type != "BIND" || msg.Port != 8080 {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("message on an authenticated connection was not received")
+	}
+
+	// The token is never logged
+	if strings.Contains(buf.String(), server.Token()) {
+		t.Errorf("token leaked into the log: %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Rejected connection") {
+		t.Errorf("expected rejected connections to be logged, got %q", buf.String())
+	}
+}
+
+// Helper function to check if path contains PID
+func containsPID(path string) bool {
+	filename := filepath.Base(path)
+	return len(filename) > len("wrapguard-.sock")
+}
+
+// Benchmark test for IPC server creation
+func TestIPCServer_CloseDrainsInFlightMessages(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		server, err := NewIPCServer(IPCOptions{})
+		if err != nil {
+			t.Fatalf("NewIPCServer failed: %v", err)
+		}
+
+		conn, err := dialIPC(server)
+		if err != nil {
+			server.Close()
+			t.Fatalf("failed to connect to IPC server: %v", err)
+		}
+
+		// Write and close immediately, like the intercept library does
+		msg := IPCMessage{Type: "CONNECT", FD: i, Port: 8080, Addr: "10.150.0.2:8080"}
+		msgBytes, _ := json.Marshal(msg)
+		conn.Write(append(msgBytes, '\n'))
+		server.Close()
+		conn.Close()
+
+		select {
+		case received := <-server.MessageChan():
+			if received.FD != i {
+				t.Errorf("iteration %d: expected FD %d, got %d", i, i, received.FD)
+			}
+		default:
+			t.Fatalf("iteration %d: message written before Close was dropped", i)
+		}
+	}
+}
+
+func TestIPCServer_CloseWithIdleConnection(t *testing.T) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+
+	conn, err := net.Dial("unix", server.socketPath)
+	if err != nil {
+		t.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	// An idle client must not hold Close for the full shutdown timeout
+	start := time.Now()
+	server.Close()
+	if elapsed := time.Since(start); elapsed >= ipcShutdownTimeout {
+		t.Errorf("Close took %v with an idle connection", elapsed)
+	}
+
+	if _, err := net.Dial("unix", server.socketPath); err == nil {
+		t.Error("expected new connections to fail after Close")
+	}
+}
+
+func TestIPCServer_ConnectionLimit(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelWarn, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	if server.maxConns != 256 {
+		t.Fatalf("expected default limit 256, got %d", server.maxConns)
+	}
+
+	unlimited, err := NewIPCServer(IPCOptions{MaxConnections: -1})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer unlimited.Close()
+	if unlimited.maxConns > 0 {
+		t.Errorf("expected no limit, got %d", unlimited.maxConns)
+	}
+
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	rejected := 0
+	for i := 0; i < 300; i++ {
+		conn, err := net.Dial("unix", server.socketPath)
+		if err != nil {
+			t.Fatalf("connection %d failed: %v", i, err)
+		}
+		conns = append(conns, conn)
+
+		if i < 256 {
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("connection %d: expected error response: %v", i, err)
+		}
+
+		var reply IPCError
+		if err := json.Unmarshal([]byte(line), &reply); err != nil || reply.Error != "connection limit reached" {
+			t.Errorf("connection %d: unexpected response %q", i, line)
+			continue
+		}
+		rejected++
+	}
+
+	if rejected != 44 {
+		t.Errorf("expected 44 rejected connections, got %d", rejected)
+	}
+
+	if count := strings.Count(buf.String(), "IPC connection limit"); count != 1 {
+		t.Errorf("expected the limit warning to be logged once, got %d", count)
+	}
+
+	// Closing a connection frees a slot for a new client
+	conns[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.activeConns.Load() >= 256 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect after freeing a slot: %v", err)
+	}
+	conns = append(conns, conn)
+
+	msg, _ := json.Marshal(IPCMessage{Type: "CONNECT", FD: 7, Port: 80, Addr: "10.150.0.2:80"})
+	conn.Write(append(msg, '\n'))
+
+	select {
+	case received := <-server.MessageChan():
+		if received.FD != 7 {
+			t.Errorf("expected FD 7, got %d", received.FD)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("message from a connection within the limit was not received")
+	}
+}
+
+func TestIPCServer_MessageRateWarning(t *testing.T) {
+	oldInterval := ipcRateInterval
+	ipcRateInterval = 50 * time.Millisecond
+	defer func() { ipcRateInterval = oldInterval }()
+
+	server, err := NewIPCServer(IPCOptions{MessageRateWarning: 10})
+	if err != nil {
+		t.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	waitForWarning := func(warned bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for server.rateWarned.Load() != warned {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected rate warning %v", warned)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// 50 messages within one 50ms check are far over 10 a second
+	msg, _ := json.Marshal(IPCMessage{Type: "BIND", Port: 8080})
+	for i := 0; i < 50; i++ {
+		conn.Write(append(msg, '\n'))
+	}
+	waitForWarning(true)
+	for i := 0; i < 50; i++ {
+		<-server.MessageChan()
+	}
+
+	// Once the flood stops the warning can be logged again
+	waitForWarning(false)
+}
+
+func BenchmarkNewIPCServer(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		server, err := NewIPCServer(IPCOptions{})
+		if err != nil {
+			b.Fatalf("NewIPCServer failed: %v", err)
+		}
+		server.Close()
+	}
+}
+
+// Benchmark test for message handling
+func BenchmarkIPCServer_MessageHandling(b *testing.B) {
+	server, err := NewIPCServer(IPCOptions{})
+	if err != nil {
+		b.Fatalf("NewIPCServer failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give server time to start
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := dialIPC(server)
+	if err != nil {
+		b.Fatalf("failed to connect to IPC server: %v", err)
+	}
+	defer conn.Close()
+
+	msg := IPCMessage{
+		Type: "CONNECT",
+		FD:   42,
+		Port: 8080,
+		Addr: "127.0.0.1:8080",
+	}
+
+	msgBytes, _ := json.Marshal(msg)
+	msgLine := append(msgBytes, '\n')
+
+	// Drain the channel in a goroutine
+	go func() {
+		for {
+			select {
+			case <-server.msgChan:
+			case <-time.After(1 * time.Second):
+				return
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(msgLine)
+	}
+}
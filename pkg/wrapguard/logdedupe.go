@@ -0,0 +1,176 @@
+package wrapguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+	"time"
+)
+
+// dedupeWriter is a log output that writes the first of a run of identical
+// entries and counts the rest. Once window has passed since the first, a
+// summary entry with the number suppressed is written in their place.
+type dedupeWriter struct {
+	out    io.Writer
+	window time.Duration
+	mu     sync.Mutex
+	seen   map[uint64]*dedupeEntry
+}
+
+// dedupeEntry tracks the repeats of one entry within its window
+type dedupeEntry struct {
+	level LogLevel
+	entry LogEntry
+	count int
+	timer *time.Timer
+}
+
+// dedupeSummary is the entry written for suppressed repeats
+type dedupeSummary struct {
+	LogEntry
+	Suppressed int `json:"suppressed"`
+}
+
+func newDedupeWriter(out io.Writer, window time.Duration) *dedupeWriter {
+	return &dedupeWriter{
+		out:    out,
+		window: window,
+		seen:   make(map[uint64]*dedupeEntry),
+	}
+}
+
+// Deduplicate returns a logger that suppresses entries identical to one
+// written within the last window, apart from their timestamp. Call Flush
+// before exiting to write the summaries still pending.
+func (l *Logger) Deduplicate(window time.Duration) *Logger {
+	return &Logger{
+		level:  l.level,
+		output: newDedupeWriter(l.output, window),
+		mu:     l.mu,
+		fields: l.fields,
+	}
+}
+
+// WriteLevel writes entry unless an identical one is inside its window
+func (d *dedupeWriter) WriteLevel(level LogLevel, data []byte) error {
+	var entry LogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.write(level, data)
+	}
+
+	key, err := dedupeKey(entry)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if seen, ok := d.seen[key]; ok {
+		seen.count++
+		return nil
+	}
+
+	seen := &dedupeEntry{level: level, entry: entry}
+	seen.timer = time.AfterFunc(d.window, func() { d.expire(key, seen) })
+	d.seen[key] = seen
+	return d.write(level, data)
+}
+
+// Write handles entries written without a level as informational
+func (d *dedupeWriter) Write(p []byte) (int, error) {
+	level := LogLevelInfo
+	var entry LogEntry
+	if json.Unmarshal(p, &entry) == nil {
+		if parsed, err := ParseLogLevel(entry.Level); err == nil {
+			level = parsed
+		}
+	}
+	if err := d.WriteLevel(level, bytes.TrimRight(p, "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// expire ends seen's window, writing its summary if anything was suppressed
+func (d *dedupeWriter) expire(key uint64, seen *dedupeEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen[key] != seen {
+		return
+	}
+	delete(d.seen, key)
+	d.writeSummary(seen)
+}
+
+// Flush ends every open window and writes the pending summaries
+func (d *dedupeWriter) Flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var firstErr error
+	for key, seen := range d.seen {
+		seen.timer.Stop()
+		delete(d.seen, key)
+		if err := d.writeSummary(seen); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Rotate rotates the wrapped output if it supports rotation
+func (d *dedupeWriter) Rotate() error {
+	r, ok := d.out.(rotator)
+	if !ok {
+		return fmt.Errorf("log output does not support rotation")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return r.Rotate()
+}
+
+// writeSummary writes the suppressed count for seen, if there is one. The
+// caller holds d.mu.
+func (d *dedupeWriter) writeSummary(seen *dedupeEntry) error {
+	if seen.count == 0 {
+		return nil
+	}
+
+	summary := dedupeSummary{LogEntry: seen.entry, Suppressed: seen.count}
+	summary.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return d.write(seen.level, data)
+}
+
+// write passes one entry to the wrapped output. The caller holds d.mu.
+func (d *dedupeWriter) write(level LogLevel, data []byte) error {
+	if w, ok := d.out.(levelWriter); ok {
+		return w.WriteLevel(level, data)
+	}
+	_, err := fmt.Fprintf(d.out, "%s\n", data)
+	return err
+}
+
+// dedupeKey hashes everything in entry except its timestamp
+func dedupeKey(entry LogEntry) (uint64, error) {
+	entry.Timestamp = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64(), nil
+}
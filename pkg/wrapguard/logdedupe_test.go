@@ -0,0 +1,192 @@
+package wrapguard
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingOutput is a levelWriter that keeps each entry with its level
+type recordingOutput struct {
+	mu      sync.Mutex
+	levels  []LogLevel
+	entries []string
+}
+
+func (r *recordingOutput) WriteLevel(level LogLevel, entry []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.levels = append(r.levels, level)
+	r.entries = append(r.entries, string(entry))
+	return nil
+}
+
+func (r *recordingOutput) Write(p []byte) (int, error) {
+	return len(p), r.WriteLevel(LogLevelInfo, p)
+}
+
+func (r *recordingOutput) snapshot() ([]LogLevel, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LogLevel(nil), r.levels...), append([]string(nil), r.entries...)
+}
+
+// decodeSummaries returns the suppressed counts of the summary lines in output
+func decodeSummaries(t *testing.T, lines []string) map[string]int {
+	t.Helper()
+
+	summaries := make(map[string]int)
+	for _, line := range lines {
+		var summary dedupeSummary
+		if err := json.Unmarshal([]byte(line), &summary); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if summary.Suppressed > 0 {
+			summaries[summary.Message] += summary.Suppressed
+		}
+	}
+	return summaries
+}
+
+func TestDedupeWriter_SuppressesRepeats(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(LogLevelInfo, &buf).Deduplicate(5 * time.Second)
+
+	// 100 identical messages over a second, all inside one 5s window
+	for i := 0; i < 100; i++ {
+		logger.Warnf("SOCKS5 dial failed: %s", "connection refused")
+		if i == 50 {
+			logger.Infof("a different message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := logger.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected the first entry, the other message and one summary, got %d lines:\n%s", len(lines), buf.String())
+	}
+	if strings.Count(buf.String(), `"suppressed"`) != 1 {
+		t.Errorf("expected exactly one summary line:\n%s", buf.String())
+	}
+
+	summaries := decodeSummaries(t, lines)
+	if summaries["SOCKS5 dial failed: connection refused"] != 99 {
+		t.Errorf("expected 99 suppressed entries, got %v", summaries)
+	}
+
+	// The summary keeps the level of the entries it replaces
+	var summary dedupeSummary
+	json.Unmarshal([]byte(lines[2]), &summary)
+	if summary.Level != "warn" || summary.Timestamp == "" {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+
+	// Nothing is pending after a flush
+	logger.Flush()
+	if strings.Count(buf.String(), "\n") != 3 {
+		t.Errorf("expected a second Flush to write nothing:\n%s", buf.String())
+	}
+}
+
+func TestDedupeWriter_WindowExpiry(t *testing.T) {
+	output := &recordingOutput{}
+	logger := NewLogger(LogLevelInfo, output).Deduplicate(100 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		logger.Errorf("upstream unreachable")
+	}
+
+	// The summary is written when the window expires, without a Flush
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, entries := output.snapshot()
+		if len(entries) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no summary after the window expired: %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A new window starts with the next entry
+	logger.Errorf("upstream unreachable")
+	logger.Flush()
+
+	levels, entries := output.snapshot()
+	if len(entries) != 3 {
+		t.Fatalf("expected the entry to be written again after its window, got %v", entries)
+	}
+	if summaries := decodeSummaries(t, entries); summaries["upstream unreachable"] != 2 {
+		t.Errorf("expected 2 suppressed entries, got %v", summaries)
+	}
+	for i, level := range levels {
+		if level != LogLevelError {
+			t.Errorf("entry %d passed on at level %v, expected error", i, level)
+		}
+	}
+}
+
+func TestDedupeWriter_FieldsDistinguishEntries(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(LogLevelInfo, &buf).Deduplicate(time.Minute)
+
+	logger.WithFields(map[string]interface{}{"peer": 0}).Warnf("handshake failed")
+	logger.WithFields(map[string]interface{}{"peer": 1}).Warnf("handshake failed")
+	logger.WithFields(map[string]interface{}{"peer": 1}).Warnf("handshake failed")
+	logger.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected one entry per peer and one summary, got:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[2], `"peer":1`) || !strings.Contains(lines[2], `"suppressed":1`) {
+		t.Errorf("expected a summary for peer 1, got %s", lines[2])
+	}
+}
+
+func TestDedupeWriter_Write(t *testing.T) {
+	var buf bytes.Buffer
+	writer := newDedupeWriter(&buf, time.Minute)
+
+	// Entries that are not JSON pass through untouched
+	writer.Write([]byte("plain text\n"))
+	writer.Write([]byte("plain text\n"))
+
+	entry := []byte(`{"timestamp":"2024-01-01T00:00:00Z","level":"error","message":"boom"}` + "\n")
+	for i := 0; i < 3; i++ {
+		if n, err := writer.Write(entry); err != nil || n != len(entry) {
+			t.Fatalf("Write returned %d, %v", n, err)
+		}
+	}
+	writer.Flush()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || lines[0] != "plain text" || lines[1] != "plain text" {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[3], `"level":"error"`) || !strings.Contains(lines[3], `"suppressed":2`) {
+		t.Errorf("unexpected summary %s", lines[3])
+	}
+}
+
+func TestDedupeWriter_Rotate(t *testing.T) {
+	if err := NewLogger(LogLevelInfo, &bytes.Buffer{}).Deduplicate(time.Second).Rotate(); err == nil {
+		t.Error("expected an error rotating a buffer")
+	}
+
+	rf, err := OpenRotatingFile(t.TempDir()+"/wrapguard.log", 2, 0)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+	if err := NewLogger(LogLevelInfo, rf).Deduplicate(time.Second).Rotate(); err != nil {
+		t.Errorf("expected rotation to reach the file, got %v", err)
+	}
+}
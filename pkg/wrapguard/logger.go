@@ -0,0 +1,257 @@
+package wrapguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	LogLevelError LogLevel = iota
+	LogLevelWarn
+	LogLevelInfo
+	LogLevelDebug
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelError:
+		return "error"
+	case LogLevelWarn:
+		return "warn"
+	case LogLevelInfo:
+		return "info"
+	case LogLevelDebug:
+		return "debug"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return LogLevelError, nil
+	case "warn", "warning":
+		return LogLevelWarn, nil
+	case "info":
+		return LogLevelInfo, nil
+	case "debug":
+		return LogLevelDebug, nil
+	default:
+		return LogLevelInfo, fmt.Errorf("invalid log level: %s", s)
+	}
+}
+
+type Logger struct {
+	level  LogLevel
+	output io.Writer
+	mu     *sync.Mutex
+	fields logFields
+}
+
+// maxInlineFields is how many fields a Logger holds without a map, covering
+// the peer and destination fields the proxies attach to each connection
+const maxInlineFields = 3
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// logFields holds a logger's fields inline while there are few of them, and
+// in a map once there are more than maxInlineFields
+type logFields struct {
+	inline [maxInlineFields]logField
+	count  int
+	spill  map[string]interface{}
+}
+
+func (f *logFields) get(key string) (interface{}, bool) {
+	if f.spill != nil {
+		value, ok := f.spill[key]
+		return value, ok
+	}
+	for _, field := range f.inline[:f.count] {
+		if field.key == key {
+			return field.value, true
+		}
+	}
+	return nil, false
+}
+
+func (f *logFields) set(key string, value interface{}) {
+	if f.spill != nil {
+		f.spill[key] = value
+		return
+	}
+	for i := range f.inline[:f.count] {
+		if f.inline[i].key == key {
+			f.inline[i].value = value
+			return
+		}
+	}
+	if f.count < maxInlineFields {
+		f.inline[f.count] = logField{key, value}
+		f.count++
+		return
+	}
+	f.spill = f.toMap()
+	f.spill[key] = value
+}
+
+// toMap returns the fields as a map, or nil if there are none. The map must
+// not be modified.
+func (f *logFields) toMap() map[string]interface{} {
+	if f.spill != nil {
+		return f.spill
+	}
+	if f.count == 0 {
+		return nil
+	}
+	m := make(map[string]interface{}, f.count)
+	for _, field := range f.inline[:f.count] {
+		m[field.key] = field.value
+	}
+	return m
+}
+
+type LogEntry struct {
+	Timestamp string                 `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+func NewLogger(level LogLevel, output io.Writer) *Logger {
+	return &Logger{
+		level:  level,
+		output: output,
+		mu:     &sync.Mutex{},
+	}
+}
+
+// WithFields returns a child logger that includes the given key-value pairs in
+// every entry. The child shares the parent's output and lock. Up to
+// maxInlineFields fields in all are stored in the child itself, so creating
+// it allocates nothing else, and the map an entry needs is only built when
+// the entry is written.
+func (l *Logger) WithFields(fields map[string]interface{}) *Logger {
+	if len(fields) == 0 {
+		return l
+	}
+
+	child := &Logger{
+		level:  l.level,
+		output: l.output,
+		mu:     l.mu,
+		fields: l.fields,
+	}
+	if l.fields.spill != nil {
+		child.fields.spill = maps.Clone(l.fields.spill)
+	}
+	for k, v := range fields {
+		child.fields.set(k, v)
+	}
+	return child
+}
+
+func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
+	if level > l.level {
+		return
+	}
+
+	entry := LogEntry{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Level:     level.String(),
+		Message:   fmt.Sprintf(format, args...),
+		Fields:    l.fields.toMap(),
+	}
+
+	data, _ := json.Marshal(entry)
+
+	l.mu.Lock()
+	if w, ok := l.output.(levelWriter); ok {
+		w.WriteLevel(level, data)
+	} else {
+		fmt.Fprintf(l.output, "%s\n", data)
+	}
+	l.mu.Unlock()
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LogLevelError, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LogLevelWarn, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LogLevelInfo, format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(LogLevelDebug, format, args...)
+}
+
+// levelWriter is implemented by log outputs that record each entry's level
+// themselves, such as syslog
+type levelWriter interface {
+	WriteLevel(level LogLevel, entry []byte) error
+}
+
+// rotator is implemented by log outputs that support rotation
+type rotator interface {
+	Rotate() error
+}
+
+// Rotate rotates the log output if it supports rotation. The swap happens under
+// the logger's lock so no entry is written to a half-rotated file.
+func (l *Logger) Rotate() error {
+	r, ok := l.output.(rotator)
+	if !ok {
+		return fmt.Errorf("log output does not support rotation")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return r.Rotate()
+}
+
+// flusher is implemented by log outputs that hold entries back
+type flusher interface {
+	Flush() error
+}
+
+// Flush writes out anything the log output is holding back, such as the
+// summaries of deduplicated entries
+func (l *Logger) Flush() error {
+	f, ok := l.output.(flusher)
+	if !ok {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return f.Flush()
+}
+
+// Global logger instance
+var logger *Logger
+
+func init() {
+	// Default logger to stderr with info level
+	logger = NewLogger(LogLevelInfo, os.Stderr)
+}
+
+func SetGlobalLogger(l *Logger) {
+	logger = l
+}
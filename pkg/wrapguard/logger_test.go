@@ -1,9 +1,11 @@
-package main
+package wrapguard
 
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -391,6 +393,122 @@ func TestLogger_LongMessage(t *testing.T) {
 	}
 }
 
+func TestLogger_WithFields(t *testing.T) {
+	var buf bytes.Buffer
+	parent := NewLogger(LogLevelInfo, &buf)
+
+	child := parent.WithFields(map[string]interface{}{"peer_addr": "127.0.0.1:1234"})
+	child.Infof("connection accepted")
+
+	var entry LogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to parse JSON output: %v", err)
+	}
+
+	if entry.Fields["peer_addr"] != "127.0.0.1:1234" {
+		t.Errorf("expected peer_addr field, got %v", entry.Fields)
+	}
+
+	if !strings.Contains(buf.String(), `"fields":{"peer_addr":"127.0.0.1:1234"}`) {
+		t.Errorf("expected fields to be serialized as \"fields\", got %s", buf.String())
+	}
+
+	// Parent logger must not pick up the child's fields
+	buf.Reset()
+	parent.Infof("plain message")
+	if strings.Contains(buf.String(), "fields") {
+		t.Errorf("parent logger should not include fields, got %s", buf.String())
+	}
+}
+
+func TestLogger_WithFieldsMerge(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(LogLevelDebug, &buf)
+
+	child := logger.WithFields(map[string]interface{}{"component": "socks5", "port": 1080})
+	grandchild := child.WithFields(map[string]interface{}{"port": 8080, "peer_addr": "10.0.0.1:5555"})
+	grandchild.Debugf("dial")
+
+	var entry LogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to parse JSON output: %v", err)
+	}
+
+	if len(entry.Fields) != 3 {
+		t.Errorf("expected 3 fields, got %d: %v", len(entry.Fields), entry.Fields)
+	}
+
+	if entry.Fields["component"] != "socks5" {
+		t.Errorf("expected inherited component field, got %v", entry.Fields["component"])
+	}
+
+	// JSON numbers decode as float64
+	if entry.Fields["port"] != float64(8080) {
+		t.Errorf("expected child to override port, got %v", entry.Fields["port"])
+	}
+
+	// The intermediate logger keeps its own value
+	if port, _ := child.fields.get("port"); port != 1080 {
+		t.Errorf("expected intermediate logger port 1080, got %v", port)
+	}
+}
+
+func TestLogger_WithFieldsSpill(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(LogLevelInfo, &buf)
+
+	child := logger.WithFields(map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	spilled := child.WithFields(map[string]interface{}{"d": 4, "a": 5})
+	spilled.WithFields(map[string]interface{}{"e": 6}).Infof("many fields")
+
+	var entry LogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("failed to parse JSON output: %v", err)
+	}
+	expected := map[string]interface{}{"a": float64(5), "b": float64(2), "c": float64(3), "d": float64(4), "e": float64(6)}
+	if !reflect.DeepEqual(entry.Fields, expected) {
+		t.Errorf("expected fields %v, got %v", expected, entry.Fields)
+	}
+
+	// Neither ancestor picks up fields added after it
+	if _, ok := spilled.fields.get("e"); ok {
+		t.Error("expected the spilled logger not to have its child's field")
+	}
+	if value, _ := child.fields.get("a"); value != 1 {
+		t.Errorf("expected the inline logger to keep a=1, got %v", value)
+	}
+}
+
+func TestLogger_WithFieldsAllocs(t *testing.T) {
+	logger := NewLogger(LogLevelInfo, io.Discard).WithFields(map[string]interface{}{"component": "socks5"})
+
+	// Up to maxInlineFields fields need only the child logger
+	allocs := testing.AllocsPerRun(100, func() {
+		logger.WithFields(map[string]interface{}{"peer_addr": "127.0.0.1:1234", "destination": "10.0.0.1:80"})
+	})
+	if allocs != 1 {
+		t.Errorf("expected 1 allocation for a child with %d fields, got %v", maxInlineFields, allocs)
+	}
+}
+
+func TestLogger_WithFieldsEmpty(t *testing.T) {
+	logger := NewLogger(LogLevelInfo, &bytes.Buffer{})
+
+	if logger.WithFields(nil) != logger {
+		t.Error("WithFields(nil) should return the same logger")
+	}
+}
+
+func TestLogger_WithFieldsLevelFiltering(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(LogLevelWarn, &buf)
+
+	logger.WithFields(map[string]interface{}{"key": "value"}).Infof("filtered")
+	if buf.Len() != 0 {
+		t.Errorf("expected info message to be filtered, got %s", buf.String())
+	}
+}
+
 // Benchmark tests for performance
 func BenchmarkLogger_Info(b *testing.B) {
 	var buf bytes.Buffer
@@ -402,6 +520,16 @@ func BenchmarkLogger_Info(b *testing.B) {
 	}
 }
 
+func BenchmarkLogger_InfoWithFields(b *testing.B) {
+	var buf bytes.Buffer
+	logger := NewLogger(LogLevelInfo, &buf).WithFields(map[string]interface{}{"peer_addr": "127.0.0.1:1234"})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.Infof("benchmark message %d", i)
+	}
+}
+
 func BenchmarkLogger_InfoFiltered(b *testing.B) {
 	var buf bytes.Buffer
 	logger := NewLogger(LogLevelError, &buf) // Debug messages will be filtered
@@ -0,0 +1,135 @@
+package wrapguard
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// RotatingFile is a log file writer that can be rotated by renaming the
+// current file to <path>.1 (shifting older files up to maxCount) and reopening
+// a fresh file at the original path. It is not safe for concurrent use on its
+// own; Logger serialises writes and rotation with its mutex.
+type RotatingFile struct {
+	path     string
+	maxCount int
+	maxSize  int64
+	file     *os.File
+	size     int64
+	retryAt  int64 // Size past which a failed automatic rotation is tried again
+}
+
+// OpenRotatingFile opens path for appending. maxCount is the number of rotated
+// files to keep and maxSize, when positive, triggers rotation automatically
+// once the file would grow beyond that many bytes.
+func OpenRotatingFile(path string, maxCount int, maxSize int64) (*RotatingFile, error) {
+	if maxCount < 1 {
+		maxCount = 1
+	}
+
+	rf := &RotatingFile{
+		path:     path,
+		maxCount: maxCount,
+		maxSize:  maxSize,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past
+// maxSize. If the rotation fails, p is still written to the current file and
+// the rotation error returned; it is not retried until the file has grown by
+// another maxSize.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	var rotateErr error
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > max(rf.maxSize, rf.retryAt) {
+		if err := rf.Rotate(); err != nil {
+			rotateErr = fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	}
+	if rf.file == nil {
+		return 0, errors.Join(rotateErr, os.ErrInvalid)
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	if rotateErr != nil {
+		rf.retryAt = rf.size + rf.maxSize
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, rotateErr
+}
+
+// Rotate closes the current file, shifts <path>.N to <path>.N+1, renames the
+// current file to <path>.1 and reopens a new file at the original path. If a
+// rename fails, the original path is reopened for appending so that logging
+// carries on.
+func (rf *RotatingFile) Rotate() error {
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+
+	if err := rf.rotate(); err != nil {
+		if rf.file == nil {
+			if openErr := rf.open(); openErr != nil {
+				return errors.Join(err, openErr)
+			}
+		}
+		return err
+	}
+	rf.retryAt = 0
+	return nil
+}
+
+// rotate renames the log files and opens a new one at the original path
+func (rf *RotatingFile) rotate() error {
+	// Drop the oldest file and shift the rest up by one
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxCount))
+	for i := rf.maxCount - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", rf.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", rf.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return rf.open()
+}
+
+func (rf *RotatingFile) Close() error {
+	if rf.file != nil {
+		err := rf.file.Close()
+		rf.file = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package wrapguard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapguard.log")
+
+	rf, err := OpenRotatingFile(path, 3, 0)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+
+	if _, err := rf.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "hello\n" {
+		t.Errorf("unexpected file content: %q", string(data))
+	}
+}
+
+func TestOpenRotatingFile_InvalidPath(t *testing.T) {
+	if _, err := OpenRotatingFile("/nonexistent/dir/wrapguard.log", 3, 0); err == nil {
+		t.Error("expected error for invalid path")
+	}
+}
+
+func TestRotatingFile_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapguard.log")
+
+	rf, err := OpenRotatingFile(path, 2, 0)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		rf.Write([]byte(line))
+		if err := rf.Rotate(); err != nil {
+			t.Fatalf("Rotate failed: %v", err)
+		}
+	}
+	rf.Write([]byte("current\n"))
+
+	expected := map[string]string{
+		path:        "current\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for file, content := range expected {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Errorf("failed to read %s: %v", file, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s: expected %q, got %q", file, content, string(data))
+		}
+	}
+
+	// Only maxCount rotated files are kept
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected %s.3 to not exist", path)
+	}
+}
+
+func TestRotatingFile_RotateFailureKeepsLogging(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapguard.log")
+
+	// A non-empty directory in the way of <path>.1 makes the rename fail,
+	// even for root, which a read-only directory would not
+	if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	rf, err := OpenRotatingFile(path, 1, 10)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+
+	rf.Write([]byte("before\n"))
+	if err := rf.Rotate(); err == nil {
+		t.Fatal("expected Rotate to fail")
+	}
+
+	// Writes go on to the original file, and one over maxSize that fails to
+	// rotate is still written
+	if _, err := rf.Write([]byte("after\n")); err == nil {
+		t.Error("expected the failed automatic rotation to be reported")
+	}
+	if _, err := rf.Write([]byte("again\n")); err != nil {
+		t.Errorf("expected the rotation not to be retried straight away, got %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	if string(data) != "before\nafter\nagain\n" {
+		t.Errorf("expected every write in the original file, got %q", data)
+	}
+}
+
+func TestRotatingFile_SizeBasedRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapguard.log")
+
+	rf, err := OpenRotatingFile(path, 20, 1024)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+
+	logger := NewLogger(LogLevelInfo, rf)
+	for i := 0; i < 50; i++ {
+		logger.Infof("log line %03d %s", i, strings.Repeat("x", 40))
+	}
+
+	rotated, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatalf("expected rotated file to exist: %v", err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read current file: %v", err)
+	}
+
+	if len(current) > 1024 || len(rotated) > 1024 {
+		t.Errorf("files exceed max size: current=%d rotated=%d", len(current), len(rotated))
+	}
+
+	if !strings.Contains(string(current), "log line 049") {
+		t.Error("current file should contain the latest log line")
+	}
+
+	// Every line must end up in exactly one file, none split across a rotation
+	var all string
+	for i := 20; i >= 1; i-- {
+		data, _ := os.ReadFile(fmt.Sprintf("%s.%d", path, i))
+		all += string(data)
+	}
+	all += string(current)
+
+	for i := 0; i < 50; i++ {
+		line := fmt.Sprintf("log line %03d", i)
+		if strings.Count(all, line) != 1 {
+			t.Errorf("expected %q exactly once across log files", line)
+		}
+	}
+}
+
+func TestLogger_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wrapguard.log")
+
+	rf, err := OpenRotatingFile(path, 3, 0)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile failed: %v", err)
+	}
+	defer rf.Close()
+
+	logger := NewLogger(LogLevelInfo, rf)
+	logger.Infof("before rotation")
+
+	if err := logger.Rotate(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	logger.Infof("after rotation")
+
+	rotated, _ := os.ReadFile(path + ".1")
+	if !strings.Contains(string(rotated), "before rotation") {
+		t.Errorf("rotated file missing old entry: %q", string(rotated))
+	}
+
+	current, _ := os.ReadFile(path)
+	if !strings.Contains(string(current), "after rotation") || strings.Contains(string(current), "before rotation") {
+		t.Errorf("unexpected current file content: %q", string(current))
+	}
+}
+
+func TestLogger_RotateUnsupportedOutput(t *testing.T) {
+	logger := NewLogger(LogLevelInfo, os.Stderr)
+	if err := logger.Rotate(); err == nil {
+		t.Error("expected error when output does not support rotation")
+	}
+}
@@ -0,0 +1,159 @@
+package wrapguard
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// pacRule sends destinations within prefixes to the SOCKS5 proxy on port
+type pacRule struct {
+	prefixes []netip.Prefix
+	port     int
+}
+
+// allowedPrefixes returns the IPv4 AllowedIPs of every peer in config. PAC
+// files can only match IPv4 networks with isInNet, so IPv6 entries are
+// left out.
+func allowedPrefixes(config *WireGuardConfig) []netip.Prefix {
+	if config == nil {
+		return nil
+	}
+
+	var prefixes []netip.Prefix
+	for _, peer := range config.Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(allowedIP))
+			if err != nil || !prefix.Addr().Is4() {
+				continue
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+// writePAC writes a FindProxyForURL function that checks rules in order and
+// connects directly to anything they don't match
+func writePAC(w io.Writer, rules []pacRule) error {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tvar ip = dnsResolve(host);\n")
+	b.WriteString("\tif (!ip) {\n\t\treturn \"DIRECT\";\n\t}\n")
+	for _, rule := range rules {
+		for _, prefix := range rule.prefixes {
+			mask := net.IP(net.CIDRMask(prefix.Bits(), 32)).String()
+			fmt.Fprintf(&b, "\tif (isInNet(ip, %q, %q)) {\n\t\treturn \"SOCKS5 127.0.0.1:%d\";\n\t}\n", prefix.Addr(), mask, rule.port)
+		}
+	}
+	b.WriteString("\treturn \"DIRECT\";\n}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// servePAC answers a PAC file request with the given rules
+func servePAC(w http.ResponseWriter, rules []pacRule) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	if err := writePAC(w, rules); err != nil {
+		logger.Debugf("Failed to write PAC file: %v", err)
+	}
+}
+
+// SetConfig replaces the config the PAC file is generated from, for when
+// the WireGuard config is reloaded
+func (s *SOCKS5Server) SetConfig(config *WireGuardConfig) {
+	prefixes := allowedPrefixes(config)
+
+	s.pacMutex.Lock()
+	defer s.pacMutex.Unlock()
+	s.pacPrefixes = prefixes
+}
+
+// pacRule returns the rule that sends this server's AllowedIPs to it
+func (s *SOCKS5Server) pacRule() pacRule {
+	s.pacMutex.RLock()
+	defer s.pacMutex.RUnlock()
+	return pacRule{prefixes: s.pacPrefixes, port: s.port}
+}
+
+// ServePAC serves a proxy auto-configuration file that sends the peers'
+// AllowedIPs through this SOCKS5 server and everything else direct
+func (s *SOCKS5Server) ServePAC(w http.ResponseWriter, r *http.Request) {
+	servePAC(w, []pacRule{s.pacRule()})
+}
+
+// ServePAC serves a proxy auto-configuration file covering every tunnel,
+// each through its own SOCKS5 server
+func (a *Agent) ServePAC(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	rules := make([]pacRule, 0, len(a.socksServers))
+	for _, socksServer := range a.socksServers {
+		rules = append(rules, socksServer.pacRule())
+	}
+	a.mutex.Unlock()
+
+	servePAC(w, rules)
+}
+
+// PACServer serves a PAC file over HTTP for browsers
+type PACServer struct {
+	listener net.Listener
+	server   *http.Server
+	served   chan struct{}
+}
+
+// NewPACServer listens on addr, a host:port optionally followed by the PAC
+// file path, e.g. ":8080/proxy.pac", and serves handler at that path. The
+// path defaults to /proxy.pac.
+func NewPACServer(addr string, handler http.HandlerFunc) (*PACServer, error) {
+	hostPort, path := addr, "/proxy.pac"
+	if i := strings.Index(addr, "/"); i >= 0 {
+		hostPort, path = addr[:i], addr[i:]
+	}
+
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for PAC requests: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, r)
+	})
+
+	s := &PACServer{
+		listener: listener,
+		server:   &http.Server{Handler: mux},
+		served:   make(chan struct{}),
+	}
+
+	// Start serving in background
+	go func() {
+		defer close(s.served)
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Debugf("PAC server stopped: %v", err)
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *PACServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server and waits for it to finish serving
+func (s *PACServer) Close() error {
+	err := s.server.Close()
+	<-s.served
+	return err
+}
@@ -0,0 +1,196 @@
+package wrapguard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	pacRuleLine   = regexp.MustCompile(`^\tif \(isInNet\(ip, "([0-9.]+)", "([0-9.]+)"\)\) \{$`)
+	pacReturnLine = regexp.MustCompile(`^\t\treturn "(DIRECT|SOCKS5 127\.0\.0\.1:[0-9]+)";$`)
+)
+
+// evalPAC checks that pac has exactly the shape writePAC produces, so that
+// it is valid JavaScript, and returns what FindProxyForURL gives for ip
+func evalPAC(t *testing.T, pac, ip string) string {
+	t.Helper()
+
+	lines := strings.Split(strings.TrimSuffix(pac, "\n"), "\n")
+	header := []string{"function FindProxyForURL(url, host) {", "\tvar ip = dnsResolve(host);", "\tif (!ip) {", "\t\treturn \"DIRECT\";", "\t}"}
+	footer := []string{"\treturn \"DIRECT\";", "}"}
+	if len(lines) < len(header)+len(footer) || (len(lines)-len(header)-len(footer))%3 != 0 {
+		t.Fatalf("unexpected PAC file:\n%s", pac)
+	}
+	for i, line := range header {
+		if lines[i] != line {
+			t.Fatalf("unexpected PAC line %d %q, expected %q", i, lines[i], line)
+		}
+	}
+	for i, line := range footer {
+		if got := lines[len(lines)-len(footer)+i]; got != line {
+			t.Fatalf("unexpected PAC line %q, expected %q", got, line)
+		}
+	}
+
+	result := ""
+	for i := len(header); i < len(lines)-len(footer); i += 3 {
+		rule := pacRuleLine.FindStringSubmatch(lines[i])
+		ret := pacReturnLine.FindStringSubmatch(lines[i+1])
+		if rule == nil || ret == nil || lines[i+2] != "\t}" {
+			t.Fatalf("malformed PAC rule at line %d:\n%s", i, pac)
+		}
+
+		network, mask := net.ParseIP(rule[1]).To4(), net.IPMask(net.ParseIP(rule[2]).To4())
+		if result == "" && net.ParseIP(ip).To4().Mask(mask).Equal(network) {
+			result = ret[1]
+		}
+	}
+	if result == "" {
+		return "DIRECT"
+	}
+	return result
+}
+
+func TestWritePAC(t *testing.T) {
+	config := newTestConfig(t, diffTestConfig)
+	config.Peers[1].AllowedIPs = []string{"10.160.0.0/24", "fd00::/64", "192.168.1.7/32"}
+
+	var buf strings.Builder
+	if err := writePAC(&buf, []pacRule{{prefixes: allowedPrefixes(config), port: 1080}}); err != nil {
+		t.Fatalf("writePAC failed: %v", err)
+	}
+	pac := buf.String()
+
+	if strings.Contains(pac, "fd00") {
+		t.Errorf("IPv6 AllowedIPs should be left out:\n%s", pac)
+	}
+
+	tests := []struct {
+		ip       string
+		expected string
+	}{
+		{"10.150.0.1", "SOCKS5 127.0.0.1:1080"},
+		{"10.160.0.200", "SOCKS5 127.0.0.1:1080"},
+		{"192.168.1.7", "SOCKS5 127.0.0.1:1080"},
+		{"192.168.1.8", "DIRECT"},
+		{"8.8.8.8", "DIRECT"},
+	}
+	for _, tt := range tests {
+		if got := evalPAC(t, pac, tt.ip); got != tt.expected {
+			t.Errorf("FindProxyForURL for %s = %q, expected %q", tt.ip, got, tt.expected)
+		}
+	}
+}
+
+func TestWritePAC_NoRules(t *testing.T) {
+	var buf strings.Builder
+	if err := writePAC(&buf, nil); err != nil {
+		t.Fatalf("writePAC failed: %v", err)
+	}
+	if got := evalPAC(t, buf.String(), "10.150.0.1"); got != "DIRECT" {
+		t.Errorf("expected DIRECT without rules, got %q", got)
+	}
+}
+
+func TestSOCKS5Server_ServePAC(t *testing.T) {
+	server := &SOCKS5Server{port: 1080}
+	server.SetConfig(newTestConfig(t, testConfig{}))
+
+	rec := httptest.NewRecorder()
+	server.ServePAC(rec, httptest.NewRequest(http.MethodGet, "/proxy.pac", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ns-proxy-autoconfig" {
+		t.Errorf("unexpected Content-Type %q", ct)
+	}
+	if got := evalPAC(t, rec.Body.String(), "10.150.0.9"); got != "SOCKS5 127.0.0.1:1080" {
+		t.Errorf("expected the WireGuard IP to use the proxy, got %q", got)
+	}
+
+	// A reloaded config replaces the networks
+	server.SetConfig(newTestConfig(t, testConfig{peers: []testPeer{{allowedIPs: "10.170.0.0/16"}}}))
+	rec = httptest.NewRecorder()
+	server.ServePAC(rec, httptest.NewRequest(http.MethodGet, "/proxy.pac", nil))
+	if got := evalPAC(t, rec.Body.String(), "10.150.0.9"); got != "DIRECT" {
+		t.Errorf("expected the old network to go direct after a reload, got %q", got)
+	}
+	if got := evalPAC(t, rec.Body.String(), "10.170.3.4"); got != "SOCKS5 127.0.0.1:1080" {
+		t.Errorf("expected the new network to use the proxy, got %q", got)
+	}
+}
+
+func TestAgent_ServePAC(t *testing.T) {
+	agent := &Agent{ProxyMode: "socks5"}
+	err := agent.StartTunnels(context.Background(), []*WireGuardConfig{
+		newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.1.0.0/16"}}}),
+		newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "10.2.0.0/16"}}}),
+	})
+	if err != nil {
+		t.Fatalf("StartTunnels failed: %v", err)
+	}
+	defer agent.Stop()
+
+	server, err := NewPACServer("127.0.0.1:0", agent.ServePAC)
+	if err != nil {
+		t.Fatalf("NewPACServer failed: %v", err)
+	}
+	defer server.Close()
+
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/proxy.pac", server.Port()))
+	if err != nil {
+		t.Fatalf("failed to fetch PAC file: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// Each tunnel's networks go through its own SOCKS5 server
+	ports, _ := envValue(agent.Env(), "WRAPGUARD_SOCKS_PORT")
+	portList := strings.Split(ports, ",")
+	if got := evalPAC(t, string(body), "10.1.2.3"); got != "SOCKS5 127.0.0.1:"+portList[0] {
+		t.Errorf("expected the first tunnel's proxy, got %q", got)
+	}
+	if got := evalPAC(t, string(body), "10.2.2.3"); got != "SOCKS5 127.0.0.1:"+portList[1] {
+		t.Errorf("expected the second tunnel's proxy, got %q", got)
+	}
+
+	resp, err = http.Get(fmt.Sprintf("http://127.0.0.1:%d/other", server.Port()))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for another path, got %d", resp.StatusCode)
+	}
+}
+
+func TestNewPACServer_Path(t *testing.T) {
+	server, err := NewPACServer("127.0.0.1:0/wpad.dat", (&SOCKS5Server{port: 1080}).ServePAC)
+	if err != nil {
+		t.Fatalf("NewPACServer failed: %v", err)
+	}
+	defer server.Close()
+
+	for path, status := range map[string]int{"/wpad.dat": http.StatusOK, "/proxy.pac": http.StatusNotFound} {
+		resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", server.Port(), path))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("expected %d for %s, got %d", status, path, resp.StatusCode)
+		}
+	}
+
+	if _, err := NewPACServer("127.0.0.1:99999", nil); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
@@ -0,0 +1,119 @@
+package wrapguard
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// packetRingSlots is the number of packets a packetRing holds, a power
+	// of two so that indices wrap with a mask
+	packetRingSlots = 1024
+
+	// packetRingSlotSize is the largest packet a slot holds, one MTU with
+	// room to spare
+	packetRingSlotSize = 1600
+)
+
+// errRingClosed is returned by packetRing.pop once the ring is closed and
+// empty
+var errRingClosed = fmt.Errorf("TUN closed")
+
+// packetRing is a fixed-size packet queue with a single consumer. Its slots
+// are allocated once and reused, so queueing a packet does not allocate.
+// Producers take mu to claim a slot; the consumer never locks, and owns
+// every slot between tail and head.
+type packetRing struct {
+	mu    sync.Mutex    // Serializes producers
+	head  atomic.Uint32 // Next slot to fill, advanced by producers
+	tail  atomic.Uint32 // Next slot to read, advanced by the consumer
+	sizes [packetRingSlots]uint16
+	slots [packetRingSlots][packetRingSlotSize]byte
+
+	ready     chan struct{} // Wakes a waiting consumer after a push
+	done      chan struct{} // Closed by close
+	closeOnce sync.Once
+}
+
+func newPacketRing() *packetRing {
+	return &packetRing{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// push copies packet into the next free slot. It returns false if the ring
+// is full or the packet is larger than a slot.
+func (r *packetRing) push(packet []byte) bool {
+	if len(packet) > packetRingSlotSize {
+		return false
+	}
+
+	r.mu.Lock()
+	head := r.head.Load()
+	if head-r.tail.Load() == packetRingSlots {
+		r.mu.Unlock()
+		return false
+	}
+	slot := head & (packetRingSlots - 1)
+	r.sizes[slot] = uint16(copy(r.slots[slot][:], packet))
+	r.head.Store(head + 1)
+	r.mu.Unlock()
+
+	select {
+	case r.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// tryPop copies the oldest packet into buf without waiting. It returns false
+// if the ring is empty. A packet that does not fit in buf is dropped with
+// io.ErrShortBuffer.
+func (r *packetRing) tryPop(buf []byte) (int, bool, error) {
+	tail := r.tail.Load()
+	if tail == r.head.Load() {
+		return 0, false, nil
+	}
+
+	slot := tail & (packetRingSlots - 1)
+	size := int(r.sizes[slot])
+	var err error
+	if size > len(buf) {
+		size, err = 0, io.ErrShortBuffer
+	} else {
+		copy(buf, r.slots[slot][:size])
+	}
+	r.tail.Store(tail + 1)
+	return size, true, err
+}
+
+// pop waits for a packet and copies it into buf. Packets queued before close
+// are still returned; after that pop returns errRingClosed.
+func (r *packetRing) pop(buf []byte) (int, error) {
+	for {
+		if n, ok, err := r.tryPop(buf); ok {
+			return n, err
+		}
+		select {
+		case <-r.ready:
+		case <-r.done:
+			if n, ok, err := r.tryPop(buf); ok {
+				return n, err
+			}
+			return 0, errRingClosed
+		}
+	}
+}
+
+// len returns the number of queued packets
+func (r *packetRing) len() int {
+	return int(r.head.Load() - r.tail.Load())
+}
+
+// close wakes the consumer and makes pop fail once the ring is empty
+func (r *packetRing) close() {
+	r.closeOnce.Do(func() { close(r.done) })
+}
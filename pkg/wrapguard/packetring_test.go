@@ -0,0 +1,165 @@
+package wrapguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPacketRing_PushPop(t *testing.T) {
+	ring := newPacketRing()
+	buf := make([]byte, packetRingSlotSize)
+
+	if _, ok, _ := ring.tryPop(buf); ok {
+		t.Fatal("expected an empty ring")
+	}
+
+	// Go round the ring several times so that indices wrap
+	for i := 0; i < 3*packetRingSlots; i++ {
+		packet := []byte{byte(i), byte(i >> 8), 0xff}
+		if !ring.push(packet) {
+			t.Fatalf("push %d failed", i)
+		}
+		packet[2] = 0 // The ring keeps its own copy
+
+		n, err := ring.pop(buf)
+		if err != nil {
+			t.Fatalf("pop %d returned error: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], []byte{byte(i), byte(i >> 8), 0xff}) {
+			t.Fatalf("pop %d returned %v", i, buf[:n])
+		}
+	}
+	if ring.len() != 0 {
+		t.Errorf("expected an empty ring, got %d packets", ring.len())
+	}
+}
+
+func TestPacketRing_Full(t *testing.T) {
+	ring := newPacketRing()
+	for i := 0; i < packetRingSlots; i++ {
+		if !ring.push([]byte{byte(i)}) {
+			t.Fatalf("push %d failed before the ring was full", i)
+		}
+	}
+	if ring.push([]byte("extra")) {
+		t.Error("expected push to fail on a full ring")
+	}
+	if ring.len() != packetRingSlots {
+		t.Errorf("expected %d queued packets, got %d", packetRingSlots, ring.len())
+	}
+
+	// Taking one packet frees one slot
+	buf := make([]byte, 16)
+	if n, _ := ring.pop(buf); n != 1 || buf[0] != 0 {
+		t.Errorf("expected the oldest packet first, got %v", buf[:n])
+	}
+	if !ring.push([]byte("extra")) {
+		t.Error("expected push to succeed after a pop")
+	}
+
+	if ring.push(make([]byte, packetRingSlotSize+1)) {
+		t.Error("expected push to reject a packet larger than a slot")
+	}
+}
+
+func TestPacketRing_ShortBuffer(t *testing.T) {
+	ring := newPacketRing()
+	ring.push([]byte("too long"))
+	ring.push([]byte("ok"))
+
+	// The packet that does not fit is dropped, not left at the head
+	buf := make([]byte, 4)
+	if _, err := ring.pop(buf); err != io.ErrShortBuffer {
+		t.Errorf("expected io.ErrShortBuffer, got %v", err)
+	}
+	if n, err := ring.pop(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Errorf("expected the next packet, got %q, %v", buf[:n], err)
+	}
+}
+
+func TestPacketRing_Close(t *testing.T) {
+	ring := newPacketRing()
+	buf := make([]byte, 16)
+
+	// A waiting pop is woken by a push
+	result := make(chan string)
+	go func() {
+		n, _ := ring.pop(buf)
+		result <- string(buf[:n])
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ring.push([]byte("wake"))
+	if got := <-result; got != "wake" {
+		t.Errorf("expected the pushed packet, got %q", got)
+	}
+
+	// Packets queued before close are still delivered
+	ring.push([]byte("last"))
+	ring.close()
+	ring.close()
+	if n, err := ring.pop(buf); err != nil || string(buf[:n]) != "last" {
+		t.Errorf("expected the queued packet after close, got %q, %v", buf[:n], err)
+	}
+	if _, err := ring.pop(buf); err != errRingClosed {
+		t.Errorf("expected errRingClosed, got %v", err)
+	}
+
+	// A waiting pop is woken by close
+	ring = newPacketRing()
+	errs := make(chan error)
+	go func() {
+		_, err := ring.pop(buf)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ring.close()
+	select {
+	case err := <-errs:
+		if err != errRingClosed {
+			t.Errorf("expected errRingClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pop was not woken by close")
+	}
+}
+
+func TestPacketRing_ConcurrentProducers(t *testing.T) {
+	ring := newPacketRing()
+	const producers, perProducer = 4, 5000
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			packet := make([]byte, 8)
+			for i := 0; i < perProducer; i++ {
+				binary.BigEndian.PutUint32(packet, uint32(p))
+				binary.BigEndian.PutUint32(packet[4:], uint32(i))
+				for !ring.push(packet) {
+					time.Sleep(time.Microsecond)
+				}
+			}
+		}(p)
+	}
+
+	// Each producer's packets arrive complete and in order
+	next := make([]uint32, producers)
+	buf := make([]byte, 16)
+	for i := 0; i < producers*perProducer; i++ {
+		n, err := ring.pop(buf)
+		if err != nil || n != 8 {
+			t.Fatalf("pop %d returned %d bytes, %v", i, n, err)
+		}
+		p, seq := binary.BigEndian.Uint32(buf), binary.BigEndian.Uint32(buf[4:])
+		if p >= producers || seq != next[p] {
+			t.Fatalf("packet %d from producer %d out of order, expected %d", seq, p, next[p])
+		}
+		next[p]++
+	}
+	wg.Wait()
+}
@@ -0,0 +1,228 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portDirScanInterval is how often a watched port directory is rescanned
+var portDirScanInterval = 2 * time.Second
+
+// portFile is the content of a *.port file in a watched directory
+type portFile struct {
+	Port   int    `json:"port"`
+	Proto  string `json:"proto"`
+	Target string `json:"target"`
+}
+
+// parsePortFile reads a *.port file. Proto defaults to TCP; an empty target
+// is left empty, for 127.0.0.1 on the same port.
+func parsePortFile(path string) (portFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return portFile{}, err
+	}
+
+	var pf portFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&pf); err != nil {
+		return portFile{}, fmt.Errorf("invalid port file %s: %w", path, err)
+	}
+
+	if pf.Port < 1 || pf.Port > 65535 {
+		return portFile{}, fmt.Errorf("invalid port file %s: port out of range: %d", path, pf.Port)
+	}
+	switch strings.ToLower(pf.Proto) {
+	case "", "tcp":
+		pf.Proto = "tcp"
+	case "udp":
+		return portFile{}, fmt.Errorf("invalid port file %s: UDP port forwarding is not supported", path)
+	default:
+		return portFile{}, fmt.Errorf("invalid port file %s: invalid proto %q (expected tcp)", path, pf.Proto)
+	}
+	if pf.Target != "" {
+		if _, _, err := net.SplitHostPort(pf.Target); err != nil {
+			return portFile{}, fmt.Errorf("invalid port file %s: invalid target %q: %w", path, pf.Target, err)
+		}
+	}
+	return pf, nil
+}
+
+// portDirWatcher keeps the ports forwarded from a directory in line with
+// its *.port files
+type portDirWatcher struct {
+	ctx    context.Context
+	dir    string
+	mutex  sync.Mutex
+	files  map[string]portFile // By file name, as last loaded
+	ports  map[int]string      // Ports this watcher forwards, to their file name
+	warned map[string]string   // Last problem logged for each file
+}
+
+// warn logs a problem with the file name unless it was the last one logged
+// for it, so that a periodic scan does not repeat it
+func (w *portDirWatcher) warn(name string, err error) {
+	if w.warned[name] != err.Error() {
+		w.warned[name] = err.Error()
+		logger.Warnf("Port forwarder: %v", err)
+	}
+}
+
+// WatchDir forwards a port for each *.port file in dir and keeps doing so as
+// files are added, changed and removed, until ctx is done. Each file holds
+// JSON such as {"port": 8080, "proto": "tcp", "target": "127.0.0.1:8080"};
+// proto and target are optional. The directory is rescanned every two
+// seconds, or at once by ScanDir. Ports bound by the child or registered
+// otherwise are left alone.
+func (pf *PortForwarder) WatchDir(ctx context.Context, dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to watch port directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("failed to watch port directory: %s is not a directory", dir)
+	}
+
+	pf.mutex.Lock()
+	if pf.portDir != nil {
+		pf.mutex.Unlock()
+		return fmt.Errorf("already watching port directory %s", pf.portDir.dir)
+	}
+	watcher := &portDirWatcher{
+		ctx:    ctx,
+		dir:    dir,
+		files:  make(map[string]portFile),
+		ports:  make(map[int]string),
+		warned: make(map[string]string),
+	}
+	pf.portDir = watcher
+	pf.mutex.Unlock()
+
+	pf.scanPortDir(watcher)
+	interval := portDirScanInterval
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// A scan that finished before ctx was done may have
+				// started ports after Run closed its listeners
+				watcher.mutex.Lock()
+				for port := range watcher.ports {
+					pf.unbind(port)
+				}
+				watcher.mutex.Unlock()
+				return
+			case <-ticker.C:
+				pf.scanPortDir(watcher)
+			}
+		}
+	}()
+	return nil
+}
+
+// ScanDir rescans the directory given to WatchDir without waiting for the
+// next periodic scan, as on SIGHUP. It does nothing if no directory is
+// watched.
+func (pf *PortForwarder) ScanDir() {
+	pf.mutex.RLock()
+	watcher := pf.portDir
+	pf.mutex.RUnlock()
+	if watcher != nil {
+		pf.scanPortDir(watcher)
+	}
+}
+
+// scanPortDir loads the *.port files in the watched directory and starts
+// and stops forwarding to match. A file that cannot be read or parsed keeps
+// its previous ports, so a half-written file does not drop a forward.
+func (pf *PortForwarder) scanPortDir(w *portDirWatcher) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.ctx.Err() != nil {
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(w.dir, "*.port"))
+	if err != nil {
+		logger.Warnf("Port forwarder: failed to scan %s: %v", w.dir, err)
+		return
+	}
+
+	files := make(map[string]portFile, len(paths))
+	problems := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		name := filepath.Base(path)
+		file, err := parsePortFile(path)
+		if err != nil {
+			w.warn(name, err)
+			problems[name] = true
+			if previous, ok := w.files[name]; ok {
+				files[name] = previous
+			}
+			continue
+		}
+		files[name] = file
+	}
+
+	// The first file by name wins a port that several files give
+	wanted := make(map[int]string, len(files))
+	for _, path := range paths {
+		name := filepath.Base(path)
+		file, ok := files[name]
+		if !ok {
+			continue
+		}
+		if other, taken := wanted[file.Port]; taken {
+			w.warn(name, fmt.Errorf("port %d from %s is already given by %s, ignoring the file", file.Port, name, other))
+			problems[name] = true
+			continue
+		}
+		wanted[file.Port] = name
+	}
+
+	// Stop ports whose file is gone or now says something else
+	for port, name := range w.ports {
+		if wanted[port] != name || files[name] != w.files[name] {
+			pf.unbind(port)
+			delete(w.ports, port)
+		}
+	}
+
+	for port, name := range wanted {
+		if _, ok := w.ports[port]; ok {
+			continue
+		}
+		started, err := pf.listen(port, files[name].Target, true)
+		if err != nil {
+			w.warn(name, fmt.Errorf("failed to forward port %d from %s: %w", port, name, err))
+			problems[name] = true
+			continue
+		}
+		if !started {
+			w.warn(name, fmt.Errorf("port %d from %s is already forwarded, ignoring the file", port, name))
+			problems[name] = true
+			continue
+		}
+		logger.Infof("Port forwarder: forwarding port %d to %s from %s", port, pf.target(port), name)
+		w.ports[port] = name
+	}
+
+	// Log a problem again if it comes back after being fixed
+	for name := range w.warned {
+		if !problems[name] {
+			delete(w.warned, name)
+		}
+	}
+	w.files = files
+}
@@ -0,0 +1,293 @@
+package wrapguard
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePortFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected portFile
+		err      string
+	}{
+		{"full", `{"port": 8080, "proto": "tcp", "target": "127.0.0.1:9090"}`, portFile{Port: 8080, Proto: "tcp", Target: "127.0.0.1:9090"}, ""},
+		{"defaults", `{"port": 8080}`, portFile{Port: 8080, Proto: "tcp"}, ""},
+		{"proto case", `{"port": 8080, "proto": "TCP"}`, portFile{Port: 8080, Proto: "tcp"}, ""},
+		{"udp", `{"port": 53, "proto": "udp"}`, portFile{}, "UDP port forwarding is not supported"},
+		{"bad proto", `{"port": 53, "proto": "sctp"}`, portFile{}, `invalid proto "sctp"`},
+		{"no port", `{"proto": "tcp"}`, portFile{}, "port out of range: 0"},
+		{"port too high", `{"port": 70000}`, portFile{}, "port out of range: 70000"},
+		{"bad target", `{"port": 8080, "target": "localhost"}`, portFile{}, `invalid target "localhost"`},
+		{"unknown field", `{"port": 8080, "protocol": "tcp"}`, portFile{}, "unknown field"},
+		{"not json", `port = 8080`, portFile{}, "invalid port file"},
+	}
+
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "test.port")
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatalf("failed to write port file: %v", err)
+			}
+
+			file, err := parsePortFile(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePortFile failed: %v", err)
+			}
+			if file != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, file)
+			}
+		})
+	}
+
+	if _, err := parsePortFile(filepath.Join(dir, "missing.port")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+// startEchoService runs a TCP echo service on 127.0.0.1 and returns its port
+func startEchoService(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// newPortDirForwarder returns a running forwarder whose WireGuard IP is
+// 127.0.0.2, skipping the test where that address is not usable
+func newPortDirForwarder(t *testing.T, ctx context.Context) *PortForwarder {
+	t.Helper()
+
+	probe, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not usable here: %v", err)
+	}
+	probe.Close()
+
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("127.0.0.2")}, make(chan IPCMessage), ForwarderOptions{})
+	go forwarder.Run(ctx)
+	return forwarder
+}
+
+// freeForwardPort returns a port that is free on 127.0.0.2
+func freeForwardPort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// echoThrough sends a line to 127.0.0.2:port and returns the error, if any,
+// of getting it echoed back
+func echoThrough(port int) error {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.2:%d", port), time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if string(reply) != "ping" {
+		return fmt.Errorf("unexpected echo %q", reply)
+	}
+	return nil
+}
+
+func writePortFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write port file: %v", err)
+	}
+}
+
+func TestPortForwarder_WatchDir(t *testing.T) {
+	oldInterval := portDirScanInterval
+	portDirScanInterval = time.Hour // Scans are triggered with ScanDir
+	defer func() { portDirScanInterval = oldInterval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwarder := newPortDirForwarder(t, ctx)
+
+	service := startEchoService(t)
+	other := freeForwardPort(t)
+	dir := t.TempDir()
+
+	// Files present at the start are forwarded at once
+	writePortFile(t, dir, "service.port", fmt.Sprintf(`{"port": %d}`, service))
+	writePortFile(t, dir, "ignored.txt", fmt.Sprintf(`{"port": %d}`, other))
+	if err := forwarder.WatchDir(ctx, dir); err != nil {
+		t.Fatalf("WatchDir failed: %v", err)
+	}
+	if err := echoThrough(service); err != nil {
+		t.Fatalf("expected the port from service.port to be forwarded: %v", err)
+	}
+	if err := echoThrough(other); err == nil {
+		t.Error("expected files without the .port suffix to be ignored")
+	}
+
+	// A new file with a target forwards another port to it
+	writePortFile(t, dir, "other.port", fmt.Sprintf(`{"port": %d, "proto": "tcp", "target": "127.0.0.1:%d"}`, other, service))
+	forwarder.ScanDir()
+	if err := echoThrough(other); err != nil {
+		t.Fatalf("expected the port from other.port to be forwarded to its target: %v", err)
+	}
+
+	// A broken file keeps its port until it is fixed or removed
+	writePortFile(t, dir, "other.port", `{"port": `)
+	forwarder.ScanDir()
+	if err := echoThrough(other); err != nil {
+		t.Errorf("expected a broken file to keep its port: %v", err)
+	}
+
+	// Removing the file stops forwarding its port
+	os.Remove(filepath.Join(dir, "other.port"))
+	forwarder.ScanDir()
+	if err := echoThrough(other); err == nil {
+		t.Error("expected the port to stop being forwarded after its file was removed")
+	}
+	if err := echoThrough(service); err != nil {
+		t.Errorf("expected the other port to stay forwarded: %v", err)
+	}
+
+	if err := forwarder.WatchDir(ctx, dir); err == nil {
+		t.Error("expected an error watching a second directory")
+	}
+}
+
+func TestPortForwarder_WatchDirLeavesOtherPorts(t *testing.T) {
+	oldInterval := portDirScanInterval
+	portDirScanInterval = time.Hour
+	defer func() { portDirScanInterval = oldInterval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwarder := newPortDirForwarder(t, ctx)
+	service := startEchoService(t)
+
+	// The child bound the port before a file named it
+	if err := forwarder.handleBind(service); err != nil {
+		t.Fatalf("handleBind failed: %v", err)
+	}
+	dir := t.TempDir()
+	writePortFile(t, dir, "a.port", fmt.Sprintf(`{"port": %d}`, service))
+	writePortFile(t, dir, "b.port", fmt.Sprintf(`{"port": %d}`, service))
+	if err := forwarder.WatchDir(ctx, dir); err != nil {
+		t.Fatalf("WatchDir failed: %v", err)
+	}
+	forwarder.ScanDir()
+
+	warned := forwarder.portDir.warned
+	if !strings.Contains(warned["a.port"], "is already forwarded, ignoring the file") {
+		t.Errorf("expected a warning for the port already forwarded, got %q", warned["a.port"])
+	}
+	if !strings.Contains(warned["b.port"], "is already given by a.port") {
+		t.Errorf("expected a warning for the duplicate file, got %q", warned["b.port"])
+	}
+
+	// Removing the files leaves the child's port alone
+	os.Remove(filepath.Join(dir, "a.port"))
+	os.Remove(filepath.Join(dir, "b.port"))
+	forwarder.ScanDir()
+	if err := echoThrough(service); err != nil {
+		t.Errorf("expected the child's port to stay forwarded: %v", err)
+	}
+	if len(forwarder.portDir.warned) != 0 {
+		t.Errorf("expected warnings to be forgotten with their files, got %v", forwarder.portDir.warned)
+	}
+}
+
+func TestPortForwarder_WatchDirPeriodicScan(t *testing.T) {
+	oldInterval := portDirScanInterval
+	portDirScanInterval = 20 * time.Millisecond
+	defer func() { portDirScanInterval = oldInterval }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	forwarder := newPortDirForwarder(t, ctx)
+
+	service := startEchoService(t)
+	dir := t.TempDir()
+	if err := forwarder.WatchDir(ctx, dir); err != nil {
+		t.Fatalf("WatchDir failed: %v", err)
+	}
+
+	waitFor := func(forwarded bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for (echoThrough(service) == nil) != forwarded {
+			if time.Now().After(deadline) {
+				t.Fatalf("port forwarded should be %v", forwarded)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	writePortFile(t, dir, "service.port", fmt.Sprintf(`{"port": %d}`, service))
+	waitFor(true)
+
+	// Ports from the directory are closed with the forwarder
+	cancel()
+	waitFor(false)
+}
+
+func TestPortForwarder_WatchDirErrors(t *testing.T) {
+	forwarder := NewPortForwarder(&Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}, make(chan IPCMessage), ForwarderOptions{})
+
+	if err := forwarder.WatchDir(context.Background(), filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if err := forwarder.WatchDir(context.Background(), file); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("expected an error for a file, got %v", err)
+	}
+
+	// Without a directory ScanDir does nothing
+	forwarder.ScanDir()
+}
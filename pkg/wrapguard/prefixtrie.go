@@ -0,0 +1,80 @@
+package wrapguard
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// prefixTrie maps IP prefixes to peer indices and finds the most specific
+// prefix containing an address in time proportional to the address length,
+// however many prefixes it holds. The zero value is an empty trie.
+type prefixTrie struct {
+	v4, v6 *trieNode
+}
+
+// trieNode is reached by following the bits of a prefix from the root
+type trieNode struct {
+	children [2]*trieNode
+	peers    []int // Peer indices for the prefix ending here, in insertion order
+}
+
+// insert adds prefix for peer. When several peers claim the same prefix
+// they are kept in the order inserted, and lookup returns the first.
+func (t *prefixTrie) insert(prefix netip.Prefix, peer int) {
+	prefix = prefix.Masked()
+	root := &t.v6
+	if prefix.Addr().Is4() {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+
+	node := *root
+	bytes := prefix.Addr().AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addrBit(bytes, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	if !slices.Contains(node.peers, peer) {
+		node.peers = append(node.peers, peer)
+	}
+}
+
+// lookup returns the first peer of the longest prefix containing addr, or -1
+func (t *prefixTrie) lookup(addr netip.Addr) int {
+	if peers := t.lookupAll(addr); len(peers) > 0 {
+		return peers[0]
+	}
+	return -1
+}
+
+// lookupAll returns every peer of the longest prefix containing addr, in
+// insertion order, or nil. The slice must not be modified.
+func (t *prefixTrie) lookupAll(addr netip.Addr) []int {
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+
+	var best []int
+	bytes := addr.AsSlice()
+	for i := 0; node != nil; i++ {
+		if len(node.peers) > 0 {
+			best = node.peers
+		}
+		if i == len(bytes)*8 {
+			break
+		}
+		node = node.children[addrBit(bytes, i)]
+	}
+	return best
+}
+
+// addrBit returns bit i of an address, counting from the most significant
+func addrBit(bytes []byte, i int) int {
+	return int(bytes[i/8]>>(7-i%8)) & 1
+}
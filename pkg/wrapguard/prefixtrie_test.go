@@ -0,0 +1,142 @@
+package wrapguard
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	var trie prefixTrie
+	if got := trie.lookup(netip.MustParseAddr("10.0.0.1")); got != -1 {
+		t.Errorf("expected no match in an empty trie, got %d", got)
+	}
+
+	for peer, prefixes := range [][]string{
+		{"0.0.0.0/0"},
+		{"10.0.0.0/8", "fd00::/8"},
+		{"10.1.0.0/16", "192.168.1.7/32"},
+		{"10.1.2.0/24", "fd00:1::/32"},
+		{"10.1.0.0/16"}, // Same prefix as peer 2, which keeps it
+		{"10.2.3.4/16"}, // Host bits are ignored
+	} {
+		for _, prefix := range prefixes {
+			trie.insert(netip.MustParsePrefix(prefix), peer)
+		}
+	}
+
+	tests := []struct {
+		addr     string
+		expected int
+	}{
+		{"8.8.8.8", 0},
+		{"10.200.0.1", 1},
+		{"10.1.9.9", 2},
+		{"10.1.2.3", 3},
+		{"10.2.99.1", 5},
+		{"192.168.1.7", 2},
+		{"192.168.1.8", 0},
+		{"fd00::1", 1},
+		{"fd00:1::1", 3},
+		{"2001:db8::1", -1}, // No IPv6 default route
+	}
+	for _, tt := range tests {
+		if got := trie.lookup(netip.MustParseAddr(tt.addr)); got != tt.expected {
+			t.Errorf("lookup(%s) = %d, expected %d", tt.addr, got, tt.expected)
+		}
+	}
+
+	// lookupAll returns every peer of the longest prefix, in insertion order
+	if got := trie.lookupAll(netip.MustParseAddr("10.1.9.9")); !slices.Equal(got, []int{2, 4}) {
+		t.Errorf("lookupAll(10.1.9.9) = %v, expected [2 4]", got)
+	}
+	if got := trie.lookupAll(netip.MustParseAddr("2001:db8::1")); got != nil {
+		t.Errorf("lookupAll(2001:db8::1) = %v, expected nil", got)
+	}
+}
+
+func TestRoutingEngine_MostSpecificAllowedIP(t *testing.T) {
+	engine := NewRoutingEngine(&WireGuardConfig{Peers: []PeerConfig{
+		{PublicKey: "wide", AllowedIPs: []string{"10.0.0.0/8"}},
+		{PublicKey: "narrow", AllowedIPs: []string{"10.1.0.0/16"}},
+	}}, RoutingOptions{})
+
+	// The most specific prefix wins every time, not whichever peer comes first
+	for i := 0; i < 20; i++ {
+		if peer, idx := engine.FindPeerForDestination(net.ParseIP("10.1.0.5"), 80, 0, "tcp", ""); idx != 1 || peer.PublicKey != "narrow" {
+			t.Fatalf("expected the /16 peer, got %d", idx)
+		}
+	}
+	if _, idx := engine.FindPeerForDestination(net.ParseIP("10.2.0.5"), 80, 0, "tcp", ""); idx != 0 {
+		t.Errorf("expected the /8 peer, got %d", idx)
+	}
+}
+
+// newMeshConfig returns a config with peers peers, each with 10 /24 AllowedIPs
+func newMeshConfig(peers int) *WireGuardConfig {
+	config := &WireGuardConfig{}
+	for p := 0; p < peers; p++ {
+		peer := PeerConfig{PublicKey: fmt.Sprintf("peer%d", p)}
+		for i := 0; i < 10; i++ {
+			peer.AllowedIPs = append(peer.AllowedIPs, fmt.Sprintf("10.%d.%d.0/24", p, i))
+		}
+		config.Peers = append(config.Peers, peer)
+	}
+	return config
+}
+
+// The last peer's last prefix, the worst case for a linear scan
+var meshLookupAddr = netip.MustParseAddr("10.99.9.1")
+
+func BenchmarkAllowedIPs_Trie(b *testing.B) {
+	var trie prefixTrie
+	for p, peer := range newMeshConfig(100).Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			trie.insert(netip.MustParsePrefix(allowedIP), p)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if trie.lookup(meshLookupAddr) != 99 {
+			b.Fatal("wrong peer")
+		}
+	}
+}
+
+func BenchmarkAllowedIPs_Linear(b *testing.B) {
+	peers := newMeshConfig(100).Peers
+	prefixes := make([][]netip.Prefix, len(peers))
+	for p, peer := range peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			prefixes[p] = append(prefixes[p], netip.MustParsePrefix(allowedIP))
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		found := -1
+		for p, peerPrefixes := range prefixes {
+			for _, prefix := range peerPrefixes {
+				if prefix.Contains(meshLookupAddr) {
+					found = p
+				}
+			}
+		}
+		if found != 99 {
+			b.Fatal("wrong peer")
+		}
+	}
+}
+
+func BenchmarkRoutingEngine_FindPeerForDestination(b *testing.B) {
+	engine := NewRoutingEngine(newMeshConfig(100), RoutingOptions{})
+	dstIP := net.IP(meshLookupAddr.AsSlice())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		engine.FindPeerForDestination(dstIP, 80, 0, "tcp", "")
+	}
+}
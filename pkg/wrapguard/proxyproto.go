@@ -0,0 +1,43 @@
+package wrapguard
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 commands and address families
+const (
+	proxyV2Local     = 0x20 // Version 2, LOCAL: no address information
+	proxyV2Proxy     = 0x21 // Version 2, PROXY: relayed connection
+	proxyV2TCPOverV4 = 0x11
+	proxyV2TCPOverV6 = 0x21
+)
+
+// proxyHeaderV2 builds the PROXY protocol v2 header describing a
+// connection from src to dst. Addresses that are not TCP give a LOCAL
+// header, telling the service to use the connection's own addresses.
+func proxyHeaderV2(src, dst net.Addr) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		return append(header, proxyV2Local, 0, 0, 0)
+	}
+
+	family, srcIP, dstIP := byte(proxyV2TCPOverV4), srcTCP.IP.To4(), dstTCP.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		family, srcIP, dstIP = proxyV2TCPOverV6, srcTCP.IP.To16(), dstTCP.IP.To16()
+	}
+
+	header = append(header, proxyV2Proxy, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(2*len(srcIP)+4))
+	header = append(header, srcIP...)
+	header = append(header, dstIP...)
+	header = binary.BigEndian.AppendUint16(header, uint16(srcTCP.Port))
+	header = binary.BigEndian.AppendUint16(header, uint16(dstTCP.Port))
+	return header
+}
@@ -0,0 +1,170 @@
+package wrapguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// readProxyHeaderV2 reads a PROXY protocol v2 header from r as a backend
+// would, returning the source and destination for a PROXY command and nil
+// addresses for LOCAL
+func readProxyHeaderV2(r io.Reader) (src, dst *net.TCPAddr, err error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(fixed[:12], proxyProtocolV2Signature) {
+		return nil, nil, fmt.Errorf("bad signature %q", fixed[:12])
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case fixed[12] == proxyV2Local:
+		return nil, nil, nil
+	case fixed[12] != proxyV2Proxy:
+		return nil, nil, fmt.Errorf("bad version and command %#x", fixed[12])
+	}
+
+	ipLen := map[byte]int{proxyV2TCPOverV4: 4, proxyV2TCPOverV6: 16}[fixed[13]]
+	if ipLen == 0 || len(body) != 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("bad family %#x with %d address bytes", fixed[13], len(body))
+	}
+	src = &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen:]))}
+	dst = &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:]))}
+	return src, dst, nil
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		length   int
+	}{
+		{"IPv4", &net.TCPAddr{IP: net.ParseIP("10.150.0.3"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("10.150.0.2"), Port: 8080}, 28},
+		{"IPv6", &net.TCPAddr{IP: net.ParseIP("fd00::3"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 8080}, 52},
+		{"mixed families use IPv6", &net.TCPAddr{IP: net.ParseIP("10.150.0.3"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 8080}, 52},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := proxyHeaderV2(tt.src, tt.dst)
+			if len(header) != tt.length {
+				t.Errorf("expected a %d byte header, got %d", tt.length, len(header))
+			}
+
+			src, dst, err := readProxyHeaderV2(bytes.NewReader(header))
+			if err != nil {
+				t.Fatalf("failed to parse header: %v", err)
+			}
+			if !src.IP.Equal(tt.src.(*net.TCPAddr).IP) || src.Port != 40000 {
+				t.Errorf("expected source %v, got %v", tt.src, src)
+			}
+			if !dst.IP.Equal(tt.dst.(*net.TCPAddr).IP) || dst.Port != 8080 {
+				t.Errorf("expected destination %v, got %v", tt.dst, dst)
+			}
+		})
+	}
+
+	t.Run("not TCP", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		header := proxyHeaderV2(server.RemoteAddr(), server.LocalAddr())
+		src, dst, err := readProxyHeaderV2(bytes.NewReader(header))
+		if err != nil || src != nil || dst != nil {
+			t.Errorf("expected a LOCAL header, got %v %v %v", src, dst, err)
+		}
+	})
+}
+
+// forwardTestConnection runs one connection through handleConnection to a
+// local service on port and returns the first size bytes the service received
+func forwardTestConnection(t *testing.T, forwarder *PortForwarder, local net.Listener, port, size int) (peer *net.TCPAddr, received []byte) {
+	t.Helper()
+
+	// A real TCP connection stands in for the one accepted from the tunnel
+	wgListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer wgListener.Close()
+
+	client, err := net.Dial("tcp", wgListener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+	wgConn, err := wgListener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	go forwarder.handleConnection(wgConn, port)
+
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	conn, err := local.Accept()
+	if err != nil {
+		t.Fatalf("local service failed to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	received = make([]byte, size)
+	n, _ := io.ReadFull(conn, received)
+	return client.LocalAddr().(*net.TCPAddr), received[:n]
+}
+
+func TestPortForwarder_ProxyProtocol(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer local.Close()
+	port := local.Addr().(*net.TCPAddr).Port
+
+	tunnel := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}
+
+	t.Run("header carries the peer address", func(t *testing.T) {
+		opts := ForwarderOptions{ProxyProtocol: "v2", NoProxyProtocolPorts: []int{22}}
+		peer, received := forwardTestConnection(t, NewPortForwarder(tunnel, make(chan IPCMessage), opts), local, port, 28+5)
+
+		reader := bytes.NewReader(received)
+		src, _, err := readProxyHeaderV2(reader)
+		if err != nil {
+			t.Fatalf("local service could not parse the PROXY header: %v", err)
+		}
+		if !src.IP.Equal(peer.IP) || src.Port != peer.Port {
+			t.Errorf("expected source %v, got %v", peer, src)
+		}
+		if rest, _ := io.ReadAll(reader); string(rest) != "hello" {
+			t.Errorf("expected the peer's data after the header, got %q", rest)
+		}
+	})
+
+	t.Run("excluded port", func(t *testing.T) {
+		opts := ForwarderOptions{ProxyProtocol: "v2", NoProxyProtocolPorts: []int{22, port}}
+		_, received := forwardTestConnection(t, NewPortForwarder(tunnel, make(chan IPCMessage), opts), local, port, 5)
+		if string(received) != "hello" {
+			t.Errorf("expected no header on an excluded port, got %q", received)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, received := forwardTestConnection(t, NewPortForwarder(tunnel, make(chan IPCMessage), ForwarderOptions{}), local, port, 5)
+		if string(received) != "hello" {
+			t.Errorf("expected no header by default, got %q", received)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package wrapguard
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimiter applies a token bucket per connection source. Each source may
+// burst up to one second's worth of connections and is then held to the
+// configured rate.
+type RateLimiter struct {
+	limit   rate.Limit
+	burst   int
+	mutex   sync.Mutex
+	sources map[string]*rate.Limiter
+}
+
+// NewRateLimiter creates a limiter allowing perSecond connections per source
+func NewRateLimiter(perSecond float64) *RateLimiter {
+	burst := int(perSecond)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		sources: make(map[string]*rate.Limiter),
+	}
+}
+
+// Allow reports whether source may open another connection now
+func (r *RateLimiter) Allow(source string) bool {
+	return r.allowAt(source, time.Now())
+}
+
+// allowAt is Allow at an explicit time, so rates can be tested without sleeping
+func (r *RateLimiter) allowAt(source string, now time.Time) bool {
+	r.mutex.Lock()
+	limiter, exists := r.sources[source]
+	if !exists {
+		limiter = rate.NewLimiter(r.limit, r.burst)
+		r.sources[source] = limiter
+	}
+	r.mutex.Unlock()
+
+	return limiter.AllowN(now, 1)
+}
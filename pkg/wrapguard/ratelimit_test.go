@@ -0,0 +1,76 @@
+package wrapguard
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(100)
+	if limiter.burst != 100 {
+		t.Errorf("expected burst 100, got %d", limiter.burst)
+	}
+
+	// Fractional rates still allow a single connection
+	limiter = NewRateLimiter(0.5)
+	if limiter.burst != 1 {
+		t.Errorf("expected burst 1, got %d", limiter.burst)
+	}
+}
+
+func TestRateLimiter_EnforcesRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		perSecond float64
+		duration  time.Duration
+	}{
+		{"100 per second", 100, 2 * time.Second},
+		{"10 per second", 10, 5 * time.Second},
+		{"1000 per second", 1000, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter(tt.perSecond)
+
+			// Attempt a connection every 100µs, far faster than the limit
+			start := time.Now()
+			allowed := 0
+			for elapsed := time.Duration(0); elapsed < tt.duration; elapsed += 100 * time.Microsecond {
+				if limiter.allowAt("127.0.0.1", start.Add(elapsed)) {
+					allowed++
+				}
+			}
+
+			// The initial burst plus the steady-state rate over the duration
+			expected := float64(limiter.burst) + tt.perSecond*tt.duration.Seconds()
+			if math.Abs(float64(allowed)-expected) > expected*0.05 {
+				t.Errorf("expected about %.0f connections, got %d", expected, allowed)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_IndependentSources(t *testing.T) {
+	limiter := NewRateLimiter(2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if !limiter.allowAt("127.0.0.1", now) {
+			t.Fatalf("connection %d should be within the burst", i)
+		}
+	}
+	if limiter.allowAt("127.0.0.1", now) {
+		t.Error("expected the exhausted source to be limited")
+	}
+
+	if !limiter.allowAt("127.0.0.2", now) {
+		t.Error("another source should have its own bucket")
+	}
+
+	// Tokens refill over time
+	if !limiter.allowAt("127.0.0.1", now.Add(time.Second)) {
+		t.Error("expected the source to be allowed again after refilling")
+	}
+}
@@ -0,0 +1,79 @@
+package wrapguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// ReadinessServer answers HTTP readiness probes from container orchestrators:
+// 503 until SetReady is called and 200 afterwards
+type ReadinessServer struct {
+	listener net.Listener
+	server   *http.Server
+	path     string
+	ready    atomic.Bool
+	served   chan struct{}
+}
+
+// NewReadinessServer listens on addr, a host:port optionally followed by the
+// probe path, e.g. ":8080/ready". The path defaults to /ready.
+func NewReadinessServer(addr string) (*ReadinessServer, error) {
+	hostPort, path := addr, "/ready"
+	if i := strings.Index(addr, "/"); i >= 0 {
+		hostPort, path = addr[:i], addr[i:]
+	}
+
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for readiness probes: %w", err)
+	}
+
+	s := &ReadinessServer{
+		listener: listener,
+		path:     path,
+		served:   make(chan struct{}),
+	}
+	s.server = &http.Server{Handler: s}
+
+	// Start serving in background
+	go func() {
+		defer close(s.served)
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Debugf("Readiness server stopped: %v", err)
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *ReadinessServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != s.path {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
+
+// SetReady makes the probe succeed from now on
+func (s *ReadinessServer) SetReady() {
+	s.ready.Store(true)
+}
+
+func (s *ReadinessServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the server and waits for it to finish serving
+func (s *ReadinessServer) Close() error {
+	err := s.server.Close()
+	<-s.served
+	return err
+}
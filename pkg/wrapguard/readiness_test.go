@@ -0,0 +1,74 @@
+package wrapguard
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func probe(t *testing.T, url string) (int, string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("probe request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestReadinessServer(t *testing.T) {
+	server, err := NewReadinessServer("127.0.0.1:0/healthz/ready")
+	if err != nil {
+		t.Fatalf("NewReadinessServer failed: %v", err)
+	}
+	defer server.Close()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/healthz/ready", server.Port())
+	if status, _ := probe(t, url); status != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before ready, got %d", status)
+	}
+
+	server.SetReady()
+	if status, body := probe(t, url); status != http.StatusOK || body != "ready\n" {
+		t.Errorf("expected 200 ready once ready, got %d %q", status, body)
+	}
+
+	// Only the configured path answers
+	if status, _ := probe(t, fmt.Sprintf("http://127.0.0.1:%d/ready", server.Port())); status != http.StatusNotFound {
+		t.Errorf("expected 404 for another path, got %d", status)
+	}
+}
+
+func TestReadinessServer_DefaultPath(t *testing.T) {
+	server, err := NewReadinessServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("NewReadinessServer failed: %v", err)
+	}
+	defer server.Close()
+
+	if status, _ := probe(t, fmt.Sprintf("http://127.0.0.1:%d/ready", server.Port())); status != http.StatusServiceUnavailable {
+		t.Errorf("expected the probe at /ready by default, got %d", status)
+	}
+}
+
+func TestReadinessServer_Close(t *testing.T) {
+	server, err := NewReadinessServer("127.0.0.1:0/ready")
+	if err != nil {
+		t.Fatalf("NewReadinessServer failed: %v", err)
+	}
+	port := server.Port()
+	server.Close()
+
+	if _, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/ready", port)); err == nil {
+		t.Error("expected the probe to stop answering after Close")
+	}
+}
+
+func TestReadinessServer_InvalidAddr(t *testing.T) {
+	if _, err := NewReadinessServer("not-an-addr/ready"); err == nil {
+		t.Error("expected error for an invalid listen address")
+	}
+}
@@ -0,0 +1,771 @@
+package wrapguard
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// RoutingPolicy defines a policy for routing traffic through a specific peer
+type RoutingPolicy struct {
+	DestinationCIDR string    // e.g., "192.168.1.0/24" or "0.0.0.0/0"
+	Protocol        string    // "tcp", "udp", or "any"
+	PortRange       PortRange // Port range for the policy
+	SrcPortRange    PortRange // Source port range for the policy
+	ExePattern      string    // Glob matched against the client's process name, e.g. "curl"
+	SNIPattern      string    // Glob matched against the destination hostname, e.g. "*.corp.internal"
+	Priority        int       // Higher priority policies are evaluated first
+}
+
+// PortRange represents a range of ports
+type PortRange struct {
+	Start int
+	End   int
+}
+
+// RoutingOptions configures NewRoutingEngine. The zero value sends all
+// catch-all traffic through the tunnel and every connection to the first of
+// several equally good peers.
+type RoutingOptions struct {
+	// SplitTunnel leaves catch-all AllowedIPs (0.0.0.0/0 and ::/0) out of
+	// the fallback, so that only Route policies and narrower AllowedIPs send
+	// traffic through the tunnel and everything else is dialed directly
+	SplitTunnel bool
+
+	// ECMPMode spreads connections over peers whose routes to a destination
+	// are equally good, with the same prefix length and priority: "hash"
+	// keeps each destination address and port on one peer, "round-robin"
+	// takes turns and "random" picks a peer at random. Empty sends them all
+	// to the peer listed first.
+	ECMPMode string
+}
+
+// ValidateECMPMode checks a value for RoutingOptions.ECMPMode
+func ValidateECMPMode(mode string) error {
+	switch mode {
+	case "", "hash", "round-robin", "random":
+		return nil
+	}
+	return fmt.Errorf("invalid ECMP mode: %s (expected hash, round-robin or random)", mode)
+}
+
+// RoutingEngine manages routing decisions for WireGuard peers
+type RoutingEngine struct {
+	peers       []PeerConfig
+	routeTable  map[string][]int // CIDR -> peer indices
+	allowedIPs  prefixTrie       // AllowedIP prefixes -> peer indices
+	ecmp        string
+	ecmpNext    atomic.Uint64 // Next turn with round-robin ECMP
+	splitTunnel bool
+}
+
+// NewRoutingEngine creates a new routing engine from the WireGuard configuration
+func NewRoutingEngine(config *WireGuardConfig, opts RoutingOptions) *RoutingEngine {
+	engine := &RoutingEngine{
+		peers:       append([]PeerConfig(nil), config.Peers...), // Copy so later endpoint updates don't race with lookups
+		routeTable:  make(map[string][]int),
+		ecmp:        opts.ECMPMode,
+		splitTunnel: opts.SplitTunnel,
+	}
+
+	// Build routing table from AllowedIPs
+	for peerIdx, peer := range config.Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			prefix, err := netip.ParsePrefix(allowedIP)
+			if err != nil {
+				if logger != nil {
+					logger.Warnf("Invalid AllowedIP %s for peer %d: %v", allowedIP, peerIdx, err)
+				}
+				continue
+			}
+			if engine.splitTunnel && prefix.Bits() == 0 {
+				continue
+			}
+			engine.allowedIPs.insert(prefix, peerIdx)
+		}
+
+		// Process routing policies; hostname policies are matched by
+		// FindPeerForHostname instead
+		for _, policy := range peer.RoutingPolicies {
+			if policy.SNIPattern != "" {
+				continue
+			}
+			if existingPeers, exists := engine.routeTable[policy.DestinationCIDR]; exists {
+				engine.routeTable[policy.DestinationCIDR] = append(existingPeers, peerIdx)
+			} else {
+				engine.routeTable[policy.DestinationCIDR] = []int{peerIdx}
+			}
+		}
+	}
+
+	return engine
+}
+
+// routingTableJSON is the form of a RoutingEngine written by MarshalJSON
+type routingTableJSON struct {
+	Routes []routeJSON     `json:"routes"`
+	Peers  []routePeerJSON `json:"peers"`
+	ECMP   string          `json:"ecmp,omitempty"`
+}
+
+type routeJSON struct {
+	CIDR  string `json:"cidr"`
+	Peers []int  `json:"peers"`
+}
+
+type routePeerJSON struct {
+	Idx        int               `json:"idx"`
+	PublicKey  string            `json:"public_key"`
+	Endpoint   string            `json:"endpoint,omitempty"`
+	AllowedIPs []string          `json:"allowed_ips"`
+	Policies   []routePolicyJSON `json:"policies"`
+}
+
+type routePolicyJSON struct {
+	Route    string `json:"route"` // In the syntax accepted by ParseRoutingPolicy
+	Priority int    `json:"priority"`
+}
+
+// MarshalJSON describes the routing table for inspection: each routing
+// policy CIDR with the peers that have a policy for it, sorted by CIDR, and
+// each peer with the AllowedIPs and policies it routes. AllowedIPs left out
+// by SplitTunnel are not listed, and hostname policies appear only under
+// their peer.
+func (r *RoutingEngine) MarshalJSON() ([]byte, error) {
+	table := routingTableJSON{Routes: []routeJSON{}, Peers: []routePeerJSON{}, ECMP: r.ecmp}
+
+	for cidr, peerIndices := range r.routeTable {
+		peers := slices.Compact(slices.Clone(peerIndices))
+		table.Routes = append(table.Routes, routeJSON{CIDR: cidr, Peers: peers})
+	}
+	slices.SortFunc(table.Routes, func(a, b routeJSON) int {
+		return strings.Compare(a.CIDR, b.CIDR)
+	})
+
+	for peerIdx, peer := range r.peers {
+		publicKey, err := hexToBase64(peer.PublicKey)
+		if err != nil {
+			publicKey = peer.PublicKey
+		}
+		entry := routePeerJSON{
+			Idx:        peerIdx,
+			PublicKey:  publicKey,
+			Endpoint:   peer.Endpoint,
+			AllowedIPs: []string{},
+			Policies:   []routePolicyJSON{},
+		}
+		for _, allowedIP := range peer.AllowedIPs {
+			if prefix, err := netip.ParsePrefix(allowedIP); err == nil && !(r.splitTunnel && prefix.Bits() == 0) {
+				entry.AllowedIPs = append(entry.AllowedIPs, allowedIP)
+			}
+		}
+		for _, policy := range peer.RoutingPolicies {
+			entry.Policies = append(entry.Policies, routePolicyJSON{Route: policy.String(), Priority: policy.Priority})
+		}
+		table.Peers = append(table.Peers, entry)
+	}
+
+	return json.Marshal(table)
+}
+
+// FindPeerForDestination finds the appropriate peer for routing to a destination.
+// A dstPort or srcPort of 0 means the port is unknown and matches any range.
+// exeName is the name of the client process, or empty if unknown; policies
+// with an ExePattern only match a known name.
+// Peers that tie are chosen between as set by the ECMP mode, hashing the
+// destination with ECMPSessionKey.
+func (r *RoutingEngine) FindPeerForDestination(dstIP net.IP, dstPort, srcPort int, protocol, exeName string) (*PeerConfig, int) {
+	addr, ok := routingAddr(dstIP)
+	if !ok {
+		return nil, -1
+	}
+	return r.pickPeer(r.candidatePeers(addr, dstPort, srcPort, protocol, exeName), r.ecmp, ECMPSessionKey(dstIP, dstPort))
+}
+
+// FindPeerECMP finds the peer for a destination like FindPeerForDestination,
+// with the source port and process unknown. Peers that tie are chosen
+// between as set by the ECMP mode, or by hash if none is set; with hash, the
+// same sessionKey always gets the same peer.
+func (r *RoutingEngine) FindPeerECMP(dstIP net.IP, dstPort int, protocol string, sessionKey uint64) (*PeerConfig, int) {
+	addr, ok := routingAddr(dstIP)
+	if !ok {
+		return nil, -1
+	}
+	mode := r.ecmp
+	if mode == "" {
+		mode = "hash"
+	}
+	return r.pickPeer(r.candidatePeers(addr, dstPort, 0, protocol, ""), mode, sessionKey)
+}
+
+// ECMPSessionKey hashes a destination address and port with FNV-1a, as a
+// session key for FindPeerECMP
+func ECMPSessionKey(dstIP net.IP, dstPort int) uint64 {
+	h := fnv.New64a()
+	if ip4 := dstIP.To4(); ip4 != nil {
+		h.Write(ip4)
+	} else {
+		h.Write(dstIP.To16())
+	}
+	h.Write(binary.BigEndian.AppendUint16(nil, uint16(dstPort)))
+	return h.Sum64()
+}
+
+// pickPeer chooses one of the tied candidates, in peer order, for mode
+func (r *RoutingEngine) pickPeer(candidates []int, mode string, sessionKey uint64) (*PeerConfig, int) {
+	if len(candidates) == 0 {
+		return nil, -1
+	}
+
+	n := uint64(len(candidates))
+	var i uint64
+	switch {
+	case n == 1:
+	case mode == "hash":
+		// Mix the key first, so that keys differing only in a few bits
+		// still spread over every peer
+		sessionKey ^= sessionKey >> 33
+		sessionKey *= 0xff51afd7ed558ccd
+		sessionKey ^= sessionKey >> 33
+		i = sessionKey % n
+	case mode == "round-robin":
+		i = (r.ecmpNext.Add(1) - 1) % n
+	case mode == "random":
+		i = rand.Uint64N(n)
+	}
+	peerIdx := candidates[i]
+	return &r.peers[peerIdx], peerIdx
+}
+
+// routingAddr converts dstIP for lookups, using the IPv4 form where there
+// is one
+func routingAddr(dstIP net.IP) (netip.Addr, bool) {
+	var addr netip.Addr
+	if dstIP.To4() != nil {
+		addr, _ = netip.AddrFromSlice(dstIP.To4())
+	} else {
+		addr, _ = netip.AddrFromSlice(dstIP)
+	}
+	return addr, addr.IsValid()
+}
+
+// candidatePeers returns the peers with the best route to addr in peer
+// order: those of the matching policies with the longest prefix and highest
+// priority, or else those of the longest AllowedIP
+func (r *RoutingEngine) candidatePeers(addr netip.Addr, dstPort, srcPort int, protocol, exeName string) []int {
+	// First, check routing policies
+	var bestPeers []int
+	bestPriority := -1
+	bestSpecificity := -1
+
+	for cidr, peerIndices := range r.routeTable {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			continue
+		}
+
+		if prefix.Contains(addr) {
+			specificity := prefix.Bits()
+
+			for _, peerIdx := range peerIndices {
+				if peerIdx >= len(r.peers) {
+					continue
+				}
+
+				peer := &r.peers[peerIdx]
+
+				// Check if this peer has a matching routing policy
+				for _, policy := range peer.RoutingPolicies {
+					if policy.DestinationCIDR != cidr || policy.SNIPattern != "" {
+						continue
+					}
+					if !policy.matches(dstPort, srcPort, protocol, exeName) {
+						continue
+					}
+
+					// This policy matches, check if it's better than current best
+					if specificity > bestSpecificity ||
+						(specificity == bestSpecificity && policy.Priority > bestPriority) {
+						bestPeers = append(bestPeers[:0], peerIdx)
+						bestPriority = policy.Priority
+						bestSpecificity = specificity
+					} else if specificity == bestSpecificity && policy.Priority == bestPriority &&
+						!slices.Contains(bestPeers, peerIdx) {
+						bestPeers = append(bestPeers, peerIdx)
+					}
+				}
+			}
+		}
+	}
+
+	if len(bestPeers) > 0 {
+		slices.Sort(bestPeers)
+		return bestPeers
+	}
+
+	// If no routing policy matched, fall back to the most specific AllowedIP
+	return r.allowedIPs.lookupAll(addr)
+}
+
+// FindPeerForHostname finds the peer of the highest priority policy whose
+// SNIPattern matches hostname, the name the client asked for before DNS
+// resolution. Such policies apply whatever address the name resolves to, so
+// their DestinationCIDR is not checked. The other fields match as in
+// FindPeerForDestination; ties go to the peer listed first. It returns nil,
+// -1 if no hostname policy matches, and the caller falls back to routing by
+// address.
+func (r *RoutingEngine) FindPeerForHostname(hostname string, dstPort, srcPort int, protocol, exeName string) (*PeerConfig, int) {
+	if hostname == "" {
+		return nil, -1
+	}
+
+	bestPeer := -1
+	bestPriority := -1
+	for peerIdx := range r.peers {
+		for _, policy := range r.peers[peerIdx].RoutingPolicies {
+			if policy.SNIPattern == "" || !matchSNIPattern(policy.SNIPattern, hostname) {
+				continue
+			}
+			if !policy.matches(dstPort, srcPort, protocol, exeName) {
+				continue
+			}
+			if policy.Priority > bestPriority {
+				bestPeer = peerIdx
+				bestPriority = policy.Priority
+			}
+		}
+	}
+
+	if bestPeer < 0 {
+		return nil, -1
+	}
+	return &r.peers[bestPeer], bestPeer
+}
+
+// RoutingWarning describes a routing policy that is never chosen, because
+// another policy for the same destination prefix ranks above it and matches
+// all the traffic it does. Policies are ranked by prefix length first, so
+// only policies with equal prefixes can shadow each other.
+type RoutingWarning struct {
+	PeerIdx            int    // Peer of the shadowed policy
+	CIDR               string // Destination of the shadowed policy
+	Priority           int
+	ShadowedByPeerIdx  int
+	ShadowedByCIDR     string
+	ShadowedByPriority int
+}
+
+func (w RoutingWarning) String() string {
+	return fmt.Sprintf("route %s for peer %d (priority %d) is shadowed by route %s for peer %d (priority %d) and will never be used",
+		w.CIDR, w.PeerIdx, w.Priority, w.ShadowedByCIDR, w.ShadowedByPeerIdx, w.ShadowedByPriority)
+}
+
+// Lint returns a warning for each routing policy that FindPeerForDestination
+// never chooses in favour of another peer. Hostname policies are not
+// checked.
+func (r *RoutingEngine) Lint() []RoutingWarning {
+	var warnings []RoutingWarning
+	for peerIdx := range r.peers {
+		for i, policy := range r.peers[peerIdx].RoutingPolicies {
+			if policy.SNIPattern != "" {
+				continue
+			}
+			if byPeer, by, ok := r.shadowingPolicy(peerIdx, i); ok {
+				warnings = append(warnings, RoutingWarning{
+					PeerIdx:            peerIdx,
+					CIDR:               policy.DestinationCIDR,
+					Priority:           policy.Priority,
+					ShadowedByPeerIdx:  byPeer,
+					ShadowedByCIDR:     by.DestinationCIDR,
+					ShadowedByPriority: by.Priority,
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+// shadowingPolicy finds a policy of another peer that wins over policy i of
+// peerIdx for every destination, port, protocol and process the latter
+// matches
+func (r *RoutingEngine) shadowingPolicy(peerIdx, i int) (int, *RoutingPolicy, bool) {
+	policy := &r.peers[peerIdx].RoutingPolicies[i]
+	prefix, err := netip.ParsePrefix(policy.DestinationCIDR)
+	if err != nil {
+		return -1, nil, false
+	}
+
+	for otherPeer := range r.peers {
+		for j := range r.peers[otherPeer].RoutingPolicies {
+			other := &r.peers[otherPeer].RoutingPolicies[j]
+			// A route shadowed by another to the same peer still reaches it
+			if otherPeer == peerIdx || other.SNIPattern != "" {
+				continue
+			}
+
+			otherPrefix, err := netip.ParsePrefix(other.DestinationCIDR)
+			if err != nil || otherPrefix.Masked() != prefix.Masked() {
+				continue
+			}
+
+			// Ties on priority go to the peer listed first, unless ECMP
+			// shares them out
+			outranks := other.Priority > policy.Priority ||
+				(other.Priority == policy.Priority && otherPeer < peerIdx && r.ecmp == "")
+			if outranks && other.covers(policy) {
+				return otherPeer, other, true
+			}
+		}
+	}
+	return -1, nil, false
+}
+
+// covers reports whether p matches all the traffic that other matches,
+// disregarding their destinations
+func (p *RoutingPolicy) covers(other *RoutingPolicy) bool {
+	if p.Protocol != "any" && p.Protocol != other.Protocol {
+		return false
+	}
+	if p.PortRange.Start > other.PortRange.Start || p.PortRange.End < other.PortRange.End {
+		return false
+	}
+
+	// An unset source range matches any port
+	anySrc := PortRange{Start: 1, End: 65535}
+	srcRange, otherSrcRange := p.SrcPortRange, other.SrcPortRange
+	if srcRange == (PortRange{}) {
+		srcRange = anySrc
+	}
+	if otherSrcRange == (PortRange{}) {
+		otherSrcRange = anySrc
+	}
+	if srcRange.Start > otherSrcRange.Start || srcRange.End < otherSrcRange.End {
+		return false
+	}
+
+	return p.ExePattern == "" || p.ExePattern == other.ExePattern
+}
+
+// matches checks everything in the policy except its destination
+func (p *RoutingPolicy) matches(dstPort, srcPort int, protocol, exeName string) bool {
+	// Check protocol match
+	if p.Protocol != "any" && p.Protocol != protocol {
+		return false
+	}
+
+	// Check port range
+	if dstPort > 0 && (dstPort < p.PortRange.Start || dstPort > p.PortRange.End) {
+		return false
+	}
+
+	// Check source port range, treating an unset range as any
+	if srcPort > 0 && p.SrcPortRange != (PortRange{}) &&
+		(srcPort < p.SrcPortRange.Start || srcPort > p.SrcPortRange.End) {
+		return false
+	}
+
+	// Check the client process name
+	return p.ExePattern == "" || matchExePattern(p.ExePattern, exeName)
+}
+
+// matchSNIPattern reports whether hostname matches the glob pattern,
+// ignoring case and any trailing dot. A "*" may span several labels, so
+// "*.corp.internal" covers every subdomain of corp.internal.
+func matchSNIPattern(pattern, hostname string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	matched, _ := path.Match(pattern, hostname)
+	return matched
+}
+
+// matchExePattern reports whether the process name exeName matches the glob
+// pattern. An unknown name matches nothing.
+func matchExePattern(pattern, exeName string) bool {
+	if exeName == "" {
+		return false
+	}
+	matched, _ := path.Match(pattern, exeName)
+	return matched
+}
+
+// TunnelRoute pairs a tunnel with the config it was created from
+type TunnelRoute struct {
+	Tunnel *Tunnel
+	Config *WireGuardConfig
+}
+
+// TunnelRouter selects both the tunnel and the peer for a destination when
+// several WireGuard configs are active at once. The tunnel with the most
+// specific matching route wins; ties go to the config given first.
+type TunnelRouter struct {
+	routes  []TunnelRoute
+	engines []*RoutingEngine
+}
+
+// NewTunnelRouter creates a router over the given tunnels, in --config order.
+// Each config is routed with its tunnel's RoutingOptions.
+func NewTunnelRouter(routes []TunnelRoute) *TunnelRouter {
+	router := &TunnelRouter{routes: routes}
+	for _, route := range routes {
+		var opts RoutingOptions
+		if route.Tunnel != nil {
+			opts = route.Tunnel.options.Routing
+		}
+		router.engines = append(router.engines, NewRoutingEngine(route.Config, opts))
+	}
+	return router
+}
+
+// FindTunnelForDestination returns the tunnel, the peer within it and the
+// tunnel's index for a destination, or nil, nil, -1 if no tunnel routes it
+func (tr *TunnelRouter) FindTunnelForDestination(dstIP net.IP, dstPort, srcPort int, protocol, exeName string) (*Tunnel, *PeerConfig, int) {
+	addr, ok := netip.AddrFromSlice(dstIP)
+	if !ok {
+		return nil, nil, -1
+	}
+	addr = addr.Unmap()
+
+	var bestPeer *PeerConfig
+	bestTunnel := -1
+	bestSpecificity := -1
+
+	for i, engine := range tr.engines {
+		peer, _ := engine.FindPeerForDestination(dstIP, dstPort, srcPort, protocol, exeName)
+		if peer == nil {
+			continue
+		}
+
+		if specificity := routeSpecificity(peer, addr); specificity > bestSpecificity {
+			bestPeer = peer
+			bestTunnel = i
+			bestSpecificity = specificity
+		}
+	}
+
+	if bestTunnel < 0 {
+		return nil, nil, -1
+	}
+	return tr.routes[bestTunnel].Tunnel, bestPeer, bestTunnel
+}
+
+// EnvRoutes describes the IPv4 destinations of each tunnel for the LD_PRELOAD
+// library as "CIDR=index" pairs separated by commas, where index is the
+// position of the tunnel's SOCKS5 port in WRAPGUARD_SOCKS_PORT
+func (tr *TunnelRouter) EnvRoutes() string {
+	var entries []string
+	for i, route := range tr.routes {
+		seen := make(map[netip.Prefix]bool)
+		for _, peer := range route.Config.Peers {
+			cidrs := append([]string(nil), peer.AllowedIPs...)
+			for _, policy := range peer.RoutingPolicies {
+				if policy.SNIPattern == "" {
+					cidrs = append(cidrs, policy.DestinationCIDR)
+				}
+			}
+
+			for _, cidr := range cidrs {
+				prefix, err := netip.ParsePrefix(cidr)
+				if err != nil || !prefix.Addr().Is4() || seen[prefix.Masked()] {
+					continue
+				}
+				seen[prefix.Masked()] = true
+				entries = append(entries, fmt.Sprintf("%s=%d", prefix.Masked(), i))
+			}
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+// routeSpecificity returns the prefix length of the most specific AllowedIP
+// or routing policy of the peer that contains addr
+func routeSpecificity(peer *PeerConfig, addr netip.Addr) int {
+	best := -1
+	check := func(cidr string) {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr) && prefix.Bits() > best {
+			best = prefix.Bits()
+		}
+	}
+
+	for _, allowedIP := range peer.AllowedIPs {
+		check(allowedIP)
+	}
+	for _, policy := range peer.RoutingPolicies {
+		if policy.SNIPattern == "" {
+			check(policy.DestinationCIDR)
+		}
+	}
+	return best
+}
+
+// String formats the port range in the syntax accepted by ParsePortRange
+func (p PortRange) String() string {
+	if p.Start == 1 && p.End == 65535 {
+		return "any"
+	}
+	if p.Start == p.End {
+		return strconv.Itoa(p.Start)
+	}
+	return fmt.Sprintf("%d-%d", p.Start, p.End)
+}
+
+// String formats the policy in the syntax accepted by ParseRoutingPolicy,
+// omitting trailing fields that hold their default values
+func (p RoutingPolicy) String() string {
+	ports := p.PortRange.String()
+	if p.ExePattern != "" || p.SNIPattern != "" {
+		srcPorts := "any"
+		if p.SrcPortRange != (PortRange{}) {
+			srcPorts = p.SrcPortRange.String()
+		}
+		if p.SNIPattern != "" {
+			return fmt.Sprintf("%s:%s:%s:%s:%s:%s", p.DestinationCIDR, p.Protocol, ports, srcPorts, p.ExePattern, p.SNIPattern)
+		}
+		return fmt.Sprintf("%s:%s:%s:%s:%s", p.DestinationCIDR, p.Protocol, ports, srcPorts, p.ExePattern)
+	}
+	if p.SrcPortRange != (PortRange{}) {
+		if srcPorts := p.SrcPortRange.String(); srcPorts != "any" {
+			return fmt.Sprintf("%s:%s:%s:%s", p.DestinationCIDR, p.Protocol, ports, srcPorts)
+		}
+	}
+	if ports != "any" {
+		return fmt.Sprintf("%s:%s:%s", p.DestinationCIDR, p.Protocol, ports)
+	}
+	if p.Protocol != "" && p.Protocol != "any" {
+		return fmt.Sprintf("%s:%s", p.DestinationCIDR, p.Protocol)
+	}
+	return p.DestinationCIDR
+}
+
+// ParsePortRange parses a port range string like "80", "8080-9000", or "any"
+func ParsePortRange(portStr string) (PortRange, error) {
+	if portStr == "" || portStr == "any" {
+		return PortRange{Start: 1, End: 65535}, nil
+	}
+
+	if strings.Contains(portStr, "-") {
+		parts := strings.Split(portStr, "-")
+		if len(parts) != 2 {
+			return PortRange{}, fmt.Errorf("invalid port range format: %s", portStr)
+		}
+
+		start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return PortRange{}, fmt.Errorf("invalid start port: %s", parts[0])
+		}
+
+		end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return PortRange{}, fmt.Errorf("invalid end port: %s", parts[1])
+		}
+
+		if start > end || start < 1 || end > 65535 {
+			return PortRange{}, fmt.Errorf("invalid port range: %d-%d", start, end)
+		}
+
+		return PortRange{Start: start, End: end}, nil
+	}
+
+	// Single port
+	port, err := strconv.Atoi(strings.TrimSpace(portStr))
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	if port < 1 || port > 65535 {
+		return PortRange{}, fmt.Errorf("port out of range: %d", port)
+	}
+
+	return PortRange{Start: port, End: port}, nil
+}
+
+// ParseRoutingPolicy parses a routing policy string
+// Format: "CIDR" or "CIDR:protocol:ports" or "CIDR:protocol:ports:srcports"
+// or "CIDR:protocol:ports:srcports:exe" or "CIDR:protocol:ports:srcports:exe:sni"
+// Examples: "192.168.1.0/24", "0.0.0.0/0:tcp:80,443", "10.0.0.0/8:any:8080-9000",
+// "0.0.0.0/0:tcp:any:49152-65535", "0.0.0.0/0:any:any:any:curl",
+// "0.0.0.0/0:tcp:443:any::*.corp.internal"
+// The exe field may be left empty when an sni hostname pattern follows it.
+func ParseRoutingPolicy(policyStr string, priority int) (*RoutingPolicy, error) {
+	parts := strings.Split(policyStr, ":")
+
+	if len(parts) == 0 || parts[0] == "" {
+		return nil, fmt.Errorf("empty routing policy")
+	}
+
+	policy := &RoutingPolicy{
+		DestinationCIDR: parts[0],
+		Protocol:        "any",
+		PortRange:       PortRange{Start: 1, End: 65535},
+		SrcPortRange:    PortRange{Start: 1, End: 65535},
+		Priority:        priority,
+	}
+
+	// Validate CIDR
+	if _, err := netip.ParsePrefix(policy.DestinationCIDR); err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %s", policy.DestinationCIDR)
+	}
+
+	if len(parts) > 1 {
+		// Protocol specified
+		protocol := strings.ToLower(parts[1])
+		if protocol != "tcp" && protocol != "udp" && protocol != "any" {
+			return nil, fmt.Errorf("invalid protocol: %s", protocol)
+		}
+		policy.Protocol = protocol
+	}
+
+	if len(parts) > 2 {
+		// Port range specified
+		portRange, err := ParsePortRange(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		policy.PortRange = portRange
+	}
+
+	if len(parts) > 3 {
+		// Source port range specified
+		srcPortRange, err := ParsePortRange(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid source port range: %w", err)
+		}
+		policy.SrcPortRange = srcPortRange
+	}
+
+	if len(parts) > 4 {
+		// Process name pattern specified
+		if parts[4] == "" && len(parts) == 5 {
+			return nil, fmt.Errorf("empty process name pattern in routing policy: %s", policyStr)
+		}
+		if _, err := path.Match(parts[4], ""); err != nil {
+			return nil, fmt.Errorf("invalid process name pattern: %s", parts[4])
+		}
+		policy.ExePattern = parts[4]
+	}
+
+	if len(parts) > 5 {
+		// Hostname pattern specified
+		if parts[5] == "" {
+			return nil, fmt.Errorf("empty hostname pattern in routing policy: %s", policyStr)
+		}
+		if _, err := path.Match(parts[5], ""); err != nil {
+			return nil, fmt.Errorf("invalid hostname pattern: %s", parts[5])
+		}
+		policy.SNIPattern = parts[5]
+	}
+
+	if len(parts) > 6 {
+		return nil, fmt.Errorf("too many fields in routing policy: %s", policyStr)
+	}
+
+	return policy, nil
+}
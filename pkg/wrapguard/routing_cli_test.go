@@ -1,4 +1,4 @@
-package main
+package wrapguard
 
 import (
 	"testing"
@@ -9,7 +9,7 @@ func TestApplyCLIRoutes(t *testing.T) {
 	config := &WireGuardConfig{
 		Interface: InterfaceConfig{
 			PrivateKey: "test-private-key",
-			Address:    "10.0.0.2/24",
+			Address:    []string{"10.0.0.2/24"},
 		},
 		Peers: []PeerConfig{
 			{
@@ -69,7 +69,7 @@ func TestApplyCLIRoutesErrors(t *testing.T) {
 	config := &WireGuardConfig{
 		Interface: InterfaceConfig{
 			PrivateKey: "test-private-key",
-			Address:    "10.0.0.2/24",
+			Address:    []string{"10.0.0.2/24"},
 		},
 		Peers: []PeerConfig{
 			{
@@ -98,3 +98,31 @@ func TestApplyCLIRoutesErrors(t *testing.T) {
 		t.Error("Expected error for peer IP not in any AllowedIPs")
 	}
 }
+
+func TestApplyCLIRoutesToTunnels(t *testing.T) {
+	corp := &WireGuardConfig{
+		Peers: []PeerConfig{{PublicKey: "corp-peer", AllowedIPs: []string{"10.1.0.0/16"}}},
+	}
+	vpn := &WireGuardConfig{
+		Peers: []PeerConfig{{PublicKey: "vpn-peer", AllowedIPs: []string{"10.2.0.0/16"}}},
+	}
+
+	err := ApplyCLIRoutesToTunnels([]*WireGuardConfig{corp, vpn}, "10.2.0.1", []string{"192.168.0.0/16:10.1.0.1"})
+	if err != nil {
+		t.Fatalf("ApplyCLIRoutesToTunnels failed: %v", err)
+	}
+
+	if len(corp.Peers[0].RoutingPolicies) != 1 || corp.Peers[0].RoutingPolicies[0].DestinationCIDR != "192.168.0.0/16" {
+		t.Errorf("expected the subnet route on the corp tunnel, got %v", corp.Peers[0].RoutingPolicies)
+	}
+
+	if len(vpn.Peers[0].RoutingPolicies) != 1 || vpn.Peers[0].RoutingPolicies[0].DestinationCIDR != "0.0.0.0/0" {
+		t.Errorf("expected the exit node route on the vpn tunnel, got %v", vpn.Peers[0].RoutingPolicies)
+	}
+
+	// A peer IP that no tunnel can reach is an error
+	err = ApplyCLIRoutesToTunnels([]*WireGuardConfig{corp, vpn}, "", []string{"172.16.0.0/12:10.3.0.1"})
+	if err == nil {
+		t.Error("expected error for peer IP not in any tunnel")
+	}
+}
@@ -0,0 +1,992 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected PortRange
+		hasError bool
+	}{
+		{"80", PortRange{Start: 80, End: 80}, false},
+		{"8080-9000", PortRange{Start: 8080, End: 9000}, false},
+		{"any", PortRange{Start: 1, End: 65535}, false},
+		{"", PortRange{Start: 1, End: 65535}, false},
+		{"invalid", PortRange{}, true},
+		{"80-70", PortRange{}, true},
+		{"0-100", PortRange{}, true},
+		{"100-70000", PortRange{}, true},
+	}
+
+	for _, test := range tests {
+		result, err := ParsePortRange(test.input)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected error for input %s, but got none", test.input)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Unexpected error for input %s: %v", test.input, err)
+			}
+			if result != test.expected {
+				t.Errorf("For input %s, expected %v but got %v", test.input, test.expected, result)
+			}
+		}
+	}
+}
+
+func TestParseRoutingPolicy(t *testing.T) {
+	tests := []struct {
+		input    string
+		priority int
+		expected RoutingPolicy
+		hasError bool
+	}{
+		{
+			"192.168.1.0/24",
+			0,
+			RoutingPolicy{
+				DestinationCIDR: "192.168.1.0/24",
+				Protocol:        "any",
+				PortRange:       PortRange{Start: 1, End: 65535},
+				SrcPortRange:    PortRange{Start: 1, End: 65535},
+				Priority:        0,
+			},
+			false,
+		},
+		{
+			"0.0.0.0/0:tcp:80",
+			1,
+			RoutingPolicy{
+				DestinationCIDR: "0.0.0.0/0",
+				Protocol:        "tcp",
+				PortRange:       PortRange{Start: 80, End: 80},
+				SrcPortRange:    PortRange{Start: 1, End: 65535},
+				Priority:        1,
+			},
+			false,
+		},
+		{
+			"10.0.0.0/8:udp:5000-6000",
+			2,
+			RoutingPolicy{
+				DestinationCIDR: "10.0.0.0/8",
+				Protocol:        "udp",
+				PortRange:       PortRange{Start: 5000, End: 6000},
+				SrcPortRange:    PortRange{Start: 1, End: 65535},
+				Priority:        2,
+			},
+			false,
+		},
+		{
+			"0.0.0.0/0:tcp:any:49152-65535",
+			3,
+			RoutingPolicy{
+				DestinationCIDR: "0.0.0.0/0",
+				Protocol:        "tcp",
+				PortRange:       PortRange{Start: 1, End: 65535},
+				SrcPortRange:    PortRange{Start: 49152, End: 65535},
+				Priority:        3,
+			},
+			false,
+		},
+		{
+			"0.0.0.0/0:tcp:80:1024",
+			0,
+			RoutingPolicy{
+				DestinationCIDR: "0.0.0.0/0",
+				Protocol:        "tcp",
+				PortRange:       PortRange{Start: 80, End: 80},
+				SrcPortRange:    PortRange{Start: 1024, End: 1024},
+				Priority:        0,
+			},
+			false,
+		},
+		{
+			"0.0.0.0/0:tcp:any:70000",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"0.0.0.0/0:tcp:any:2000-1000",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"0.0.0.0/0:any:any:any:curl",
+			0,
+			RoutingPolicy{
+				DestinationCIDR: "0.0.0.0/0",
+				Protocol:        "any",
+				PortRange:       PortRange{Start: 1, End: 65535},
+				SrcPortRange:    PortRange{Start: 1, End: 65535},
+				ExePattern:      "curl",
+				Priority:        0,
+			},
+			false,
+		},
+		{
+			"0.0.0.0/0:tcp:443:any::*.corp.internal",
+			2,
+			RoutingPolicy{
+				DestinationCIDR: "0.0.0.0/0",
+				Protocol:        "tcp",
+				PortRange:       PortRange{Start: 443, End: 443},
+				SrcPortRange:    PortRange{Start: 1, End: 65535},
+				SNIPattern:      "*.corp.internal",
+				Priority:        2,
+			},
+			false,
+		},
+		{
+			"0.0.0.0/0:any:any:any:curl:*.corp.internal",
+			0,
+			RoutingPolicy{
+				DestinationCIDR: "0.0.0.0/0",
+				Protocol:        "any",
+				PortRange:       PortRange{Start: 1, End: 65535},
+				SrcPortRange:    PortRange{Start: 1, End: 65535},
+				ExePattern:      "curl",
+				SNIPattern:      "*.corp.internal",
+				Priority:        0,
+			},
+			false,
+		},
+		{
+			"0.0.0.0/0:tcp:any:any::",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"0.0.0.0/0:tcp:any:any::[corp",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"0.0.0.0/0:tcp:any:any:curl:*.corp.internal:extra",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"0.0.0.0/0:tcp:any:any:",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"0.0.0.0/0:tcp:any:any:[curl",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"invalid-cidr",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+		{
+			"192.168.1.0/24:invalid-protocol:80",
+			0,
+			RoutingPolicy{},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := ParseRoutingPolicy(test.input, test.priority)
+		if test.hasError {
+			if err == nil {
+				t.Errorf("Expected error for input %s, but got none", test.input)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Unexpected error for input %s: %v", test.input, err)
+			}
+			if result == nil {
+				t.Errorf("Expected non-nil result for input %s", test.input)
+			} else if *result != test.expected {
+				t.Errorf("For input %s, expected %+v but got %+v", test.input, test.expected, *result)
+			}
+		}
+	}
+}
+
+func TestRoutingEngine(t *testing.T) {
+	// Create a test configuration
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.150.0.2/24"},
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:  "peer1",
+				Endpoint:   "vpn1.example.com:51820",
+				AllowedIPs: []string{"0.0.0.0/0"},
+				RoutingPolicies: []RoutingPolicy{
+					{
+						DestinationCIDR: "0.0.0.0/0",
+						Protocol:        "any",
+						PortRange:       PortRange{Start: 1, End: 65535},
+						Priority:        0,
+					},
+				},
+			},
+			{
+				PublicKey:  "peer2",
+				Endpoint:   "vpn2.example.com:51820",
+				AllowedIPs: []string{"192.168.0.0/16", "172.16.0.0/12"},
+				RoutingPolicies: []RoutingPolicy{
+					{
+						DestinationCIDR: "192.168.1.0/24",
+						Protocol:        "tcp",
+						PortRange:       PortRange{Start: 80, End: 443},
+						Priority:        1,
+					},
+					{
+						DestinationCIDR: "0.0.0.0/0",
+						Protocol:        "tcp",
+						PortRange:       PortRange{Start: 8080, End: 9000},
+						Priority:        2,
+					},
+				},
+			},
+			{
+				PublicKey:  "peer3",
+				Endpoint:   "dev-vpn.example.com:51820",
+				AllowedIPs: []string{"10.0.0.0/8"},
+				RoutingPolicies: []RoutingPolicy{
+					{
+						DestinationCIDR: "10.0.0.0/8",
+						Protocol:        "any",
+						PortRange:       PortRange{Start: 1, End: 65535},
+						Priority:        0,
+					},
+				},
+			},
+		},
+	}
+
+	engine := NewRoutingEngine(config, RoutingOptions{})
+
+	tests := []struct {
+		name         string
+		dstIP        string
+		dstPort      int
+		protocol     string
+		expectedPeer int
+	}{
+		{"General traffic", "8.8.8.8", 53, "udp", 0},
+		{"HTTP to 192.168.1.x", "192.168.1.100", 80, "tcp", 1},
+		{"HTTPS to 192.168.1.x", "192.168.1.100", 443, "tcp", 1},
+		{"Port 8080 to any IP", "1.2.3.4", 8080, "tcp", 1},
+		{"Development network", "10.1.2.3", 3000, "tcp", 2},
+		{"SSH to 192.168.1.x (no specific rule)", "192.168.1.100", 22, "tcp", 0},
+		{"UDP to port 8080 (TCP-only rule)", "1.2.3.4", 8080, "udp", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ip := net.ParseIP(test.dstIP)
+			if ip == nil {
+				t.Fatalf("Failed to parse IP: %s", test.dstIP)
+			}
+
+			peer, peerIdx := engine.FindPeerForDestination(ip, test.dstPort, 0, test.protocol, "")
+			if peerIdx != test.expectedPeer {
+				t.Errorf("Expected peer %d, but got peer %d", test.expectedPeer, peerIdx)
+			}
+			if test.expectedPeer >= 0 && peer == nil {
+				t.Errorf("Expected non-nil peer for peer index %d", test.expectedPeer)
+			}
+		})
+	}
+}
+
+func TestRoutingEngine_SourcePortRange(t *testing.T) {
+	ephemeral, _ := ParseRoutingPolicy("0.0.0.0/0:tcp:any:49152-65535", 1)
+	wellKnown, _ := ParseRoutingPolicy("0.0.0.0/0:tcp", 0)
+
+	config := &WireGuardConfig{
+		Peers: []PeerConfig{
+			{
+				PublicKey:       "peer1",
+				AllowedIPs:      []string{"10.0.0.1/32"},
+				RoutingPolicies: []RoutingPolicy{*wellKnown},
+			},
+			{
+				PublicKey:       "peer2",
+				AllowedIPs:      []string{"10.0.0.2/32"},
+				RoutingPolicies: []RoutingPolicy{*ephemeral},
+			},
+		},
+	}
+
+	engine := NewRoutingEngine(config, RoutingOptions{})
+
+	tests := []struct {
+		name         string
+		srcPort      int
+		expectedPeer int
+	}{
+		{"ephemeral source port", 50000, 1},
+		{"lowest ephemeral port", 49152, 1},
+		{"well-known source port", 1023, 0},
+		{"unknown source port", 0, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, peerIdx := engine.FindPeerForDestination(net.ParseIP("8.8.8.8"), 443, test.srcPort, "tcp", "")
+			if peerIdx != test.expectedPeer {
+				t.Errorf("Expected peer %d, but got peer %d", test.expectedPeer, peerIdx)
+			}
+		})
+	}
+
+	// Policies built without a source port range match any source port
+	config.Peers[1].RoutingPolicies[0].SrcPortRange = PortRange{}
+	engine = NewRoutingEngine(config, RoutingOptions{})
+	if _, peerIdx := engine.FindPeerForDestination(net.ParseIP("8.8.8.8"), 443, 1023, "tcp", ""); peerIdx != 1 {
+		t.Errorf("Expected unset source range to match, got peer %d", peerIdx)
+	}
+}
+
+func TestRoutingEngine_ExePattern(t *testing.T) {
+	byExe, _ := ParseRoutingPolicy("0.0.0.0/0:any:any:any:curl", 0)
+	byGlob, _ := ParseRoutingPolicy("0.0.0.0/0:tcp:any:any:wget*", 0)
+
+	config := &WireGuardConfig{
+		Peers: []PeerConfig{
+			{
+				PublicKey:  "peer1",
+				AllowedIPs: []string{"10.0.0.0/8"},
+			},
+			{
+				PublicKey:       "peer2",
+				AllowedIPs:      []string{"192.168.0.0/16"},
+				RoutingPolicies: []RoutingPolicy{*byExe, *byGlob},
+			},
+		},
+	}
+
+	engine := NewRoutingEngine(config, RoutingOptions{})
+
+	tests := []struct {
+		name         string
+		dst          string
+		exeName      string
+		expectedPeer int
+	}{
+		{"exe policy overrides AllowedIPs", "10.1.2.3", "curl", 1},
+		{"glob pattern", "10.1.2.3", "wget2", 1},
+		{"other process uses AllowedIPs", "10.1.2.3", "python3", 0},
+		{"unknown process uses AllowedIPs", "10.1.2.3", "", 0},
+		{"exe policy reaches beyond AllowedIPs", "8.8.8.8", "curl", 1},
+		{"no route for other processes", "8.8.8.8", "python3", -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, peerIdx := engine.FindPeerForDestination(net.ParseIP(test.dst), 443, 0, "tcp", test.exeName)
+			if peerIdx != test.expectedPeer {
+				t.Errorf("Expected peer %d, but got peer %d", test.expectedPeer, peerIdx)
+			}
+		})
+	}
+
+	// The exe check comes after the protocol check
+	if _, peerIdx := engine.FindPeerForDestination(net.ParseIP("10.1.2.3"), 53, 0, "udp", "wget"); peerIdx != 0 {
+		t.Errorf("Expected tcp-only exe policy to skip udp, got peer %d", peerIdx)
+	}
+}
+
+func TestRoutingEngine_SplitTunnel(t *testing.T) {
+	corp, _ := ParseRoutingPolicy("192.168.0.0/16", 0)
+	config := &WireGuardConfig{
+		Peers: []PeerConfig{
+			{
+				PublicKey:       "vpn",
+				AllowedIPs:      []string{"0.0.0.0/0", "::/0", "10.150.0.0/24"},
+				RoutingPolicies: []RoutingPolicy{*corp},
+			},
+		},
+	}
+
+	tests := []struct {
+		dst         string
+		full, split int
+	}{
+		{"8.8.8.8", 0, -1},
+		{"2001:4860:4860::8888", 0, -1},
+		{"192.168.1.1", 0, 0},
+		{"10.150.0.3", 0, 0},
+	}
+
+	full := NewRoutingEngine(config, RoutingOptions{})
+	split := NewRoutingEngine(config, RoutingOptions{SplitTunnel: true})
+
+	for _, test := range tests {
+		t.Run(test.dst, func(t *testing.T) {
+			if _, peerIdx := full.FindPeerForDestination(net.ParseIP(test.dst), 443, 0, "tcp", ""); peerIdx != test.full {
+				t.Errorf("Expected peer %d without split tunneling, got %d", test.full, peerIdx)
+			}
+			if _, peerIdx := split.FindPeerForDestination(net.ParseIP(test.dst), 443, 0, "tcp", ""); peerIdx != test.split {
+				t.Errorf("Expected peer %d with split tunneling, got %d", test.split, peerIdx)
+			}
+		})
+	}
+}
+
+// redundantPeers is two peers with the same default route, as for failover
+var redundantPeers = &WireGuardConfig{Peers: []PeerConfig{
+	{PublicKey: "first", AllowedIPs: []string{"0.0.0.0/0"}},
+	{PublicKey: "second", AllowedIPs: []string{"0.0.0.0/0", "10.1.0.0/16"}},
+}}
+
+func TestRoutingEngine_ECMP(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	randomDestination := func() (net.IP, int) {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, rng.Uint32())
+		return ip, 1 + rng.IntN(65535)
+	}
+
+	for _, mode := range []string{"hash", "round-robin", "random"} {
+		t.Run(mode, func(t *testing.T) {
+			engine := NewRoutingEngine(redundantPeers, RoutingOptions{ECMPMode: mode})
+
+			// A destination in 10.1.0.0/16 has only one best route
+			var counts [2]int
+			for i := 0; i < 1000; i++ {
+				ip, port := randomDestination()
+				if ip[0] == 10 && ip[1] == 1 {
+					ip[0] = 11
+				}
+				_, peerIdx := engine.FindPeerForDestination(ip, port, 0, "tcp", "")
+				if peerIdx < 0 {
+					t.Fatalf("no peer for %s:%d", ip, port)
+				}
+				counts[peerIdx]++
+			}
+			if counts[0] < 450 || counts[0] > 550 {
+				t.Errorf("expected about 500 connections per peer, got %v", counts)
+			}
+
+			if _, peerIdx := engine.FindPeerForDestination(net.ParseIP("10.1.2.3"), 443, 0, "tcp", ""); peerIdx != 1 {
+				t.Errorf("expected the more specific route to win, got peer %d", peerIdx)
+			}
+		})
+	}
+
+	// Without ECMP the first peer gets everything
+	engine := NewRoutingEngine(redundantPeers, RoutingOptions{})
+	for i := 0; i < 100; i++ {
+		ip, port := randomDestination()
+		if _, peerIdx := engine.FindPeerForDestination(ip, port, 0, "tcp", ""); peerIdx != 0 {
+			t.Fatalf("expected peer 0 without ECMP, got %d for %s:%d", peerIdx, ip, port)
+		}
+	}
+}
+
+func TestRoutingEngine_ECMPHashIsConsistent(t *testing.T) {
+	engine := NewRoutingEngine(redundantPeers, RoutingOptions{ECMPMode: "hash"})
+
+	// The same destination always gets the same peer
+	dst := net.ParseIP("203.0.113.7")
+	_, first := engine.FindPeerForDestination(dst, 443, 0, "tcp", "")
+	for srcPort := 1024; srcPort < 1124; srcPort++ {
+		if _, peerIdx := engine.FindPeerForDestination(dst, 443, srcPort, "tcp", ""); peerIdx != first {
+			t.Fatalf("expected peer %d for every connection to %s:443, got %d", first, dst, peerIdx)
+		}
+	}
+	if _, peerIdx := engine.FindPeerECMP(dst, 443, "tcp", ECMPSessionKey(dst, 443)); peerIdx != first {
+		t.Errorf("expected FindPeerECMP to agree with FindPeerForDestination, got %d and %d", peerIdx, first)
+	}
+
+	// Sequential session keys spread evenly too
+	var counts [2]int
+	for key := uint64(0); key < 1000; key++ {
+		_, peerIdx := engine.FindPeerECMP(dst, 443, "tcp", key)
+		counts[peerIdx]++
+	}
+	if counts[0] < 450 || counts[0] > 550 {
+		t.Errorf("expected about 500 sessions per peer, got %v", counts)
+	}
+
+	// FindPeerECMP hashes even when no ECMP mode is set
+	unset := NewRoutingEngine(redundantPeers, RoutingOptions{})
+	var unsetCounts [2]int
+	for key := uint64(0); key < 100; key++ {
+		_, peerIdx := unset.FindPeerECMP(dst, 443, "tcp", key)
+		unsetCounts[peerIdx]++
+	}
+	if unsetCounts[0] == 0 || unsetCounts[1] == 0 {
+		t.Errorf("expected sessions on both peers, got %v", unsetCounts)
+	}
+
+	if ECMPSessionKey(dst, 443) == ECMPSessionKey(dst, 444) || ECMPSessionKey(dst, 443) == ECMPSessionKey(net.ParseIP("203.0.113.8"), 443) {
+		t.Error("expected different destinations to get different session keys")
+	}
+}
+
+func TestRoutingEngine_ECMPRoundRobin(t *testing.T) {
+	// Policies tie on prefix length and priority as well
+	route, _ := ParseRoutingPolicy("192.168.0.0/16", 0)
+	engine := NewRoutingEngine(&WireGuardConfig{Peers: []PeerConfig{
+		{PublicKey: "a", RoutingPolicies: []RoutingPolicy{*route}},
+		{PublicKey: "b", AllowedIPs: []string{"192.168.0.0/16"}},
+		{PublicKey: "c", RoutingPolicies: []RoutingPolicy{*route}},
+	}}, RoutingOptions{ECMPMode: "round-robin"})
+
+	var got []int
+	for i := 0; i < 6; i++ {
+		_, peerIdx := engine.FindPeerForDestination(net.ParseIP("192.168.1.1"), 80, 0, "tcp", "")
+		got = append(got, peerIdx)
+	}
+	if expected := []int{0, 2, 0, 2, 0, 2}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected peers %v, got %v", expected, got)
+	}
+}
+
+func TestValidateECMPMode(t *testing.T) {
+	for _, mode := range []string{"", "hash", "round-robin", "random"} {
+		if err := ValidateECMPMode(mode); err != nil {
+			t.Errorf("ValidateECMPMode(%q) failed: %v", mode, err)
+		}
+	}
+	if err := ValidateECMPMode("weighted"); err == nil || !strings.Contains(err.Error(), "invalid ECMP mode: weighted") {
+		t.Errorf("expected an error for an unknown mode, got %v", err)
+	}
+}
+
+func TestRoutingEngine_MarshalJSON(t *testing.T) {
+	https, _ := ParseRoutingPolicy("10.0.0.0/8:tcp:443", 5)
+	corp, _ := ParseRoutingPolicy("10.0.0.0/8", 0)
+	internal, _ := ParseRoutingPolicy("0.0.0.0/0:tcp:any:any::*.corp.internal", 1)
+	hexKey, _ := base64ToHex(testPublicKey(t, 2))
+	config := &WireGuardConfig{Peers: []PeerConfig{
+		{
+			PublicKey:       hexKey,
+			Endpoint:        "203.0.113.1:51820",
+			AllowedIPs:      []string{"0.0.0.0/0", "10.150.0.0/24"},
+			RoutingPolicies: []RoutingPolicy{*https, *corp},
+		},
+		{
+			PublicKey:       testPublicKey(t, 3),
+			AllowedIPs:      []string{"192.168.0.0/16"},
+			RoutingPolicies: []RoutingPolicy{*corp, *internal},
+		},
+		{PublicKey: testPublicKey(t, 4)},
+	}}
+
+	data, err := json.Marshal(NewRoutingEngine(config, RoutingOptions{ECMPMode: "hash"}))
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+
+	// Peer 0's two policies for 10.0.0.0/8 list it once
+	expected := fmt.Sprintf(`{"routes":[{"cidr":"10.0.0.0/8","peers":[0,1]}],"peers":[`+
+		`{"idx":0,"public_key":"%s","endpoint":"203.0.113.1:51820","allowed_ips":["0.0.0.0/0","10.150.0.0/24"],"policies":[{"route":"10.0.0.0/8:tcp:443","priority":5},{"route":"10.0.0.0/8","priority":0}]},`+
+		`{"idx":1,"public_key":"%s","allowed_ips":["192.168.0.0/16"],"policies":[{"route":"10.0.0.0/8","priority":0},{"route":"0.0.0.0/0:tcp:any:any::*.corp.internal","priority":1}]},`+
+		`{"idx":2,"public_key":"%s","allowed_ips":[],"policies":[]}],"ecmp":"hash"}`,
+		testPublicKey(t, 2), testPublicKey(t, 3), testPublicKey(t, 4))
+	if string(data) != expected {
+		t.Errorf("unexpected routing table\n got: %s\nwant: %s", data, expected)
+	}
+
+	// Catch-all AllowedIPs ignored with split tunneling are left out
+	split := NewRoutingEngine(config, RoutingOptions{SplitTunnel: true})
+	data, err = json.Marshal(split)
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	if !strings.Contains(string(data), `"allowed_ips":["10.150.0.0/24"]`) || strings.Contains(string(data), `"ecmp"`) {
+		t.Errorf("expected only the narrower AllowedIP and no ECMP mode, got %s", data)
+	}
+
+	// An engine without peers still has both lists
+	data, _ = json.Marshal(NewRoutingEngine(&WireGuardConfig{}, RoutingOptions{}))
+	if string(data) != `{"routes":[],"peers":[]}` {
+		t.Errorf("unexpected empty routing table %s", data)
+	}
+}
+
+func TestRoutingEngine_SNIPattern(t *testing.T) {
+	corp, _ := ParseRoutingPolicy("0.0.0.0/0:tcp:any:any::*.corp.internal", 0)
+	api, _ := ParseRoutingPolicy("0.0.0.0/0:tcp:443:any::api.corp.internal", 1)
+
+	config := &WireGuardConfig{
+		Peers: []PeerConfig{
+			{
+				PublicKey:       "corp",
+				AllowedIPs:      []string{"10.0.0.0/8"},
+				RoutingPolicies: []RoutingPolicy{*corp},
+			},
+			{
+				PublicKey:       "api",
+				AllowedIPs:      []string{"192.168.0.0/16"},
+				RoutingPolicies: []RoutingPolicy{*api},
+			},
+			{
+				PublicKey:  "default",
+				AllowedIPs: []string{"0.0.0.0/0"},
+			},
+		},
+	}
+
+	engine := NewRoutingEngine(config, RoutingOptions{})
+
+	tests := []struct {
+		name         string
+		hostname     string
+		port         int
+		protocol     string
+		expectedPeer int
+	}{
+		{"subdomain", "git.corp.internal", 443, "tcp", 0},
+		{"nested subdomain", "a.b.corp.internal", 22, "tcp", 0},
+		{"case and trailing dot", "Git.Corp.Internal.", 443, "tcp", 0},
+		{"higher priority wins", "api.corp.internal", 443, "tcp", 1},
+		{"port outside the higher priority policy", "api.corp.internal", 80, "tcp", 0},
+		{"protocol mismatch", "git.corp.internal", 53, "udp", -1},
+		{"domain itself", "corp.internal", 443, "tcp", -1},
+		{"other hostname", "example.com", 443, "tcp", -1},
+		{"no hostname", "", 443, "tcp", -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, peerIdx := engine.FindPeerForHostname(test.hostname, test.port, 0, test.protocol, "")
+			if peerIdx != test.expectedPeer {
+				t.Errorf("Expected peer %d, but got peer %d", test.expectedPeer, peerIdx)
+			}
+		})
+	}
+
+	// Hostname policies play no part in routing by address, whatever their CIDR
+	if _, peerIdx := engine.FindPeerForDestination(net.ParseIP("8.8.8.8"), 443, 0, "tcp", ""); peerIdx != 2 {
+		t.Errorf("Expected address routing to ignore hostname policies, got peer %d", peerIdx)
+	}
+	if _, peerIdx := engine.FindPeerForDestination(net.ParseIP("10.1.2.3"), 443, 0, "tcp", ""); peerIdx != 0 {
+		t.Errorf("Expected AllowedIPs to still route 10.1.2.3, got peer %d", peerIdx)
+	}
+}
+
+func TestRoutingEngine_Lint(t *testing.T) {
+	policy := func(spec string, priority int) RoutingPolicy {
+		t.Helper()
+		p, err := ParseRoutingPolicy(spec, priority)
+		if err != nil {
+			t.Fatalf("ParseRoutingPolicy(%q) failed: %v", spec, err)
+		}
+		return *p
+	}
+
+	// Peer 1's catch-all for 10.0.0.0/24 outranks peer 0's HTTPS route
+	config := &WireGuardConfig{Peers: []PeerConfig{
+		{PublicKey: "https", RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:tcp:443", 0)}},
+		{PublicKey: "catch-all", RoutingPolicies: []RoutingPolicy{policy("0.0.0.0/0", 0), policy("10.0.0.0/24", 1)}},
+	}}
+	engine := NewRoutingEngine(config, RoutingOptions{})
+
+	expected := []RoutingWarning{{
+		PeerIdx:            0,
+		CIDR:               "10.0.0.0/24",
+		Priority:           0,
+		ShadowedByPeerIdx:  1,
+		ShadowedByCIDR:     "10.0.0.0/24",
+		ShadowedByPriority: 1,
+	}}
+	warnings := engine.Lint()
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, warnings)
+	}
+
+	// The warning describes what the engine actually does
+	if _, peerIdx := engine.FindPeerForDestination(net.ParseIP("10.0.0.5"), 443, 0, "tcp", ""); peerIdx != 1 {
+		t.Errorf("expected the shadowing route to win, got peer %d", peerIdx)
+	}
+	if !strings.Contains(warnings[0].String(), "route 10.0.0.0/24 for peer 0 (priority 0) is shadowed by route 10.0.0.0/24 for peer 1 (priority 1)") {
+		t.Errorf("unexpected warning text %q", warnings[0])
+	}
+
+	tests := []struct {
+		name  string
+		peers []PeerConfig
+	}{
+		// A more specific prefix always wins, whatever the priorities
+		{"less specific higher priority", []PeerConfig{
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24", 5)}},
+			{RoutingPolicies: []RoutingPolicy{policy("0.0.0.0/0", 10)}},
+		}},
+		{"narrower winner", []PeerConfig{
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24", 0)}},
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:tcp:443", 1)}},
+		}},
+		{"different process", []PeerConfig{
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:any:any:any:curl", 0)}},
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:any:any:any:wget", 1)}},
+		}},
+		{"source ports", []PeerConfig{
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24", 0)}},
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:any:any:1024-2048", 1)}},
+		}},
+		{"same peer", []PeerConfig{
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:tcp:443", 0), policy("10.0.0.0/24", 1)}},
+		}},
+		{"hostname policies", []PeerConfig{
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:tcp:any:any::*.corp.internal", 0)}},
+			{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24", 1)}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if warnings := NewRoutingEngine(&WireGuardConfig{Peers: tt.peers}, RoutingOptions{}).Lint(); len(warnings) != 0 {
+				t.Errorf("expected no warnings, got %+v", warnings)
+			}
+		})
+	}
+
+	// Ties on priority go to the peer listed first
+	tied := NewRoutingEngine(&WireGuardConfig{Peers: []PeerConfig{
+		{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24", 0)}},
+		{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:tcp", 0)}},
+	}}, RoutingOptions{}).Lint()
+	if len(tied) != 1 || tied[0].PeerIdx != 1 || tied[0].ShadowedByPeerIdx != 0 {
+		t.Errorf("expected peer 1 to be shadowed by peer 0, got %+v", tied)
+	}
+
+	// unless ECMP shares them out
+	shared := NewRoutingEngine(&WireGuardConfig{Peers: []PeerConfig{
+		{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24", 0)}},
+		{RoutingPolicies: []RoutingPolicy{policy("10.0.0.0/24:tcp", 0)}},
+	}}, RoutingOptions{ECMPMode: "hash"}).Lint()
+	if len(shared) != 0 {
+		t.Errorf("expected no warnings with ECMP, got %+v", shared)
+	}
+}
+
+func TestTunnel_LoadRoutesWarns(t *testing.T) {
+	var buf bytes.Buffer
+	https, _ := ParseRoutingPolicy("10.0.0.0/24:tcp:443", 0)
+	all, _ := ParseRoutingPolicy("10.0.0.0/24", 1)
+	(&Tunnel{log: NewLogger(LogLevelWarn, &buf)}).ReloadRoutes(&WireGuardConfig{Peers: []PeerConfig{
+		{PublicKey: "https", RoutingPolicies: []RoutingPolicy{*https}},
+		{PublicKey: "all", RoutingPolicies: []RoutingPolicy{*all}},
+	}})
+
+	if count := strings.Count(buf.String(), "Routing: route 10.0.0.0/24 for peer 0 (priority 0) is shadowed"); count != 1 {
+		t.Errorf("expected one shadowed route warning, got %d:\n%s", count, buf.String())
+	}
+	if !strings.Contains(buf.String(), `"level":"warn"`) {
+		t.Errorf("expected the warning at warn level:\n%s", buf.String())
+	}
+}
+
+func TestRoutingPolicy_String(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"192.168.1.0/24", "192.168.1.0/24"},
+		{"192.168.1.0/24:any", "192.168.1.0/24"},
+		{"192.168.1.0/24:tcp", "192.168.1.0/24:tcp"},
+		{"10.0.0.0/8:tcp:443", "10.0.0.0/8:tcp:443"},
+		{"10.0.0.0/8:any:8080-9000", "10.0.0.0/8:any:8080-9000"},
+		{"0.0.0.0/0:tcp:any:any", "0.0.0.0/0:tcp"},
+		{"0.0.0.0/0:tcp:any:49152-65535", "0.0.0.0/0:tcp:any:49152-65535"},
+		{"0.0.0.0/0:any:any:any:curl", "0.0.0.0/0:any:any:any:curl"},
+		{"10.0.0.0/8:tcp:443:1024-2048:wget*", "10.0.0.0/8:tcp:443:1024-2048:wget*"},
+		{"0.0.0.0/0:tcp:443:any::*.corp.internal", "0.0.0.0/0:tcp:443:any::*.corp.internal"},
+		{"0.0.0.0/0:any:any:any:curl:*.corp.internal", "0.0.0.0/0:any:any:any:curl:*.corp.internal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			policy, err := ParseRoutingPolicy(tt.input, 0)
+			if err != nil {
+				t.Fatalf("ParseRoutingPolicy failed: %v", err)
+			}
+			if got := policy.String(); got != tt.expected {
+				t.Errorf("String() = %q, want %q", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTunnelRouter_FindTunnelForDestination(t *testing.T) {
+	corpConfig := newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.1.0.0/16, 192.168.0.0/16"}}})
+	vpnConfig := newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "0.0.0.0/0"}}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	corp, err := NewTunnel(ctx, corpConfig, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("failed to create corp tunnel: %v", err)
+	}
+	defer corp.Close()
+
+	vpn, err := NewTunnel(ctx, vpnConfig, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("failed to create vpn tunnel: %v", err)
+	}
+	defer vpn.Close()
+
+	// List the catch-all tunnel first to check that specificity beats order
+	router := NewTunnelRouter([]TunnelRoute{
+		{Tunnel: vpn, Config: vpnConfig},
+		{Tunnel: corp, Config: corpConfig},
+	})
+
+	tests := []struct {
+		name          string
+		dst           string
+		expected      *Tunnel
+		expectedIndex int
+	}{
+		{"corp subnet", "10.1.5.5", corp, 1},
+		{"second corp subnet", "192.168.1.1", corp, 1},
+		{"internet", "8.8.8.8", vpn, 0},
+		{"vpn subnet", "10.2.0.9", vpn, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel, peer, index := router.FindTunnelForDestination(net.ParseIP(tt.dst), 443, 0, "tcp", "")
+			if tunnel != tt.expected {
+				t.Errorf("destination %s routed to the wrong tunnel (index %d)", tt.dst, index)
+			}
+			if index != tt.expectedIndex {
+				t.Errorf("expected tunnel index %d, got %d", tt.expectedIndex, index)
+			}
+			if peer == nil {
+				t.Error("expected a peer")
+			}
+		})
+	}
+}
+
+func TestTunnelRouter_NoRoute(t *testing.T) {
+	config := newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.1.0.0/16"}}})
+	router := NewTunnelRouter([]TunnelRoute{{Config: config}})
+
+	tunnel, peer, index := router.FindTunnelForDestination(net.ParseIP("8.8.8.8"), 443, 0, "tcp", "")
+	if tunnel != nil || peer != nil || index != -1 {
+		t.Errorf("expected no route, got tunnel %v peer %v index %d", tunnel, peer, index)
+	}
+
+	if _, _, index := router.FindTunnelForDestination(nil, 443, 0, "tcp", ""); index != -1 {
+		t.Errorf("expected no route for invalid IP, got index %d", index)
+	}
+}
+
+func TestTunnelRouter_TiesGoToFirstConfig(t *testing.T) {
+	first := newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.0.0.0/8"}}})
+	second := newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "10.0.0.0/8"}}})
+	router := NewTunnelRouter([]TunnelRoute{{Config: first}, {Config: second}})
+
+	if _, _, index := router.FindTunnelForDestination(net.ParseIP("10.5.5.5"), 80, 0, "tcp", ""); index != 0 {
+		t.Errorf("expected tie to go to the first config, got index %d", index)
+	}
+
+	// A routing policy makes the second tunnel more specific
+	second.Peers[0].RoutingPolicies = []RoutingPolicy{{
+		DestinationCIDR: "10.5.0.0/16",
+		Protocol:        "any",
+		PortRange:       PortRange{Start: 1, End: 65535},
+	}}
+	router = NewTunnelRouter([]TunnelRoute{{Config: first}, {Config: second}})
+
+	if _, _, index := router.FindTunnelForDestination(net.ParseIP("10.5.5.5"), 80, 0, "tcp", ""); index != 1 {
+		t.Errorf("expected routing policy to select the second config, got index %d", index)
+	}
+}
+
+func TestTunnelRouter_EnvRoutes(t *testing.T) {
+	first := newTestConfig(t, testConfig{address: "10.1.0.2/16", peers: []testPeer{{allowedIPs: "10.1.0.0/16, 10.1.0.5/16, fd00::/64"}}})
+	second := newTestConfig(t, testConfig{seed: 10, address: "10.2.0.2/16", peers: []testPeer{{allowedIPs: "0.0.0.0/0"}}})
+	second.Peers[0].RoutingPolicies = []RoutingPolicy{{DestinationCIDR: "172.16.0.0/12"}}
+
+	router := NewTunnelRouter([]TunnelRoute{{Config: first}, {Config: second}})
+
+	expected := "10.1.0.0/16=0,0.0.0.0/0=1,172.16.0.0/12=1"
+	if got := router.EnvRoutes(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestTunnel_ReloadRoutes(t *testing.T) {
+	// The destination moves from the only peer of the first config to the
+	// second peer of the next one
+	before := &WireGuardConfig{Peers: []PeerConfig{
+		{PublicKey: "before-0", AllowedIPs: []string{"10.0.0.0/8"}},
+	}}
+	after := &WireGuardConfig{Peers: []PeerConfig{
+		{PublicKey: "after-0", AllowedIPs: []string{"192.168.0.0/16"}},
+		{PublicKey: "after-1", AllowedIPs: []string{"10.0.0.0/8"}},
+	}}
+	expectedKeys := map[int]string{0: "before-0", 1: "after-1"}
+
+	tunnel := &Tunnel{}
+	tunnel.ReloadRoutes(before)
+
+	dst := net.ParseIP("10.1.2.3")
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Each lookup sees one engine as a whole, never a mix
+				peer, index := tunnel.router.Load().FindPeerForDestination(dst, 443, 0, "tcp", "")
+				if peer == nil || expectedKeys[index] != peer.PublicKey {
+					t.Errorf("inconsistent lookup: peer %+v at index %d", peer, index)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		config, key := before, "before-0"
+		if i%2 == 0 {
+			config, key = after, "after-1"
+		}
+		tunnel.ReloadRoutes(config)
+
+		// Once ReloadRoutes returns, lookups use the new routes
+		if peer, _ := tunnel.router.Load().FindPeerForDestination(dst, 443, 0, "tcp", ""); peer == nil || peer.PublicKey != key {
+			t.Fatalf("reload %d: expected peer %s, got %+v", i, key, peer)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,249 @@
+package wrapguard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Settings holds wrapguard's own options from the [wrapguard] table of a
+// TOML file, kept apart from the WireGuard INI config that carries the keys
+// and peers. Empty fields were not set in the file.
+type Settings struct {
+	LogLevel       string   // log_level
+	LogFile        string   // log_file
+	ExitNode       string   // exit_node
+	Routes         []string // routes, each "CIDR:peerIP" as for --route
+	OnConnected    string   // on_connected
+	OnDisconnected string   // on_disconnected
+	MetricsAddr    string   // metrics_addr
+}
+
+// ParseSettingsFile reads Settings from a TOML file
+func ParseSettingsFile(path string) (*Settings, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open settings file: %w", err)
+	}
+	defer file.Close()
+
+	return ParseSettingsReader(file)
+}
+
+// ParseSettingsReader reads Settings from TOML text. Only the subset of TOML
+// the settings need is understood: tables, comments, strings and arrays of
+// strings. Tables other than [wrapguard] are ignored so the file can be
+// shared with other tools.
+func ParseSettingsReader(r io.Reader) (*Settings, error) {
+	settings := &Settings{}
+	scanner := bufio.NewScanner(r)
+	var currentTable string
+	lineNum := 0
+	var errs []error
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines and comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Check for table headers
+		if strings.HasPrefix(line, "[") {
+			header, _, _ := strings.Cut(line, "#")
+			header = strings.TrimSpace(header)
+			if !strings.HasSuffix(header, "]") {
+				errs = append(errs, fmt.Errorf("line %d: invalid table header %s", lineNum, line))
+				continue
+			}
+			currentTable = strings.TrimSpace(header[1 : len(header)-1])
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			errs = append(errs, fmt.Errorf("line %d: expected key = value", lineNum))
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		// Arrays may continue over several lines
+		keyLine := lineNum
+		if strings.HasPrefix(value, "[") {
+			for !tomlArrayClosed(value) && scanner.Scan() {
+				lineNum++
+				value += "\n" + scanner.Text()
+			}
+		}
+
+		if currentTable != "wrapguard" {
+			continue
+		}
+		if err := parseSettingsField(settings, key, value); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: error parsing setting %s: %w", keyLine, key, err))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to read settings: %w", err))
+	}
+	if err := newConfigErrors(errs...); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func parseSettingsField(settings *Settings, key, value string) error {
+	if key == "routes" {
+		routes, err := parseTOMLStringArray(value)
+		if err != nil {
+			return err
+		}
+		settings.Routes = routes
+		return nil
+	}
+
+	fields := map[string]*string{
+		"log_level":       &settings.LogLevel,
+		"log_file":        &settings.LogFile,
+		"exit_node":       &settings.ExitNode,
+		"on_connected":    &settings.OnConnected,
+		"on_disconnected": &settings.OnDisconnected,
+		"metrics_addr":    &settings.MetricsAddr,
+	}
+	field, ok := fields[key]
+	if !ok {
+		return fmt.Errorf("unknown setting")
+	}
+
+	s, rest, err := parseTOMLString(value)
+	if err != nil {
+		return err
+	}
+	if err := checkTOMLTrailer(rest); err != nil {
+		return err
+	}
+	*field = s
+	return nil
+}
+
+// parseTOMLString parses the basic ("...") or literal ('...') string at the
+// start of value and returns it with the rest of value
+func parseTOMLString(value string) (string, string, error) {
+	if value == "" {
+		return "", "", fmt.Errorf("expected a string")
+	}
+
+	switch value[0] {
+	case '\'':
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return value[1 : end+1], value[end+2:], nil
+	case '"':
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '\\':
+				i++
+			case '"':
+				s, err := strconv.Unquote(value[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s", value[:i+1])
+				}
+				return s, value[i+1:], nil
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	default:
+		return "", "", fmt.Errorf("expected a quoted string, got %s", value)
+	}
+}
+
+// parseTOMLStringArray parses an array of strings such as ["a", 'b',]
+func parseTOMLStringArray(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		return nil, fmt.Errorf("expected an array of strings, got %s", value)
+	}
+	rest := value[1:]
+
+	values := []string{}
+	for {
+		rest = skipTOMLSpace(rest)
+		if strings.HasPrefix(rest, "]") {
+			return values, checkTOMLTrailer(rest[1:])
+		}
+
+		s, remaining, err := parseTOMLString(rest)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, s)
+
+		// Elements are separated by commas; a trailing comma is allowed
+		rest = skipTOMLSpace(remaining)
+		if strings.HasPrefix(rest, ",") {
+			rest = rest[1:]
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+	}
+}
+
+// skipTOMLSpace drops leading whitespace, newlines and comments
+func skipTOMLSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[i+1:]
+		} else {
+			return ""
+		}
+	}
+}
+
+// checkTOMLTrailer allows only whitespace or a comment after a value
+func checkTOMLTrailer(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected text after value: %s", rest)
+	}
+	return nil
+}
+
+// tomlArrayClosed reports whether the array at the start of value has its
+// closing bracket, ignoring brackets inside strings and comments
+func tomlArrayClosed(value string) bool {
+	var quote byte
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			end := strings.IndexByte(value[i:], '\n')
+			if end < 0 {
+				return false
+			}
+			i += end
+		case c == ']':
+			return true
+		}
+	}
+	return false
+}
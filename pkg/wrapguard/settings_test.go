@@ -0,0 +1,112 @@
+package wrapguard
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSettingsReader(t *testing.T) {
+	input := `# wrapguard settings kept next to wg0.conf
+[other]
+log_level = "ignored"
+
+[wrapguard]
+log_level = "debug"
+log_file = '/var/log/wrapguard.log'  # literal string
+exit_node = "10.150.0.3"
+routes = [
+  "192.168.1.0/24:10.150.0.3", # office
+  '10.0.0.0/8:tcp:443:10.150.0.4',
+]
+on_connected = "./register.sh \"$WRAPGUARD_INTERFACE_IP\""
+on_disconnected = "./deregister.sh"
+metrics_addr = "127.0.0.1:9100"
+`
+
+	settings, err := ParseSettingsReader(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseSettingsReader failed: %v", err)
+	}
+
+	expected := &Settings{
+		LogLevel:       "debug",
+		LogFile:        "/var/log/wrapguard.log",
+		ExitNode:       "10.150.0.3",
+		Routes:         []string{"192.168.1.0/24:10.150.0.3", "10.0.0.0/8:tcp:443:10.150.0.4"},
+		OnConnected:    `./register.sh "$WRAPGUARD_INTERFACE_IP"`,
+		OnDisconnected: "./deregister.sh",
+		MetricsAddr:    "127.0.0.1:9100",
+	}
+	if !reflect.DeepEqual(settings, expected) {
+		t.Errorf("expected %+v, got %+v", expected, settings)
+	}
+}
+
+func TestParseSettingsReader_Empty(t *testing.T) {
+	settings, err := ParseSettingsReader(strings.NewReader("[wrapguard]\nroutes = []\n"))
+	if err != nil {
+		t.Fatalf("ParseSettingsReader failed: %v", err)
+	}
+	if settings.LogLevel != "" || len(settings.Routes) != 0 {
+		t.Errorf("expected unset settings, got %+v", settings)
+	}
+}
+
+func TestParseSettingsReader_Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		errContains string
+	}{
+		{"unknown key", "[wrapguard]\nlog_colour = \"red\"", "line 2: error parsing setting log_colour: unknown setting"},
+		{"unquoted string", "[wrapguard]\nlog_level = debug", "expected a quoted string"},
+		{"unterminated string", "[wrapguard]\nlog_level = \"debug", "unterminated string"},
+		{"trailing text", "[wrapguard]\nlog_level = \"debug\" info", "unexpected text after value"},
+		{"routes not an array", "[wrapguard]\nroutes = \"10.0.0.0/8:10.0.0.3\"", "expected an array of strings"},
+		{"array missing comma", "[wrapguard]\nroutes = [\"a\" \"b\"]", "expected , or ]"},
+		{"unterminated array", "[wrapguard]\nroutes = [\n\"a\",", "expected a string"},
+		{"missing equals", "[wrapguard]\nlog_level", "line 2: expected key = value"},
+		{"bad header", "[wrapguard\nlog_level = \"debug\"", "line 1: invalid table header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSettingsReader(strings.NewReader(tt.input))
+			if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("expected error containing %q, got %v", tt.errContains, err)
+			}
+		})
+	}
+}
+
+func TestParseSettingsReader_CollectsErrors(t *testing.T) {
+	_, err := ParseSettingsReader(strings.NewReader("[wrapguard]\nfoo = \"1\"\nbar = \"2\"\n"))
+
+	var configErrs ConfigErrors
+	if !errors.As(err, &configErrs) || len(configErrs) != 2 {
+		t.Errorf("expected two collected errors, got %v", err)
+	}
+}
+
+func TestParseSettingsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.toml")
+	if err := os.WriteFile(path, []byte("[wrapguard]\nexit_node = \"10.150.0.3\"\n"), 0600); err != nil {
+		t.Fatalf("failed to write settings: %v", err)
+	}
+
+	settings, err := ParseSettingsFile(path)
+	if err != nil {
+		t.Fatalf("ParseSettingsFile failed: %v", err)
+	}
+	if settings.ExitNode != "10.150.0.3" {
+		t.Errorf("expected exit node 10.150.0.3, got %q", settings.ExitNode)
+	}
+
+	if _, err := ParseSettingsFile(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("expected error for a missing file")
+	}
+}
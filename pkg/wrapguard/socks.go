@@ -0,0 +1,460 @@
+package wrapguard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/armon/go-socks5"
+)
+
+type SOCKS5Server struct {
+	server   *socks5.Server
+	listener net.Listener
+	port     int
+	tunnel   *Tunnel
+	served   chan struct{} // Closed once Serve has returned
+
+	pacMutex    sync.RWMutex
+	pacPrefixes []netip.Prefix // AllowedIPs sent through this server by ServePAC
+}
+
+// ProxyOptions configures NewSOCKS5Server and NewHTTPConnectServer. The zero
+// value allows every destination, dials those outside the WireGuard network
+// directly and sets no SOCKS5 rate limit.
+type ProxyOptions struct {
+	// AllowedNetworks restricts the destinations the proxy will connect to;
+	// when empty every destination is allowed
+	AllowedNetworks []netip.Prefix
+
+	// UpstreamDial, when set, is used to reach destinations outside the
+	// WireGuard network through an upstream proxy
+	UpstreamDial DialFunc
+
+	// MaxConnRate limits how many SOCKS5 connections per second each client
+	// may open; zero disables the limit
+	MaxConnRate float64
+
+	// DenyNetworks and DenyHosts block SOCKS5 destinations. Networks are
+	// matched against the destination address once hostnames have been
+	// resolved; host patterns are matched against the hostname the client
+	// asked for, where "*.example.com" covers every subdomain of example.com.
+	DenyNetworks []netip.Prefix
+	DenyHosts    []string
+
+	// HopCount is how many wrapguard instances a connection to the HTTP
+	// CONNECT proxy may have passed through; zero means MaxHopCount
+	HopCount int
+}
+
+// errDestinationNotAllowed is returned by the proxy dialer for destinations
+// outside the allowed networks
+var errDestinationNotAllowed = errors.New("destination not in allowed networks")
+
+// destinationAllowed reports whether ip falls within allowed, or allowed is
+// empty
+func destinationAllowed(allowed []netip.Prefix, ip net.IP) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func NewSOCKS5Server(tunnel *Tunnel, opts ProxyOptions) (*SOCKS5Server, error) {
+	return newSOCKS5Server(tunnel, opts, nil)
+}
+
+// newSOCKS5Server creates a SOCKS5 server that looks up the process behind
+// each client connection in exeNames, if not nil
+func newSOCKS5Server(tunnel *Tunnel, opts ProxyOptions, exeNames *exeNameTable) (*SOCKS5Server, error) {
+	rules := &socksRuleSet{
+		exeNames:        exeNames,
+		allowedNetworks: opts.AllowedNetworks,
+		denyNetworks:    opts.DenyNetworks,
+		denyHosts:       opts.DenyHosts,
+	}
+	if opts.MaxConnRate > 0 {
+		rules.limiter = NewRateLimiter(opts.MaxConnRate)
+	}
+
+	// Create SOCKS5 server with custom dialer that routes WireGuard IPs through the tunnel
+	dial := newTunnelDialer(tunnel, "SOCKS5", opts.AllowedNetworks, opts.UpstreamDial)
+	socksConfig := &socks5.Config{
+		Dial:  dial,
+		Rules: rules,
+	}
+
+	// Resolve hostnames under the WireGuard search domains through the WireGuard DNS servers
+	if tunnel != nil {
+		if config := tunnel.config.Load(); config != nil {
+			servers, domains := splitDNSConfig(config.Interface.DNS)
+			socksConfig.Resolver = newTunnelResolver(servers, domains, dial)
+		}
+	}
+
+	server, err := socks5.New(socksConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SOCKS5 server: %w", err)
+	}
+
+	// Listen on localhost for SOCKS5 connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for SOCKS5 connections: %w", err)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	proxyPorts.add(port)
+
+	s := &SOCKS5Server{
+		server:   server,
+		listener: listener,
+		port:     port,
+		tunnel:   tunnel,
+		served:   make(chan struct{}),
+	}
+	if tunnel != nil {
+		s.SetConfig(tunnel.config.Load())
+	}
+
+	// Start serving in background
+	go func() {
+		defer close(s.served)
+		if err := server.Serve(listener); err != nil {
+			// Log error but don't crash - server might be shutting down
+			logger.Debugf("SOCKS5 server stopped: %v", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// tunnelResolver resolves hostnames that fall under a WireGuard DNS search
+// domain using the WireGuard DNS servers, reached through the tunnel. Other
+// hostnames are resolved by the system resolver.
+type tunnelResolver struct {
+	domains  []string
+	resolver *net.Resolver
+	fallback socks5.NameResolver
+}
+
+// splitDNSConfig separates the DNS entries of an [Interface] section into
+// server addresses and search domains, as wg-quick does
+func splitDNSConfig(dns []string) (servers, domains []string) {
+	for _, entry := range dns {
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			servers = append(servers, net.JoinHostPort(ip.String(), "53"))
+		} else {
+			domains = append(domains, strings.ToLower(strings.Trim(entry, ".")))
+		}
+	}
+	return servers, domains
+}
+
+// newTunnelResolver creates a resolver that sends queries for the given
+// search domains to servers (host:port) using dial
+func newTunnelResolver(servers, domains []string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) *tunnelResolver {
+	r := &tunnelResolver{
+		domains:  domains,
+		fallback: socks5.DNSResolver{},
+	}
+
+	if len(servers) > 0 && len(domains) > 0 {
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				// Ignore the system nameserver and try each WireGuard DNS server in turn
+				var lastErr error
+				for _, server := range servers {
+					conn, err := dial(ctx, network, server)
+					if err == nil {
+						return conn, nil
+					}
+					lastErr = err
+				}
+				return nil, lastErr
+			},
+		}
+	}
+
+	return r
+}
+
+// Resolve implements socks5.NameResolver
+func (r *tunnelResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if r.resolver == nil || !r.matchesDomain(name) {
+		return r.fallback.Resolve(ctx, name)
+	}
+
+	addrs, err := r.resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to resolve %s via WireGuard DNS: %w", name, err)
+	}
+	if len(addrs) == 0 {
+		return ctx, nil, fmt.Errorf("no IP addresses found for hostname %s", name)
+	}
+
+	// Prefer IPv4, matching how endpoints are resolved
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return ctx, addr.IP, nil
+		}
+	}
+	return ctx, addrs[0].IP, nil
+}
+
+// matchesDomain reports whether name is one of the search domains or a subdomain of one
+func (r *tunnelResolver) matchesDomain(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range r.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddrKey is the context key holding the address of the proxy client
+type clientAddrKey struct{}
+
+// withClientAddr attaches the proxy client's address to the dial context
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// clientSourcePort returns the proxy client's source port, or 0 if unknown
+func clientSourcePort(ctx context.Context) int {
+	addr, ok := ctx.Value(clientAddrKey{}).(string)
+	if !ok {
+		return 0
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	portNum, _ := strconv.Atoi(port)
+	return portNum
+}
+
+// clientExeKey is the context key holding the proxy client's process name
+type clientExeKey struct{}
+
+// withClientExe attaches the proxy client's process name to the dial context
+func withClientExe(ctx context.Context, exeName string) context.Context {
+	return context.WithValue(ctx, clientExeKey{}, exeName)
+}
+
+// clientExeName returns the proxy client's process name, or "" if unknown
+func clientExeName(ctx context.Context) string {
+	exeName, _ := ctx.Value(clientExeKey{}).(string)
+	return exeName
+}
+
+// destHostKey is the context key holding the hostname the client asked for
+type destHostKey struct{}
+
+// withDestHost attaches the destination hostname, before DNS resolution, to
+// the dial context
+func withDestHost(ctx context.Context, hostname string) context.Context {
+	return context.WithValue(ctx, destHostKey{}, hostname)
+}
+
+// destHostname returns the hostname the client asked for, or "" if it gave
+// an address
+func destHostname(ctx context.Context) string {
+	hostname, _ := ctx.Value(destHostKey{}).(string)
+	return hostname
+}
+
+// dialLogger returns a logger annotated with the proxy client's address, if known
+func dialLogger(ctx context.Context) *Logger {
+	if addr, ok := ctx.Value(clientAddrKey{}).(string); ok && addr != "" {
+		return logger.WithFields(map[string]interface{}{"peer_addr": addr})
+	}
+	return logger
+}
+
+// socksRuleSet permits SOCKS5 commands, subject to the connection rate limit,
+// and records the client address in the request context so that dial logs can
+// be attributed to a connection
+type socksRuleSet struct {
+	limiter         *RateLimiter
+	exeNames        *exeNameTable // Process names reported over IPC
+	allowedNetworks []netip.Prefix
+	denyNetworks    []netip.Prefix
+	denyHosts       []string
+}
+
+func (r *socksRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RemoteAddr == nil {
+		return ctx, true
+	}
+	ctx = withClientAddr(ctx, req.RemoteAddr.String())
+	if exeName := r.exeNames.take(req.RemoteAddr.Port); exeName != "" {
+		ctx = withClientExe(ctx, exeName)
+	}
+
+	// The dialer only sees the resolved address, so keep the hostname for
+	// SNIPattern routing
+	if req.DestAddr != nil && req.DestAddr.FQDN != "" {
+		ctx = withDestHost(ctx, req.DestAddr.FQDN)
+	}
+
+	// Reject destinations outside --allow-network; FQDNs are already resolved here
+	if req.DestAddr != nil && req.DestAddr.IP != nil && !destinationAllowed(r.allowedNetworks, req.DestAddr.IP) {
+		dialLogger(ctx).Warnf("SOCKS5 connection to %s blocked by network allowlist", req.DestAddr.IP)
+		return ctx, false
+	}
+
+	// Deny rules and wrapguard's own ports
+	if req.DestAddr != nil {
+		if reason := r.denyReason(req.DestAddr.FQDN, req.DestAddr.IP, req.DestAddr.Port); reason != "" {
+			dialLogger(ctx).WithFields(map[string]interface{}{"destination": req.DestAddr.String(), "exe_name": clientExeName(ctx)}).
+				Warnf("SOCKS5 connection to %s blocked: %s", req.DestAddr, reason)
+			return ctx, false
+		}
+	}
+
+	// Connections from the child all arrive over loopback, so the bucket is
+	// keyed by client IP rather than by the ephemeral source port
+	if r.limiter != nil && !r.limiter.Allow(req.RemoteAddr.IP.String()) {
+		dialLogger(ctx).Warnf("SOCKS5 connection rate limit exceeded, rejecting connection")
+		return ctx, false
+	}
+	return ctx, true
+}
+
+// newTunnelDialer returns a dial function shared by the proxy servers that routes
+// WireGuard destinations through the tunnel and dials everything else directly,
+// or through the upstream proxy when one is configured
+func newTunnelDialer(tunnel *Tunnel, proxyName string, allowed []netip.Prefix, upstream DialFunc) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		log := dialLogger(ctx)
+		log.Debugf("%s dial request: %s %s", proxyName, network, addr)
+
+		// Parse the address to check if it's a WireGuard IP
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address format: %w", err)
+		}
+
+		// Enforce the network allowlist, resolving hostnames so that they
+		// cannot be used to reach a blocked address
+		ip := net.ParseIP(host)
+		hostname := destHostname(ctx)
+		if ip == nil {
+			hostname = host
+		}
+		if len(allowed) > 0 {
+			if ip == nil {
+				if ip, err = resolveAllowed(ctx, allowed, host); err != nil {
+					log.Warnf("%s connection to %s blocked: %v", proxyName, addr, err)
+					return nil, err
+				}
+				host = ip.String()
+				addr = net.JoinHostPort(host, port)
+			} else if !destinationAllowed(allowed, ip) {
+				log.Warnf("%s connection to %s blocked by network allowlist", proxyName, addr)
+				return nil, fmt.Errorf("%s: %w", addr, errDestinationNotAllowed)
+			}
+		}
+
+		// Hostname policies take precedence over the address the name resolves to
+		portNum, _ := strconv.Atoi(port)
+		if tunnel != nil && hostname != "" {
+			if peer, peerIdx := tunnel.router.Load().FindPeerForHostname(hostname, portNum, clientSourcePort(ctx), "tcp", clientExeName(ctx)); peer != nil {
+				if ip == nil {
+					if ip, err = resolveAllowed(ctx, allowed, host); err != nil {
+						log.Warnf("%s connection to %s failed: %v", proxyName, addr, err)
+						return nil, err
+					}
+				}
+				log.Debugf("Routing %s (%s) through WireGuard tunnel via peer %d (endpoint: %s)", hostname, ip, peerIdx, peer.Endpoint)
+				return tunnel.DialWireGuard(withDestHost(ctx, hostname), network, ip.String(), port)
+			}
+		}
+
+		// Check if this is a WireGuard IP that should be routed through the tunnel
+		if ip != nil {
+			// Use routing engine to find appropriate peer
+			peer, peerIdx := tunnel.router.Load().FindPeerForDestination(ip, portNum, clientSourcePort(ctx), "tcp", clientExeName(ctx))
+			if peer != nil {
+				log.Debugf("Routing %s through WireGuard tunnel via peer %d (endpoint: %s)", addr, peerIdx, peer.Endpoint)
+				return tunnel.DialWireGuard(ctx, network, host, port)
+			}
+		}
+
+		// For non-WireGuard IPs, use normal dialing or chain through the upstream proxy
+		var conn net.Conn
+		if upstream != nil {
+			log.Debugf("Using upstream proxy for %s", addr)
+			// Tell an HTTP upstream that is another wrapguard where the connection has been
+			if tunnel != nil {
+				if key := tunnel.PublicKey(); key != "" {
+					ctx = withVia(ctx, append(slices.Clip(viaChain(ctx)), key))
+				}
+			}
+			conn, err = upstream(ctx, network, addr)
+		} else {
+			log.Debugf("Using normal dial for %s", addr)
+			dialer := &net.Dialer{}
+			conn, err = dialer.DialContext(ctx, network, addr)
+		}
+		if err != nil {
+			log.Debugf("%s dial failed for %s: %v", proxyName, addr, err)
+		} else {
+			log.Debugf("%s dial succeeded for %s", proxyName, addr)
+		}
+		return conn, err
+	}
+}
+
+// resolveAllowed resolves host and returns its first address inside allowed
+func resolveAllowed(ctx context.Context, allowed []netip.Prefix, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if destinationAllowed(allowed, addr.IP) {
+			return addr.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", host, errDestinationNotAllowed)
+}
+
+func (s *SOCKS5Server) Port() int {
+	return s.port
+}
+
+// Close stops accepting connections and waits for the accept loop to exit
+func (s *SOCKS5Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	proxyPorts.remove(s.port)
+	err := s.listener.Close()
+	if s.served != nil {
+		<-s.served
+	}
+	return err
+}
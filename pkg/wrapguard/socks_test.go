@@ -0,0 +1,868 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNewSOCKS5Server(t *testing.T) {
+	// Create a mock tunnel
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	if server == nil {
+		t.Fatal("NewSOCKS5Server returned nil")
+	}
+
+	if server.server == nil {
+		t.Error("SOCKS5 server is nil")
+	}
+
+	if server.listener == nil {
+		t.Error("listener is nil")
+	}
+
+	if server.tunnel != tunnel {
+		t.Error("tunnel reference not set correctly")
+	}
+
+	if server.port == 0 {
+		t.Error("port should be set to non-zero value")
+	}
+}
+
+func TestSOCKS5Server_Port(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	port := server.Port()
+	if port == 0 {
+		t.Error("Port() returned 0")
+	}
+
+	// Port should be in valid range
+	if port < 1024 || port > 65535 {
+		t.Errorf("Port() returned invalid port %d", port)
+	}
+}
+
+func TestSOCKS5Server_Close(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+
+	// Test that Close doesn't return error
+	err = server.Close()
+	if err != nil {
+		t.Errorf("Close() returned error: %v", err)
+	}
+
+	// Test multiple closes don't panic (may return error, that's OK)
+	server.Close() // Don't check error for second close as it may fail
+}
+
+func TestSOCKS5Server_Integration(t *testing.T) {
+	// This is an integration test that may not work in all test environments
+	// but tests the SOCKS5 server functionality
+
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give the server a moment to start
+	time.Sleep(50 * time.Millisecond)
+
+	// Test that we can connect to the SOCKS5 server
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+itoa(server.Port()), 1*time.Second)
+	if err != nil {
+		t.Logf("Could not connect to SOCKS5 server (may be expected in test env): %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Basic connectivity test - just ensure we can connect
+	// Full SOCKS5 protocol testing would require more complex setup
+}
+
+func TestSOCKS5Server_CustomDialer(t *testing.T) {
+	// Test the custom dialer logic in the SOCKS5 server
+	// This tests the logic but not the actual network connections
+
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	// Since we can't easily override the method, we'll test the server creation
+	// The actual dialer testing would require more complex mocking
+	server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	// Verify the server was created successfully
+	if server.server == nil {
+		t.Error("SOCKS5 server not created")
+	}
+}
+
+func TestSOCKS5Server_ListenerAddress(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	// Check that the server listens on localhost
+	addr := server.listener.Addr().(*net.TCPAddr)
+	if !addr.IP.IsLoopback() {
+		t.Errorf("server should listen on loopback interface, got %v", addr.IP)
+	}
+
+	if addr.Port == 0 {
+		t.Error("server should have a non-zero port")
+	}
+
+	// Port should match what Port() returns
+	if addr.Port != server.Port() {
+		t.Errorf("listener port %d doesn't match Port() %d", addr.Port, server.Port())
+	}
+}
+
+func TestSOCKS5Server_NilTunnel(t *testing.T) {
+	// Test behavior with nil tunnel (should not panic but may fail)
+	_, err := NewSOCKS5Server(nil, ProxyOptions{})
+
+	// This will likely panic or fail, which is acceptable behavior
+	// We just want to ensure it doesn't crash the test suite
+	if err != nil {
+		t.Logf("NewSOCKS5Server with nil tunnel failed as expected: %v", err)
+	}
+}
+
+func TestSOCKS5Server_PortRange(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	// Create multiple servers to test port allocation
+	servers := make([]*SOCKS5Server, 5)
+	defer func() {
+		for _, server := range servers {
+			if server != nil {
+				server.Close()
+			}
+		}
+	}()
+
+	ports := make(map[int]bool)
+
+	for i := 0; i < 5; i++ {
+		server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+		if err != nil {
+			t.Fatalf("NewSOCKS5Server %d failed: %v", i, err)
+		}
+		servers[i] = server
+
+		port := server.Port()
+		if ports[port] {
+			t.Errorf("duplicate port %d allocated", port)
+		}
+		ports[port] = true
+
+		// Each server should get a different port
+		if port < 1024 || port > 65535 {
+			t.Errorf("invalid port %d allocated", port)
+		}
+	}
+}
+
+func TestSOCKS5Server_ServerRunning(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	// Give server time to start
+	time.Sleep(10 * time.Millisecond)
+
+	// Test that the server is actually listening
+	listener := server.listener
+	if listener == nil {
+		t.Fatal("listener is nil")
+	}
+
+	addr := listener.Addr()
+	if addr == nil {
+		t.Fatal("listener address is nil")
+	}
+
+	// The server should be running (we can't easily test the Serve goroutine
+	// without complex setup, but we can verify the listener is active)
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		t.Fatalf("listener address is not TCP: %T", addr)
+	}
+
+	if tcpAddr.Port == 0 {
+		t.Error("listener has no port assigned")
+	}
+}
+
+// Helper function to parse IP addresses for testing
+func mustParseIPAddr(s string) netip.Addr {
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		panic("invalid IP: " + s + " - " + err.Error())
+	}
+	return ip
+}
+
+// Helper function to convert int to string (simple implementation)
+func itoa(i int) string {
+	if i == 0 {
+		return "0"
+	}
+
+	negative := false
+	if i < 0 {
+		negative = true
+		i = -i
+	}
+
+	var digits []byte
+	for i > 0 {
+		digits = append([]byte{byte('0' + i%10)}, digits...)
+		i /= 10
+	}
+
+	if negative {
+		digits = append([]byte{'-'}, digits...)
+	}
+
+	return string(digits)
+}
+
+// Test that tests the tunnel's IsWireGuardIP method with SOCKS5 context
+func TestSOCKS5_WireGuardIPDetection(t *testing.T) {
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+		want bool
+	}{
+		{"WireGuard IP", "10.150.0.5", true},
+		{"Non-WireGuard IP", "8.8.8.8", false},
+		{"Localhost", "127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("invalid IP: %s", tt.ip)
+			}
+
+			result := tunnel.IsWireGuardIP(ip)
+			if result != tt.want {
+				t.Errorf("IsWireGuardIP(%s) = %v, want %v", tt.ip, result, tt.want)
+			}
+		})
+	}
+}
+
+func TestSOCKSRuleSet_AttachesClientAddr(t *testing.T) {
+	rules := &socksRuleSet{}
+	req := &socks5.Request{
+		Command:    socks5.ConnectCommand,
+		RemoteAddr: &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 4321},
+	}
+
+	ctx, ok := rules.Allow(context.Background(), req)
+	if !ok {
+		t.Fatal("expected request to be allowed")
+	}
+
+	if addr, _ := ctx.Value(clientAddrKey{}).(string); addr != "127.0.0.1:4321" {
+		t.Errorf("expected client address 127.0.0.1:4321 in context, got %q", addr)
+	}
+}
+
+func TestSOCKSRuleSet_AttachesClientExe(t *testing.T) {
+	exeNames := newExeNameTable()
+	exeNames.record(4322, "curl")
+
+	rules := &socksRuleSet{exeNames: exeNames}
+	req := &socks5.Request{
+		Command:    socks5.ConnectCommand,
+		RemoteAddr: &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 4322},
+	}
+
+	ctx, ok := rules.Allow(context.Background(), req)
+	if !ok {
+		t.Fatal("expected request to be allowed")
+	}
+	if exeName := clientExeName(ctx); exeName != "curl" {
+		t.Errorf("expected process name curl in context, got %q", exeName)
+	}
+
+	// Each name is used for a single connection
+	ctx, _ = rules.Allow(context.Background(), req)
+	if exeName := clientExeName(ctx); exeName != "" {
+		t.Errorf("expected no process name for a reused source port, got %q", exeName)
+	}
+}
+
+func TestSOCKSRuleSet_AttachesDestHost(t *testing.T) {
+	rules := &socksRuleSet{}
+	req := &socks5.Request{
+		Command:    socks5.ConnectCommand,
+		RemoteAddr: &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 4323},
+		DestAddr:   &socks5.AddrSpec{FQDN: "git.corp.internal", IP: net.ParseIP("127.0.0.1"), Port: 443},
+	}
+
+	ctx, ok := rules.Allow(context.Background(), req)
+	if !ok {
+		t.Fatal("expected request to be allowed")
+	}
+	if hostname := destHostname(ctx); hostname != "git.corp.internal" {
+		t.Errorf("expected hostname git.corp.internal in context, got %q", hostname)
+	}
+
+	req.DestAddr = &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 443}
+	ctx, _ = rules.Allow(context.Background(), req)
+	if hostname := destHostname(ctx); hostname != "" {
+		t.Errorf("expected no hostname for an address request, got %q", hostname)
+	}
+}
+
+func TestDialLogger_IncludesPeerAddr(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelDebug, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	dialLogger(withClientAddr(context.Background(), "127.0.0.1:4321")).Debugf("dial")
+
+	if !strings.Contains(buf.String(), `"peer_addr":"127.0.0.1:4321"`) {
+		t.Errorf("expected peer_addr field in log output, got %s", buf.String())
+	}
+
+	if dialLogger(context.Background()) != logger {
+		t.Error("expected global logger when no client address is set")
+	}
+}
+
+// Benchmark test for SOCKS5 server creation
+func BenchmarkNewSOCKS5Server(b *testing.B) {
+	tunnel := &Tunnel{
+		ourIP: mustParseIPAddr("10.150.0.2"),
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server, err := NewSOCKS5Server(tunnel, ProxyOptions{})
+		if err != nil {
+			b.Fatalf("NewSOCKS5Server failed: %v", err)
+		}
+		server.Close()
+	}
+}
+
+func TestClientSourcePort(t *testing.T) {
+	if port := clientSourcePort(context.Background()); port != 0 {
+		t.Errorf("expected 0 without client address, got %d", port)
+	}
+
+	ctx := withClientAddr(context.Background(), "127.0.0.1:54321")
+	if port := clientSourcePort(ctx); port != 54321 {
+		t.Errorf("expected 54321, got %d", port)
+	}
+
+	ctx = withClientAddr(context.Background(), "not-an-address")
+	if port := clientSourcePort(ctx); port != 0 {
+		t.Errorf("expected 0 for malformed address, got %d", port)
+	}
+}
+
+// startMockDNSServer answers A queries for the given names on a loopback UDP
+// socket and returns NXDOMAIN for anything else
+func startMockDNSServer(t *testing.T, records map[string]net.IP) (string, *int32) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start mock DNS server: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var queries int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&queries, 1)
+
+			var parser dnsmessage.Parser
+			header, err := parser.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			question, err := parser.Question()
+			if err != nil {
+				continue
+			}
+
+			resp := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true},
+				Questions: []dnsmessage.Question{question},
+			}
+
+			ip, found := records[strings.TrimSuffix(question.Name.String(), ".")]
+			switch {
+			case !found:
+				resp.Header.RCode = dnsmessage.RCodeNameError
+			case question.Type == dnsmessage.TypeA:
+				var a [4]byte
+				copy(a[:], ip.To4())
+				resp.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: a},
+				}}
+			}
+
+			packed, err := resp.Pack()
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(packed, addr)
+		}
+	}()
+
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestSplitDNSConfig(t *testing.T) {
+	servers, domains := splitDNSConfig([]string{"10.0.0.1", "Corp.Internal.", "fd00::53", "", "lab"})
+
+	if !reflect.DeepEqual(servers, []string{"10.0.0.1:53", "[fd00::53]:53"}) {
+		t.Errorf("unexpected servers: %v", servers)
+	}
+	if !reflect.DeepEqual(domains, []string{"corp.internal", "lab"}) {
+		t.Errorf("unexpected domains: %v", domains)
+	}
+}
+
+func TestTunnelResolver_WireGuardDomain(t *testing.T) {
+	server, queries := startMockDNSServer(t, map[string]net.IP{
+		"db.corp.internal": net.ParseIP("10.150.0.7"),
+	})
+
+	dialer := &net.Dialer{}
+	resolver := newTunnelResolver([]string{server}, []string{"corp.internal"}, dialer.DialContext)
+
+	_, ip, err := resolver.Resolve(context.Background(), "db.corp.internal")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("10.150.0.7")) {
+		t.Errorf("expected 10.150.0.7, got %v", ip)
+	}
+	if atomic.LoadInt32(queries) == 0 {
+		t.Error("expected the query to reach the WireGuard DNS server")
+	}
+
+	// Unknown names in a WireGuard domain must not fall back to the system resolver
+	if _, _, err := resolver.Resolve(context.Background(), "missing.corp.internal"); err == nil {
+		t.Error("expected error for unknown WireGuard hostname")
+	}
+}
+
+func TestTunnelResolver_SystemFallback(t *testing.T) {
+	server, queries := startMockDNSServer(t, nil)
+
+	dialer := &net.Dialer{}
+	resolver := newTunnelResolver([]string{server}, []string{"corp.internal"}, dialer.DialContext)
+
+	_, ip, err := resolver.Resolve(context.Background(), "localhost")
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if !ip.IsLoopback() {
+		t.Errorf("expected loopback address, got %v", ip)
+	}
+	if atomic.LoadInt32(queries) != 0 {
+		t.Error("non-WireGuard hostnames should not be sent to the WireGuard DNS server")
+	}
+}
+
+func TestTunnelResolver_MatchesDomain(t *testing.T) {
+	resolver := newTunnelResolver(nil, []string{"corp.internal"}, nil)
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"corp.internal", true},
+		{"db.corp.internal", true},
+		{"DB.Corp.Internal.", true},
+		{"notcorp.internal", false},
+		{"example.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := resolver.matchesDomain(tt.name); got != tt.expected {
+			t.Errorf("matchesDomain(%q) = %v, want %v", tt.name, got, tt.expected)
+		}
+	}
+
+	// Without DNS servers every name goes to the system resolver
+	if resolver.resolver != nil {
+		t.Error("resolver should be nil without WireGuard DNS servers")
+	}
+}
+
+func TestSOCKSRuleSet_RateLimit(t *testing.T) {
+	rules := &socksRuleSet{limiter: NewRateLimiter(3)}
+	req := &socks5.Request{
+		Command:    socks5.ConnectCommand,
+		RemoteAddr: &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 4321},
+	}
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if _, ok := rules.Allow(context.Background(), req); ok {
+			allowed++
+		}
+	}
+
+	if allowed != 3 {
+		t.Errorf("expected 3 connections within the burst, got %d", allowed)
+	}
+}
+
+func TestSOCKS5Server_RateLimitReply(t *testing.T) {
+	server, err := NewSOCKS5Server(newTestRoutingTunnel(), ProxyOptions{MaxConnRate: 5})
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	// socksConnect performs a SOCKS5 CONNECT and returns the reply code
+	socksConnect := func() byte {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("failed to connect to SOCKS5 server: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		conn.Write([]byte{0x05, 0x01, 0x00})
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			t.Fatalf("failed to read greeting: %v", err)
+		}
+
+		request := []byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(targetPort >> 8), byte(targetPort)}
+		conn.Write(request)
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		return reply[1]
+	}
+
+	succeeded, rejected := 0, 0
+	for i := 0; i < 15; i++ {
+		switch code := socksConnect(); code {
+		case 0x00:
+			succeeded++
+		case 0x02:
+			rejected++
+		default:
+			t.Errorf("unexpected SOCKS5 reply code %#x", code)
+		}
+	}
+
+	// The burst of 5 is allowed, plus at most a refill or two during the loop
+	if succeeded < 5 || succeeded > 7 {
+		t.Errorf("expected 5-7 successful connections, got %d", succeeded)
+	}
+	if rejected == 0 {
+		t.Error("expected connections over the rate to be rejected with 0x02")
+	}
+}
+
+func TestDestinationAllowed(t *testing.T) {
+	if !destinationAllowed(nil, net.ParseIP("8.8.8.8")) {
+		t.Error("everything should be allowed without an allowlist")
+	}
+
+	allowed := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.1.2.3", true},
+		{"192.168.5.5", true},
+		{"::ffff:10.0.0.1", true},
+		{"fd12::1", true},
+		{"8.8.8.8", false},
+		{"172.16.0.1", false},
+		{"2001:db8::1", false},
+	}
+
+	for _, tt := range tests {
+		if got := destinationAllowed(allowed, net.ParseIP(tt.ip)); got != tt.allowed {
+			t.Errorf("destinationAllowed(%s) = %v, want %v", tt.ip, got, tt.allowed)
+		}
+	}
+
+	if destinationAllowed(allowed, nil) {
+		t.Error("nil IP should not be allowed with an allowlist")
+	}
+}
+
+func TestSOCKS5Server_AllowNetwork(t *testing.T) {
+	opts := ProxyOptions{AllowedNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}}
+	server, err := NewSOCKS5Server(newTestRoutingTunnel(), opts)
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	// Listen on all loopback addresses so that only the allowlist decides
+	target, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	socksConnect := func(ip net.IP) byte {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("failed to connect to SOCKS5 server: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		conn.Write([]byte{0x05, 0x01, 0x00})
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			t.Fatalf("failed to read greeting: %v", err)
+		}
+
+		request := append([]byte{0x05, 0x01, 0x00, 0x01}, ip.To4()...)
+		request = append(request, byte(targetPort>>8), byte(targetPort))
+		conn.Write(request)
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		return reply[1]
+	}
+
+	if code := socksConnect(net.IPv4(127, 0, 0, 1)); code != 0x00 {
+		t.Errorf("expected allowed destination to succeed, got reply %#x", code)
+	}
+	if code := socksConnect(net.IPv4(127, 0, 0, 2)); code != 0x02 {
+		t.Errorf("expected blocked destination to be rejected with 0x02, got %#x", code)
+	}
+}
+
+func TestTunnelDialer_AllowNetwork(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echoAddr)
+
+	dial := newTunnelDialer(newTestRoutingTunnel(), "test", []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}, nil)
+
+	// Hostnames are resolved and checked before dialing
+	conn, err := dial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("expected localhost to be allowed: %v", err)
+	}
+	conn.Close()
+
+	_, err = dial(context.Background(), "tcp", "8.8.8.8:53")
+	if !errors.Is(err, errDestinationNotAllowed) {
+		t.Errorf("expected errDestinationNotAllowed for blocked IP, got %v", err)
+	}
+
+	dial = newTunnelDialer(newTestRoutingTunnel(), "test", []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, nil)
+	_, err = dial(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if !errors.Is(err, errDestinationNotAllowed) {
+		t.Errorf("expected errDestinationNotAllowed for blocked hostname, got %v", err)
+	}
+}
+
+func TestTunnelDialer_SNIPattern(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelDebug, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	echoAddr := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echoAddr)
+
+	corp, _ := ParseRoutingPolicy("0.0.0.0/0:tcp:any:any::*.corp.internal", 0)
+	local, _ := ParseRoutingPolicy("0.0.0.0/0:tcp:any:any::localhost", 0)
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{Address: []string{"10.150.0.2/24"}},
+		Peers: []PeerConfig{
+			{PublicKey: "corp", RoutingPolicies: []RoutingPolicy{*corp, *local}},
+			{PublicKey: "default", AllowedIPs: []string{"0.0.0.0/0"}},
+		},
+	}
+	tunnel := newTestRoutingTunnel()
+	tunnel.config.Store(config)
+	tunnel.router.Store(NewRoutingEngine(config, RoutingOptions{}))
+	dial := newTunnelDialer(tunnel, "test", nil, nil)
+
+	tests := []struct {
+		name     string
+		hostname string
+		addr     string
+		expected string
+	}{
+		// SOCKS5 resolves the name before dialing and passes it in the context
+		{"corp hostname", "git.corp.internal", echoAddr, "through peer 0"},
+		{"other hostname", "example.com", echoAddr, "through peer 1"},
+		// The HTTP CONNECT proxy dials the hostname itself
+		{"unresolved hostname", "", net.JoinHostPort("localhost", port), "through peer 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf.Reset()
+			ctx := context.Background()
+			if test.hostname != "" {
+				ctx = withDestHost(ctx, test.hostname)
+			}
+
+			conn, err := dial(ctx, "tcp", test.addr)
+			if err != nil {
+				t.Fatalf("dial failed: %v", err)
+			}
+			conn.Close()
+
+			if !strings.Contains(buf.String(), "WireGuard tunnel: routing 127.0.0.1:"+port+" "+test.expected+" ") {
+				t.Errorf("expected the connection to be routed %s:\n%s", test.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestTunnelDialer_SplitTunnel(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelDebug, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	echoAddr := startEchoServer(t)
+
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{Address: []string{"10.150.0.2/24"}},
+		Peers:     []PeerConfig{{PublicKey: "vpn", AllowedIPs: []string{"0.0.0.0/0"}}},
+	}
+	tunnel := newTestRoutingTunnel()
+	tunnel.config.Store(config)
+
+	tunnel.router.Store(NewRoutingEngine(config, RoutingOptions{SplitTunnel: true}))
+
+	conn, err := newTunnelDialer(tunnel, "test", nil, nil)(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	conn.Close()
+
+	if !strings.Contains(buf.String(), "Using normal dial for "+echoAddr) {
+		t.Errorf("expected a direct dial for a destination only covered by 0.0.0.0/0:\n%s", buf.String())
+	}
+	if strings.Contains(buf.String(), "through WireGuard tunnel") {
+		t.Errorf("expected the tunnel to be bypassed:\n%s", buf.String())
+	}
+}
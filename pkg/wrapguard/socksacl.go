@@ -0,0 +1,78 @@
+package wrapguard
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// proxyPorts holds the loopback ports of wrapguard's own proxy servers, to
+// which the child can never connect through the SOCKS5 proxy
+var proxyPorts = &portSet{}
+
+// portSet is a set of ports safe for concurrent use
+type portSet struct {
+	mutex sync.RWMutex
+	ports map[int]bool
+}
+
+func (s *portSet) add(port int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ports == nil {
+		s.ports = make(map[int]bool)
+	}
+	s.ports[port] = true
+}
+
+func (s *portSet) remove(port int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.ports, port)
+}
+
+func (s *portSet) contains(port int) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.ports[port]
+}
+
+// denyReason returns why a SOCKS5 destination is blocked, or "" if it is
+// not. fqdn is the hostname the client asked for, if any, and ip the address
+// it resolved to.
+func (r *socksRuleSet) denyReason(fqdn string, ip net.IP, port int) string {
+	if ip != nil && (ip.IsLoopback() || ip.IsUnspecified()) && proxyPorts.contains(port) {
+		return "connection to wrapguard's own proxy"
+	}
+
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		addr = addr.Unmap()
+		for _, prefix := range r.denyNetworks {
+			if prefix.Contains(addr) {
+				return "denied network " + prefix.String()
+			}
+		}
+	}
+
+	if fqdn != "" {
+		for _, pattern := range r.denyHosts {
+			if matchHostPattern(pattern, fqdn) {
+				return "denied host " + pattern
+			}
+		}
+	}
+	return ""
+}
+
+// matchHostPattern reports whether host matches pattern, ignoring case and
+// any trailing dot. A leading "*." matches any subdomain, but not the domain
+// itself.
+func matchHostPattern(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return host == pattern
+}
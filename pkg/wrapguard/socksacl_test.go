@@ -0,0 +1,182 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/armon/go-socks5"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		expected      bool
+	}{
+		{"*.internal.corp", "db.internal.corp", true},
+		{"*.internal.corp", "a.b.internal.corp", true},
+		{"*.internal.corp", "DB.Internal.Corp.", true},
+		{"*.internal.corp", "internal.corp", false},
+		{"*.internal.corp", "notinternal.corp", false},
+		{"metadata.google.internal", "metadata.google.internal", true},
+		{"metadata.google.internal", "x.metadata.google.internal", false},
+	}
+	for _, tt := range tests {
+		if got := matchHostPattern(tt.pattern, tt.host); got != tt.expected {
+			t.Errorf("matchHostPattern(%q, %q) = %v, expected %v", tt.pattern, tt.host, got, tt.expected)
+		}
+	}
+}
+
+func TestSOCKSRuleSet_DenyReason(t *testing.T) {
+	rules := &socksRuleSet{
+		denyNetworks: []netip.Prefix{netip.MustParsePrefix("169.254.0.0/16"), netip.MustParsePrefix("::1/128")},
+		denyHosts:    []string{"*.internal.corp"},
+	}
+
+	proxyPorts.add(1)
+	defer proxyPorts.remove(1)
+
+	tests := []struct {
+		name   string
+		fqdn   string
+		ip     string
+		port   int
+		reason string
+	}{
+		{"denied IPv4 network", "", "169.254.169.254", 80, "denied network 169.254.0.0/16"},
+		{"denied IPv6 network", "", "::1", 80, "denied network ::1/128"},
+		{"denied host", "db.internal.corp", "10.0.0.5", 5432, "denied host *.internal.corp"},
+		{"own proxy port", "", "127.0.0.1", 1, "connection to wrapguard's own proxy"},
+		{"own proxy port on any address", "", "0.0.0.0", 1, "connection to wrapguard's own proxy"},
+		{"other loopback port", "", "127.0.0.1", 2, ""},
+		{"allowed", "example.com", "93.184.216.34", 443, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.denyReason(tt.fqdn, net.ParseIP(tt.ip), tt.port); got != tt.reason {
+				t.Errorf("expected reason %q, got %q", tt.reason, got)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Server_DenyRules(t *testing.T) {
+	opts := ProxyOptions{
+		DenyNetworks: []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32")},
+		DenyHosts:    []string{"localhost"},
+	}
+	server, err := NewSOCKS5Server(newTestRoutingTunnel(), opts)
+	if err != nil {
+		t.Fatalf("NewSOCKS5Server failed: %v", err)
+	}
+	defer server.Close()
+
+	target, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	// socksConnect sends a CONNECT for address, given as SOCKS5 address
+	// type and bytes, and returns the reply code
+	socksConnect := func(addrType byte, addr []byte, port int) byte {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", server.Port()))
+		if err != nil {
+			t.Fatalf("failed to connect to SOCKS5 server: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+		conn.Write([]byte{0x05, 0x01, 0x00})
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			t.Fatalf("failed to read greeting: %v", err)
+		}
+
+		request := append([]byte{0x05, 0x01, 0x00, addrType}, addr...)
+		request = append(request, byte(port>>8), byte(port))
+		conn.Write(request)
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatalf("failed to read reply: %v", err)
+		}
+		return reply[1]
+	}
+	ipv4 := func(ip net.IP) []byte { return ip.To4() }
+	fqdn := func(host string) []byte { return append([]byte{byte(len(host))}, host...) }
+
+	if code := socksConnect(0x01, ipv4(net.IPv4(127, 0, 0, 1)), targetPort); code != 0x00 {
+		t.Errorf("expected an allowed destination to succeed, got %#x", code)
+	}
+	if code := socksConnect(0x01, ipv4(net.IPv4(127, 0, 0, 2)), targetPort); code != 0x02 {
+		t.Errorf("expected a denied network to be rejected with 0x02, got %#x", code)
+	}
+	if code := socksConnect(0x03, fqdn("localhost"), targetPort); code != 0x02 {
+		t.Errorf("expected a denied host to be rejected with 0x02, got %#x", code)
+	}
+	if code := socksConnect(0x01, ipv4(net.IPv4(127, 0, 0, 1)), server.Port()); code != 0x02 {
+		t.Errorf("expected a connection to the proxy itself to be rejected with 0x02, got %#x", code)
+	}
+
+	// Once closed, the port is no longer treated as wrapguard's own
+	port := server.Port()
+	server.Close()
+	if proxyPorts.contains(port) {
+		t.Error("expected the port to be released on Close")
+	}
+}
+
+func TestHTTPConnectServer_RegistersProxyPort(t *testing.T) {
+	server, err := NewHTTPConnectServer(newTestRoutingTunnel(), ProxyOptions{})
+	if err != nil {
+		t.Fatalf("NewHTTPConnectServer failed: %v", err)
+	}
+	if !proxyPorts.contains(server.Port()) {
+		t.Error("expected the HTTP proxy port to be blocked for SOCKS5 clients")
+	}
+	server.Close()
+	if proxyPorts.contains(server.Port()) {
+		t.Error("expected the port to be released on Close")
+	}
+}
+
+func TestSOCKSRuleSet_DenyLogs(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelWarn, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	exeNames := newExeNameTable()
+	exeNames.record(4321, "curl")
+	rules := &socksRuleSet{exeNames: exeNames, denyNetworks: []netip.Prefix{netip.MustParsePrefix("169.254.0.0/16")}}
+	_, ok := rules.Allow(context.Background(), &socks5.Request{
+		Command:    socks5.ConnectCommand,
+		RemoteAddr: &socks5.AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 4321},
+		DestAddr:   &socks5.AddrSpec{IP: net.ParseIP("169.254.169.254"), Port: 80},
+	})
+	if ok {
+		t.Fatal("expected the denied destination to be rejected")
+	}
+
+	for _, expected := range []string{`"level":"warn"`, `"destination":"169.254.169.254:80"`, `"peer_addr":"127.0.0.1:4321"`, `"exe_name":"curl"`, "denied network 169.254.0.0/16"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("expected %s in the warning, got:\n%s", expected, buf.String())
+		}
+	}
+}
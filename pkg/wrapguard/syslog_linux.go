@@ -0,0 +1,88 @@
+package wrapguard
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// SyslogFacility is a syslog facility, such as syslog.LOG_DAEMON
+type SyslogFacility = syslog.Priority
+
+// syslogFacilities maps facility names, as used by --syslog-facility, to
+// their syslog priorities
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// ParseSyslogFacility returns the syslog facility with the given name, such
+// as "daemon" or "local0"
+func ParseSyslogFacility(name string) (SyslogFacility, error) {
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("invalid syslog facility: %s", name)
+	}
+	return facility, nil
+}
+
+// NewSyslogLogger returns a logger that sends its JSON entries to the local
+// syslog daemon, with each entry's level mapped to the syslog severity
+func NewSyslogLogger(level LogLevel, facility SyslogFacility, tag string) (*Logger, error) {
+	return newSyslogLogger("", "", level, facility, tag)
+}
+
+// newSyslogLogger connects to the syslog daemon at raddr over network, or to
+// the local daemon when both are empty
+func newSyslogLogger(network, raddr string, level LogLevel, facility SyslogFacility, tag string) (*Logger, error) {
+	writer, err := syslog.Dial(network, raddr, facility|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return NewLogger(level, &syslogOutput{writer: writer}), nil
+}
+
+// syslogOutput writes log entries to syslog at the severity of their level
+type syslogOutput struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogOutput) WriteLevel(level LogLevel, entry []byte) error {
+	message := string(entry)
+	switch level {
+	case LogLevelError:
+		return s.writer.Err(message)
+	case LogLevelWarn:
+		return s.writer.Warning(message)
+	case LogLevelInfo:
+		return s.writer.Info(message)
+	default:
+		return s.writer.Debug(message)
+	}
+}
+
+// Write sends entries that carry no level at informational severity
+func (s *syslogOutput) Write(p []byte) (int, error) {
+	if err := s.writer.Info(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
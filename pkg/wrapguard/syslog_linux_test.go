@@ -0,0 +1,129 @@
+package wrapguard
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenSyslog starts a UDP listener standing in for a syslog daemon
+func listenSyslog(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readSyslog returns the next message received by the listener
+func readSyslog(t *testing.T, conn *net.UDPConn) string {
+	t.Helper()
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no syslog message received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSyslogLogger_Severities(t *testing.T) {
+	conn := listenSyslog(t)
+
+	logger, err := newSyslogLogger("udp", conn.LocalAddr().String(), LogLevelDebug, syslog.LOG_DAEMON, "wrapguard-test")
+	if err != nil {
+		t.Fatalf("newSyslogLogger failed: %v", err)
+	}
+
+	// The priority is facility*8 + severity; daemon is facility 3
+	tests := []struct {
+		log      func(format string, args ...interface{})
+		priority string
+		level    string
+	}{
+		{logger.Errorf, "<27>", "error"},
+		{logger.Warnf, "<28>", "warn"},
+		{logger.Infof, "<30>", "info"},
+		{logger.Debugf, "<31>", "debug"},
+	}
+
+	for _, tt := range tests {
+		tt.log("tunnel %s", "up")
+		message := readSyslog(t, conn)
+
+		if !strings.HasPrefix(message, tt.priority) {
+			t.Errorf("%s: expected priority %s, got %q", tt.level, tt.priority, message)
+		}
+		if !strings.Contains(message, "wrapguard-test[") {
+			t.Errorf("%s: expected tag in %q", tt.level, message)
+		}
+
+		// The message body is the usual JSON entry
+		body := strings.TrimSpace(message[strings.Index(message, "{"):])
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(body), &entry); err != nil {
+			t.Errorf("%s: body is not a JSON entry: %q", tt.level, body)
+			continue
+		}
+		if entry.Level != tt.level || entry.Message != "tunnel up" {
+			t.Errorf("%s: unexpected entry %+v", tt.level, entry)
+		}
+	}
+}
+
+func TestSyslogLogger_FiltersLevel(t *testing.T) {
+	conn := listenSyslog(t)
+
+	logger, err := newSyslogLogger("udp", conn.LocalAddr().String(), LogLevelWarn, syslog.LOG_LOCAL0, "wrapguard-test")
+	if err != nil {
+		t.Fatalf("newSyslogLogger failed: %v", err)
+	}
+
+	logger.Infof("not sent")
+	logger.WithFields(map[string]interface{}{"port": 8080}).Warnf("sent")
+
+	message := readSyslog(t, conn)
+	if strings.Contains(message, "not sent") {
+		t.Fatalf("entry below the log level was sent: %q", message)
+	}
+	// local0 is facility 16, warning severity 4
+	if !strings.HasPrefix(message, "<132>") || !strings.Contains(message, `"fields":{"port":8080}`) {
+		t.Errorf("unexpected message %q", message)
+	}
+}
+
+func TestParseSyslogFacility(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected syslog.Priority
+		hasError bool
+	}{
+		{"daemon", syslog.LOG_DAEMON, false},
+		{"LOCAL7", syslog.LOG_LOCAL7, false},
+		{"user", syslog.LOG_USER, false},
+		{"bogus", 0, true},
+		{"", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			facility, err := ParseSyslogFacility(tt.name)
+			if tt.hasError {
+				if err == nil {
+					t.Errorf("expected error for %q", tt.name)
+				}
+				return
+			}
+			if err != nil || facility != tt.expected {
+				t.Errorf("expected %v, got %v (err %v)", tt.expected, facility, err)
+			}
+		})
+	}
+}
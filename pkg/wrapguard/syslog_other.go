@@ -0,0 +1,19 @@
+//go:build !linux
+
+package wrapguard
+
+import "errors"
+
+// SyslogFacility is a syslog facility. log/syslog does not exist on every
+// platform, so this is a plain number outside Linux.
+type SyslogFacility int
+
+// ParseSyslogFacility reports that syslog output is only supported on Linux
+func ParseSyslogFacility(name string) (SyslogFacility, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// NewSyslogLogger reports that syslog output is only supported on Linux
+func NewSyslogLogger(level LogLevel, facility SyslogFacility, tag string) (*Logger, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,1255 @@
+package wrapguard
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+type Tunnel struct {
+	device     *device.Device
+	tun        *MemoryTUN
+	ourIP      netip.Addr
+	connMap    map[string]*TunnelConn
+	mutex      sync.RWMutex
+	resetMutex sync.Mutex                      // Serialises Reset, Suspend, Resume and Close
+	suspended  bool                            // Device taken down by Suspend
+	connected  atomic.Bool                     // Set at the first handshake, for the on-disconnected hook
+	router     atomic.Pointer[RoutingEngine]   // Swapped as a whole by ReloadRoutes
+	config     atomic.Pointer[WireGuardConfig] // Replaced, never modified, by Reload and the endpoint refresh
+	fragments  fragmentBuffer                  // Incoming IPv4 fragments awaiting reassembly
+	events     chan TunnelEvent                // Created by the first Events call
+	eventsOnce sync.Once
+	eventsCtx  context.Context    // Stops the event poller
+	stopEvents context.CancelFunc // Called by Close
+	log        *Logger            // Routing warnings go here, or to the global logger if nil
+	options    TunnelOptions
+}
+
+type TunnelConn struct {
+	localAddr   net.Addr
+	remoteAddr  net.Addr
+	readChan    chan []byte
+	writeChan   chan []byte
+	closed      bool
+	mss         uint16 // Peer MSS from the SYN-ACK, 0 if not seen
+	windowScale uint8  // Peer window scale shift from the SYN-ACK, 0 if not seen
+	mutex       sync.RWMutex
+}
+
+// MemoryTUN implements tun.Device for userspace packet handling
+type MemoryTUN struct {
+	inbound  *packetRing
+	outbound chan []byte
+	mtu      atomic.Int32 // Changed by SetMTU while WireGuard runs
+	name     string
+	events   chan tun.Event
+	closed   bool
+	mutex    sync.RWMutex
+	tunnel   *Tunnel
+	impair   impairer // Simulated delay and loss, in debug builds only
+	counters memoryTUNCounters
+}
+
+// MemoryTUNMetrics counts the packets a MemoryTUN has passed. Inbound
+// packets are those WireGuard read from the TUN to encrypt and send to a
+// peer. Outbound packets are those it decrypted and wrote to the TUN.
+// DroppedPackets counts packets lost because a queue was full, in either
+// direction.
+type MemoryTUNMetrics struct {
+	InboundPackets  uint64
+	InboundBytes    uint64
+	OutboundPackets uint64
+	OutboundBytes   uint64
+	DroppedPackets  uint64
+}
+
+// memoryTUNCounters holds the live counts behind MemoryTUNMetrics
+type memoryTUNCounters struct {
+	inboundPackets  atomic.Uint64
+	inboundBytes    atomic.Uint64
+	outboundPackets atomic.Uint64
+	outboundBytes   atomic.Uint64
+	droppedPackets  atomic.Uint64
+}
+
+func NewMemoryTUN(name string, mtu int) *MemoryTUN {
+	m := &MemoryTUN{
+		inbound:  newPacketRing(),
+		outbound: make(chan []byte, 100),
+		name:     name,
+		events:   make(chan tun.Event, 10),
+		impair:   newImpairer(Impairment{}),
+	}
+	m.mtu.Store(int32(mtu))
+	return m
+}
+
+func (m *MemoryTUN) File() *os.File { return nil }
+
+// Read blocks until WireGuard has a packet to send and copies it into buf
+// starting at offset. A packet that does not fit after offset is dropped with
+// io.ErrShortBuffer.
+func (m *MemoryTUN) Read(buf []byte, offset int) (int, error) {
+	if offset < 0 || offset >= len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+
+	n, err := m.inbound.pop(buf[offset:])
+	if err != nil {
+		return 0, err
+	}
+	m.counters.inboundPackets.Add(1)
+	m.counters.inboundBytes.Add(uint64(n))
+	return n, nil
+}
+
+// Write hands the packet in buf[offset:] from WireGuard to the tunnel
+func (m *MemoryTUN) Write(buf []byte, offset int) (int, error) {
+	if offset < 0 || offset >= len(buf) {
+		return 0, io.ErrShortBuffer
+	}
+
+	// Hold the lock until the packet is queued so Close cannot close the
+	// channel underneath the send
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.closed {
+		return 0, fmt.Errorf("TUN closed")
+	}
+
+	packet := make([]byte, len(buf)-offset)
+	copy(packet, buf[offset:])
+
+	// Handle incoming packets from WireGuard
+	if m.tunnel != nil {
+		go m.tunnel.handleIncomingPacket(packet)
+	}
+
+	m.counters.outboundPackets.Add(1)
+	m.counters.outboundBytes.Add(uint64(len(packet)))
+
+	select {
+	case m.outbound <- packet:
+	default:
+		// Drop if full
+		m.counters.droppedPackets.Add(1)
+	}
+
+	return len(packet), nil
+}
+
+// Metrics returns the packet counts since the TUN was created
+func (m *MemoryTUN) Metrics() MemoryTUNMetrics {
+	return MemoryTUNMetrics{
+		InboundPackets:  m.counters.inboundPackets.Load(),
+		InboundBytes:    m.counters.inboundBytes.Load(),
+		OutboundPackets: m.counters.outboundPackets.Load(),
+		OutboundBytes:   m.counters.outboundBytes.Load(),
+		DroppedPackets:  m.counters.droppedPackets.Load(),
+	}
+}
+
+// InjectInbound queues a single packet for WireGuard to encrypt and send. In
+// debug builds the packet may be delayed or dropped to simulate a poor
+// network; see TunnelOptions.Impairment.
+func (m *MemoryTUN) InjectInbound(packet []byte) error {
+	if delay, drop, ok := m.impair.impairment(); ok {
+		if drop {
+			return nil
+		}
+		buf := make([]byte, len(packet))
+		copy(buf, packet)
+		time.AfterFunc(delay, func() { m.InjectBatch([][]byte{buf}) })
+		return nil
+	}
+	return m.InjectBatch([][]byte{packet})
+}
+
+// InjectBatch queues several packets for WireGuard in a single pass, taking
+// the lock once for the whole batch. Packets are copied into the queue's
+// preallocated slots so callers may reuse their buffers. If the queue fills
+// up, the remaining packets are dropped.
+func (m *MemoryTUN) InjectBatch(packets [][]byte) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.closed {
+		return fmt.Errorf("TUN closed")
+	}
+
+	for i, packet := range packets {
+		if len(packet) > packetRingSlotSize {
+			m.counters.droppedPackets.Add(uint64(len(packets) - i))
+			return fmt.Errorf("packet of %d bytes is larger than %d, dropped %d of %d packets", len(packet), packetRingSlotSize, len(packets)-i, len(packets))
+		}
+		if !m.inbound.push(packet) {
+			m.counters.droppedPackets.Add(uint64(len(packets) - i))
+			return fmt.Errorf("TUN inbound queue full, dropped %d of %d packets", len(packets)-i, len(packets))
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryTUN) Flush() error             { return nil }
+func (m *MemoryTUN) MTU() (int, error)        { return int(m.mtu.Load()), nil }
+func (m *MemoryTUN) Name() (string, error)    { return m.name, nil }
+func (m *MemoryTUN) Events() <-chan tun.Event { return m.events }
+
+// SetMTU changes the MTU and tells WireGuard to read it again
+func (m *MemoryTUN) SetMTU(mtu int) {
+	m.mtu.Store(int32(mtu))
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.events <- tun.EventMTUUpdate:
+	default:
+		// WireGuard has updates queued and reads the latest MTU for them
+	}
+}
+
+func (m *MemoryTUN) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		m.inbound.close()
+		close(m.outbound)
+		close(m.events)
+	}
+	return nil
+}
+
+// TunnelOptions configures NewTunnel with what does not come from the
+// WireGuard config. The zero value runs no hooks and logs only WireGuard's
+// errors.
+type TunnelOptions struct {
+	// Routing configures the tunnel's routing engine
+	Routing RoutingOptions
+
+	// Verbose passes wireguard-go's verbose messages, such as each handshake
+	// sent and received, to the log at debug level
+	Verbose bool
+
+	// LogHandshakes writes a structured entry at info level for every
+	// WireGuard handshake message sent or received, naming the peer, as an
+	// audit record
+	LogHandshakes bool
+
+	// OnConnected and OnDisconnected are shell commands run in the
+	// background when the tunnel completes its first handshake and when it
+	// is closed after doing so. Empty disables the hook.
+	OnConnected    string
+	OnDisconnected string
+
+	// Impairment degrades the packets handed to WireGuard, in debug builds
+	// only
+	Impairment Impairment
+}
+
+// Impairment simulates a poor network for tests: each packet injected into
+// the tunnel is delayed by Latency plus a random offset of up to Jitter
+// either way, and dropped with probability PacketLoss. Release builds
+// ignore it.
+type Impairment struct {
+	Latency    time.Duration
+	Jitter     time.Duration
+	PacketLoss float64
+}
+
+func NewTunnel(ctx context.Context, config *WireGuardConfig, opts TunnelOptions) (*Tunnel, error) {
+	// Get our WireGuard IP
+	ourIP, err := config.GetInterfaceIP()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse interface IP: %w", err)
+	}
+
+	// Create memory TUN
+	memTun := NewMemoryTUN("wg0", tunnelMTU(config))
+	memTun.impair = newImpairer(opts.Impairment)
+
+	tunnel := &Tunnel{
+		tun:     memTun,
+		ourIP:   ourIP,
+		connMap: make(map[string]*TunnelConn),
+		options: opts,
+	}
+	tunnel.config.Store(config)
+	tunnel.loadRoutes(config)
+
+	// Set tunnel reference in TUN for packet handling
+	memTun.tunnel = tunnel
+
+	dev, err := startDevice(memTun, config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel.device = dev
+
+	// Run PostUp hooks once the device is up, tearing down on failure like wg-quick
+	if err := runHooks("PostUp", config.Interface.PostUp, ourIP); err != nil {
+		dev.Close()
+		return nil, err
+	}
+
+	if opts.OnConnected != "" || opts.OnDisconnected != "" {
+		tunnel.watchFirstHandshake(ctx, opts.OnConnected)
+	}
+	tunnel.eventsCtx, tunnel.stopEvents = context.WithCancel(ctx)
+
+	return tunnel, nil
+}
+
+// newDeviceLogger returns a wireguard-go logger that writes to the current
+// global logger, prefixing each message with "WireGuard: ". Verbose messages
+// and the handshakes with config's peers are logged as opts asks; errors are
+// always logged. The device's goroutines can log after Close returns, so the
+// logger is fixed here.
+func newDeviceLogger(config *WireGuardConfig, opts TunnelOptions) *device.Logger {
+	log := logger
+	wgLogger := &device.Logger{
+		Verbosef: device.DiscardLogf,
+		Errorf: func(format string, args ...any) {
+			log.Errorf("WireGuard: "+format, args...)
+		},
+	}
+	if opts.Verbose {
+		wgLogger.Verbosef = func(format string, args ...any) {
+			log.Debugf("WireGuard: "+format, args...)
+		}
+	}
+	if opts.LogHandshakes {
+		return NewHandshakeLogger(wgLogger, log, config.Peers).DeviceLogger()
+	}
+	return wgLogger
+}
+
+// startDevice creates a WireGuard device on top of memTun, configures it and
+// brings it up
+func startDevice(memTun *MemoryTUN, config *WireGuardConfig, opts TunnelOptions) (*device.Device, error) {
+	// Create WireGuard device
+	dev := device.NewDevice(memTun, conn.NewDefaultBind(), newDeviceLogger(config, opts))
+
+	// Configure device
+	if err := configureDevice(dev, config); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to configure device: %w", err)
+	}
+
+	// Bring device up
+	if err := dev.Up(); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to bring device up: %w", err)
+	}
+
+	return dev, nil
+}
+
+// Reset tears down the WireGuard device and brings up a fresh one from the
+// same config, forcing a new handshake after the peer became unreachable.
+// The Tunnel itself is kept, so proxy servers and the child process continue
+// to use it without interruption. The new device is brought up before the
+// old one is closed, so a failed Reset leaves the tunnel as it was.
+func (t *Tunnel) Reset(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	logger.Warnf("Resetting WireGuard tunnel")
+
+	t.resetMutex.Lock()
+	defer t.resetMutex.Unlock()
+
+	t.mutex.RLock()
+	oldDevice, oldTun := t.device, t.tun
+	t.mutex.RUnlock()
+
+	config := t.config.Load()
+
+	// Keep an MTU changed by SetMTU
+	mtu := tunnelMTU(config)
+	if oldTun != nil {
+		mtu, _ = oldTun.MTU()
+	}
+	memTun := NewMemoryTUN("wg0", mtu)
+	memTun.impair = newImpairer(t.options.Impairment)
+	memTun.tunnel = t
+
+	// The old device still holds a fixed ListenPort, so the new one starts
+	// on a random port and takes the fixed one over once the old is closed
+	startConfig := *config
+	startConfig.Interface.ListenPort = 0
+	dev, err := startDevice(memTun, &startConfig, t.options)
+	if err != nil {
+		memTun.Close()
+		return fmt.Errorf("failed to reset tunnel: %w", err)
+	}
+
+	t.mutex.Lock()
+	t.device, t.tun = dev, memTun
+	t.mutex.Unlock()
+	t.suspended = false
+
+	if oldDevice != nil {
+		oldDevice.Close()
+	}
+	if oldTun != nil {
+		oldTun.Close()
+	}
+
+	if port := config.Interface.ListenPort; port > 0 {
+		if err := dev.IpcSet(fmt.Sprintf("listen_port=%d\n", port)); err != nil {
+			return fmt.Errorf("failed to reset tunnel: the new device runs on a random port: %w", err)
+		}
+	}
+
+	logger.Warnf("WireGuard tunnel reset completed in %v", time.Since(start))
+	return nil
+}
+
+// ReloadRoutes rebuilds the routing engine from config and swaps it in, so
+// that changed AllowedIPs and Route entries apply without restarting the
+// tunnel. Lookups already in progress finish on the previous engine.
+func (t *Tunnel) ReloadRoutes(config *WireGuardConfig) {
+	t.loadRoutes(config)
+}
+
+// Reload applies a re-read config to the running tunnel without dropping
+// connections to peers that did not change: peers are added, removed and
+// updated on the device, the routing engine is rebuilt and the changes are
+// logged with LogConfigDiff. A new MTU is applied with SetMTU; other
+// changes to the [Interface] section need a restart, and are logged and
+// otherwise ignored.
+func (t *Tunnel) Reload(config *WireGuardConfig) error {
+	// Serialise with Reset and the endpoint refresh, which read the config
+	t.resetMutex.Lock()
+	defer t.resetMutex.Unlock()
+
+	if t.device == nil {
+		return fmt.Errorf("tunnel closed")
+	}
+
+	old := t.config.Load()
+	diff := DiffConfigs(old, config)
+	next := *config
+	next.Interface = old.Interface
+	if diff.InterfaceChanged {
+		if config.Interface.MTU != old.Interface.MTU {
+			t.tun.SetMTU(tunnelMTU(config))
+			next.Interface.MTU = config.Interface.MTU
+		}
+		changed := slices.DeleteFunc(interfaceChanges(old.Interface, config.Interface), func(name string) bool { return name == "MTU" })
+		if len(changed) > 0 {
+			logger.Warnf("Config reload: changes to %s need a restart to apply", strings.Join(changed, ", "))
+		}
+	}
+
+	var ipcConfig string
+	for _, peer := range diff.PeersRemoved {
+		ipcConfig += fmt.Sprintf("public_key=%s\nremove=true\n", peer.PublicKey)
+	}
+	for _, peer := range diff.PeersAdded {
+		ipcConfig += peerIPCConfig(peer)
+	}
+	for _, peerDiff := range diff.PeersModified {
+		ipcConfig += peerUpdateIPCConfig(peerDiff.OldPeer, peerDiff.NewPeer)
+	}
+	if ipcConfig != "" {
+		if err := t.device.IpcSet(ipcConfig); err != nil {
+			return fmt.Errorf("failed to apply reloaded config: %w", err)
+		}
+	}
+
+	t.config.Store(&next)
+	t.loadRoutes(&next)
+	LogConfigDiff(old, config, diff)
+	return nil
+}
+
+// loadRoutes swaps in a routing engine for config, warning about any
+// routes that can never be used
+func (t *Tunnel) loadRoutes(config *WireGuardConfig) {
+	log := t.log
+	if log == nil {
+		log = logger
+	}
+
+	engine := NewRoutingEngine(config, t.options.Routing)
+	for _, warning := range engine.Lint() {
+		log.Warnf("Routing: %s", warning)
+	}
+	t.router.Store(engine)
+}
+
+// Limits of the MTU a tunnel accepts. Packets queued for WireGuard must fit
+// a packetRing slot.
+const (
+	minTunnelMTU = 576
+	maxTunnelMTU = packetRingSlotSize
+)
+
+// ValidateMTU checks an MTU given in a config or to SetMTU
+func ValidateMTU(mtu int) error {
+	if mtu < minTunnelMTU || mtu > maxTunnelMTU {
+		return fmt.Errorf("invalid MTU: %d (expected %d to %d)", mtu, minTunnelMTU, maxTunnelMTU)
+	}
+	return nil
+}
+
+// tunnelMTU returns the MTU set in config, or the default
+func tunnelMTU(config *WireGuardConfig) int {
+	if config != nil && config.Interface.MTU > 0 {
+		return config.Interface.MTU
+	}
+	return defaultTunnelMTU
+}
+
+// SetMTU changes the tunnel MTU while it runs. Connections opened afterwards
+// offer an MSS to match. TCP fixes the MSS in the handshake, so connections
+// already open keep theirs; the kernel sockets at either end of the proxy
+// split larger writes themselves. The MTU is kept across Reset.
+func (t *Tunnel) SetMTU(mtu int) error {
+	if err := ValidateMTU(mtu); err != nil {
+		return err
+	}
+
+	t.resetMutex.Lock()
+	defer t.resetMutex.Unlock()
+	if t.device == nil {
+		return fmt.Errorf("tunnel closed")
+	}
+
+	t.tun.SetMTU(mtu)
+	logger.Infof("WireGuard tunnel MTU set to %d", mtu)
+	return nil
+}
+
+// Stats returns the packet counts of the tunnel's TUN device. Reset replaces
+// the device, so the counts start again from zero after a reset.
+func (t *Tunnel) Stats() MemoryTUNMetrics {
+	t.mutex.RLock()
+	memTun := t.tun
+	t.mutex.RUnlock()
+
+	if memTun == nil {
+		return MemoryTUNMetrics{}
+	}
+	return memTun.Metrics()
+}
+
+// ResumeHandshakeTimeout is how long Resume waits for a fresh handshake
+var ResumeHandshakeTimeout = 30 * time.Second
+
+// Suspend takes the WireGuard device down, for example before the machine
+// hibernates. Connections through the tunnel stall until Resume; the child
+// process is left running.
+func (t *Tunnel) Suspend() error {
+	return t.takeDown("suspend", func() { logger.Warnf("Suspending WireGuard tunnel") })
+}
+
+// Down takes the WireGuard device down ahead of Close, so connections the
+// child opens while it shuts down fail instead of being cut off later
+func (t *Tunnel) Down() error {
+	return t.takeDown("take down", func() { logger.Debugf("Taking WireGuard tunnel down before shutdown") })
+}
+
+// takeDown takes the device down unless it already is, calling announce
+// first. operation names the caller in errors, such as "suspend".
+func (t *Tunnel) takeDown(operation string, announce func()) error {
+	t.resetMutex.Lock()
+	defer t.resetMutex.Unlock()
+
+	if t.device == nil {
+		return fmt.Errorf("tunnel closed")
+	}
+	if t.suspended {
+		return nil
+	}
+
+	announce()
+	if err := t.device.Down(); err != nil {
+		return fmt.Errorf("failed to %s tunnel: %w", operation, err)
+	}
+	t.suspended = true
+	return nil
+}
+
+// Resume brings a suspended device back up, re-resolves peer endpoints that
+// are hostnames and waits up to ResumeHandshakeTimeout for a fresh handshake.
+// The device stays up even if no handshake completes in time.
+func (t *Tunnel) Resume(ctx context.Context) error {
+	t.resetMutex.Lock()
+	if t.device == nil {
+		t.resetMutex.Unlock()
+		return fmt.Errorf("tunnel closed")
+	}
+	if !t.suspended {
+		t.resetMutex.Unlock()
+		return nil
+	}
+
+	start := time.Now()
+	logger.Warnf("Resuming WireGuard tunnel")
+	if err := t.device.Up(); err != nil {
+		t.resetMutex.Unlock()
+		return fmt.Errorf("failed to resume tunnel: %w", err)
+	}
+	t.suspended = false
+	t.resetMutex.Unlock()
+
+	// The network may have changed while suspended
+	t.refreshEndpoints(ctx, net.DefaultResolver)
+
+	ctx, cancel := context.WithTimeout(ctx, ResumeHandshakeTimeout)
+	defer cancel()
+
+	if err := t.waitForHandshake(ctx, start); err != nil {
+		return fmt.Errorf("no handshake within %v of resuming: %w", ResumeHandshakeTimeout, err)
+	}
+	logger.Infof("WireGuard tunnel resumed after %v", time.Since(start))
+	return nil
+}
+
+// WaitForHandshake blocks until the tunnel has completed a handshake with
+// any peer, or until ctx is done
+func (t *Tunnel) WaitForHandshake(ctx context.Context) error {
+	return t.waitForHandshake(ctx, time.Time{})
+}
+
+// waitForHandshake polls the device until it reports a handshake after since
+func (t *Tunnel) waitForHandshake(ctx context.Context, since time.Time) error {
+	ticker := time.NewTicker(handshakePollInterval)
+	defer ticker.Stop()
+	for {
+		if t.lastHandshake().After(since) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// endpointResolver looks up the addresses of a hostname. net.DefaultResolver
+// satisfies it; tests substitute their own.
+type endpointResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// StartEndpointRefresh re-resolves peer endpoints that were configured by
+// hostname every ttl, until ctx is cancelled, so that DNS changes such as a
+// failover reach the WireGuard device. A ttl of zero disables refreshing.
+func (t *Tunnel) StartEndpointRefresh(ctx context.Context, ttl time.Duration, resolver endpointResolver) {
+	if ttl <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(ttl)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t.refreshEndpoints(ctx, resolver)
+			}
+		}
+	}()
+}
+
+// refreshEndpoints resolves each peer's original hostname once and updates the
+// device for any peer whose address changed
+func (t *Tunnel) refreshEndpoints(ctx context.Context, resolver endpointResolver) {
+	// Serialise with Reset and Close, which read the config and swap the device
+	t.resetMutex.Lock()
+	defer t.resetMutex.Unlock()
+
+	config := t.config.Load()
+	if config == nil || t.device == nil {
+		return
+	}
+
+	// Readers of the config do not take resetMutex, so update a copy
+	next := *config
+	next.Peers = slices.Clone(config.Peers)
+	defer t.config.Store(&next)
+
+	for i := range next.Peers {
+		peer := &next.Peers[i]
+		if peer.OriginalHostname == "" {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(peer.OriginalHostname)
+		if err != nil {
+			continue
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			logger.Warnf("Failed to re-resolve endpoint %s for peer %d: %v", peer.OriginalHostname, i, err)
+			continue
+		}
+
+		ips := make([]net.IP, len(addrs))
+		for j, addr := range addrs {
+			ips[j] = addr.IP
+		}
+		endpoint := net.JoinHostPort(pickEndpointIP(ips).String(), port)
+		peer.ResolvedAt = time.Now()
+
+		if endpoint == peer.Endpoint {
+			continue
+		}
+
+		ipcConfig := fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peer.PublicKey, endpoint)
+		if err := t.device.IpcSet(ipcConfig); err != nil {
+			logger.Warnf("Failed to update endpoint for peer %d: %v", i, err)
+			continue
+		}
+
+		logger.Infof("Peer %d endpoint %s changed from %s to %s", i, peer.OriginalHostname, peer.Endpoint, endpoint)
+		peer.Endpoint = endpoint
+	}
+}
+
+// runHooks executes PostUp/PostDown shell commands in order, stopping at the
+// first failure. WRAPGUARD_INTERFACE_IP is set to our tunnel address.
+func runHooks(stage string, commands []string, ourIP netip.Addr) error {
+	for _, command := range commands {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), "WRAPGUARD_INTERFACE_IP="+ourIP.String())
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s command %q failed: %w: %s", stage, command, err, strings.TrimSpace(string(output)))
+		}
+
+		if logger != nil {
+			logger.Debugf("%s command %q completed: %s", stage, command, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+func configureDevice(dev *device.Device, config *WireGuardConfig) error {
+	ipcConfig := fmt.Sprintf("private_key=%s\n", config.Interface.PrivateKey)
+
+	if config.Interface.ListenPort > 0 {
+		ipcConfig += fmt.Sprintf("listen_port=%d\n", config.Interface.ListenPort)
+	}
+
+	for _, peer := range config.Peers {
+		ipcConfig += peerIPCConfig(peer)
+	}
+
+	return dev.IpcSet(ipcConfig)
+}
+
+// peerIPCConfig returns the device settings that add peer
+func peerIPCConfig(peer PeerConfig) string {
+	ipcConfig := fmt.Sprintf("public_key=%s\n", peer.PublicKey)
+
+	if peer.PresharedKey != "" {
+		ipcConfig += fmt.Sprintf("preshared_key=%s\n", peer.PresharedKey)
+	}
+
+	if peer.Endpoint != "" {
+		ipcConfig += fmt.Sprintf("endpoint=%s\n", peer.Endpoint)
+	}
+
+	if peer.PersistentKeepalive > 0 {
+		ipcConfig += fmt.Sprintf("persistent_keepalive_interval=%d\n", peer.PersistentKeepalive)
+	}
+
+	for _, allowedIP := range peer.AllowedIPs {
+		ipcConfig += fmt.Sprintf("allowed_ip=%s\n", allowedIP)
+	}
+	return ipcConfig
+}
+
+// peerUpdateIPCConfig returns the device settings that bring a peer from
+// old to new, leaving alone what did not change, such as an endpoint the
+// peer roamed to
+func peerUpdateIPCConfig(old, new PeerConfig) string {
+	ipcConfig := fmt.Sprintf("public_key=%s\nupdate_only=true\n", new.PublicKey)
+
+	for _, field := range peerChanges(old, new) {
+		switch field {
+		case "PresharedKey":
+			key := new.PresharedKey
+			if key == "" {
+				key = strings.Repeat("0", 64) // No preshared key
+			}
+			ipcConfig += fmt.Sprintf("preshared_key=%s\n", key)
+		case "Endpoint":
+			if new.Endpoint != "" {
+				ipcConfig += fmt.Sprintf("endpoint=%s\n", new.Endpoint)
+			}
+		case "PersistentKeepalive":
+			ipcConfig += fmt.Sprintf("persistent_keepalive_interval=%d\n", new.PersistentKeepalive)
+		case "AllowedIPs":
+			ipcConfig += "replace_allowed_ips=true\n"
+			for _, allowedIP := range new.AllowedIPs {
+				ipcConfig += fmt.Sprintf("allowed_ip=%s\n", allowedIP)
+			}
+		}
+	}
+	return ipcConfig
+}
+
+func (t *Tunnel) handleIncomingPacket(packet []byte) {
+	if len(packet) < 20 {
+		return // Too short for IP header
+	}
+
+	// Parse IP header to extract source/dest
+	version := packet[0] >> 4
+	if version != 4 {
+		return // Only IPv4 for now
+	}
+
+	// Reassemble fragmented packets before looking at the transport header
+	if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+		if packet = t.fragments.add(packet, time.Now()); packet == nil {
+			return
+		}
+	}
+
+	protocol := packet[9]
+	srcIP := net.IP(packet[12:16])
+	dstIP := net.IP(packet[16:20])
+
+	// Answer pings to our address so peers can check the tunnel is up
+	if protocol == ipProtocolICMP {
+		if !dstIP.Equal(net.IP(t.ourIP.AsSlice())) {
+			return
+		}
+		if reply := createICMPEchoReply(packet); reply != nil {
+			t.mutex.RLock()
+			memTun := t.tun
+			t.mutex.RUnlock()
+			if memTun != nil {
+				memTun.InjectInbound(reply)
+			}
+		}
+		return
+	}
+
+	if protocol != 6 {
+		return // Only TCP for now
+	}
+
+	// Extract TCP ports
+	if len(packet) < 24 {
+		return
+	}
+
+	srcPort := binary.BigEndian.Uint16(packet[20:22])
+	dstPort := binary.BigEndian.Uint16(packet[22:24])
+
+	connKey := fmt.Sprintf("%s:%d->%s:%d", srcIP, srcPort, dstIP, dstPort)
+
+	t.mutex.RLock()
+	conn, exists := t.connMap[connKey]
+	t.mutex.RUnlock()
+
+	if exists {
+		// Record the peer's MSS and window scale from its SYN-ACK
+		if tcpHeader := packet[20:]; len(tcpHeader) >= 20 && tcpHeader[13]&0x12 == 0x12 {
+			options := parseOptions(tcpHeader)
+			conn.mutex.Lock()
+			if mss, ok := options[tcpOptionMSS]; ok && len(mss) == 2 {
+				conn.mss = binary.BigEndian.Uint16(mss)
+			}
+			if shift, ok := options[tcpOptionWindowScale]; ok && len(shift) == 1 {
+				conn.windowScale = min(shift[0], maxWindowScale)
+			}
+			conn.mutex.Unlock()
+		}
+
+		// Deliver to existing connection
+		select {
+		case conn.readChan <- packet[20:]: // TCP payload
+		default:
+			// Drop if full
+		}
+	}
+}
+
+// ICMPv4 protocol number and the echo message types
+const (
+	ipProtocolICMP  = 1
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
+
+// createICMPEchoReply builds the reply to an IPv4 ICMP echo request, with
+// the addresses swapped and both checksums recomputed. It returns nil if
+// request is not a complete, unfragmented echo request.
+func createICMPEchoReply(request []byte) []byte {
+	if len(request) < 20 || request[0]>>4 != 4 || request[9] != ipProtocolICMP {
+		return nil
+	}
+
+	headerLen := int(request[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(request[2:4]))
+	if headerLen < 20 || totalLen < headerLen+8 || totalLen > len(request) {
+		return nil
+	}
+
+	// More fragments flag or a fragment offset
+	if binary.BigEndian.Uint16(request[6:8])&0x3fff != 0 {
+		return nil
+	}
+
+	if request[headerLen] != icmpEchoRequest || request[headerLen+1] != 0 {
+		return nil
+	}
+
+	reply := make([]byte, totalLen)
+	copy(reply, request[:totalLen])
+
+	// IP header: swap addresses and reset the TTL
+	copy(reply[12:16], request[16:20])
+	copy(reply[16:20], request[12:16])
+	reply[8] = 64
+	binary.BigEndian.PutUint16(reply[10:12], 0)
+	binary.BigEndian.PutUint16(reply[10:12], internetChecksum(reply[:headerLen]))
+
+	// ICMP header: same identifier, sequence and data
+	icmp := reply[headerLen:]
+	icmp[0] = icmpEchoReply
+	binary.BigEndian.PutUint16(icmp[2:4], 0)
+	binary.BigEndian.PutUint16(icmp[2:4], internetChecksum(icmp))
+
+	return reply
+}
+
+// internetChecksum computes the RFC 1071 checksum used by IPv4 and ICMP
+func internetChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// DialContext creates a connection through WireGuard
+func (t *Tunnel) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	// For now, return an error since we need the WireGuard interface to be configured
+	// In a full implementation, this would send packets through the WireGuard tunnel
+	return nil, fmt.Errorf("WireGuard tunnel dial not implemented - requires system WireGuard interface or full TCP/IP stack")
+}
+
+// TCP option kinds used in SYN packets
+const (
+	tcpOptionEnd         = 0
+	tcpOptionNOP         = 1
+	tcpOptionMSS         = 2
+	tcpOptionWindowScale = 3
+)
+
+// tcpReceiveBuffer is the receive window advertised through window scaling,
+// so that throughput is not capped at 64 KiB per round trip
+const tcpReceiveBuffer = 4 << 20
+
+// maxWindowScale is the largest shift count allowed by RFC 7323
+const maxWindowScale = 14
+
+// windowScaleFor returns the smallest shift count that lets a 16-bit window
+// field describe a buffer of the given size
+func windowScaleFor(buffer int) uint8 {
+	var shift uint8
+	for shift < maxWindowScale && buffer>>shift > 0xffff {
+		shift++
+	}
+	return shift
+}
+
+// defaultTunnelMTU is used for MSS calculation when no TUN is attached
+const defaultTunnelMTU = 1420
+
+// mss returns the maximum segment size advertised in SYN packets: the
+// tunnel MTU minus the IPv4 and TCP headers.
+func (t *Tunnel) mss() uint16 {
+	t.mutex.RLock()
+	memTun := t.tun
+	t.mutex.RUnlock()
+
+	mtu := defaultTunnelMTU
+	if memTun != nil {
+		if m, err := memTun.MTU(); err == nil && m > 40 {
+			mtu = m
+		}
+	}
+	return uint16(mtu - 40)
+}
+
+func (t *Tunnel) createTCPSyn(dstIP net.IP, dstPort int) []byte {
+	// Create a minimal TCP SYN packet
+	// This is very simplified - a real implementation would need proper TCP handling
+	packet := make([]byte, 48) // IP header (20) + TCP header (20) + MSS (4) + NOP and window scale (4)
+
+	// IP header
+	packet[0] = 0x45                                // Version 4, header length 5
+	packet[1] = 0x00                                // DSCP/ECN
+	binary.BigEndian.PutUint16(packet[2:4], 48)     // Total length
+	binary.BigEndian.PutUint16(packet[4:6], 0x1234) // ID
+	binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Flags
+	packet[8] = 64                                  // TTL
+	packet[9] = 6                                   // Protocol (TCP)
+	copy(packet[12:16], t.ourIP.AsSlice())          // Source IP
+	copy(packet[16:20], dstIP.To4())                // Dest IP
+
+	// TCP header
+	binary.BigEndian.PutUint16(packet[20:22], 12345)           // Source port
+	binary.BigEndian.PutUint16(packet[22:24], uint16(dstPort)) // Dest port
+	binary.BigEndian.PutUint32(packet[24:28], 0x12345678)      // Seq number
+	binary.BigEndian.PutUint32(packet[28:32], 0)               // Ack number
+	packet[32] = 0x70                                          // Header length (7 words)
+	packet[33] = 0x02                                          // SYN flag
+	binary.BigEndian.PutUint16(packet[34:36], 0xffff)          // Window, unscaled in a SYN
+
+	// TCP options
+	packet[40] = tcpOptionMSS
+	packet[41] = 4
+	binary.BigEndian.PutUint16(packet[42:44], t.mss())
+	packet[44] = tcpOptionNOP
+	packet[45] = tcpOptionWindowScale
+	packet[46] = 3
+	packet[47] = windowScaleFor(tcpReceiveBuffer)
+
+	return packet
+}
+
+// parseOptions returns the options in a TCP header keyed by kind. Each
+// value holds the option data without the kind and length bytes.
+// Malformed options stop parsing and what was read so far is returned.
+func parseOptions(tcpHeader []byte) map[byte][]byte {
+	options := make(map[byte][]byte)
+	if len(tcpHeader) < 20 {
+		return options
+	}
+
+	headerLen := int(tcpHeader[12]>>4) * 4
+	if headerLen < 20 || headerLen > len(tcpHeader) {
+		return options
+	}
+
+	data := tcpHeader[20:headerLen]
+	for len(data) > 0 {
+		kind := data[0]
+		switch kind {
+		case tcpOptionEnd:
+			return options
+		case tcpOptionNOP:
+			data = data[1:]
+			continue
+		}
+
+		if len(data) < 2 {
+			return options
+		}
+		length := int(data[1])
+		if length < 2 || length > len(data) {
+			return options
+		}
+		options[kind] = data[2:length]
+		data = data[length:]
+	}
+
+	return options
+}
+
+func (t *Tunnel) Listen(network, address string) (net.Listener, error) {
+	// For incoming connections, we need to listen on our WireGuard IP
+	// This is a placeholder - real implementation would handle TCP listening
+	return net.Listen("tcp", fmt.Sprintf("%s%s", t.ourIP.String(), address))
+}
+
+// IsWireGuardIP checks if an IP is in the WireGuard network
+func (t *Tunnel) IsWireGuardIP(ip net.IP) bool {
+	// Check if the IP is in the 10.150.0.0/24 range (our WireGuard network)
+	_, wgNet, err := net.ParseCIDR("10.150.0.0/24")
+	if err != nil {
+		return false
+	}
+	return wgNet.Contains(ip)
+}
+
+// PublicKey returns the base64 public key of the tunnel's interface, or ""
+// if its config has no usable private key
+func (t *Tunnel) PublicKey() string {
+	config := t.config.Load()
+	if config == nil {
+		return ""
+	}
+	privateKey := config.Interface.PrivateKey
+	if isHexString(privateKey) {
+		var err error
+		if privateKey, err = hexToBase64(privateKey); err != nil {
+			return ""
+		}
+	}
+	publicKey, err := PublicKey(privateKey)
+	if err != nil {
+		return ""
+	}
+	return publicKey
+}
+
+// DialWireGuard creates a connection to a WireGuard IP through the tunnel
+func (t *Tunnel) DialWireGuard(ctx context.Context, network, host, port string) (net.Conn, error) {
+	// Parse destination IP and port
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", host)
+	}
+
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", port)
+	}
+
+	// Find the appropriate peer using routing engine, by the hostname the
+	// client asked for before its address
+	router := t.router.Load()
+	peer, peerIdx := router.FindPeerForHostname(destHostname(ctx), portNum, clientSourcePort(ctx), network, clientExeName(ctx))
+	if peer == nil {
+		peer, peerIdx = router.FindPeerForDestination(ip, portNum, clientSourcePort(ctx), network, clientExeName(ctx))
+	}
+	if peer == nil {
+		return nil, fmt.Errorf("no route to %s:%s", host, port)
+	}
+
+	logger.Debugf("WireGuard tunnel: routing %s:%s through peer %d (endpoint: %s)", host, port, peerIdx, peer.Endpoint)
+
+	// For now, fall back to hostname translation for testing
+	// In a production system, this would send packets through the WireGuard tunnel
+	// to the selected peer
+	var realHost string
+	switch host {
+	case "10.150.0.2":
+		realHost = "node-server-1"
+	case "10.150.0.3":
+		realHost = "node-server-2"
+	default:
+		// In a real implementation, we would encapsulate and send through the tunnel
+		// For now, try direct connection as fallback
+		logger.Warnf("No hostname mapping for %s, attempting direct connection", host)
+		realHost = host
+	}
+
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, network, realHost+":"+port)
+}
+
+func (t *Tunnel) Close() error {
+	t.resetMutex.Lock()
+	defer t.resetMutex.Unlock()
+
+	t.mutex.Lock()
+	dev, memTun := t.device, t.tun
+	t.device = nil
+	t.mutex.Unlock()
+
+	if t.stopEvents != nil {
+		t.stopEvents()
+	}
+
+	if dev != nil {
+		dev.Close()
+
+		// A tunnel that never connected has nothing to disconnect from
+		if t.options.OnDisconnected != "" && t.connected.Load() {
+			t.runLifecycleHook("on-disconnected", t.options.OnDisconnected)
+		}
+
+		if config := t.config.Load(); config != nil {
+			if err := runHooks("PostDown", config.Interface.PostDown, t.ourIP); err != nil && logger != nil {
+				logger.Warnf("Hook failed: %v", err)
+			}
+		}
+	}
+	if memTun != nil {
+		memTun.Close()
+	}
+	return nil
+}
+
+// TunnelConn implements net.Conn
+func (tc *TunnelConn) Read(b []byte) (int, error) {
+	data, ok := <-tc.readChan
+	if !ok {
+		return 0, fmt.Errorf("connection closed")
+	}
+	copy(b, data)
+	return len(data), nil
+}
+
+func (tc *TunnelConn) Write(b []byte) (int, error) {
+	select {
+	case tc.writeChan <- b:
+		return len(b), nil
+	default:
+		return 0, fmt.Errorf("write buffer full")
+	}
+}
+
+func (tc *TunnelConn) Close() error {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	if !tc.closed {
+		tc.closed = true
+		close(tc.readChan)
+		close(tc.writeChan)
+	}
+	return nil
+}
+
+func (tc *TunnelConn) LocalAddr() net.Addr                { return tc.localAddr }
+func (tc *TunnelConn) RemoteAddr() net.Addr               { return tc.remoteAddr }
+func (tc *TunnelConn) SetDeadline(t time.Time) error      { return nil }
+func (tc *TunnelConn) SetReadDeadline(t time.Time) error  { return nil }
+func (tc *TunnelConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func mustParsePort(s string) int {
+	p, _ := strconv.Atoi(s)
+	return p
+}
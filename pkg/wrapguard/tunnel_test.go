@@ -0,0 +1,1977 @@
+package wrapguard
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+func TestNewMemoryTUN(t *testing.T) {
+	tun := NewMemoryTUN("test-tun", 1420)
+
+	if tun == nil {
+		t.Fatal("NewMemoryTUN returned nil")
+	}
+
+	if mtu := tun.mtu.Load(); mtu != 1420 {
+		t.Errorf("expected MTU 1420, got %d", mtu)
+	}
+
+	if tun.name != "test-tun" {
+		t.Errorf("expected name 'test-tun', got %q", tun.name)
+	}
+
+	if tun.closed {
+		t.Error("TUN should not be closed initially")
+	}
+
+	if tun.inbound == nil {
+		t.Error("inbound queue not initialized")
+	}
+
+	if tun.outbound == nil {
+		t.Error("outbound channel not initialized")
+	}
+
+	if tun.events == nil {
+		t.Error("events channel not initialized")
+	}
+
+	tun.Close()
+}
+
+func TestMemoryTUN_File(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	if file := tun.File(); file != nil {
+		t.Error("File() should return nil for memory TUN")
+	}
+}
+
+func TestMemoryTUN_MTU(t *testing.T) {
+	tun := NewMemoryTUN("test", 1500)
+	defer tun.Close()
+
+	mtu, err := tun.MTU()
+	if err != nil {
+		t.Errorf("MTU() returned error: %v", err)
+	}
+
+	if mtu != 1500 {
+		t.Errorf("expected MTU 1500, got %d", mtu)
+	}
+}
+
+func TestMemoryTUN_SetMTU(t *testing.T) {
+	memTun := NewMemoryTUN("test", 1420)
+
+	// WireGuard is told to read the MTU again
+	memTun.SetMTU(1280)
+	if mtu, _ := memTun.MTU(); mtu != 1280 {
+		t.Errorf("expected MTU 1280, got %d", mtu)
+	}
+	if event := <-memTun.Events(); event != tun.EventMTUUpdate {
+		t.Errorf("expected an MTU update event, got %v", event)
+	}
+
+	// A full event queue does not block
+	for i := 0; i < cap(memTun.events)+1; i++ {
+		memTun.SetMTU(1400)
+	}
+
+	// Changing the MTU of a closed TUN does not send on the closed channel
+	memTun.Close()
+	memTun.SetMTU(1420)
+}
+
+func TestMemoryTUN_Name(t *testing.T) {
+	tun := NewMemoryTUN("test-interface", 1420)
+	defer tun.Close()
+
+	name, err := tun.Name()
+	if err != nil {
+		t.Errorf("Name() returned error: %v", err)
+	}
+
+	if name != "test-interface" {
+		t.Errorf("expected name 'test-interface', got %q", name)
+	}
+}
+
+func TestMemoryTUN_Events(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	events := tun.Events()
+	if events == nil {
+		t.Error("Events() returned nil channel")
+	}
+}
+
+func TestMemoryTUN_ReadWrite(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	// Test data
+	testData := []byte("test packet data")
+
+	// Write data
+	go func() {
+		time.Sleep(10 * time.Millisecond) // Small delay to ensure Read is waiting
+		tun.inbound.push(testData)
+	}()
+
+	// Read data
+	buf := make([]byte, 1500)
+	n, err := tun.Read(buf, 0)
+	if err != nil {
+		t.Errorf("Read() returned error: %v", err)
+	}
+
+	if n != len(testData) {
+		t.Errorf("expected to read %d bytes, got %d", len(testData), n)
+	}
+
+	if string(buf[:n]) != string(testData) {
+		t.Errorf("expected data %q, got %q", string(testData), string(buf[:n]))
+	}
+
+	// With an offset the packet starts at that position in the buffer
+	tun.inbound.push(testData)
+	buf = make([]byte, 1500)
+	n, err = tun.Read(buf, 4)
+	if err != nil {
+		t.Fatalf("Read() with offset returned error: %v", err)
+	}
+	if n != len(testData) {
+		t.Errorf("expected to read %d bytes, got %d", len(testData), n)
+	}
+	if !bytes.Equal(buf[:4], make([]byte, 4)) {
+		t.Errorf("bytes before the offset were written: %v", buf[:4])
+	}
+	if string(buf[4:4+n]) != string(testData) {
+		t.Errorf("expected data %q at offset 4, got %q", string(testData), string(buf[4:4+n]))
+	}
+}
+
+func TestMemoryTUN_OffsetBounds(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	buf := make([]byte, 8)
+	for _, offset := range []int{-1, 8, 9} {
+		if _, err := tun.Read(buf, offset); err != io.ErrShortBuffer {
+			t.Errorf("Read() with offset %d: expected io.ErrShortBuffer, got %v", offset, err)
+		}
+		if _, err := tun.Write(buf, offset); err != io.ErrShortBuffer {
+			t.Errorf("Write() with offset %d: expected io.ErrShortBuffer, got %v", offset, err)
+		}
+	}
+
+	// A packet that does not fit after the offset is rejected
+	tun.inbound.push([]byte("too long"))
+	if _, err := tun.Read(buf, 4); err != io.ErrShortBuffer {
+		t.Errorf("expected io.ErrShortBuffer for a packet past the buffer, got %v", err)
+	}
+
+	// Write sends only the bytes after the offset
+	n, err := tun.Write([]byte("hdr:data"), 4)
+	if err != nil {
+		t.Fatalf("Write() with offset returned error: %v", err)
+	}
+	if n != 4 {
+		t.Errorf("expected to write 4 bytes, got %d", n)
+	}
+	if packet := <-tun.outbound; string(packet) != "data" {
+		t.Errorf("expected outbound packet %q, got %q", "data", packet)
+	}
+}
+
+func TestMemoryTUN_InjectInbound(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	packet := []byte("injected packet")
+	if err := tun.InjectInbound(packet); err != nil {
+		t.Fatalf("InjectInbound() returned error: %v", err)
+	}
+
+	// The queued packet must be a copy of the caller's buffer
+	packet[0] = 'X'
+
+	buf := make([]byte, 1500)
+	n, err := tun.Read(buf, 0)
+	if err != nil {
+		t.Fatalf("Read() returned error: %v", err)
+	}
+
+	if string(buf[:n]) != "injected packet" {
+		t.Errorf("expected %q, got %q", "injected packet", string(buf[:n]))
+	}
+}
+
+func TestMemoryTUN_InjectBatch(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	packets := [][]byte{[]byte("one"), []byte("two"), []byte("three")}
+	if err := tun.InjectBatch(packets); err != nil {
+		t.Fatalf("InjectBatch() returned error: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	for _, expected := range packets {
+		n, err := tun.Read(buf, 0)
+		if err != nil {
+			t.Fatalf("Read() returned error: %v", err)
+		}
+		if string(buf[:n]) != string(expected) {
+			t.Errorf("expected %q, got %q", string(expected), string(buf[:n]))
+		}
+	}
+}
+
+func TestMemoryTUN_InjectBatchFull(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	packets := make([][]byte, packetRingSlots+5)
+	for i := range packets {
+		packets[i] = []byte{byte(i)}
+	}
+
+	err := tun.InjectBatch(packets)
+	if err == nil {
+		t.Fatal("expected error when inbound queue overflows")
+	}
+
+	if !strings.Contains(err.Error(), "dropped 5 of") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	if tun.inbound.len() != packetRingSlots {
+		t.Errorf("expected queue to be filled to capacity, got %d", tun.inbound.len())
+	}
+}
+
+// BenchmarkMemoryTUN_Throughput pushes MTU-sized packets from one goroutine
+// through InjectInbound to Read, reporting millions of packets per second
+// and the GC pause time spent per packet
+func BenchmarkMemoryTUN_Throughput(b *testing.B) {
+	tun := NewMemoryTUN("bench", 1420)
+	defer tun.Close()
+
+	packet := make([]byte, 1420)
+	buf := make([]byte, 1500)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			// Wait for the reader rather than dropping when the queue is full
+			for tun.InjectInbound(packet) != nil {
+				runtime.Gosched()
+			}
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		if _, err := tun.Read(buf, 0); err != nil {
+			b.Fatalf("Read() returned error: %v", err)
+		}
+	}
+
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds()/1e6, "Mpps")
+	b.ReportMetric(float64(after.PauseTotalNs-before.PauseTotalNs)/float64(b.N), "gc-pause-ns/op")
+	b.ReportMetric(float64(after.NumGC-before.NumGC), "gc-cycles")
+}
+
+func TestMemoryTUN_InjectAfterClose(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	tun.Close()
+
+	if err := tun.InjectInbound([]byte("late")); err == nil {
+		t.Error("InjectInbound() should return error after close")
+	}
+}
+
+func TestMemoryTUN_Metrics(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	if metrics := tun.Metrics(); metrics != (MemoryTUNMetrics{}) {
+		t.Errorf("expected zero metrics for a new TUN, got %+v", metrics)
+	}
+
+	// 10 packets of 100 bytes each way
+	packet := make([]byte, 100)
+	buf := make([]byte, 1500)
+	for i := 0; i < 10; i++ {
+		if err := tun.InjectInbound(packet); err != nil {
+			t.Fatalf("InjectInbound() returned error: %v", err)
+		}
+		if _, err := tun.Read(buf, 0); err != nil {
+			t.Fatalf("Read() returned error: %v", err)
+		}
+		if _, err := tun.Write(packet, 0); err != nil {
+			t.Fatalf("Write() returned error: %v", err)
+		}
+		<-tun.outbound
+	}
+
+	expected := MemoryTUNMetrics{
+		InboundPackets:  10,
+		InboundBytes:    1000,
+		OutboundPackets: 10,
+		OutboundBytes:   1000,
+	}
+	if metrics := tun.Metrics(); metrics != expected {
+		t.Errorf("expected %+v, got %+v", expected, metrics)
+	}
+
+	// Packets that find a queue full are dropped and counted
+	for i := 0; i < cap(tun.outbound)+3; i++ {
+		tun.Write(packet, 0)
+	}
+	batch := make([][]byte, packetRingSlots+2)
+	for i := range batch {
+		batch[i] = packet
+	}
+	tun.InjectBatch(batch)
+
+	metrics := tun.Metrics()
+	if metrics.DroppedPackets != 5 {
+		t.Errorf("expected 5 dropped packets, got %d", metrics.DroppedPackets)
+	}
+	if metrics.OutboundPackets != 10+uint64(cap(tun.outbound))+3 {
+		t.Errorf("expected every written packet to be counted, got %d", metrics.OutboundPackets)
+	}
+	if metrics.InboundPackets != 10 {
+		t.Errorf("expected queued packets to count once read, got %d", metrics.InboundPackets)
+	}
+}
+
+func TestTunnel_Stats(t *testing.T) {
+	if stats := (&Tunnel{}).Stats(); stats != (MemoryTUNMetrics{}) {
+		t.Errorf("expected zero stats without a TUN, got %+v", stats)
+	}
+
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+	tunnel := &Tunnel{tun: tun}
+
+	tun.Write([]byte("outbound packet data"), 0)
+	if stats := tunnel.Stats(); stats.OutboundPackets != 1 || stats.OutboundBytes != 20 {
+		t.Errorf("expected the TUN's metrics, got %+v", stats)
+	}
+}
+
+func TestMemoryTUN_WriteToOutbound(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	testData := []byte("outbound packet data")
+
+	// Write to TUN (simulating WireGuard writing)
+	n, err := tun.Write(testData, 0)
+	if err != nil {
+		t.Errorf("Write() returned error: %v", err)
+	}
+
+	if n != len(testData) {
+		t.Errorf("expected to write %d bytes, got %d", len(testData), n)
+	}
+
+	// Check if data appeared in outbound channel
+	select {
+	case data := <-tun.outbound:
+		if string(data) != string(testData) {
+			t.Errorf("expected outbound data %q, got %q", string(testData), string(data))
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("no data received on outbound channel")
+	}
+}
+
+func TestMemoryTUN_Close(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+
+	// Close the TUN
+	err := tun.Close()
+	if err != nil {
+		t.Errorf("Close() returned error: %v", err)
+	}
+
+	if !tun.closed {
+		t.Error("TUN should be marked as closed")
+	}
+
+	// Test that Read returns error after close
+	buf := make([]byte, 100)
+	_, err = tun.Read(buf, 0)
+	if err == nil {
+		t.Error("Read() should return error after close")
+	}
+
+	// Test that Write returns error after close
+	_, err = tun.Write([]byte("test"), 0)
+	if err == nil {
+		t.Error("Write() should return error after close")
+	}
+
+	// Multiple closes should not panic
+	err = tun.Close()
+	if err != nil {
+		t.Errorf("Second Close() returned error: %v", err)
+	}
+}
+
+func TestMemoryTUN_Flush(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	defer tun.Close()
+
+	// Flush should not return error
+	err := tun.Flush()
+	if err != nil {
+		t.Errorf("Flush() returned error: %v", err)
+	}
+}
+
+func TestNewDeviceLogger(t *testing.T) {
+	oldLogger := logger
+	defer SetGlobalLogger(oldLogger)
+
+	// wireGuardEntries starts a device and returns the WireGuard log entries by level
+	wireGuardEntries := func(t *testing.T, opts TunnelOptions, uapi string) map[LogLevel][]string {
+		output := &recordingOutput{}
+		SetGlobalLogger(NewLogger(LogLevelDebug, output))
+
+		dev, err := startDevice(NewMemoryTUN("test", 1420), newTestConfig(t, testConfig{}), opts)
+		if err != nil {
+			t.Fatalf("startDevice failed: %v", err)
+		}
+		if uapi != "" {
+			dev.IpcSet(uapi)
+		}
+		dev.Close()
+
+		entries := make(map[LogLevel][]string)
+		levels, lines := output.snapshot()
+		for i, line := range lines {
+			if strings.Contains(line, `"message":"WireGuard: `) {
+				entries[levels[i]] = append(entries[levels[i]], line)
+			}
+		}
+		return entries
+	}
+
+	// Verbose messages from configuring the device are logged at debug level
+	entries := wireGuardEntries(t, TunnelOptions{Verbose: true}, "")
+	if !strings.Contains(strings.Join(entries[LogLevelDebug], "\n"), "UAPI: Updating private key") {
+		t.Errorf("expected the device's verbose messages at debug level, got %v", entries)
+	}
+
+	// Without Verbose only errors are passed on
+	entries = wireGuardEntries(t, TunnelOptions{}, "private_key=zz\n")
+	if len(entries[LogLevelDebug]) != 0 {
+		t.Errorf("expected no verbose messages, got %v", entries[LogLevelDebug])
+	}
+	if len(entries[LogLevelError]) != 1 || !strings.Contains(entries[LogLevelError][0], "failed to set private_key") {
+		t.Errorf("expected the UAPI error at error level, got %v", entries[LogLevelError])
+	}
+}
+
+func TestTunnel_IsWireGuardIP(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.150.0.2/24"},
+		},
+	}
+
+	ourIP, _ := config.GetInterfaceIP()
+	tunnel := &Tunnel{
+		ourIP: ourIP,
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		expected bool
+	}{
+		{"WireGuard network IP", "10.150.0.5", true},
+		{"Our IP", "10.150.0.2", true},
+		{"Network address", "10.150.0.0", true},
+		{"Broadcast address", "10.150.0.255", true},
+		{"Outside network", "10.151.0.5", false},
+		{"Different network", "192.168.1.1", false},
+		{"Public IP", "8.8.8.8", false},
+		{"Invalid IP", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			result := tunnel.IsWireGuardIP(ip)
+
+			if result != tt.expected {
+				t.Errorf("IsWireGuardIP(%q) = %v, want %v", tt.ip, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTunnel_DialWireGuard(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.150.0.2/24"},
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:  "test-peer",
+				Endpoint:   "test.example.com:51820",
+				AllowedIPs: []string{"0.0.0.0/0"},
+			},
+		},
+	}
+
+	ourIP, _ := config.GetInterfaceIP()
+	tunnel := &Tunnel{ourIP: ourIP}
+	tunnel.config.Store(config)
+	tunnel.router.Store(NewRoutingEngine(config, RoutingOptions{}))
+
+	ctx := context.Background()
+
+	// Test dialing known WireGuard IPs (fallback mode)
+	tests := []struct {
+		name        string
+		host        string
+		port        string
+		expectError bool
+	}{
+		{"node-server-1", "10.150.0.2", "8080", false},
+		{"node-server-2", "10.150.0.3", "8080", false},
+		{"unknown WireGuard IP", "10.150.0.99", "8080", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tunnel.DialWireGuard(ctx, "tcp", tt.host, tt.port)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error but got none")
+					if conn != nil {
+						conn.Close()
+					}
+				}
+			} else {
+				// Note: This will likely fail in test environment since
+				// node-server-1 and node-server-2 don't exist, but we test
+				// that the function doesn't panic and handles the mapping
+				if err != nil {
+					// Expected in test environment
+					t.Logf("DialWireGuard failed as expected in test environment: %v", err)
+				} else if conn != nil {
+					conn.Close()
+				}
+			}
+		})
+	}
+}
+
+func TestCreateTCPSyn(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.150.0.2/24"},
+		},
+	}
+
+	ourIP, _ := config.GetInterfaceIP()
+	tunnel := &Tunnel{
+		ourIP: ourIP,
+	}
+
+	dstIP := net.ParseIP("10.150.0.3")
+	dstPort := 80
+
+	packet := tunnel.createTCPSyn(dstIP, dstPort)
+
+	if len(packet) != 48 {
+		t.Errorf("expected packet length 48, got %d", len(packet))
+	}
+
+	// Check IP version
+	version := packet[0] >> 4
+	if version != 4 {
+		t.Errorf("expected IP version 4, got %d", version)
+	}
+
+	// Check protocol (should be TCP = 6)
+	protocol := packet[9]
+	if protocol != 6 {
+		t.Errorf("expected protocol 6 (TCP), got %d", protocol)
+	}
+
+	// Check source IP
+	srcIP := net.IP(packet[12:16])
+	if !srcIP.Equal(ourIP.AsSlice()) {
+		t.Errorf("expected source IP %v, got %v", ourIP, srcIP)
+	}
+
+	// Check destination IP
+	dstIPFromPacket := net.IP(packet[16:20])
+	if !dstIPFromPacket.Equal(dstIP) {
+		t.Errorf("expected destination IP %v, got %v", dstIP, dstIPFromPacket)
+	}
+}
+
+func TestCreateTCPSyn_MSSOption(t *testing.T) {
+	tests := []struct {
+		name        string
+		tun         *MemoryTUN
+		expectedMSS uint16
+	}{
+		{"no tun", nil, 1380},
+		{"mtu 1420", NewMemoryTUN("test", 1420), 1380},
+		{"mtu 1500", NewMemoryTUN("test", 1500), 1460},
+		{"mtu 1280", NewMemoryTUN("test", 1280), 1240},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.2"), tun: tt.tun}
+			packet := tunnel.createTCPSyn(net.ParseIP("10.150.0.3"), 80)
+
+			if total := binary.BigEndian.Uint16(packet[2:4]); int(total) != len(packet) {
+				t.Errorf("IP total length %d does not match packet length %d", total, len(packet))
+			}
+			if headerLen := int(packet[32]>>4) * 4; headerLen != 28 {
+				t.Errorf("expected TCP header length 28, got %d", headerLen)
+			}
+
+			mss, ok := parseOptions(packet[20:])[tcpOptionMSS]
+			if !ok {
+				t.Fatal("SYN has no MSS option")
+			}
+			if got := binary.BigEndian.Uint16(mss); got != tt.expectedMSS {
+				t.Errorf("expected MSS %d, got %d", tt.expectedMSS, got)
+			}
+		})
+	}
+}
+
+func TestCreateTCPSyn_DuringReset(t *testing.T) {
+	tunnel, err := NewTunnel(context.Background(), newTestConfig(t, testConfig{}), TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	// Reset swaps the TUN the MSS is read from; run with -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			tunnel.createTCPSyn(net.ParseIP("10.150.0.3"), 80)
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if err := tunnel.Reset(context.Background()); err != nil {
+			t.Fatalf("Reset failed: %v", err)
+		}
+	}
+	<-done
+}
+
+func TestParseOptions(t *testing.T) {
+	header := func(options ...byte) []byte {
+		h := make([]byte, 20+len(options))
+		h[12] = byte((len(h) / 4) << 4)
+		copy(h[20:], options)
+		return h
+	}
+
+	tests := []struct {
+		name     string
+		header   []byte
+		expected map[byte][]byte
+	}{
+		{"no options", header(), map[byte][]byte{}},
+		{"mss", header(2, 4, 0x05, 0xb4), map[byte][]byte{2: {0x05, 0xb4}}},
+		{"mss and window scale", header(2, 4, 0x05, 0xb4, 1, 3, 3, 7), map[byte][]byte{2: {0x05, 0xb4}, 3: {7}}},
+		{"end of options", header(0, 2, 4, 0x05), map[byte][]byte{}},
+		{"truncated option", header(2, 8, 0x05, 0xb4), map[byte][]byte{}},
+		{"zero length option", header(2, 0, 1, 1), map[byte][]byte{}},
+		{"short header", []byte{1, 2, 3}, map[byte][]byte{}},
+		{"header length past data", append(header(2, 4, 0x05, 0xb4)[:20:20], 2, 4), map[byte][]byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseOptions(tt.header)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTunnel_SynAckMSSRoundTrip(t *testing.T) {
+	ourIP := netip.MustParseAddr("10.150.0.2")
+	client := &Tunnel{ourIP: ourIP, tun: NewMemoryTUN("client", 1420), connMap: make(map[string]*TunnelConn)}
+	server := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.3"), tun: NewMemoryTUN("server", 1500)}
+
+	syn := client.createTCPSyn(net.ParseIP("10.150.0.3"), 80)
+
+	// Build the server's SYN-ACK from its own SYN, swapping addresses and ports
+	synAck := server.createTCPSyn(net.IP(syn[12:16]), int(binary.BigEndian.Uint16(syn[20:22])))
+	binary.BigEndian.PutUint16(synAck[20:22], binary.BigEndian.Uint16(syn[22:24]))
+	synAck[33] = 0x12 // SYN+ACK
+
+	conn := &TunnelConn{readChan: make(chan []byte, 1)}
+	client.connMap["10.150.0.3:80->10.150.0.2:12345"] = conn
+
+	client.handleIncomingPacket(synAck)
+
+	conn.mutex.RLock()
+	mss := conn.mss
+	conn.mutex.RUnlock()
+	if mss != 1460 {
+		t.Errorf("expected peer MSS 1460 from SYN-ACK, got %d", mss)
+	}
+
+	// A plain SYN must not update the MSS
+	conn.mss = 0
+	plain := server.createTCPSyn(net.IP(syn[12:16]), 12345)
+	binary.BigEndian.PutUint16(plain[20:22], 80)
+	client.handleIncomingPacket(plain)
+	if conn.mss != 0 {
+		t.Errorf("SYN without ACK should not set MSS, got %d", conn.mss)
+	}
+}
+
+func TestWindowScaleFor(t *testing.T) {
+	tests := []struct {
+		buffer   int
+		expected uint8
+	}{
+		{0, 0},
+		{65535, 0},
+		{65536, 1},
+		{256 << 10, 3},
+		{tcpReceiveBuffer, 7},
+		{1 << 40, maxWindowScale},
+	}
+
+	for _, tt := range tests {
+		if got := windowScaleFor(tt.buffer); got != tt.expected {
+			t.Errorf("windowScaleFor(%d) = %d, want %d", tt.buffer, got, tt.expected)
+		}
+	}
+}
+
+func TestCreateTCPSyn_WindowScaleOption(t *testing.T) {
+	tunnel := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.2")}
+	packet := tunnel.createTCPSyn(net.ParseIP("10.150.0.3"), 80)
+
+	shift, ok := parseOptions(packet[20:])[tcpOptionWindowScale]
+	if !ok || len(shift) != 1 {
+		t.Fatalf("SYN has no window scale option: %v", parseOptions(packet[20:]))
+	}
+	if shift[0] != windowScaleFor(tcpReceiveBuffer) {
+		t.Errorf("expected window scale %d, got %d", windowScaleFor(tcpReceiveBuffer), shift[0])
+	}
+
+	// The window field of a SYN is never scaled
+	if window := binary.BigEndian.Uint16(packet[34:36]); window != 0xffff {
+		t.Errorf("expected unscaled SYN window 65535, got %d", window)
+	}
+}
+
+func TestTunnel_SynAckWindowScale(t *testing.T) {
+	client := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.2"), connMap: make(map[string]*TunnelConn)}
+	server := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.3")}
+
+	syn := client.createTCPSyn(net.ParseIP("10.150.0.3"), 80)
+	if shift := parseOptions(syn[20:])[tcpOptionWindowScale]; len(shift) != 1 || shift[0] != 7 {
+		t.Fatalf("expected the client to advertise shift 7, got %v", shift)
+	}
+
+	// The server answers with its own, smaller, shift count
+	synAck := server.createTCPSyn(net.IP(syn[12:16]), int(binary.BigEndian.Uint16(syn[20:22])))
+	binary.BigEndian.PutUint16(synAck[20:22], binary.BigEndian.Uint16(syn[22:24]))
+	synAck[33] = 0x12 // SYN+ACK
+	synAck[47] = 5
+	binary.BigEndian.PutUint16(synAck[34:36], 29200)
+
+	conn := &TunnelConn{readChan: make(chan []byte, 2)}
+	client.connMap["10.150.0.3:80->10.150.0.2:12345"] = conn
+
+	client.handleIncomingPacket(synAck)
+
+	conn.mutex.RLock()
+	scale := conn.windowScale
+	conn.mutex.RUnlock()
+	if scale != 5 {
+		t.Errorf("expected peer window scale 5 from SYN-ACK, got %d", scale)
+	}
+}
+
+func TestTunnel_SynAckWindowScaleClamped(t *testing.T) {
+	client := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.2"), connMap: make(map[string]*TunnelConn)}
+	server := &Tunnel{ourIP: netip.MustParseAddr("10.150.0.3")}
+
+	synAck := server.createTCPSyn(net.ParseIP("10.150.0.2"), 12345)
+	binary.BigEndian.PutUint16(synAck[20:22], 80)
+	synAck[33] = 0x12
+	synAck[47] = 20 // RFC 7323 caps the shift at 14
+
+	conn := &TunnelConn{readChan: make(chan []byte, 1)}
+	client.connMap["10.150.0.3:80->10.150.0.2:12345"] = conn
+	client.handleIncomingPacket(synAck)
+
+	if conn.windowScale != maxWindowScale {
+		t.Errorf("expected window scale clamped to %d, got %d", maxWindowScale, conn.windowScale)
+	}
+}
+
+func TestTunnel_HandleIncomingPacket(t *testing.T) {
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			Address: []string{"10.150.0.2/24"},
+		},
+	}
+
+	ourIP, _ := config.GetInterfaceIP()
+	tunnel := &Tunnel{
+		ourIP:   ourIP,
+		connMap: make(map[string]*TunnelConn),
+	}
+
+	// Test with short packet
+	tunnel.handleIncomingPacket([]byte("short"))
+	// Should not panic
+
+	// Test with non-IPv4 packet
+	packet := make([]byte, 40)
+	packet[0] = 0x60 // IPv6
+	tunnel.handleIncomingPacket(packet)
+	// Should not panic
+
+	// Test with non-TCP packet
+	packet[0] = 0x45 // IPv4
+	packet[9] = 17   // UDP
+	tunnel.handleIncomingPacket(packet)
+	// Should not panic
+
+	// Test with too short for TCP
+	packet[9] = 6 // TCP
+	shortPacket := packet[:23]
+	tunnel.handleIncomingPacket(shortPacket)
+	// Should not panic
+}
+
+// newICMPEchoRequest builds an IPv4 echo request from src to dst
+func newICMPEchoRequest(src, dst string, id, seq uint16, data []byte) []byte {
+	packet := make([]byte, 28+len(data))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 32
+	packet[9] = 1 // ICMP
+	copy(packet[12:16], net.ParseIP(src).To4())
+	copy(packet[16:20], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(packet[10:12], internetChecksum(packet[:20]))
+
+	icmp := packet[20:]
+	icmp[0] = 8 // Echo request
+	binary.BigEndian.PutUint16(icmp[4:6], id)
+	binary.BigEndian.PutUint16(icmp[6:8], seq)
+	copy(icmp[8:], data)
+	binary.BigEndian.PutUint16(icmp[2:4], internetChecksum(icmp))
+	return packet
+}
+
+func TestCreateICMPEchoReply(t *testing.T) {
+	request := newICMPEchoRequest("10.150.0.1", "10.150.0.2", 0x1234, 7, []byte("ping data"))
+
+	reply := createICMPEchoReply(request)
+	if reply == nil {
+		t.Fatal("expected a reply to an echo request")
+	}
+	if len(reply) != len(request) {
+		t.Fatalf("expected reply of %d bytes, got %d", len(request), len(reply))
+	}
+
+	if got := net.IP(reply[12:16]).String(); got != "10.150.0.2" {
+		t.Errorf("expected source 10.150.0.2, got %s", got)
+	}
+	if got := net.IP(reply[16:20]).String(); got != "10.150.0.1" {
+		t.Errorf("expected destination 10.150.0.1, got %s", got)
+	}
+	if reply[20] != 0 || reply[21] != 0 {
+		t.Errorf("expected echo reply type 0 code 0, got %d %d", reply[20], reply[21])
+	}
+	if id, seq := binary.BigEndian.Uint16(reply[24:26]), binary.BigEndian.Uint16(reply[26:28]); id != 0x1234 || seq != 7 {
+		t.Errorf("expected id 0x1234 and sequence 7, got %#x %d", id, seq)
+	}
+	if string(reply[28:]) != "ping data" {
+		t.Errorf("expected echoed data, got %q", reply[28:])
+	}
+
+	// A valid checksum sums to zero over the covered bytes
+	if internetChecksum(reply[:20]) != 0 {
+		t.Error("invalid IP header checksum")
+	}
+	if internetChecksum(reply[20:]) != 0 {
+		t.Error("invalid ICMP checksum")
+	}
+
+	// The request is left untouched
+	if request[20] != 8 {
+		t.Error("request was modified")
+	}
+}
+
+func TestCreateICMPEchoReply_Rejects(t *testing.T) {
+	valid := newICMPEchoRequest("10.150.0.1", "10.150.0.2", 1, 1, nil)
+
+	modify := func(f func(p []byte) []byte) []byte {
+		p := append([]byte(nil), valid...)
+		return f(p)
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"too short", valid[:10]},
+		{"IPv6", modify(func(p []byte) []byte { p[0] = 0x60; return p })},
+		{"TCP", modify(func(p []byte) []byte { p[9] = 6; return p })},
+		{"echo reply", modify(func(p []byte) []byte { p[20] = 0; return p })},
+		{"truncated", valid[:25]},
+		{"fragment", modify(func(p []byte) []byte { p[6] = 0x20; return p })},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reply := createICMPEchoReply(tt.packet); reply != nil {
+				t.Errorf("expected no reply, got %v", reply)
+			}
+		})
+	}
+}
+
+// waitInbound returns the next packet queued for WireGuard on tun, or false
+// if none is queued within timeout
+func waitInbound(tun *MemoryTUN, timeout time.Duration) ([]byte, bool) {
+	buf := make([]byte, packetRingSlotSize)
+	deadline := time.Now().Add(timeout)
+	for {
+		if n, ok, _ := tun.inbound.tryPop(buf); ok {
+			return buf[:n], true
+		}
+		if time.Now().After(deadline) {
+			return nil, false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTunnel_AnswersPing(t *testing.T) {
+	memTun := NewMemoryTUN("test", 1420)
+	defer memTun.Close()
+
+	tunnel := &Tunnel{
+		tun:     memTun,
+		ourIP:   netip.MustParseAddr("10.150.0.2"),
+		connMap: make(map[string]*TunnelConn),
+	}
+
+	// A ping to our address is answered through WireGuard
+	tunnel.handleIncomingPacket(newICMPEchoRequest("10.150.0.1", "10.150.0.2", 42, 1, []byte("hello")))
+
+	reply, ok := waitInbound(memTun, time.Second)
+	if !ok {
+		t.Fatal("no echo reply was sent")
+	}
+	if reply[20] != 0 || net.IP(reply[16:20]).String() != "10.150.0.1" {
+		t.Errorf("unexpected reply %v", reply)
+	}
+
+	// Pings to other addresses are not ours to answer
+	tunnel.handleIncomingPacket(newICMPEchoRequest("10.150.0.1", "10.150.0.3", 42, 2, nil))
+	if reply, ok := waitInbound(memTun, 50*time.Millisecond); ok {
+		t.Errorf("unexpected reply for another address: %v", reply)
+	}
+}
+
+func TestTunnelConn_Implementation(t *testing.T) {
+	readChan := make(chan []byte, 10)
+	writeChan := make(chan []byte, 10)
+
+	localAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:8080")
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:9090")
+
+	conn := &TunnelConn{
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		readChan:   readChan,
+		writeChan:  writeChan,
+	}
+
+	// Test addresses
+	if conn.LocalAddr() != localAddr {
+		t.Errorf("LocalAddr() = %v, want %v", conn.LocalAddr(), localAddr)
+	}
+
+	if conn.RemoteAddr() != remoteAddr {
+		t.Errorf("RemoteAddr() = %v, want %v", conn.RemoteAddr(), remoteAddr)
+	}
+
+	// Test Write
+	testData := []byte("test data")
+	n, err := conn.Write(testData)
+	if err != nil {
+		t.Errorf("Write() returned error: %v", err)
+	}
+	if n != len(testData) {
+		t.Errorf("Write() returned %d, want %d", n, len(testData))
+	}
+
+	// Check data was written to channel
+	select {
+	case data := <-writeChan:
+		if string(data) != string(testData) {
+			t.Errorf("written data = %q, want %q", string(data), string(testData))
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("no data written to channel")
+	}
+
+	// Test Read
+	readData := []byte("read test data")
+	readChan <- readData
+
+	buf := make([]byte, 100)
+	n, err = conn.Read(buf)
+	if err != nil {
+		t.Errorf("Read() returned error: %v", err)
+	}
+	if n != len(readData) {
+		t.Errorf("Read() returned %d bytes, want %d", n, len(readData))
+	}
+	if string(buf[:n]) != string(readData) {
+		t.Errorf("read data = %q, want %q", string(buf[:n]), string(readData))
+	}
+
+	// Test deadline methods (should not return error)
+	if err := conn.SetDeadline(time.Now()); err != nil {
+		t.Errorf("SetDeadline() returned error: %v", err)
+	}
+	if err := conn.SetReadDeadline(time.Now()); err != nil {
+		t.Errorf("SetReadDeadline() returned error: %v", err)
+	}
+	if err := conn.SetWriteDeadline(time.Now()); err != nil {
+		t.Errorf("SetWriteDeadline() returned error: %v", err)
+	}
+
+	// Test Close
+	err = conn.Close()
+	if err != nil {
+		t.Errorf("Close() returned error: %v", err)
+	}
+
+	if !conn.closed {
+		t.Error("connection should be marked as closed")
+	}
+
+	// Test Read after close
+	_, err = conn.Read(buf)
+	if err == nil {
+		t.Error("Read() should return error after close")
+	}
+
+	// Multiple closes should not panic
+	err = conn.Close()
+	if err != nil {
+		t.Errorf("second Close() returned error: %v", err)
+	}
+}
+
+func TestTunnelConn_WriteBufferFull(t *testing.T) {
+	// Create connection with small buffer
+	writeChan := make(chan []byte, 1)
+
+	conn := &TunnelConn{
+		writeChan: writeChan,
+	}
+
+	// Fill the buffer
+	_, err := conn.Write([]byte("first"))
+	if err != nil {
+		t.Errorf("first Write() returned error: %v", err)
+	}
+
+	// Second write should fail due to full buffer
+	_, err = conn.Write([]byte("second"))
+	if err == nil {
+		t.Error("Write() should return error when buffer is full")
+	}
+}
+
+func TestMustParsePort(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int
+	}{
+		{"80", 80},
+		{"8080", 8080},
+		{"443", 443},
+		{"0", 0},
+		{"invalid", 0}, // strconv.Atoi returns 0 for invalid input
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			result := mustParsePort(tt.input)
+			if result != tt.expected {
+				t.Errorf("mustParsePort(%q) = %d, want %d", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+// Integration test for tunnel creation (may fail due to WireGuard dependencies)
+func TestNewTunnel_Integration(t *testing.T) {
+	// This test may fail in CI/test environments without proper WireGuard setup
+	// but tests the tunnel creation logic
+
+	config := &WireGuardConfig{
+		Interface: InterfaceConfig{
+			PrivateKey: "cGluZy1wcml2YXRlLWtleS0xMjM0NTY3ODkwMTIzNDU2Nzg5MDEyMzQ1Njc4OTA=", // base64 encoded 32 bytes
+			Address:    []string{"10.150.0.2/24"},
+		},
+		Peers: []PeerConfig{
+			{
+				PublicKey:  "cGluZy1wdWJsaWMta2V5LTEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDEy", // base64 encoded 32 bytes
+				Endpoint:   "127.0.0.1:51820",
+				AllowedIPs: []string{"0.0.0.0/0"},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	tunnel, err := NewTunnel(ctx, config, TunnelOptions{})
+
+	// In test environment, this will likely fail due to missing WireGuard setup
+	// but we test that it doesn't panic and handles errors gracefully
+	if err != nil {
+		t.Logf("NewTunnel failed as expected in test environment: %v", err)
+		return
+	}
+
+	if tunnel == nil {
+		t.Error("NewTunnel returned nil tunnel without error")
+		return
+	}
+
+	// Test tunnel properties
+	expectedIP, _ := config.GetInterfaceIP()
+	if tunnel.ourIP != expectedIP {
+		t.Errorf("tunnel.ourIP = %v, want %v", tunnel.ourIP, expectedIP)
+	}
+
+	if tunnel.device == nil {
+		t.Error("tunnel.device is nil")
+	}
+
+	if tunnel.tun == nil {
+		t.Error("tunnel.tun is nil")
+	}
+
+	if tunnel.connMap == nil {
+		t.Error("tunnel.connMap is nil")
+	}
+
+	// Clean up
+	tunnel.Close()
+}
+
+func TestNewTunnel_PostUpPostDown(t *testing.T) {
+	dir := t.TempDir()
+	upFlag := filepath.Join(dir, "up")
+	downFlag := filepath.Join(dir, "down")
+
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho \"$WRAPGUARD_INTERFACE_IP\" > \"$1\"\n"), 0700); err != nil {
+		t.Fatalf("failed to write hook script: %v", err)
+	}
+
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.150.0.2/24
+PostUp = `+script+` `+upFlag+`
+PostDown = `+script+` `+downFlag+`
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 10.150.0.0/24`)
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	tunnel, err := NewTunnel(context.Background(), config, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+
+	data, err := os.ReadFile(upFlag)
+	if err != nil {
+		t.Fatalf("PostUp hook did not run: %v", err)
+	}
+	if strings.TrimSpace(string(data)) != "10.150.0.2" {
+		t.Errorf("expected WRAPGUARD_INTERFACE_IP 10.150.0.2, got %q", string(data))
+	}
+
+	if _, err := os.Stat(downFlag); !os.IsNotExist(err) {
+		t.Error("PostDown hook should not run before Close")
+	}
+
+	tunnel.Close()
+
+	if _, err := os.Stat(downFlag); err != nil {
+		t.Errorf("PostDown hook did not run: %v", err)
+	}
+}
+
+func TestNewTunnel_PostUpFailure(t *testing.T) {
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.150.0.2/24
+PostUp = exit 3
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 10.150.0.0/24`)
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+	_, err = NewTunnel(context.Background(), config, TunnelOptions{})
+	if err == nil {
+		t.Fatal("expected error when PostUp fails")
+	}
+
+	if !strings.Contains(err.Error(), "PostUp") || !strings.Contains(err.Error(), "exit 3") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestTunnel_Reset(t *testing.T) {
+	path := writeTempConfig(t, `[Interface]
+PrivateKey = `+generateTestKeyWithSeed(1)+`
+Address = 10.150.0.2/24
+
+[Peer]
+PublicKey = `+generateTestKeyWithSeed(2)+`
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 10.150.0.0/24, 127.0.0.0/8`)
+
+	config, err := ParseConfig(path)
+	if err != nil {
+		t.Fatalf("ParseConfig failed: %v", err)
+	}
+
+	tunnel, err := NewTunnel(context.Background(), config, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	oldDevice := tunnel.device
+
+	// Dial concurrently while the tunnel is reset; run with -race to catch data races
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := tunnel.DialWireGuard(context.Background(), "tcp", "127.0.0.1", port)
+			if err != nil {
+				errs <- err
+				return
+			}
+			conn.Close()
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := tunnel.Reset(context.Background()); err != nil {
+			t.Fatalf("Reset failed: %v", err)
+		}
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("DialWireGuard failed during reset: %v", err)
+	}
+
+	tunnel.mutex.RLock()
+	newDevice, newTun := tunnel.device, tunnel.tun
+	tunnel.mutex.RUnlock()
+
+	if newDevice == nil || newDevice == oldDevice {
+		t.Error("Reset should replace the WireGuard device")
+	}
+	if newTun == nil || newTun.tunnel != tunnel {
+		t.Error("Reset should create a new TUN bound to the tunnel")
+	}
+}
+
+func TestTunnel_ResetFailureKeepsDevice(t *testing.T) {
+	tunnel, err := NewTunnel(context.Background(), newTestConfig(t, testConfig{}), TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	tunnel.mutex.RLock()
+	oldDevice, oldTun := tunnel.device, tunnel.tun
+	tunnel.mutex.RUnlock()
+
+	// A device that fails to configure leaves the running one in place
+	config := tunnel.config.Load()
+	broken := *config
+	broken.Interface.PrivateKey = "not a key"
+	tunnel.config.Store(&broken)
+	if err := tunnel.Reset(context.Background()); err == nil {
+		t.Fatal("expected Reset to fail")
+	}
+	tunnel.config.Store(config)
+
+	tunnel.mutex.RLock()
+	device, memTun := tunnel.device, tunnel.tun
+	tunnel.mutex.RUnlock()
+	if device != oldDevice || memTun != oldTun || memTun.closed {
+		t.Error("expected a failed Reset to keep the old device and TUN")
+	}
+	if err := tunnel.SetMTU(1380); err != nil {
+		t.Errorf("expected the tunnel to keep working, got %v", err)
+	}
+
+	// and a later Reset still works
+	if err := tunnel.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if mtu, _ := tunnel.tun.MTU(); tunnel.device == oldDevice || mtu != 1380 {
+		t.Errorf("expected a new device keeping the MTU, got MTU %d", mtu)
+	}
+}
+
+func TestTunnel_ResetListenPort(t *testing.T) {
+	probe, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+	probe.Close()
+
+	config := newTestConfig(t, testConfig{})
+	config.Interface.ListenPort = port
+	tunnel, err := NewTunnel(context.Background(), config, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	// The fixed port moves to the new device
+	if err := tunnel.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if conn, err := net.ListenPacket("udp4", ":"+strconv.Itoa(port)); err == nil {
+		conn.Close()
+		t.Errorf("expected the new device to listen on port %d", port)
+	}
+}
+
+func TestTunnel_ResetCancelledContext(t *testing.T) {
+	tunnel := &Tunnel{tun: NewMemoryTUN("test", 1420)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := tunnel.Reset(ctx); err == nil {
+		t.Error("expected error for cancelled context")
+	}
+
+	if tunnel.tun.closed {
+		t.Error("cancelled Reset should leave the tunnel untouched")
+	}
+}
+
+// fakeEndpointResolver returns canned addresses for endpoint re-resolution tests
+type fakeEndpointResolver struct {
+	mutex sync.Mutex
+	addrs map[string][]net.IPAddr
+	calls int
+}
+
+func (r *fakeEndpointResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.calls++
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func (r *fakeEndpointResolver) set(host string, ips ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.addrs[host] = nil
+	for _, ip := range ips {
+		r.addrs[host] = append(r.addrs[host], net.IPAddr{IP: net.ParseIP(ip)})
+	}
+}
+
+func newHostnameEndpointTunnel(t *testing.T) *Tunnel {
+	t.Helper()
+
+	config := newTestConfig(t, testConfig{})
+	// Pretend the endpoint was written as a hostname
+	config.Peers[0].OriginalHostname = "vpn.example.test:51820"
+
+	tunnel, err := NewTunnel(context.Background(), config, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	t.Cleanup(func() { tunnel.Close() })
+
+	return tunnel
+}
+
+func TestTunnel_RefreshEndpoints(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelInfo, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	tunnel := newHostnameEndpointTunnel(t)
+	resolver := &fakeEndpointResolver{addrs: make(map[string][]net.IPAddr)}
+
+	// Unchanged address: nothing to update
+	resolver.set("vpn.example.test", "127.0.0.1")
+	tunnel.refreshEndpoints(context.Background(), resolver)
+	if strings.Contains(buf.String(), "changed from") {
+		t.Errorf("unexpected endpoint change logged: %s", buf.String())
+	}
+
+	// Changed address, preferring IPv4: the device endpoint is updated
+	resolver.set("vpn.example.test", "::1", "127.0.0.2")
+	tunnel.refreshEndpoints(context.Background(), resolver)
+
+	ipc, err := tunnel.device.IpcGet()
+	if err != nil {
+		t.Fatalf("IpcGet failed: %v", err)
+	}
+	if !strings.Contains(ipc, "endpoint=127.0.0.2:51820") {
+		t.Errorf("device endpoint not updated, IPC state:\n%s", ipc)
+	}
+
+	if peer := tunnel.config.Load().Peers[0]; peer.Endpoint != "127.0.0.2:51820" {
+		t.Errorf("config endpoint not updated: %s", peer.Endpoint)
+	}
+	if tunnel.config.Load().Peers[0].ResolvedAt.IsZero() {
+		t.Error("ResolvedAt should be set after re-resolution")
+	}
+	if !strings.Contains(buf.String(), "changed from 127.0.0.1:51820 to 127.0.0.2:51820") {
+		t.Errorf("expected endpoint change to be logged, got %s", buf.String())
+	}
+
+	// Resolution failures keep the current endpoint
+	delete(resolver.addrs, "vpn.example.test")
+	tunnel.refreshEndpoints(context.Background(), resolver)
+	if peer := tunnel.config.Load().Peers[0]; peer.Endpoint != "127.0.0.2:51820" {
+		t.Errorf("endpoint should be kept on resolution failure, got %s", peer.Endpoint)
+	}
+}
+
+func TestTunnel_StartEndpointRefresh(t *testing.T) {
+	tunnel := newHostnameEndpointTunnel(t)
+	resolver := &fakeEndpointResolver{addrs: make(map[string][]net.IPAddr)}
+	resolver.set("vpn.example.test", "127.0.0.3")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel.StartEndpointRefresh(ctx, 10*time.Millisecond, resolver)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		ipc, _ := tunnel.device.IpcGet()
+		if strings.Contains(ipc, "endpoint=127.0.0.3:51820") {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("background refresh did not update the endpoint")
+}
+
+func TestTunnel_StartEndpointRefreshDisabled(t *testing.T) {
+	tunnel := &Tunnel{}
+	resolver := &fakeEndpointResolver{addrs: make(map[string][]net.IPAddr)}
+
+	tunnel.StartEndpointRefresh(context.Background(), 0, resolver)
+	time.Sleep(20 * time.Millisecond)
+
+	if resolver.calls != 0 {
+		t.Errorf("expected no lookups with refresh disabled, got %d", resolver.calls)
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	addr := netip.MustParseAddr("10.0.0.2")
+
+	if err := runHooks("PostUp", nil, addr); err != nil {
+		t.Errorf("no commands should not fail: %v", err)
+	}
+
+	flag := filepath.Join(t.TempDir(), "flag")
+	err := runHooks("PostUp", []string{"false", "touch " + flag}, addr)
+	if err == nil {
+		t.Fatal("expected error from failing command")
+	}
+
+	if _, err := os.Stat(flag); !os.IsNotExist(err) {
+		t.Error("commands after a failure should not run")
+	}
+}
+
+// Test tunnel close
+func TestTunnel_Close(t *testing.T) {
+	tun := NewMemoryTUN("test", 1420)
+	tunnel := &Tunnel{
+		tun: tun,
+		// device: nil, // Don't create actual WireGuard device in test
+	}
+
+	err := tunnel.Close()
+	if err != nil {
+		t.Errorf("Close() returned error: %v", err)
+	}
+
+	// TUN should be closed
+	if !tun.closed {
+		t.Error("TUN should be closed after tunnel close")
+	}
+}
+
+func BenchmarkMemoryTUN_InjectSingle(b *testing.B) {
+	benchmarkMemoryTUNInject(b, 1)
+}
+
+func BenchmarkMemoryTUN_InjectBatch(b *testing.B) {
+	benchmarkMemoryTUNInject(b, 32)
+}
+
+func benchmarkMemoryTUNInject(b *testing.B, batchSize int) {
+	tun := NewMemoryTUN("bench", 1420)
+	defer tun.Close()
+
+	packet := make([]byte, 1400)
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		batch[i] = packet
+	}
+
+	// Drain the queue concurrently as WireGuard would
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, err := tun.Read(buf, 0); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batchSize {
+		if batchSize == 1 {
+			for tun.InjectInbound(packet) != nil {
+				runtime.Gosched()
+			}
+			continue
+		}
+		for tun.InjectBatch(batch) != nil {
+			runtime.Gosched()
+		}
+	}
+}
+
+func TestTunnel_SuspendResume(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelInfo, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	tunnelA := newPeeredTunnel(t, ctx, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)
+	newPeeredTunnel(t, ctx, 2, 1, "10.160.0.2", "10.160.0.1", portB, portA)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !tunnelA.hasHandshake() && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	before := tunnelA.lastHandshake()
+	if before.IsZero() {
+		t.Fatal("tunnels did not complete a handshake")
+	}
+
+	if err := tunnelA.Suspend(); err != nil {
+		t.Fatalf("Suspend failed: %v", err)
+	}
+	if !tunnelA.suspended {
+		t.Error("expected tunnel to be suspended")
+	}
+	// Suspending twice is harmless
+	if err := tunnelA.Suspend(); err != nil {
+		t.Errorf("second Suspend failed: %v", err)
+	}
+
+	if err := tunnelA.Resume(ctx); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if tunnelA.suspended {
+		t.Error("expected tunnel to be resumed")
+	}
+	if !tunnelA.lastHandshake().After(before) {
+		t.Errorf("expected a fresh handshake after resuming, last was %v", tunnelA.lastHandshake())
+	}
+
+	// Resuming a running tunnel does nothing
+	if err := tunnelA.Resume(ctx); err != nil {
+		t.Errorf("Resume of a running tunnel failed: %v", err)
+	}
+
+	output := buf.String()
+	suspendAt := strings.Index(output, "Suspending WireGuard tunnel")
+	resumeAt := strings.Index(output, "Resuming WireGuard tunnel")
+	resumedAt := strings.Index(output, "WireGuard tunnel resumed after")
+	if suspendAt < 0 || resumeAt < suspendAt || resumedAt < resumeAt {
+		t.Errorf("unexpected event sequence:\n%s", output)
+	}
+	if strings.Count(output, "Suspending WireGuard tunnel") != 1 || strings.Count(output, "Resuming WireGuard tunnel") != 1 {
+		t.Errorf("expected one suspend and one resume:\n%s", output)
+	}
+}
+
+func TestTunnel_ResumeWithoutHandshake(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelError, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	oldTimeout := ResumeHandshakeTimeout
+	ResumeHandshakeTimeout = 200 * time.Millisecond
+	defer func() { ResumeHandshakeTimeout = oldTimeout }()
+
+	tunnel, err := NewTunnel(context.Background(), newTestConfig(t, testConfig{}), TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+
+	if err := tunnel.Suspend(); err != nil {
+		t.Fatalf("Suspend failed: %v", err)
+	}
+
+	// The peer never answers, so Resume gives up waiting but stays up
+	err = tunnel.Resume(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no handshake within") {
+		t.Errorf("expected handshake timeout, got %v", err)
+	}
+	if tunnel.suspended {
+		t.Error("tunnel should be up after a timed out Resume")
+	}
+
+	tunnel.Close()
+	if err := tunnel.Suspend(); err == nil {
+		t.Error("expected Suspend of a closed tunnel to fail")
+	}
+	if err := tunnel.Resume(context.Background()); err == nil {
+		t.Error("expected Resume of a closed tunnel to fail")
+	}
+}
+
+func TestTunnel_DownBeforeClose(t *testing.T) {
+	var buf bytes.Buffer
+	oldLogger := logger
+	SetGlobalLogger(NewLogger(LogLevelInfo, &buf))
+	defer SetGlobalLogger(oldLogger)
+
+	tunnel, err := NewTunnel(context.Background(), newTestConfig(t, testConfig{}), TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+
+	if err := tunnel.Down(); err != nil {
+		t.Fatalf("Down failed: %v", err)
+	}
+	if !tunnel.suspended {
+		t.Error("expected the device to be down")
+	}
+	if err := tunnel.Down(); err != nil {
+		t.Errorf("second Down failed: %v", err)
+	}
+
+	// Shutting down is not a suspend, so nothing is logged at info level
+	if strings.Contains(buf.String(), "Suspending") {
+		t.Errorf("unexpected suspend message during shutdown: %s", buf.String())
+	}
+
+	if err := tunnel.Close(); err != nil {
+		t.Errorf("Close after Down failed: %v", err)
+	}
+	if err := tunnel.Down(); err == nil {
+		t.Error("expected Down of a closed tunnel to fail")
+	}
+}
+
+func TestTunnel_PingThroughWireGuard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	newPeeredTunnel(t, ctx, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)
+	tunnelB := newPeeredTunnel(t, ctx, 2, 1, "10.160.0.2", "10.160.0.1", portB, portA)
+
+	// B pings A over the encrypted tunnel and A's reply comes back to B
+	request := newICMPEchoRequest("10.160.0.2", "10.160.0.1", 99, 1, []byte("over wireguard"))
+	deadline := time.After(10 * time.Second)
+	retry := time.NewTicker(500 * time.Millisecond)
+	defer retry.Stop()
+
+	tunnelB.tun.InjectInbound(request)
+	for {
+		select {
+		case packet := <-tunnelB.tun.outbound:
+			if len(packet) >= 28 && packet[9] == 1 && packet[20] == 0 && binary.BigEndian.Uint16(packet[24:26]) == 99 {
+				if string(packet[28:]) != "over wireguard" {
+					t.Errorf("unexpected echo data %q", packet[28:])
+				}
+				return
+			}
+		case <-retry.C:
+			// The first request may be dropped while the handshake completes
+			tunnelB.tun.InjectInbound(request)
+		case <-deadline:
+			t.Fatal("no echo reply through WireGuard")
+		}
+	}
+}
+
+func TestTunnel_Reload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	tunnel := newPeeredTunnel(t, ctx, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)
+	peerKey, err := base64ToHex(testPublicKey(t, 2))
+	if err != nil {
+		t.Fatalf("base64ToHex failed: %v", err)
+	}
+	addedKey, err := base64ToHex(testPublicKey(t, 3))
+	if err != nil {
+		t.Fatalf("base64ToHex failed: %v", err)
+	}
+
+	// The peer gets another AllowedIP and a second peer is added, and the
+	// MTU changes, while the new ListenPort needs a restart
+	config := newPeeredConfig(t, 1, 2, "10.160.0.1", "10.160.0.2", freeUDPPort(t), portB)
+	config.Interface.MTU = 1280
+	config.Peers[0].AllowedIPs = append(config.Peers[0].AllowedIPs, "10.160.1.0/24")
+	config.Peers = append(config.Peers, PeerConfig{PublicKey: addedKey, AllowedIPs: []string{"10.160.2.0/24"}})
+	if err := tunnel.Reload(config); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+
+	state, err := tunnel.device.IpcGet()
+	if err != nil {
+		t.Fatalf("IpcGet failed: %v", err)
+	}
+	for _, expected := range []string{"public_key=" + addedKey, "allowed_ip=10.160.1.0/24", "allowed_ip=10.160.2.0/24", "endpoint=127.0.0.1:" + strconv.Itoa(portB)} {
+		if !strings.Contains(state, expected) {
+			t.Errorf("expected %q in the device config, got:\n%s", expected, state)
+		}
+	}
+	if _, idx := tunnel.router.Load().FindPeerForDestination(net.ParseIP("10.160.2.5"), 80, 0, "tcp", ""); idx != 1 {
+		t.Errorf("expected the route to the added peer, got peer %d", idx)
+	}
+	if port := tunnel.config.Load().Interface.ListenPort; port != portA {
+		t.Errorf("expected the interface to keep listen port %d, got %d", portA, port)
+	}
+	if mtu, _ := tunnel.tun.MTU(); mtu != 1280 || tunnel.config.Load().Interface.MTU != 1280 {
+		t.Errorf("expected the new MTU 1280 to apply, got %d", mtu)
+	}
+
+	// Reloading the first config again removes the added peer
+	if err := tunnel.Reload(newPeeredConfig(t, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	state, err = tunnel.device.IpcGet()
+	if err != nil {
+		t.Fatalf("IpcGet failed: %v", err)
+	}
+	if strings.Contains(state, addedKey) || strings.Contains(state, "10.160.1.0/24") {
+		t.Errorf("expected the added peer and AllowedIP to be gone, got:\n%s", state)
+	}
+	if !strings.Contains(state, "public_key="+peerKey) {
+		t.Errorf("expected the original peer to stay, got:\n%s", state)
+	}
+
+	tunnel.Close()
+	if err := tunnel.Reload(config); err == nil {
+		t.Error("expected Reload of a closed tunnel to fail")
+	}
+}
+
+func TestTunnel_ReloadConcurrentReaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	tunnel := newPeeredTunnel(t, ctx, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)
+	publicKey := tunnel.PublicKey()
+
+	// PublicKey and the event poller read the config without resetMutex
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		states := make(map[string]*peerState)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if key := tunnel.PublicKey(); key != publicKey {
+				t.Errorf("expected public key %s during reloads, got %s", publicKey, key)
+				return
+			}
+			tunnel.diffPeerStates(states, nil, time.Now())
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		config := newPeeredConfig(t, 1, 2, "10.160.0.1", "10.160.0.2", portA, portB)
+		config.Peers[0].AllowedIPs = append(config.Peers[0].AllowedIPs, "10.161."+strconv.Itoa(i)+".0/24")
+		if err := tunnel.Reload(config); err != nil {
+			t.Fatalf("Reload failed: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestTunnel_SetMTU(t *testing.T) {
+	config := newTestConfig(t, testConfig{})
+	config.Interface.MTU = 1400
+	tunnel, err := NewTunnel(context.Background(), config, TunnelOptions{})
+	if err != nil {
+		t.Fatalf("NewTunnel failed: %v", err)
+	}
+	defer tunnel.Close()
+
+	synMSS := func() uint16 {
+		t.Helper()
+		packet := tunnel.createTCPSyn(net.ParseIP("10.150.0.3"), 80)
+		mss, ok := parseOptions(packet[20:])[tcpOptionMSS]
+		if !ok {
+			t.Fatal("SYN has no MSS option")
+		}
+		return binary.BigEndian.Uint16(mss)
+	}
+	if mss := synMSS(); mss != 1360 {
+		t.Errorf("expected MSS 1360 for the configured MTU, got %d", mss)
+	}
+
+	// Connections opened after the change advertise the smaller MSS
+	if err := tunnel.SetMTU(1280); err != nil {
+		t.Fatalf("SetMTU failed: %v", err)
+	}
+	if mss := synMSS(); mss != 1240 {
+		t.Errorf("expected MSS 1240 after SetMTU(1280), got %d", mss)
+	}
+
+	for _, mtu := range []int{0, 575, 1601} {
+		if err := tunnel.SetMTU(mtu); err == nil {
+			t.Errorf("expected SetMTU(%d) to fail", mtu)
+		}
+	}
+
+	// A reset keeps the MTU
+	if err := tunnel.Reset(context.Background()); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if mss := synMSS(); mss != 1240 {
+		t.Errorf("expected MSS 1240 after Reset, got %d", mss)
+	}
+
+	tunnel.Close()
+	if err := tunnel.SetMTU(1280); err == nil {
+		t.Error("expected SetMTU on a closed tunnel to fail")
+	}
+}
@@ -0,0 +1,178 @@
+package wrapguard
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc is the dial signature shared by the proxy servers
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NewUpstreamDialer creates a dial function that connects through the proxy
+// described by rawURL. Supported schemes are socks5, socks4 and http.
+func NewUpstreamDialer(rawURL string) (DialFunc, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy URL %q: missing host", rawURL)
+	}
+
+	forward := &net.Dialer{}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+
+		dialer, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 upstream dialer: %w", err)
+		}
+		return dialer.(proxy.ContextDialer).DialContext, nil
+	case "socks4":
+		userID := ""
+		if u.User != nil {
+			userID = u.User.Username()
+		}
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSOCKS4(ctx, forward, u.Host, userID, addr)
+		}, nil
+	case "http":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialHTTPConnect(ctx, forward, u.Host, u.User, addr)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q (expected socks5, socks4 or http)", u.Scheme)
+	}
+}
+
+// dialSOCKS4 connects to addr through a SOCKS4 proxy, using the SOCKS4a
+// extension when addr is a hostname
+func dialSOCKS4(ctx context.Context, forward *net.Dialer, proxyAddr, userID, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address format: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	// VN=4, CD=1 (CONNECT), DSTPORT, DSTIP, USERID, NUL
+	request := []byte{0x04, 0x01, 0, 0}
+	binary.BigEndian.PutUint16(request[2:4], uint16(port))
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		// SOCKS4a: an invalid IP of 0.0.0.x tells the proxy to resolve the hostname
+		request = append(request, 0, 0, 0, 1)
+	case ip.To4() != nil:
+		request = append(request, ip.To4()...)
+	default:
+		return nil, fmt.Errorf("SOCKS4 does not support IPv6 destination %s", host)
+	}
+	request = append(request, userID...)
+	request = append(request, 0)
+	if ip == nil {
+		request = append(request, host...)
+		request = append(request, 0)
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SOCKS4 upstream: %w", err)
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send SOCKS4 request: %w", err)
+	}
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read SOCKS4 reply: %w", err)
+	}
+	if reply[1] != 0x5a {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS4 upstream rejected connection to %s (code %#x)", addr, reply[1])
+	}
+
+	return conn, nil
+}
+
+// dialHTTPConnect connects to addr through an HTTP proxy using CONNECT
+func dialHTTPConnect(ctx context.Context, forward *net.Dialer, proxyAddr string, user *url.Userinfo, addr string) (net.Conn, error) {
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to HTTP upstream: %w", err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if via := viaChain(ctx); len(via) > 0 {
+		req.Header.Set(viaHeader, strings.Join(via, ", "))
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT request: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP upstream rejected connection to %s: %s", addr, resp.Status)
+	}
+
+	// Server-first protocols may already have sent data that the reader buffered
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads first drain data already buffered
+// while reading the proxy's response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// childFDLimit returns the RLIMIT_NOFILE to give the child for
+// --max-child-fds=max, as both its soft and hard limit. The hard limit is
+// capped at wrapguard's own, which an unprivileged child could not exceed
+// anyway.
+func childFDLimit(max int) (syscall.Rlimit, error) {
+	var parent syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &parent); err != nil {
+		return syscall.Rlimit{}, fmt.Errorf("failed to read the open file limit: %w", err)
+	}
+
+	limit := min(uint64(max), parent.Max)
+	return syscall.Rlimit{Cur: limit, Max: limit}, nil
+}
+
+// limitChildFDs makes cmd run its program through /bin/sh, which sets the
+// limit with ulimit before exec'ing the program. Go cannot set a child's
+// rlimits itself, and lowering wrapguard's own hard limit to pass it on
+// would be permanent. The program is run by the path cmd resolved, so a
+// missing command still fails cmd.Start.
+func limitChildFDs(cmd *exec.Cmd, limit syscall.Rlimit) {
+	if cmd.Err != nil {
+		return
+	}
+
+	script := `ulimit -S -n "$1" && ulimit -H -n "$2" && shift 2 && exec "$@"`
+	args := []string{"/bin/sh", "-c", script, "wrapguard", strconv.FormatUint(limit.Cur, 10), strconv.FormatUint(limit.Max, 10), cmd.Path}
+	cmd.Path = "/bin/sh"
+	cmd.Args = append(args, cmd.Args[1:]...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestChildFDLimit(t *testing.T) {
+	var parent syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &parent); err != nil {
+		t.Fatalf("Getrlimit failed: %v", err)
+	}
+
+	limit, err := childFDLimit(64)
+	if err != nil {
+		t.Fatalf("childFDLimit failed: %v", err)
+	}
+	if limit.Cur != 64 || limit.Max != 64 {
+		t.Errorf("expected soft and hard limits of 64, got %+v", limit)
+	}
+
+	// The hard limit cannot go above wrapguard's own
+	if parent.Max < 1<<62 {
+		limit, err = childFDLimit(int(parent.Max) + 1)
+		if err != nil {
+			t.Fatalf("childFDLimit failed: %v", err)
+		}
+		if limit.Cur != parent.Max || limit.Max != parent.Max {
+			t.Errorf("expected limits capped at %d, got %+v", parent.Max, limit)
+		}
+	}
+}
+
+func TestLimitChildFDs(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `ulimit -S -n; ulimit -H -n; echo "$0 $1"`, "name", "arg")
+	limitChildFDs(cmd, syscall.Rlimit{Cur: 32, Max: 64})
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("limited command failed: %v", err)
+	}
+	if string(output) != "32\n64\nname arg\n" {
+		t.Errorf("expected the limits set and the arguments passed on, got %q", output)
+	}
+
+	// A missing command still fails to start
+	cmd = exec.Command("wrapguard-no-such-command")
+	limitChildFDs(cmd, syscall.Rlimit{Cur: 32, Max: 32})
+	if err := cmd.Start(); err == nil || !strings.Contains(err.Error(), "wrapguard-no-such-command") {
+		t.Errorf("expected a missing command error, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// suspendSignals toggle suspending the tunnels; Linux sends SIGPWR around
+// hibernation
+var suspendSignals = []os.Signal{syscall.SIGPWR}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// suspendSignals is empty where there is no hibernation signal
+var suspendSignals []os.Signal